@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"io"
 	"net/http"
 
 	cloud "github.com/mattermost/mattermost-cloud/model"
@@ -63,20 +64,70 @@ func (p *Plugin) ServeHTTP(c *plugin.Context, w http.ResponseWriter, r *http.Req
 	case "/profile.png":
 		p.handleProfileImage(w, r)
 	case "/api/v1/userinstalls":
-		p.handleUserInstalls(w, r)
+		p.requireUser(permissionViewInstallations, apiTokenScopeRead, p.handleUserInstalls)(w, r)
 	case "/api/v1/sharedinstalls":
-		p.handleSharedInstalls(w, r)
+		p.requireUser(permissionViewInstallations, apiTokenScopeRead, p.handleSharedInstalls)(w, r)
 	case "/api/v1/deletion-lock":
-		p.handleDeletionLock(w, r)
+		p.requireUser(permissionManageInstallations, "deletion-lock", p.handleDeletionLock)(w, r)
 	case "/api/v1/deletion-unlock":
-		p.handleDeletionUnlock(w, r)
+		p.requireUser(permissionManageInstallations, "deletion-unlock", p.handleDeletionUnlock)(w, r)
 	case "/api/v1/config":
-		p.handleGetConfig(w, r)
+		p.requireUser(permissionViewInstallations, apiTokenScopeRead, p.handleGetConfig)(w, r)
+	case metricsPath:
+		p.handleMetrics(w, r)
+	case actionDebugPacketPath, actionRetryPath, actionSetupRetryPath, actionHibernatePath, actionUpgradePath:
+		p.requireUser(permissionManageInstallations, "", p.handleInstallationAction)(w, r)
+	case actionDigestUnsubscribePath:
+		p.requireUser(permissionReceiveDigest, "", p.handleDigestUnsubscribe)(w, r)
 	default:
+		if installationID, ok := parseInstallationEventsPath(path); ok {
+			p.requireUser(permissionViewInstallations, apiTokenScopeRead, func(w http.ResponseWriter, r *http.Request, userID string) {
+				p.handleInstallationEvents(w, r, userID, installationID)
+			})(w, r)
+			return
+		}
+		if command, name, ok := parseInstallationsPath(path); ok {
+			p.requireUser(commandPermissions[command], command, func(w http.ResponseWriter, r *http.Request, userID string) {
+				p.handleInstallationsAPI(w, r, userID, command, name)
+			})(w, r)
+			return
+		}
 		http.NotFound(w, r)
 	}
 }
 
+// userHandler handles a request made by an authorized Mattermost user.
+type userHandler func(w http.ResponseWriter, r *http.Request, userID string)
+
+// requireUser returns a handler which resolves the Mattermost user making the
+// request and checks that their plugin role grants the permission. The server
+// sets the Mattermost-User-ID header from the session of the request, so
+// clients can't provide it. Requests without a session may instead act on
+// behalf of a user with an API token granting the scope. An empty scope
+// requires a session.
+func (p *Plugin) requireUser(perm permission, scope string, handler userHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		userID := r.Header.Get("Mattermost-User-ID")
+		if secret := r.Header.Get(apiTokenHeaderKey); userID == "" && secret != "" {
+			var ok bool
+			userID, ok = p.authenticateAPIToken(w, secret, scope)
+			if !ok {
+				return
+			}
+		}
+		if userID == "" {
+			http.Error(w, "Not authorized", http.StatusUnauthorized)
+			return
+		}
+		if !p.hasPermission(userID, perm) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		handler(w, r, userID)
+	}
+}
+
 // CloudUserRequest is the request type to obtain installs for a given user.
 type CloudUserRequest struct {
 	UserID string `json:"user_id"`
@@ -87,21 +138,22 @@ type CloudDeletionLockRequest struct {
 	InstallationID string `json:"installation_id"`
 }
 
-func (p *Plugin) handleUserInstalls(w http.ResponseWriter, r *http.Request) {
-	userID := r.Header.Get("Mattermost-User-ID")
-	if userID == "" {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return
-	}
-
+func (p *Plugin) handleUserInstalls(w http.ResponseWriter, r *http.Request, userID string) {
 	req := &CloudUserRequest{}
 	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil || req.UserID == "" {
-		if err != nil {
-			p.API.LogError(errors.Wrap(err, "Unable to decode cloud user request").Error())
-		}
+	if err != nil && err != io.EOF {
+		p.API.LogError(errors.Wrap(err, "Unable to decode cloud user request").Error())
+		http.Error(w, "Please provide a JSON object with a user_id field", http.StatusBadRequest)
+		return
+	}
 
-		http.Error(w, "Please provide a JSON object with a non-blank user_id field", http.StatusBadRequest)
+	// Users may only list their own installations, unless they are plugin
+	// admins.
+	if req.UserID == "" {
+		req.UserID = userID
+	}
+	if req.UserID != userID && !p.authorizedPluginAdmin(userID) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
 		return
 	}
 
@@ -132,20 +184,7 @@ func (p *Plugin) handleUserInstalls(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
-func (p *Plugin) handleSharedInstalls(w http.ResponseWriter, r *http.Request) {
-	userID := r.Header.Get("Mattermost-User-ID")
-	if userID == "" {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return
-	}
-	// Let's require users to also have plugin permissions to view the shared
-	// list. It should be fine to allow for all logged in users to see the list,
-	// but let's start with this.
-	if !p.authorizedPluginUser(userID) {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return
-	}
-
+func (p *Plugin) handleSharedInstalls(w http.ResponseWriter, r *http.Request, userID string) {
 	sharedInstalls, err := p.getUpdatedSharedInstallations(false)
 	if err != nil {
 		p.API.LogError(errors.Wrap(err, "Unable to getUpdatedSharedInstallations").Error())
@@ -173,13 +212,7 @@ func (p *Plugin) handleSharedInstalls(w http.ResponseWriter, r *http.Request) {
 	w.Write(data)
 }
 
-func (p *Plugin) handleDeletionLock(w http.ResponseWriter, r *http.Request) {
-	userID := r.Header.Get("Mattermost-User-ID")
-	if userID == "" {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return
-	}
-
+func (p *Plugin) handleDeletionLock(w http.ResponseWriter, r *http.Request, userID string) {
 	req := &CloudDeletionLockRequest{}
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil || req.InstallationID == "" {
@@ -210,13 +243,7 @@ func (p *Plugin) handleDeletionLock(w http.ResponseWriter, r *http.Request) {
 	w.Write(j)
 }
 
-func (p *Plugin) handleDeletionUnlock(w http.ResponseWriter, r *http.Request) {
-	userID := r.Header.Get("Mattermost-User-ID")
-	if userID == "" {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return
-	}
-
+func (p *Plugin) handleDeletionUnlock(w http.ResponseWriter, r *http.Request, userID string) {
 	req := &CloudDeletionLockRequest{}
 	err := json.NewDecoder(r.Body).Decode(&req)
 	if err != nil || req.InstallationID == "" {
@@ -247,13 +274,7 @@ func (p *Plugin) handleDeletionUnlock(w http.ResponseWriter, r *http.Request) {
 	w.Write(j)
 }
 
-func (p *Plugin) handleGetConfig(w http.ResponseWriter, r *http.Request) {
-	userID := r.Header.Get("Mattermost-User-ID")
-	if userID == "" {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
-		return
-	}
-
+func (p *Plugin) handleGetConfig(w http.ResponseWriter, r *http.Request, userID string) {
 	config := p.getConfiguration()
 
 	data, err := json.Marshal(config.ToConfigResponse())
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+// installationsAPIPath is the root of the REST endpoints managing the
+// lifecycle of installations. They run the slash command handlers, so
+// requests are validated and ownership is checked the same way:
+//
+//	POST   /api/v1/installations                 create
+//	POST   /api/v1/installations/import          import
+//	POST   /api/v1/installations/{name}/{action} update, restart, hibernate, wake-up, share or unshare
+//	DELETE /api/v1/installations/{name}          delete
+const installationsAPIPath = "/api/v1/installations"
+
+// installationActions are the actions which can be run on an installation
+// with /api/v1/installations/{name}/{action}.
+var installationActions = map[string]bool{
+	"update":    true,
+	"restart":   true,
+	"hibernate": true,
+	"wake-up":   true,
+	"share":     true,
+	"unshare":   true,
+}
+
+// InstallationRequest is the request type to change installations through
+// the REST API. Options are the flags of the matching slash command without
+// the leading dashes, e.g. {"size": "miniHA", "test-data": "true"}.
+type InstallationRequest struct {
+	Name    string            `json:"name,omitempty"`
+	DNS     string            `json:"dns,omitempty"`
+	TeamID  string            `json:"team_id,omitempty"`
+	Options map[string]string `json:"options,omitempty"`
+}
+
+// InstallationResponse is the response type of the requests changing
+// installations. Installation is omitted once the installation is deleted.
+type InstallationResponse struct {
+	Message      string               `json:"message"`
+	Installation *InstallationSummary `json:"installation,omitempty"`
+}
+
+// InstallationSummary describes the installation changed by a request.
+type InstallationSummary struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	DNS   string `json:"dns,omitempty"`
+	State string `json:"state"`
+}
+
+func newInstallationSummary(install *Installation) *InstallationSummary {
+	summary := &InstallationSummary{
+		ID:    install.ID,
+		Name:  install.Name,
+		State: install.State,
+	}
+	if len(install.DNSRecords) > 0 {
+		summary.DNS = install.DNSRecords[0].DomainName
+	}
+
+	return summary
+}
+
+// parseInstallationsPath returns the command run by a request to the
+// installations REST API, and the name of the installation it applies to.
+func parseInstallationsPath(path string) (command, name string, ok bool) {
+	if path == installationsAPIPath {
+		return "create", "", true
+	}
+	if !strings.HasPrefix(path, installationsAPIPath+"/") {
+		return "", "", false
+	}
+
+	parts := strings.Split(strings.TrimPrefix(path, installationsAPIPath+"/"), "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "import":
+		return "import", "", true
+	case len(parts) == 1 && parts[0] != "":
+		return "delete", parts[0], true
+	case len(parts) == 2 && parts[0] != "" && installationActions[parts[1]]:
+		return parts[1], parts[0], true
+	}
+
+	return "", "", false
+}
+
+// installationCommandHandler returns the slash command handler run by a
+// request to the installations REST API.
+func (p *Plugin) installationCommandHandler(command string) commandHandler {
+	switch command {
+	case "create":
+		return p.runCreateCommand
+	case "import":
+		return p.runImportCommand
+	case "update":
+		return p.runUpdateCommand
+	case "restart":
+		return p.runRestartCommand
+	case "hibernate":
+		return p.runHibernateCommand
+	case "wake-up":
+		return p.runWakeUpCommand
+	case "share":
+		return p.runShareInstallationCommand
+	case "unshare":
+		return p.runUnshareInstallationCommand
+	case "delete":
+		return p.runDeleteCommand
+	}
+
+	return nil
+}
+
+// installationCommandArgs returns the slash command arguments for the
+// request, with the options sorted so they are parsed in a stable order.
+func installationCommandArgs(command, name string, req *InstallationRequest) ([]string, error) {
+	switch command {
+	case "create":
+		name = req.Name
+	case "import":
+		name = req.DNS
+	}
+	if name == "" {
+		if command == "import" {
+			return nil, errors.New("must provide an installation DNS")
+		}
+		return nil, errors.New("must provide an installation name")
+	}
+
+	keys := make([]string, 0, len(req.Options))
+	for key := range req.Options {
+		if key == "" || strings.HasPrefix(key, "-") {
+			return nil, errors.Errorf("invalid option %q, options are flag names without dashes", key)
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	args := []string{name}
+	for _, key := range keys {
+		args = append(args, fmt.Sprintf("--%s=%s", key, req.Options[key]))
+	}
+
+	return args, nil
+}
+
+// getChangedInstallation returns the installation changed by a successful
+// request to the installations REST API, or nil if it was deleted. The
+// installations of the user are preferred over shared installations with the
+// same name.
+func (p *Plugin) getChangedInstallation(userID, command string, args []string) (*Installation, error) {
+	if command == "delete" {
+		return nil, nil
+	}
+
+	name := standardizeName(args[0])
+	if command == "import" {
+		var err error
+		_, name, err = parseImportDNS(args[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	installs, err := p.getUpdatableInstallationsForUser(userID, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var changed *Installation
+	for _, install := range installs {
+		if standardizeName(install.Name) != name {
+			continue
+		}
+		// Installations are stored in the order they were added, so the last
+		// match is the newest when an import reuses the name of another one.
+		if install.OwnerID == userID || changed == nil || changed.OwnerID != userID {
+			changed = install
+		}
+	}
+	if changed == nil {
+		return nil, nil
+	}
+
+	// The state and DNS records are refreshed, as the stored installation
+	// doesn't reflect the change yet.
+	cloudInstall, err := p.cloudClient.GetInstallation(changed.ID, &cloud.GetInstallationRequest{})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get installation")
+	}
+	if cloudInstall != nil {
+		changed.State = cloudInstall.State
+		changed.DNSRecords = cloudInstall.DNSRecords
+	}
+
+	return changed, nil
+}
+
+func (p *Plugin) handleInstallationsAPI(w http.ResponseWriter, r *http.Request, userID, command, name string) {
+	method := http.MethodPost
+	if command == "delete" {
+		method = http.MethodDelete
+	}
+	if r.Method != method {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := &InstallationRequest{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil && err != io.EOF {
+		p.API.LogError(errors.Wrap(err, "Unable to decode installation request").Error())
+		http.Error(w, "Please provide a JSON object describing the installation", http.StatusBadRequest)
+		return
+	}
+
+	args, err := installationCommandArgs(command, name, req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	extra := &model.CommandArgs{
+		UserId:  userID,
+		TeamId:  req.TeamID,
+		Command: fmt.Sprintf("/cloud %s %s", command, strings.Join(args, " ")),
+	}
+	resp, isUserError, err := p.runObservedCommand(command, p.installationCommandHandler(command), args, extra)
+	if err != nil {
+		if isUserError {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.API.LogError(errors.Wrapf(err, "Unable to run %s through the REST API", command).Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	installResp := &InstallationResponse{
+		Message: strings.TrimPrefix(resp.Text, "Command invoked: `"+extra.Command+"`\n\n"),
+	}
+	install, err := p.getChangedInstallation(userID, command, args)
+	if err != nil {
+		p.API.LogWarn("Unable to get the installation changed through the REST API", "command", command, "error", err.Error())
+	} else if install != nil {
+		installResp.Installation = newInstallationSummary(install)
+	}
+
+	data, err := json.Marshal(installResp)
+	if err != nil {
+		p.API.LogError(errors.Wrap(err, "Unable to marshal installation response").Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	if command == "create" || command == "import" {
+		w.WriteHeader(http.StatusCreated)
+	}
+	w.Write(data)
+}
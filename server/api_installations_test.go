@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseInstallationsPath(t *testing.T) {
+	for path, expected := range map[string][]string{
+		"/api/v1/installations":                     {"create", ""},
+		"/api/v1/installations/import":              {"import", ""},
+		"/api/v1/installations/someinstall":         {"delete", "someinstall"},
+		"/api/v1/installations/someinstall/wake-up": {"wake-up", "someinstall"},
+	} {
+		command, name, ok := parseInstallationsPath(path)
+		require.True(t, ok, path)
+		assert.Equal(t, expected, []string{command, name}, path)
+	}
+
+	for _, path := range []string{
+		"/api/v1/installationsfoo",
+		"/api/v1/installations/",
+		"/api/v1/installations/someinstall/events",
+		"/api/v1/installations/someinstall/credentials",
+		"/api/v1/installations/someinstall/restart/now",
+	} {
+		_, _, ok := parseInstallationsPath(path)
+		assert.False(t, ok, path)
+	}
+}
+
+func TestInstallationsAPI(t *testing.T) {
+	response := func(t *testing.T, w *httptest.ResponseRecorder, expectedCode int) *InstallationResponse {
+		require.Equal(t, expectedCode, w.Code, w.Body.String())
+		resp := &InstallationResponse{}
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), resp))
+		return resp
+	}
+	message := func(t *testing.T, w *httptest.ResponseRecorder, expectedCode int) string {
+		return response(t, w, expectedCode).Message
+	}
+
+	t.Run("create", func(t *testing.T) {
+		plugin, mockedCloudClient := newAPITestPlugin(t)
+		path := "/api/v1/installations"
+
+		w := serveAPIRequest(t, plugin, "userid", http.MethodPost, path, &InstallationRequest{
+			Name:    "apitest",
+			TeamID:  "someteamid",
+			Options: map[string]string{"size": "miniSingleton", "test-data": "true"},
+		})
+		resp := response(t, w, http.StatusCreated)
+		assert.Contains(t, resp.Message, "Installation being created.")
+		assert.Equal(t, &InstallationSummary{ID: "someid", Name: "apitest", State: cloud.InstallationStateStable}, resp.Installation)
+		require.NotNil(t, mockedCloudClient.creationRequest)
+		assert.Equal(t, "miniSingleton", mockedCloudClient.creationRequest.Size)
+		assert.Equal(t, "userid", mockedCloudClient.creationRequest.OwnerID)
+
+		w = serveAPIRequest(t, plugin, "userid", http.MethodPost, path, &InstallationRequest{
+			Name:    "isolatedtest",
+			Options: map[string]string{"affinity": cloud.InstallationAffinityIsolated},
+		})
+		assert.Equal(t, http.StatusBadRequest, w.Code, "power user options are validated like the slash command")
+		assert.Contains(t, w.Body.String(), "isolated installations are restricted")
+
+		assert.Equal(t, http.StatusBadRequest, serveAPIRequest(t, plugin, "userid", http.MethodPost, path, &InstallationRequest{}).Code)
+		assert.Equal(t, http.StatusBadRequest, serveAPIRequest(t, plugin, "userid", http.MethodPost, path, &InstallationRequest{
+			Name:    "apitest",
+			Options: map[string]string{"--size": "miniSingleton"},
+		}).Code)
+		assert.Equal(t, http.StatusForbidden, serveAPIRequest(t, plugin, "viewerid", http.MethodPost, path, &InstallationRequest{Name: "apitest"}).Code)
+		assert.Equal(t, http.StatusUnauthorized, serveAPIRequest(t, plugin, "", http.MethodPost, path, &InstallationRequest{Name: "apitest"}).Code)
+		assert.Equal(t, http.StatusMethodNotAllowed, serveAPIRequest(t, plugin, "userid", http.MethodGet, path, nil).Code)
+	})
+
+	t.Run("installation actions", func(t *testing.T) {
+		plugin, mockedCloudClient := newAPITestPlugin(t)
+
+		w := serveAPIRequest(t, plugin, "userid", http.MethodPost, "/api/v1/installations/usersinstall/restart", nil)
+		assert.Equal(t, "Installation usersinstall restarting now.", message(t, w, http.StatusOK))
+
+		w = serveAPIRequest(t, plugin, "adminid", http.MethodPost, "/api/v1/installations/usersinstall/restart", nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code, "only the owner can change the installation")
+		assert.Contains(t, w.Body.String(), "no installation with the name usersinstall found")
+
+		mockedCloudClient.overrideGetInstallationDTO = &cloud.InstallationDTO{
+			Installation: &cloud.Installation{ID: "someid", OwnerID: "userid", State: cloud.InstallationStateUpdateRequested},
+			DNSRecords:   []*cloud.InstallationDNS{{DomainName: "usersinstall.test.mattermost.cloud"}},
+		}
+		w = serveAPIRequest(t, plugin, "userid", http.MethodPost, "/api/v1/installations/usersinstall/update", &InstallationRequest{
+			Options: map[string]string{"size": "miniSingleton"},
+		})
+		assert.Equal(t, &InstallationSummary{
+			ID:    "someid",
+			Name:  "usersinstall",
+			DNS:   "usersinstall.test.mattermost.cloud",
+			State: cloud.InstallationStateUpdateRequested,
+		}, response(t, w, http.StatusOK).Installation)
+		mockedCloudClient.overrideGetInstallationDTO = nil
+		require.NotNil(t, mockedCloudClient.patchRequest)
+		assert.Equal(t, "miniSingleton", *mockedCloudClient.patchRequest.Size)
+
+		w = serveAPIRequest(t, plugin, "userid", http.MethodPost, "/api/v1/installations/usersinstall/wake-up", nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "must be hibernating to wake up")
+
+		w = serveAPIRequest(t, plugin, "userid", http.MethodPost, "/api/v1/installations/usersinstall/share", &InstallationRequest{
+			Options: map[string]string{"allow-updates": "true"},
+		})
+		assert.Contains(t, message(t, w, http.StatusOK), "Other plugin users will be allowed to update this installation.")
+		install, err := plugin.getInstallation("someid")
+		require.NoError(t, err)
+		assert.True(t, install.Shared)
+		assert.True(t, install.AllowSharedUpdates)
+
+		w = serveAPIRequest(t, plugin, "userid", http.MethodPost, "/api/v1/installations/usersinstall/unshare", nil)
+		assert.Equal(t, "Installation has been unshared.", message(t, w, http.StatusOK))
+
+		assert.Equal(t, http.StatusForbidden, serveAPIRequest(t, plugin, "viewerid", http.MethodPost, "/api/v1/installations/usersinstall/restart", nil).Code)
+		assert.Equal(t, http.StatusNotFound, serveAPIRequest(t, plugin, "userid", http.MethodPost, "/api/v1/installations/usersinstall/mmctl", nil).Code)
+	})
+
+	t.Run("import", func(t *testing.T) {
+		plugin, mockedCloudClient := newAPITestPlugin(t)
+		path := "/api/v1/installations/import"
+
+		w := serveAPIRequest(t, plugin, "userid", http.MethodPost, path, &InstallationRequest{DNS: "usersinstall.test.mattermost.cloud"})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "installation has already been imported to cloud plugin")
+
+		w = serveAPIRequest(t, plugin, "userid", http.MethodPost, path, nil)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "must provide an installation DNS")
+
+		mockedCloudClient.overrideGetInstallationDTO = &cloud.InstallationDTO{
+			Installation: &cloud.Installation{ID: "importedid", OwnerID: "userid", State: cloud.InstallationStateHibernating},
+			DNSRecords:   []*cloud.InstallationDNS{{DomainName: "imported.test.mattermost.cloud"}},
+		}
+		w = serveAPIRequest(t, plugin, "userid", http.MethodPost, path, &InstallationRequest{DNS: "https://imported.test.mattermost.cloud"})
+		assert.Equal(t, &InstallationSummary{
+			ID:    "importedid",
+			Name:  "imported",
+			DNS:   "imported.test.mattermost.cloud",
+			State: cloud.InstallationStateHibernating,
+		}, response(t, w, http.StatusCreated).Installation)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		plugin, mockedCloudClient := newAPITestPlugin(t)
+		path := "/api/v1/installations/usersinstall"
+
+		assert.Equal(t, http.StatusMethodNotAllowed, serveAPIRequest(t, plugin, "userid", http.MethodPost, path, nil).Code)
+		assert.Equal(t, http.StatusForbidden, serveAPIRequest(t, plugin, "viewerid", http.MethodDelete, path, nil).Code)
+		assert.Empty(t, mockedCloudClient.deletedInstallationID)
+
+		w := serveAPIRequest(t, plugin, "userid", http.MethodDelete, path, nil)
+		resp := response(t, w, http.StatusOK)
+		assert.Equal(t, "Installation usersinstall deleted.", resp.Message)
+		assert.Nil(t, resp.Installation)
+		assert.Equal(t, "someid", mockedCloudClient.deletedInstallationID)
+
+		install, err := plugin.getInstallation("someid")
+		require.NoError(t, err)
+		assert.Nil(t, install)
+	})
+}
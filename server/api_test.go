@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newAPITestPlugin returns a plugin where everyone is a viewer, users with a
+// mattermost.com email are users and userid owns the installation someid.
+func newAPITestPlugin(t *testing.T) (*Plugin, *MockClient) {
+	plugin := newRBACTestPlugin(`[{"role": "viewer"}, {"role": "user", "email_domains": ["mattermost.com"]}]`)
+	plugin.configuration.ProvisioningServerURL = "https://provisioner"
+	plugin.configuration.ProvisioningServerAuthToken = "token"
+	plugin.configuration.DeletionLockInstallationsAllowedPerPerson = "1"
+
+	mockedCloudClient := &MockClient{
+		mockedCloudInstallationsDTO: []*cloud.InstallationDTO{
+			{Installation: &cloud.Installation{ID: "someid", OwnerID: "userid", State: cloud.InstallationStateStable}},
+		},
+	}
+	plugin.cloudClient = mockedCloudClient
+
+	appErr := plugin.API.KVSet(StoreInstallsKey, []byte(`[
+		{"ID": "someid", "OwnerID": "userid", "Name": "usersinstall"},
+		{"ID": "otherid", "OwnerID": "joramid", "Name": "joramsinstall", "Shared": true}
+	]`))
+	require.Nil(t, appErr)
+
+	return plugin, mockedCloudClient
+}
+
+// serveAPIRequest sends a request with a JSON body to the plugin as the user.
+func serveAPIRequest(t *testing.T, plugin *Plugin, userID, method, path string, body interface{}) *httptest.ResponseRecorder {
+	return serveAPIRequestWithHeader(t, plugin, "Mattermost-User-ID", userID, method, path, body)
+}
+
+// serveAPIRequestWithHeader sends a request with a JSON body to the plugin,
+// setting the header if the value isn't empty.
+func serveAPIRequestWithHeader(t *testing.T, plugin *Plugin, header, value, method, path string, body interface{}) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		require.NoError(t, err)
+		reader = bytes.NewReader(data)
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, path, reader)
+	if value != "" {
+		r.Header.Set(header, value)
+	}
+	plugin.ServeHTTP(nil, w, r)
+	return w
+}
+
+func TestServeHTTPCallerIdentity(t *testing.T) {
+	listInstalls := func(t *testing.T, w *httptest.ResponseRecorder) []*InstallationWebWrapper {
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var installs []*InstallationWebWrapper
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &installs))
+		return installs
+	}
+
+	t.Run("user installs", func(t *testing.T) {
+		plugin, _ := newAPITestPlugin(t)
+		path := "/api/v1/userinstalls"
+
+		installs := listInstalls(t, serveAPIRequest(t, plugin, "userid", http.MethodPost, path, &CloudUserRequest{UserID: "userid"}))
+		require.Len(t, installs, 1)
+		assert.Equal(t, "someid", installs[0].ID)
+
+		installs = listInstalls(t, serveAPIRequest(t, plugin, "userid", http.MethodPost, path, nil))
+		require.Len(t, installs, 1, "the caller's installations are returned without a user_id")
+
+		w := serveAPIRequest(t, plugin, "viewerid", http.MethodPost, path, &CloudUserRequest{UserID: "userid"})
+		assert.Equal(t, http.StatusForbidden, w.Code, "only admins may list the installations of other users")
+
+		installs = listInstalls(t, serveAPIRequest(t, plugin, "adminid", http.MethodPost, path, &CloudUserRequest{UserID: "userid"}))
+		assert.Len(t, installs, 1)
+
+		assert.Equal(t, http.StatusUnauthorized, serveAPIRequest(t, plugin, "", http.MethodPost, path, &CloudUserRequest{UserID: "userid"}).Code)
+
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader("{"))
+		r.Header.Set("Mattermost-User-ID", "userid")
+		w = httptest.NewRecorder()
+		plugin.ServeHTTP(nil, w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("shared installs", func(t *testing.T) {
+		plugin, _ := newAPITestPlugin(t)
+		path := "/api/v1/sharedinstalls"
+
+		installs := listInstalls(t, serveAPIRequest(t, plugin, "viewerid", http.MethodGet, path, nil))
+		require.Len(t, installs, 1)
+		assert.Equal(t, "joramsinstall", installs[0].Name)
+		assert.Equal(t, http.StatusUnauthorized, serveAPIRequest(t, plugin, "", http.MethodGet, path, nil).Code)
+	})
+
+	t.Run("deletion lock", func(t *testing.T) {
+		plugin, mockedCloudClient := newAPITestPlugin(t)
+
+		for _, path := range []string{"/api/v1/deletion-lock", "/api/v1/deletion-unlock"} {
+			assert.Equal(t, http.StatusUnauthorized, serveAPIRequest(t, plugin, "", http.MethodPost, path, &CloudDeletionLockRequest{InstallationID: "someid"}).Code, path)
+			assert.Equal(t, http.StatusForbidden, serveAPIRequest(t, plugin, "viewerid", http.MethodPost, path, &CloudDeletionLockRequest{InstallationID: "someid"}).Code, path)
+			assert.Equal(t, http.StatusInternalServerError, serveAPIRequest(t, plugin, "adminid", http.MethodPost, path, &CloudDeletionLockRequest{InstallationID: "someid"}).Code, "%s only applies to the caller's installations", path)
+			assert.Equal(t, http.StatusCreated, serveAPIRequest(t, plugin, "userid", http.MethodPost, path, &CloudDeletionLockRequest{InstallationID: "someid"}).Code, path)
+		}
+		assert.Equal(t, "someid", mockedCloudClient.unlockedInstallationID)
+	})
+
+	t.Run("config", func(t *testing.T) {
+		plugin, _ := newAPITestPlugin(t)
+
+		assert.Equal(t, http.StatusUnauthorized, serveAPIRequest(t, plugin, "", http.MethodGet, "/api/v1/config", nil).Code)
+		assert.Equal(t, http.StatusOK, serveAPIRequest(t, plugin, "viewerid", http.MethodGet, "/api/v1/config", nil).Code)
+	})
+
+	t.Run("events", func(t *testing.T) {
+		plugin, _ := newAPITestPlugin(t)
+		plugin.recordPluginEvent("someid", "userid", "restart", "")
+		path := "/api/v1/installations/someid/events"
+
+		assert.Equal(t, http.StatusUnauthorized, serveAPIRequest(t, plugin, "", http.MethodGet, path, nil).Code)
+		assert.Equal(t, http.StatusNotFound, serveAPIRequest(t, plugin, "viewerid", http.MethodGet, path, nil).Code)
+		assert.Equal(t, http.StatusOK, serveAPIRequest(t, plugin, "userid", http.MethodGet, path, nil).Code)
+	})
+
+	t.Run("actions", func(t *testing.T) {
+		plugin, mockedCloudClient := newAPITestPlugin(t)
+		request := &model.PostActionIntegrationRequest{Context: map[string]interface{}{"installation_id": "someid"}}
+
+		assert.Equal(t, http.StatusUnauthorized, serveAPIRequest(t, plugin, "", http.MethodPost, actionRetryPath, request).Code)
+		assert.Equal(t, http.StatusForbidden, serveAPIRequest(t, plugin, "viewerid", http.MethodPost, actionRetryPath, request).Code)
+		assert.Empty(t, mockedCloudClient.retriedInstallationID)
+	})
+
+	t.Run("digest unsubscribe", func(t *testing.T) {
+		plugin, _ := newAPITestPlugin(t)
+
+		assert.Equal(t, http.StatusUnauthorized, serveAPIRequest(t, plugin, "", http.MethodPost, actionDigestUnsubscribePath, nil).Code)
+		assert.Equal(t, http.StatusOK, serveAPIRequest(t, plugin, "viewerid", http.MethodPost, actionDigestUnsubscribePath, nil).Code)
+
+		optedOut, err := plugin.digestOptedOut("viewerid")
+		require.NoError(t, err)
+		assert.True(t, optedOut)
+	})
+}
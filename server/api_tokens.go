@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// apiTokenHeaderKey holds a plugin API token authenticating a request to
+	// the REST API without a Mattermost session.
+	apiTokenHeaderKey = "X-MM-Cloud-Plugin-Token"
+	// apiTokenKeyPrefix prefixes the keys storing API tokens by the hash of
+	// their secret in the plugin KV store. Secrets are never stored.
+	apiTokenKeyPrefix = "apitoken_"
+	apiTokenPrefix    = "mmcloud_"
+
+	// apiTokenScopeRead allows listing installations, their events and the
+	// plugin configuration.
+	apiTokenScopeRead = "read"
+)
+
+// apiTokenScopes are the scopes which can be granted to API tokens. Besides
+// read, each scope allows the REST endpoint of the matching slash command.
+var apiTokenScopes = []string{
+	apiTokenScopeRead,
+	"create",
+	"import",
+	"update",
+	"restart",
+	"hibernate",
+	"wake-up",
+	"delete",
+	"share",
+	"unshare",
+	"deletion-lock",
+	"deletion-unlock",
+}
+
+// apiToken authenticates requests to the REST API on behalf of the user who
+// created it, limited to its scopes.
+type apiToken struct {
+	ID       string   `json:"id"`
+	Name     string   `json:"name"`
+	UserID   string   `json:"user_id"`
+	Scopes   []string `json:"scopes"`
+	CreateAt int64    `json:"create_at"`
+
+	key string
+}
+
+func (t *apiToken) hasScope(scope string) bool {
+	for _, tokenScope := range t.Scopes {
+		if tokenScope == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// apiTokenKey returns the KV key of the token with the given secret.
+func apiTokenKey(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return apiTokenKeyPrefix + hex.EncodeToString(hash[:])
+}
+
+// generateAPITokenSecret returns a new random API token secret.
+func generateAPITokenSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to generate API token")
+	}
+	return apiTokenPrefix + hex.EncodeToString(b), nil
+}
+
+// parseAPITokenScopes validates scopes, removing duplicates.
+func parseAPITokenScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return nil, errors.Errorf("must provide at least one scope, valid scopes are %s", strings.Join(apiTokenScopes, ", "))
+	}
+
+	var parsed []string
+	seen := make(map[string]bool)
+	for _, scope := range scopes {
+		scope = strings.ToLower(strings.TrimSpace(scope))
+		valid := false
+		for _, validScope := range apiTokenScopes {
+			valid = valid || scope == validScope
+		}
+		if !valid {
+			return nil, errors.Errorf("invalid scope %q, valid scopes are %s", scope, strings.Join(apiTokenScopes, ", "))
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			parsed = append(parsed, scope)
+		}
+	}
+
+	return parsed, nil
+}
+
+// createAPIToken stores a new token for the user and returns it with its
+// secret, which is only known to the caller from then on.
+func (p *Plugin) createAPIToken(userID, name string, scopes []string) (*apiToken, string, error) {
+	secret, err := generateAPITokenSecret()
+	if err != nil {
+		return nil, "", err
+	}
+	token := &apiToken{
+		ID:       model.NewId(),
+		Name:     name,
+		UserID:   userID,
+		Scopes:   scopes,
+		CreateAt: model.GetMillis(),
+		key:      apiTokenKey(secret),
+	}
+
+	data, err := json.Marshal(token)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to marshal API token")
+	}
+	appErr := p.API.KVSet(token.key, data)
+	if appErr != nil {
+		return nil, "", errors.Wrap(appErr, "failed to store API token")
+	}
+
+	return token, secret, nil
+}
+
+// getAPIToken returns the token with the given secret, or nil if there is
+// none.
+func (p *Plugin) getAPIToken(secret string) (*apiToken, error) {
+	if !strings.HasPrefix(secret, apiTokenPrefix) {
+		return nil, nil
+	}
+
+	return p.getAPITokenByKey(apiTokenKey(secret))
+}
+
+func (p *Plugin) getAPITokenByKey(key string) (*apiToken, error) {
+	data, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get API token")
+	}
+	if data == nil {
+		return nil, nil
+	}
+
+	token := &apiToken{key: key}
+	err := json.Unmarshal(data, token)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal API token")
+	}
+
+	return token, nil
+}
+
+// getAPITokensForUser returns the tokens created by the user, sorted by name.
+func (p *Plugin) getAPITokensForUser(userID string) ([]*apiToken, error) {
+	keys, err := p.listKVKeys(apiTokenKeyPrefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []*apiToken
+	for _, key := range keys {
+		token, err := p.getAPITokenByKey(key)
+		if err != nil {
+			return nil, err
+		}
+		if token != nil && token.UserID == userID {
+			tokens = append(tokens, token)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Name < tokens[j].Name
+	})
+
+	return tokens, nil
+}
+
+// revokeAPIToken deletes the token of the user with the given name or ID.
+func (p *Plugin) revokeAPIToken(userID, nameOrID string) (*apiToken, error) {
+	tokens, err := p.getAPITokensForUser(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, token := range tokens {
+		if token.ID == nameOrID || token.Name == nameOrID {
+			appErr := p.API.KVDelete(token.key)
+			if appErr != nil {
+				return nil, errors.Wrap(appErr, "failed to delete API token")
+			}
+			return token, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// authenticateAPIToken returns the ID of the user a request made with an API
+// token acts on behalf of. It writes an error response and returns false if
+// the token is invalid or lacks the scope.
+func (p *Plugin) authenticateAPIToken(w http.ResponseWriter, secret, scope string) (string, bool) {
+	token, err := p.getAPIToken(secret)
+	if err != nil {
+		p.API.LogError(errors.Wrap(err, "Unable to authenticate API token").Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return "", false
+	}
+	if token == nil {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return "", false
+	}
+
+	// Tokens stop working once the user who created them is deactivated.
+	user, appErr := p.API.GetUser(token.UserID)
+	if appErr != nil || user.DeleteAt != 0 {
+		http.Error(w, "Not authorized", http.StatusUnauthorized)
+		return "", false
+	}
+	if scope == "" || !token.hasScope(scope) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return "", false
+	}
+
+	return token.UserID, true
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAPITokenScopes(t *testing.T) {
+	scopes, err := parseAPITokenScopes([]string{"create", " Delete", "create"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"create", "delete"}, scopes)
+
+	_, err = parseAPITokenScopes([]string{"create", "mmctl"})
+	assert.EqualError(t, err, `invalid scope "mmctl", valid scopes are read, create, import, update, restart, hibernate, wake-up, delete, share, unshare, deletion-lock, deletion-unlock`)
+	_, err = parseAPITokenScopes(nil)
+	assert.Error(t, err)
+}
+
+func TestAPITokens(t *testing.T) {
+	plugin, mockedCloudClient := newAPITestPlugin(t)
+	api := plugin.API.(*plugintest.API)
+	api.On("LogInfo", mock.AnythingOfType("string"), mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+	api.On("LogInfo", mock.AnythingOfType("string"), mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+
+	runToken := func(userID string, args ...string) (string, bool, error) {
+		resp, isUserError, err := plugin.runTokenCommand(args, &model.CommandArgs{UserId: userID, Command: "/cloud token"})
+		if err != nil {
+			return "", isUserError, err
+		}
+		return resp.Text, false, nil
+	}
+
+	text, _, err := runToken("userid", "create", "--name", "ci", "--scopes", "create,delete")
+	require.NoError(t, err)
+	secret := regexp.MustCompile(apiTokenPrefix + "[0-9a-f]{64}").FindString(text)
+	require.NotEmpty(t, secret)
+
+	t.Run("stored hashed", func(t *testing.T) {
+		keys, err := plugin.listKVKeys(apiTokenKeyPrefix)
+		require.NoError(t, err)
+		require.Len(t, keys, 1)
+		assert.Equal(t, apiTokenKey(secret), keys[0])
+
+		value, appErr := plugin.API.KVGet(keys[0])
+		require.Nil(t, appErr)
+		assert.NotContains(t, string(value), secret)
+	})
+
+	t.Run("create errors", func(t *testing.T) {
+		_, isUserError, err := runToken("userid", "create", "--name", "ci", "--scopes", "read")
+		require.EqualError(t, err, "you already have a token named ci")
+		assert.True(t, isUserError)
+
+		_, isUserError, err = runToken("userid", "create", "--scopes", "read")
+		require.Error(t, err)
+		assert.True(t, isUserError)
+
+		_, isUserError, err = runToken("userid", "create", "--name", "other")
+		require.Error(t, err)
+		assert.True(t, isUserError)
+	})
+
+	serveWithToken := func(token, method, path string, body interface{}) int {
+		w := serveAPIRequestWithHeader(t, plugin, apiTokenHeaderKey, token, method, path, body)
+		return w.Code
+	}
+
+	t.Run("authenticates requests", func(t *testing.T) {
+		code := serveWithToken(secret, http.MethodPost, "/api/v1/installations", &InstallationRequest{Name: "citest"})
+		require.Equal(t, http.StatusCreated, code)
+		require.NotNil(t, mockedCloudClient.creationRequest)
+		assert.Equal(t, "userid", mockedCloudClient.creationRequest.OwnerID, "tokens act on behalf of their user")
+
+		assert.Equal(t, http.StatusForbidden, serveWithToken(secret, http.MethodPost, "/api/v1/installations/usersinstall/restart", nil), "the token lacks the restart scope")
+		assert.Equal(t, http.StatusForbidden, serveWithToken(secret, http.MethodGet, "/api/v1/config", nil), "the token lacks the read scope")
+		assert.Equal(t, http.StatusForbidden, serveWithToken(secret, http.MethodPost, actionRetryPath, nil), "actions require a session")
+		assert.Equal(t, http.StatusUnauthorized, serveWithToken(apiTokenPrefix+"invalid", http.MethodPost, "/api/v1/installations", &InstallationRequest{Name: "citest"}))
+		assert.Equal(t, http.StatusUnauthorized, serveWithToken("invalid", http.MethodPost, "/api/v1/installations", &InstallationRequest{Name: "citest"}))
+	})
+
+	t.Run("role is still required", func(t *testing.T) {
+		_, viewerSecret, err := plugin.createAPIToken("viewerid", "ci", []string{"create"})
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusForbidden, serveWithToken(viewerSecret, http.MethodPost, "/api/v1/installations", &InstallationRequest{Name: "citest"}))
+	})
+
+	t.Run("list and revoke", func(t *testing.T) {
+		text, _, err := runToken("userid", "list")
+		require.NoError(t, err)
+		assert.Contains(t, text, "| ci |")
+		assert.Contains(t, text, "create, delete")
+		assert.NotContains(t, text, secret)
+
+		_, isUserError, err := runToken("userid", "revoke", "unknown")
+		require.Error(t, err)
+		assert.True(t, isUserError)
+
+		text, _, err = runToken("userid", "revoke", "ci")
+		require.NoError(t, err)
+		assert.Contains(t, text, "Token `ci` revoked.")
+		assert.Equal(t, http.StatusUnauthorized, serveWithToken(secret, http.MethodDelete, "/api/v1/installations/usersinstall", nil))
+
+		text, _, err = runToken("userid", "list")
+		require.NoError(t, err)
+		assert.Contains(t, text, "You don't have any API tokens.")
+
+		tokens, err := plugin.getAPITokensForUser("viewerid")
+		require.NoError(t, err)
+		assert.Len(t, tokens, 1, "only the tokens of the user are revoked")
+	})
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// backgroundJobs tracks work started in the background by commands and
+// actions, which is interrupted and waited for when the plugin stops.
+type backgroundJobs struct {
+	lock sync.Mutex
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// start runs the job in the background. The stop channel passed to the job is
+// closed when the plugin stops.
+func (j *backgroundJobs) start(job func(stop <-chan struct{})) {
+	j.lock.Lock()
+	if j.stop == nil {
+		j.stop = make(chan struct{})
+	}
+	stop := j.stop
+	j.wg.Add(1)
+	j.lock.Unlock()
+
+	go func() {
+		defer j.wg.Done()
+		job(stop)
+	}()
+}
+
+// stopAndWait interrupts the running jobs and waits up to the timeout for them
+// to return. It returns false if some jobs are still running.
+func (j *backgroundJobs) stopAndWait(timeout time.Duration) bool {
+	j.lock.Lock()
+	if j.stop != nil {
+		close(j.stop)
+		j.stop = nil
+	}
+	j.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		j.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
@@ -8,6 +8,19 @@ import (
 
 // PostBotDM posts a DM as the cloud bot user.
 func (p *Plugin) PostBotDM(userID, message string) error {
+	return p.postBotDM(userID, &model.Post{Message: message})
+}
+
+// PostBotDMWithAttachments posts a DM with message attachments, such as
+// interactive buttons, as the cloud bot user.
+func (p *Plugin) PostBotDMWithAttachments(userID, message string, attachments []*model.SlackAttachment) error {
+	post := &model.Post{Message: message}
+	model.ParseSlackAttachment(post, attachments)
+
+	return p.postBotDM(userID, post)
+}
+
+func (p *Plugin) postBotDM(userID string, post *model.Post) error {
 	channel, appError := p.API.GetDirectChannel(userID, p.BotUserID)
 	if appError != nil {
 		return appError
@@ -16,13 +29,14 @@ func (p *Plugin) PostBotDM(userID, message string) error {
 		return fmt.Errorf("could not get direct channel for bot and user_id=%s", userID)
 	}
 
-	_, appError = p.API.CreatePost(&model.Post{
-		UserId:    p.BotUserID,
-		ChannelId: channel.Id,
-		Message:   message,
-	})
+	post.UserId = p.BotUserID
+	post.ChannelId = channel.Id
+	_, appError = p.API.CreatePost(post)
+	if appError != nil {
+		return appError
+	}
 
-	return appError
+	return nil
 }
 
 // PostToChannelByIDAsBot posts a message to the provided channel.
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+var catalogNameMatcher = regexp.MustCompile(`^[a-zA-Z0-9-_]+$`)
+
+// imageOption is a docker repository which Mattermost servers can be created
+// from.
+type imageOption struct {
+	Repository string `json:"repository"`
+	Label      string `json:"label"`
+	// TestImage marks repositories that contain artifacts used primarily
+	// for internal testing. They may require configuration overrides such
+	// as special licenses.
+	TestImage bool `json:"test_image"`
+	Default   bool `json:"default"`
+}
+
+// sizeOption is a valid installation size.
+type sizeOption struct {
+	Name    string `json:"name"`
+	Label   string `json:"label"`
+	Default bool   `json:"default"`
+	// PowerUser restricts the size to users with the power-user role.
+	PowerUser bool `json:"power_user"`
+}
+
+// licenseOption is a named Mattermost license that installations can be
+// created with. An empty License value creates an unlicensed installation.
+type licenseOption struct {
+	Name    string `json:"name"`
+	Label   string `json:"label"`
+	License string `json:"license"`
+	Default bool   `json:"default"`
+	// MultitenantFilestore marks licenses which allow the multitenant S3
+	// filestore, whose shared bucket requires enterprise features.
+	MultitenantFilestore bool `json:"multitenant_filestore"`
+}
+
+// defaultImageCatalog is used when no image catalog is configured.
+var defaultImageCatalog = []imageOption{
+	{Repository: imageEE, Label: "Enterprise Edition", Default: true},
+	{Repository: imageEECloud, Label: "Enterprise Edition (Cloud)"},
+	{Repository: imageTE, Label: "Team Edition"},
+	{Repository: imageTeamEdition, Label: "Team Edition"},
+	{Repository: imageEETest, Label: "Enterprise Edition test build", TestImage: true},
+	{Repository: imageTETest, Label: "Team Edition test build"},
+	{Repository: imageEEDev, Label: "Enterprise Edition development build", TestImage: true},
+	{Repository: imageTEDev, Label: "Team Edition development build"},
+}
+
+// defaultSizeCatalog is used when no installation sizes are configured.
+var defaultSizeCatalog = []sizeOption{
+	{Name: "miniSingleton", Label: "Mini Singleton instance", Default: true},
+	{Name: "miniHA", Label: "Mini cluster made of two servers", PowerUser: true},
+}
+
+// defaultLicenseCatalog builds the license catalog from the individual
+// license settings, which predate the configurable license catalog.
+func (c *configuration) defaultLicenseCatalog() []licenseOption {
+	return []licenseOption{
+		{Name: licenseOptionEnterprise, Label: "Enterprise Edition License", License: c.EnterpriseLicense, Default: true, MultitenantFilestore: true},
+		{Name: licenseOptionProfessional, Label: "Professional Edition License", License: c.ProfessionalLicense},
+		{Name: licenseOptionE20, Label: "E20 License", License: c.E20License, MultitenantFilestore: true},
+		{Name: licenseOptionE10, Label: "E10 License", License: c.E10License},
+		{Name: licenseOptionTE, Label: "Team Edition License"},
+	}
+}
+
+func parseImageCatalog(raw string) ([]imageOption, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+
+	var images []imageOption
+	err := json.Unmarshal([]byte(raw), &images)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse image catalog")
+	}
+	if len(images) == 0 {
+		return nil, errors.New("image catalog must contain at least one image")
+	}
+
+	seen := map[string]bool{}
+	defaults := 0
+	for _, image := range images {
+		if image.Repository == "" {
+			return nil, errors.New("image catalog entries must specify a repository")
+		}
+		if seen[image.Repository] {
+			return nil, errors.Errorf("image %s is defined more than once", image.Repository)
+		}
+		seen[image.Repository] = true
+		if image.Default {
+			defaults++
+		}
+	}
+	if defaults > 1 {
+		return nil, errors.New("image catalog may only contain one default image")
+	}
+
+	return images, nil
+}
+
+func parseSizeCatalog(raw string) ([]sizeOption, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+
+	var sizes []sizeOption
+	err := json.Unmarshal([]byte(raw), &sizes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse installation sizes")
+	}
+	if len(sizes) == 0 {
+		return nil, errors.New("installation sizes must contain at least one size")
+	}
+
+	seen := map[string]bool{}
+	defaults := 0
+	for _, size := range sizes {
+		if !catalogNameMatcher.MatchString(size.Name) {
+			return nil, errors.Errorf("installation size name %q is invalid", size.Name)
+		}
+		if seen[size.Name] {
+			return nil, errors.Errorf("installation size %s is defined more than once", size.Name)
+		}
+		seen[size.Name] = true
+		if size.Default {
+			defaults++
+		}
+	}
+	if defaults > 1 {
+		return nil, errors.New("installation sizes may only contain one default size")
+	}
+
+	return sizes, nil
+}
+
+func parseLicenseCatalog(raw string) ([]licenseOption, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+
+	var licenses []licenseOption
+	err := json.Unmarshal([]byte(raw), &licenses)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse license catalog")
+	}
+	if len(licenses) == 0 {
+		return nil, errors.New("license catalog must contain at least one license")
+	}
+
+	seen := map[string]bool{}
+	defaults := 0
+	for _, license := range licenses {
+		if !catalogNameMatcher.MatchString(license.Name) {
+			return nil, errors.Errorf("license name %q is invalid", license.Name)
+		}
+		if seen[license.Name] {
+			return nil, errors.Errorf("license %s is defined more than once", license.Name)
+		}
+		seen[license.Name] = true
+		if license.Default {
+			defaults++
+		}
+	}
+	if defaults > 1 {
+		return nil, errors.New("license catalog may only contain one default license")
+	}
+
+	return licenses, nil
+}
+
+// loadCatalogs parses the JSON catalog settings into the configuration.
+func (c *configuration) loadCatalogs() error {
+	var err error
+
+	c.images, err = parseImageCatalog(c.ImageCatalog)
+	if err != nil {
+		return err
+	}
+	c.sizes, err = parseSizeCatalog(c.InstallationSizes)
+	if err != nil {
+		return err
+	}
+	c.licenses, err = parseLicenseCatalog(c.LicenseCatalog)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *configuration) getImages() []imageOption {
+	if c.images != nil {
+		return c.images
+	}
+	images, err := parseImageCatalog(c.ImageCatalog)
+	if err != nil || images == nil {
+		return defaultImageCatalog
+	}
+	return images
+}
+
+func (c *configuration) getSizes() []sizeOption {
+	if c.sizes != nil {
+		return c.sizes
+	}
+	sizes, err := parseSizeCatalog(c.InstallationSizes)
+	if err != nil || sizes == nil {
+		return defaultSizeCatalog
+	}
+	return sizes
+}
+
+func (c *configuration) getLicenses() []licenseOption {
+	if c.licenses != nil {
+		return c.licenses
+	}
+	licenses, err := parseLicenseCatalog(c.LicenseCatalog)
+	if err != nil || licenses == nil {
+		return c.defaultLicenseCatalog()
+	}
+	return licenses
+}
+
+func (c *configuration) imageRepositories() []string {
+	var repositories []string
+	for _, image := range c.getImages() {
+		repositories = append(repositories, image.Repository)
+	}
+	return repositories
+}
+
+func (c *configuration) sizeNames() []string {
+	var names []string
+	for _, size := range c.getSizes() {
+		names = append(names, size.Name)
+	}
+	return names
+}
+
+func (c *configuration) licenseNames() []string {
+	var names []string
+	for _, license := range c.getLicenses() {
+		names = append(names, license.Name)
+	}
+	return names
+}
+
+// multitenantFilestoreLicenses returns the names of the licenses allowing the
+// multitenant S3 filestore.
+func (c *configuration) multitenantFilestoreLicenses() []string {
+	var names []string
+	for _, license := range c.getLicenses() {
+		if license.MultitenantFilestore {
+			names = append(names, license.Name)
+		}
+	}
+	return names
+}
+
+func (c *configuration) defaultImage() string {
+	images := c.getImages()
+	for _, image := range images {
+		if image.Default {
+			return image.Repository
+		}
+	}
+	return images[0].Repository
+}
+
+func (c *configuration) defaultSize() string {
+	sizes := c.getSizes()
+	for _, size := range sizes {
+		if size.Default {
+			return size.Name
+		}
+	}
+	return sizes[0].Name
+}
+
+func (c *configuration) defaultLicense() string {
+	licenses := c.getLicenses()
+	for _, license := range licenses {
+		if license.Default {
+			return license.Name
+		}
+	}
+	return licenses[0].Name
+}
+
+func (c *configuration) validImage(repository string) bool {
+	return Contains(c.imageRepositories(), repository)
+}
+
+func (c *configuration) validSize(size string) bool {
+	return Contains(c.sizeNames(), size)
+}
+
+// powerUserSize returns if the size is restricted to power users.
+func (c *configuration) powerUserSize(size string) bool {
+	for _, option := range c.getSizes() {
+		if option.Name == size {
+			return option.PowerUser
+		}
+	}
+	return false
+}
+
+func (c *configuration) validLicense(name string) bool {
+	return Contains(c.licenseNames(), name)
+}
+
+// quotedList returns the values as a human readable list of quoted options.
+func quotedList(values []string) string {
+	quoted := make([]string, 0, len(values))
+	for _, value := range values {
+		quoted = append(quoted, fmt.Sprintf("'%s'", value))
+	}
+	return strings.Join(quoted, ", ")
+}
+
+func (c *configuration) imageHelpText() string {
+	var entries []string
+	for _, image := range c.getImages() {
+		entry := image.Repository
+		if image.TestImage {
+			entry += " (test image)"
+		}
+		entries = append(entries, entry)
+	}
+	return fmt.Sprintf("Docker image repository. Can be %s", strings.Join(entries, ", "))
+}
+
+func (c *configuration) sizeHelpText() string {
+	return fmt.Sprintf("Size of the Mattermost installation. Can be %s", quotedList(c.sizeNames()))
+}
+
+func (c *configuration) licenseHelpText() string {
+	return fmt.Sprintf("The Mattermost license to use. Can be %s", quotedList(c.licenseNames()))
+}
+
+func (c *configuration) imageAutocompleteItems() []model.AutocompleteListItem {
+	var items []model.AutocompleteListItem
+	for _, image := range c.getImages() {
+		helpText := image.Label
+		if image.TestImage {
+			helpText += " (test image)"
+		}
+		items = append(items, model.AutocompleteListItem{Item: image.Repository, HelpText: helpText})
+	}
+	return items
+}
+
+func (c *configuration) sizeAutocompleteItems() []model.AutocompleteListItem {
+	var items []model.AutocompleteListItem
+	for _, size := range c.getSizes() {
+		items = append(items, model.AutocompleteListItem{Item: size.Name, HelpText: size.Label})
+	}
+	return items
+}
+
+func (c *configuration) licenseAutocompleteItems() []model.AutocompleteListItem {
+	var items []model.AutocompleteListItem
+	for _, license := range c.getLicenses() {
+		items = append(items, model.AutocompleteListItem{Item: license.Name, HelpText: license.Label})
+	}
+	return items
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatalogDefaults(t *testing.T) {
+	config := &configuration{EnterpriseLicense: "enterpriselicense"}
+
+	assert.Equal(t, imageEE, config.defaultImage())
+	assert.Equal(t, "miniSingleton", config.defaultSize())
+	assert.Equal(t, licenseOptionEnterprise, config.defaultLicense())
+	assert.Len(t, config.imageRepositories(), 8)
+	assert.Equal(t, []string{"miniSingleton", "miniHA"}, config.sizeNames())
+	assert.Equal(t, []string{"enterprise", "professional", "e20", "e10", "te"}, config.licenseNames())
+	assert.Equal(t, []string{"enterprise", "e20"}, config.multitenantFilestoreLicenses())
+	assert.Contains(t, config.imageHelpText(), "mattermostdevelopment/mm-ee-test (test image)")
+}
+
+func TestCatalogConfigured(t *testing.T) {
+	config := &configuration{
+		ImageCatalog:      `[{"repository": "mattermost/mattermost-enterprise-edition", "label": "EE"}, {"repository": "example/custom", "label": "Custom", "test_image": true, "default": true}]`,
+		InstallationSizes: `[{"name": "miniHA", "label": "HA"}, {"name": "1000users", "label": "1000 users"}]`,
+		LicenseCatalog:    `[{"name": "trial", "label": "Trial", "license": "triallicense", "multitenant_filestore": true}, {"name": "unlicensed", "label": "None", "default": true}]`,
+	}
+	require.NoError(t, config.loadCatalogs())
+
+	assert.Equal(t, "example/custom", config.defaultImage())
+	assert.Equal(t, "miniHA", config.defaultSize())
+	assert.Equal(t, "unlicensed", config.defaultLicense())
+	assert.True(t, config.validImage("example/custom"))
+	assert.False(t, config.validImage(imageTE))
+	assert.True(t, config.validSize("1000users"))
+	assert.False(t, config.validSize("miniSingleton"))
+	assert.True(t, config.validLicense("trial"))
+	assert.False(t, config.validLicense(licenseOptionE20))
+	assert.Equal(t, []string{"trial"}, config.multitenantFilestoreLicenses())
+
+	items := config.licenseAutocompleteItems()
+	require.Len(t, items, 2)
+	assert.Equal(t, "trial", items[0].Item)
+	assert.Equal(t, "Trial", items[0].HelpText)
+
+	plugin := Plugin{configuration: config}
+	assert.Equal(t, "triallicense", plugin.getLicenseValue("trial"))
+	assert.Equal(t, "", plugin.getLicenseValue("unlicensed"))
+}
+
+func TestParseCatalogs(t *testing.T) {
+	t.Run("images", func(t *testing.T) {
+		for name, raw := range map[string]string{
+			"invalid json":     `[{`,
+			"empty":            `[]`,
+			"no repository":    `[{"label": "nope"}]`,
+			"duplicate":        `[{"repository": "a/b"}, {"repository": "a/b"}]`,
+			"multiple default": `[{"repository": "a/b", "default": true}, {"repository": "a/c", "default": true}]`,
+		} {
+			t.Run(name, func(t *testing.T) {
+				_, err := parseImageCatalog(raw)
+				require.Error(t, err)
+			})
+		}
+	})
+
+	t.Run("sizes", func(t *testing.T) {
+		for name, raw := range map[string]string{
+			"invalid json": `{}`,
+			"empty":        `[]`,
+			"invalid name": `[{"name": "mini ha"}]`,
+			"duplicate":    `[{"name": "miniHA"}, {"name": "miniHA"}]`,
+		} {
+			t.Run(name, func(t *testing.T) {
+				_, err := parseSizeCatalog(raw)
+				require.Error(t, err)
+			})
+		}
+	})
+
+	t.Run("licenses", func(t *testing.T) {
+		for name, raw := range map[string]string{
+			"invalid json":     `nope`,
+			"empty":            `[]`,
+			"invalid name":     `[{"name": ""}]`,
+			"duplicate":        `[{"name": "e20"}, {"name": "e20"}]`,
+			"multiple default": `[{"name": "a", "default": true}, {"name": "b", "default": true}]`,
+		} {
+			t.Run(name, func(t *testing.T) {
+				_, err := parseLicenseCatalog(raw)
+				require.Error(t, err)
+			})
+		}
+	})
+
+	t.Run("blank uses defaults", func(t *testing.T) {
+		images, err := parseImageCatalog(" ")
+		require.NoError(t, err)
+		assert.Nil(t, images)
+	})
+}
+
+func TestCreateCommandWithCatalog(t *testing.T) {
+	mockCloudClient := &MockClient{}
+	plugin := Plugin{
+		cloudClient:  mockCloudClient,
+		dockerClient: &MockedDockerClient{tagExists: true},
+		configuration: &configuration{
+			ImageCatalog:      `[{"repository": "example/custom", "label": "Custom"}]`,
+			InstallationSizes: `[{"name": "1000users", "label": "1000 users"}]`,
+			LicenseCatalog:    `[{"name": "trial", "label": "Trial", "license": "triallicense"}]`,
+		},
+	}
+
+	api := &plugintest.API{}
+	api.On("KVGet", mock.AnythingOfType("string")).Return(nil, nil)
+	api.On("KVCompareAndSet", mock.AnythingOfType("string"), mock.Anything, mock.Anything).Return(true, nil)
+	plugin.SetAPI(api)
+
+	t.Run("defaults from catalog", func(t *testing.T) {
+		_, isUserError, err := plugin.runCreateCommand([]string{"catalogtest", "--version", "9.11.1"}, &model.CommandArgs{})
+		require.NoError(t, err)
+		assert.False(t, isUserError)
+		require.NotNil(t, mockCloudClient.creationRequest)
+		assert.Equal(t, "example/custom", mockCloudClient.creationRequest.Image)
+		assert.Equal(t, "1000users", mockCloudClient.creationRequest.Size)
+		assert.Equal(t, "triallicense", mockCloudClient.creationRequest.License)
+	})
+
+	t.Run("built-in options are rejected", func(t *testing.T) {
+		_, isUserError, err := plugin.runCreateCommand([]string{"catalogtest", "--version", "9.11.1", "--license", licenseOptionE20}, &model.CommandArgs{})
+		require.Error(t, err)
+		assert.True(t, isUserError)
+		assert.Contains(t, err.Error(), "valid options are trial")
+
+		_, isUserError, err = plugin.runCreateCommand([]string{"catalogtest", "--version", "9.11.1", "--size", "miniHA"}, &model.CommandArgs{})
+		require.Error(t, err)
+		assert.True(t, isUserError)
+
+		_, isUserError, err = plugin.runCreateCommand([]string{"catalogtest", "--version", "9.11.1", "--image", imageEE}, &model.CommandArgs{})
+		require.Error(t, err)
+		assert.True(t, isUserError)
+	})
+
+	t.Run("help and autocomplete", func(t *testing.T) {
+		assert.Contains(t, plugin.getHelp(), "Can be 'trial'")
+
+		command := plugin.getCommand()
+		create := command.AutocompleteData.SubCommands[0]
+		for _, arg := range create.Arguments {
+			if arg.Name == "license" {
+				list := arg.Data.(*model.AutocompleteStaticListArg)
+				require.Len(t, list.PossibleArguments, 1)
+				assert.Equal(t, "trial", list.PossibleArguments[0].Item)
+			}
+		}
+	})
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/mattermost/mattermost-server/v6/model"
 	"github.com/mattermost/mattermost-server/v6/plugin"
@@ -16,6 +17,7 @@ create [name] [flags]
 	Flags:
 %s
 	example: /cloud create myinstallation --license e10 --test-data
+	example: /cloud create myinstallation --test-data-profile large --test-data-seed 42
 
 list
 	Lists the Mattermost installations created by you.
@@ -24,6 +26,10 @@ list
 import [DNS]
 	Imports installation using DNS value.
 
+import-data [name]
+	Imports the bulk import .jsonl or .zip file you most recently attached to a post in the current channel into an installation.
+	Files of up to 1 GB are accepted. They are uploaded with a temporary admin account, which is deleted once the upload is done.
+
 update [name] [flags]
 	Update a Mattermost installation.
 	Flags:
@@ -50,6 +56,26 @@ hibernate [name]
 wake-up [name]
 	Wakes a Mattermost installation up.
 
+setup-profile [list|show|save|delete] [name] [json]
+	Manages your setup profiles, which define the users, teams, channels, config, plugins and mmctl commands applied to an installation created with --setup-profile once it is ready.
+
+	example: /cloud setup-profile save qa {"users": [{"username": "qa-admin", "roles": ["system_admin"]}], "teams": [{"name": "qa"}]}
+
+setup-retry [name]
+	Resumes the setup of an installation from the step that failed.
+
+credentials [name]
+	Shows the logins of the accounts created on an installation during setup.
+
+rotate-password [name] [user]
+	Resets the password of an account created on an installation during setup.
+
+health [name]
+	Checks the DNS, TLS certificate, server status and version of an installation.
+
+events [name]
+	Shows the timeline of webhook transitions and plugin actions for an installation.
+
 mmcli [name] [mattermost-subcommand]
 	Runs Mattermost CLI commands on an installation.
 
@@ -65,6 +91,22 @@ mmctl [name] [mmctl-subcommand]
 delete [name]
 	Deletes a Mattermost installation.
 
+digest [on|off|now]
+	Turns the weekly digest of your installations on or off, or sends it to you now.
+
+token [create|list|revoke] [flags]
+	Manages your API tokens, which authenticate requests to the plugin REST API on your behalf, e.g. from CI pipelines.
+	Flags:
+%s
+	example: /cloud token create --name ci --scopes create,delete
+	example: /cloud token revoke ci
+
+report usage [flags]
+	Reports the hours installations spent running and hibernated, and their estimated cost. Restricted to system administrators.
+	Flags:
+%s
+	example: /cloud report usage --by team --month 2026-09
+
 info
 	Shows basic cloud plugin information.
 `
@@ -72,18 +114,22 @@ info
 		help,
 		p.getCreateFlagSet().FlagUsages(),
 		getListFlagSet().FlagUsages(),
-		getUpdateFlagSet().FlagUsages(),
+		p.getUpdateFlagSet().FlagUsages(),
 		getShareFlagSet().FlagUsages(),
+		getTokenFlagSet().FlagUsages(),
+		getUsageReportFlagSet().FlagUsages(),
 	))
 }
 
 func (p *Plugin) getCommand() *model.Command {
+	config := p.getConfiguration()
+
 	return &model.Command{
 		Trigger:              "cloud",
 		DisplayName:          "Mattermost Private Cloud",
 		Description:          "This command allows spinning up and down Mattermost installations using Mattermost Private Cloud.",
-		AutoComplete:         p.getConfiguration().EnableCommandAutocompletion,
-		AutoCompleteDesc:     "Available commands: create, list, update, mmcli, mmctl, delete, share, unshare, restart, hibernate, wake-up, info, import",
+		AutoComplete:         config.EnableCommandAutocompletion,
+		AutoCompleteDesc:     "Available commands: create, list, update, mmcli, mmctl, delete, share, unshare, restart, hibernate, wake-up, health, events, setup-profile, setup-retry, credentials, rotate-password, digest, token, report, info, import, import-data",
 		AutoCompleteHint:     "[command]",
 		AutocompleteIconData: p.appBarIconData,
 		AutocompleteData: &model.AutocompleteData{
@@ -105,31 +151,10 @@ func (p *Plugin) getCommand() *model.Command {
 						{
 							Type: model.AutocompleteArgTypeStaticList,
 							Data: &model.AutocompleteStaticListArg{
-								PossibleArguments: []model.AutocompleteListItem{
-									{
-										Item:     "e20",
-										HelpText: "E20 License",
-									},
-									{
-										Item:     "e10",
-										HelpText: "E10 License",
-									},
-									{
-										Item:     "te",
-										HelpText: "Team Edition License",
-									},
-									{
-										Item:     "enterprise",
-										HelpText: "Enterprise Edition License",
-									},
-									{
-										Item:     "professional",
-										HelpText: "Professional Edition License",
-									},
-								},
+								PossibleArguments: config.licenseAutocompleteItems(),
 							},
 							Name:     "license",
-							HelpText: "The Mattermost license to use. Can be 'enterprise', 'professional', 'e20', 'e10', or 'te' (default \"enterprise\")",
+							HelpText: fmt.Sprintf("%s (default \"%s\")", config.licenseHelpText(), config.defaultLicense()),
 							Required: false,
 						},
 						{
@@ -137,6 +162,69 @@ func (p *Plugin) getCommand() *model.Command {
 							HelpText: "Set to pre-load the server with test data",
 							Required: false,
 						},
+						{
+							Type: model.AutocompleteArgTypeStaticList,
+							Data: &model.AutocompleteStaticListArg{
+								PossibleArguments: []model.AutocompleteListItem{
+									{Item: "small", HelpText: "1 team, 5 channels, 10 users and 20 posts per channel"},
+									{Item: "medium", HelpText: "2 teams, 10 channels per team, 15 users and 100 posts per channel"},
+									{Item: "large", HelpText: "5 teams, 20 channels per team, 100 users and 500 posts per channel"},
+								},
+							},
+							Name:     "test-data-profile",
+							HelpText: "Size of the test data. Implies --test-data (default \"medium\")",
+							Required: false,
+						},
+						{
+							Type: model.AutocompleteArgTypeText,
+							Data: &model.AutocompleteTextArg{
+								Hint:    "number",
+								Pattern: "^[0-9]+$",
+							},
+							Name:     "test-data-teams",
+							HelpText: "Number of test data teams, overriding the profile",
+							Required: false,
+						},
+						{
+							Type: model.AutocompleteArgTypeText,
+							Data: &model.AutocompleteTextArg{
+								Hint:    "number",
+								Pattern: "^[0-9]+$",
+							},
+							Name:     "test-data-channels-per-team",
+							HelpText: "Number of test data channels per team, overriding the profile",
+							Required: false,
+						},
+						{
+							Type: model.AutocompleteArgTypeText,
+							Data: &model.AutocompleteTextArg{
+								Hint:    "number",
+								Pattern: "^[0-9]+$",
+							},
+							Name:     "test-data-users",
+							HelpText: "Number of test data users, overriding the profile",
+							Required: false,
+						},
+						{
+							Type: model.AutocompleteArgTypeText,
+							Data: &model.AutocompleteTextArg{
+								Hint:    "number",
+								Pattern: "^[0-9]+$",
+							},
+							Name:     "test-data-posts-per-channel",
+							HelpText: "Number of test data posts per channel, overriding the profile",
+							Required: false,
+						},
+						{
+							Type: model.AutocompleteArgTypeText,
+							Data: &model.AutocompleteTextArg{
+								Hint:    "number",
+								Pattern: "^[0-9]+$",
+							},
+							Name:     "test-data-seed",
+							HelpText: "Seed making the generated test data deterministic",
+							Required: false,
+						},
 						{
 							Type: model.AutocompleteArgTypeStaticList,
 							Data: &model.AutocompleteStaticListArg{
@@ -182,11 +270,6 @@ func (p *Plugin) getCommand() *model.Command {
 							HelpText: "Environment variables in form: ENV1=test,ENV2=test",
 							Required: false,
 						},
-						{
-							Name:     "image",
-							HelpText: "Docker image repository, can be mattermost/mattermost-enterprise-edition, mattermost/mm-ee-cloud, mattermost/mm-te, mattermost/mattermost-team-edition, mattermostdevelopment/mm-ee-test, mattermostdevelopment/mm-te-test, mattermostdevelopment/mattermost-enterprise-edition, mattermostdevelopment/mattermost-team-edition",
-							Required: false,
-						},
 						{
 							Type: model.AutocompleteArgTypeStaticList,
 							Data: &model.AutocompleteStaticListArg{
@@ -210,30 +293,21 @@ func (p *Plugin) getCommand() *model.Command {
 							Required: false,
 						},
 						{
-							Type: model.AutocompleteArgTypeText,
-							Data: &model.AutocompleteTextArg{
-								Hint: "image",
+							Type: model.AutocompleteArgTypeStaticList,
+							Data: &model.AutocompleteStaticListArg{
+								PossibleArguments: config.imageAutocompleteItems(),
 							},
 							Name:     "image",
-							HelpText: "Docker image repository. Can be mattermost/mattermost-enterprise-edition, mattermost/mm-ee-cloud, mattermost/mm-te, mattermost/mattermost-team-edition, mattermostdevelopment/mm-ee-test, mattermostdevelopment/mm-te-test, mattermostdevelopment/mattermost-enterprise-edition, mattermostdevelopment/mattermost-team-edition (default \"mattermost/mattermost-enterprise-edition\")",
+							HelpText: fmt.Sprintf("%s (default \"%s\")", config.imageHelpText(), config.defaultImage()),
 							Required: false,
 						},
 						{
 							Type: model.AutocompleteArgTypeStaticList,
 							Data: &model.AutocompleteStaticListArg{
-								PossibleArguments: []model.AutocompleteListItem{
-									{
-										Item:     "miniSingleton",
-										HelpText: "Mini Singleton instance",
-									},
-									{
-										Item:     "miniHA",
-										HelpText: "Mini cluster made of two servers",
-									},
-								},
+								PossibleArguments: config.sizeAutocompleteItems(),
 							},
 							Name:     "size",
-							HelpText: "Size of the Mattermost installation e.g. 'miniSingleton' or 'miniHA' (default \"miniSingleton\")",
+							HelpText: fmt.Sprintf("%s (default \"%s\")", config.sizeHelpText(), config.defaultSize()),
 							Required: false,
 						},
 						{
@@ -279,31 +353,10 @@ func (p *Plugin) getCommand() *model.Command {
 						{
 							Type: model.AutocompleteArgTypeStaticList,
 							Data: &model.AutocompleteStaticListArg{
-								PossibleArguments: []model.AutocompleteListItem{
-									{
-										Item:     "e20",
-										HelpText: "E20 License",
-									},
-									{
-										Item:     "e10",
-										HelpText: "E10 License",
-									},
-									{
-										Item:     "te",
-										HelpText: "Team Edition License",
-									},
-									{
-										Item:     "enterprise",
-										HelpText: "Enterprise Edition License",
-									},
-									{
-										Item:     "professional",
-										HelpText: "Professional Edition License",
-									},
-								},
+								PossibleArguments: config.licenseAutocompleteItems(),
 							},
 							Name:     "license",
-							HelpText: "The enterprise license to use. Can be 'enterprise', 'professional', 'e20', 'e10', or 'te'",
+							HelpText: config.licenseHelpText(),
 							Required: false,
 						},
 						{
@@ -324,19 +377,10 @@ func (p *Plugin) getCommand() *model.Command {
 						{
 							Type: model.AutocompleteArgTypeStaticList,
 							Data: &model.AutocompleteStaticListArg{
-								PossibleArguments: []model.AutocompleteListItem{
-									{
-										Item:     "miniSingleton",
-										HelpText: "Mini Singleton instance",
-									},
-									{
-										Item:     "miniHA",
-										HelpText: "Mini cluster made of two servers",
-									},
-								},
+								PossibleArguments: config.sizeAutocompleteItems(),
 							},
 							Name:     "size",
-							HelpText: "Size of the Mattermost installation e.g. 'miniSingleton' or 'miniHA'",
+							HelpText: config.sizeHelpText(),
 							Required: false,
 						},
 					},
@@ -482,6 +526,135 @@ func (p *Plugin) getCommand() *model.Command {
 						},
 					},
 				},
+				{
+					Trigger:  "setup-profile",
+					HelpText: "Manage setup profiles applied to new installations",
+					SubCommands: []*model.AutocompleteData{
+						{
+							Trigger:  "list",
+							HelpText: "List the available setup profiles",
+						},
+						{
+							Trigger:  "show",
+							HelpText: "Show a setup profile",
+							Arguments: []*model.AutocompleteArg{
+								{
+									Type:     model.AutocompleteArgTypeText,
+									Data:     &model.AutocompleteTextArg{Hint: "[name]"},
+									HelpText: "Name of the setup profile",
+									Required: true,
+								},
+							},
+						},
+						{
+							Trigger:  "save",
+							HelpText: "Save one of your setup profiles",
+							Arguments: []*model.AutocompleteArg{
+								{
+									Type:     model.AutocompleteArgTypeText,
+									Data:     &model.AutocompleteTextArg{Hint: "[name] [json]"},
+									HelpText: "Name and JSON definition of the setup profile",
+									Required: true,
+								},
+							},
+						},
+						{
+							Trigger:  "delete",
+							HelpText: "Delete one of your setup profiles",
+							Arguments: []*model.AutocompleteArg{
+								{
+									Type:     model.AutocompleteArgTypeText,
+									Data:     &model.AutocompleteTextArg{Hint: "[name]"},
+									HelpText: "Name of the setup profile",
+									Required: true,
+								},
+							},
+						},
+					},
+				},
+				{
+					Trigger:  "setup-retry",
+					HelpText: "Resume the failed setup of a Mattermost installation",
+					Arguments: []*model.AutocompleteArg{
+						{
+							Type: model.AutocompleteArgTypeText,
+							Data: &model.AutocompleteTextArg{
+								Hint:    "[name]",
+								Pattern: "^[a-zA-Z0-9-]+$",
+							},
+							HelpText: "Name of the installation to resume setup for",
+							Required: true,
+						},
+					},
+				},
+				{
+					Trigger:  "credentials",
+					HelpText: "Show the logins of the accounts created on a Mattermost installation",
+					Arguments: []*model.AutocompleteArg{
+						{
+							Type: model.AutocompleteArgTypeText,
+							Data: &model.AutocompleteTextArg{
+								Hint:    "[name]",
+								Pattern: "^[a-zA-Z0-9-]+$",
+							},
+							HelpText: "Name of the installation to show credentials for",
+							Required: true,
+						},
+					},
+				},
+				{
+					Trigger:  "rotate-password",
+					HelpText: "Reset the password of an account created on a Mattermost installation",
+					Arguments: []*model.AutocompleteArg{
+						{
+							Type: model.AutocompleteArgTypeText,
+							Data: &model.AutocompleteTextArg{
+								Hint:    "[name]",
+								Pattern: "^[a-zA-Z0-9-]+$",
+							},
+							HelpText: "Name of the installation",
+							Required: true,
+						},
+						{
+							Type: model.AutocompleteArgTypeText,
+							Data: &model.AutocompleteTextArg{
+								Hint: "[user]",
+							},
+							HelpText: "Username of the account to reset the password of",
+							Required: true,
+						},
+					},
+				},
+				{
+					Trigger:  "health",
+					HelpText: "Check the health of a Mattermost installation",
+					Arguments: []*model.AutocompleteArg{
+						{
+							Type: model.AutocompleteArgTypeText,
+							Data: &model.AutocompleteTextArg{
+								Hint:    "[name]",
+								Pattern: "^[a-zA-Z0-9-]+$",
+							},
+							HelpText: "Name of the installation to check",
+							Required: true,
+						},
+					},
+				},
+				{
+					Trigger:  "events",
+					HelpText: "Show the event timeline of a Mattermost installation",
+					Arguments: []*model.AutocompleteArg{
+						{
+							Type: model.AutocompleteArgTypeText,
+							Data: &model.AutocompleteTextArg{
+								Hint:    "[name]",
+								Pattern: "^[a-zA-Z0-9-]+$",
+							},
+							HelpText: "Name of the installation to show events for",
+							Required: true,
+						},
+					},
+				},
 				{
 					Trigger:  "delete",
 					HelpText: "Delete a Mattermost installation",
@@ -497,6 +670,55 @@ func (p *Plugin) getCommand() *model.Command {
 						},
 					},
 				},
+				{
+					Trigger:  "digest",
+					HelpText: "Manage the weekly digest of your installations",
+					Arguments: []*model.AutocompleteArg{
+						{
+							Type: model.AutocompleteArgTypeStaticList,
+							Data: &model.AutocompleteStaticListArg{
+								PossibleArguments: []model.AutocompleteListItem{
+									{Item: "on", HelpText: "Receive the weekly digest"},
+									{Item: "off", HelpText: "Stop receiving the weekly digest"},
+									{Item: "now", HelpText: "Send the digest to you now"},
+								},
+							},
+							HelpText: "Turn the digest on or off, or send it now",
+						},
+					},
+				},
+				{
+					Trigger:  "token",
+					HelpText: "Manage your API tokens for the plugin REST API",
+					Arguments: []*model.AutocompleteArg{
+						{
+							Type: model.AutocompleteArgTypeStaticList,
+							Data: &model.AutocompleteStaticListArg{
+								PossibleArguments: []model.AutocompleteListItem{
+									{Item: "create", Hint: "--name [name] --scopes [scopes]", HelpText: "Create a token"},
+									{Item: "list", HelpText: "List your tokens"},
+									{Item: "revoke", Hint: "[name]", HelpText: "Revoke a token"},
+								},
+							},
+							HelpText: "Create, list or revoke a token",
+							Required: true,
+						},
+					},
+				},
+				{
+					Trigger:  "report",
+					HelpText: "Report installation usage and cost (system administrators only)",
+					Arguments: []*model.AutocompleteArg{
+						{
+							Type: model.AutocompleteArgTypeText,
+							Data: &model.AutocompleteTextArg{
+								Hint: "usage [--by user|team] [--month YYYY-MM]",
+							},
+							HelpText: "The report to run",
+							Required: true,
+						},
+					},
+				},
 				{
 					Trigger:  "info",
 					HelpText: "Show cloud plugin information",
@@ -515,6 +737,21 @@ func (p *Plugin) getCommand() *model.Command {
 						},
 					},
 				},
+				{
+					Trigger:  "import-data",
+					HelpText: "Import the bulk import file you most recently attached in this channel into a Mattermost installation",
+					Arguments: []*model.AutocompleteArg{
+						{
+							Type: model.AutocompleteArgTypeText,
+							Data: &model.AutocompleteTextArg{
+								Hint:    "[name]",
+								Pattern: "^[a-zA-Z0-9-]+$",
+							},
+							HelpText: "Name of the installation to import data into",
+							Required: true,
+						},
+					},
+				},
 			},
 		},
 	}
@@ -529,21 +766,51 @@ func getCommandResponse(responseType, text string, args *model.CommandArgs) *mod
 	}
 }
 
+// commandHandler runs a slash command with its arguments. It returns whether
+// an error was caused by the user.
+type commandHandler func(args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error)
+
+// runObservedCommand runs a command handler and records its outcome.
+func (p *Plugin) runObservedCommand(command string, handler commandHandler, args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+	start := time.Now()
+	resp, isUserError, err := handler(args, extra)
+	outcome := metricsOutcomeSuccess
+	if err != nil {
+		outcome = metricsOutcomeError
+		if isUserError {
+			outcome = metricsOutcomeUserError
+		}
+	}
+	p.metrics.observeCommand(command, outcome, time.Since(start))
+
+	return resp, isUserError, err
+}
+
 // ExecuteCommand executes a given command and returns a command response.
 func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
-	if !p.authorizedPluginUser(args.UserId) {
-		return getCommandResponse(model.CommandResponseTypeEphemeral, "Permission denied. Please talk to your system administrator to get access.", args), nil
+	stringArgs := strings.Split(args.Command, " ")
+
+	var command string
+	if len(stringArgs) >= 2 {
+		command = stringArgs[1]
 	}
 
-	stringArgs := strings.Split(args.Command, " ")
+	perm, ok := commandPermissions[command]
+	if !ok {
+		perm = permissionViewInstallations
+	}
+	if !p.hasPermission(args.UserId, perm) {
+		if perm == permissionViewInstallations || !p.hasPermission(args.UserId, permissionViewInstallations) {
+			return getCommandResponse(model.CommandResponseTypeEphemeral, "Permission denied. Please talk to your system administrator to get access.", args), nil
+		}
+		return getCommandResponse(model.CommandResponseTypeEphemeral, fmt.Sprintf("Permission denied. The %s command requires the %s role. Please talk to your system administrator to get access.", command, permissionRoles[perm]), args), nil
+	}
 
 	if len(stringArgs) < 2 {
 		return getCommandResponse(model.CommandResponseTypeEphemeral, p.getHelp(), args), nil
 	}
 
-	command := stringArgs[1]
-
-	var handler func([]string, *model.CommandArgs) (*model.CommandResponse, bool, error)
+	var handler commandHandler
 
 	switch command {
 	case "create":
@@ -566,14 +833,39 @@ func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*mo
 		handler = p.runHibernateCommand
 	case "wake-up":
 		handler = p.runWakeUpCommand
+	case "health":
+		handler = p.runHealthCommand
+	case "events":
+		handler = p.runEventsCommand
+	case "setup-profile":
+		handler = p.runSetupProfileCommand
+	case "setup-retry":
+		handler = p.runSetupRetryCommand
+	case "credentials":
+		handler = p.runCredentialsCommand
+	case "rotate-password":
+		handler = p.runRotatePasswordCommand
 	case "delete":
 		handler = p.runDeleteCommand
 	case "status":
-		handler = p.runStatusCommand
+		// The status command moved to the admin commands.
+		handler = func(args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+			return p.runAdminCommand(append([]string{"status"}, args...), extra)
+		}
+	case "admin":
+		handler = p.runAdminCommand
+	case "digest":
+		handler = p.runDigestCommand
+	case "token":
+		handler = p.runTokenCommand
+	case "report":
+		handler = p.runReportCommand
 	case "info":
 		handler = p.runInfoCommand
 	case "import":
 		handler = p.runImportCommand
+	case "import-data":
+		handler = p.runImportDataCommand
 	case "share":
 		handler = p.runShareInstallationCommand
 	case "unshare":
@@ -588,7 +880,7 @@ func (p *Plugin) ExecuteCommand(c *plugin.Context, args *model.CommandArgs) (*mo
 		return getCommandResponse(model.CommandResponseTypeEphemeral, p.getHelp(), args), nil
 	}
 
-	resp, isUserError, err := handler(stringArgs[2:], args)
+	resp, isUserError, err := p.runObservedCommand(command, handler, stringArgs[2:], args)
 	if err != nil {
 		if isUserError {
 			return getCommandResponse(model.CommandResponseTypeEphemeral, fmt.Sprintf("__Error: %s__\n\nRun `/cloud help` for usage instructions.", err.Error()), args), nil
@@ -605,6 +897,17 @@ func (p *Plugin) runInfoCommand(args []string, extra *model.CommandArgs) (*model
 		"[%s](https://github.com/mattermost/mattermost-plugin-cloud/commit/%s), built %s\n",
 		manifest.Version, BuildHashShort, BuildHash, BuildDate)
 
+	status := p.getReleasesCacheStatus()
+	if status.Count == 0 {
+		resp += "Release metadata: not fetched yet\n"
+	} else {
+		resp += fmt.Sprintf("Release metadata: %d releases, fetched %s ago\n",
+			status.Count, time.Since(status.Timestamp).Round(time.Second))
+		if status.LastError != nil {
+			resp += fmt.Sprintf("Release metadata is stale, the last refresh failed: %s\n", status.LastError.Error())
+		}
+	}
+
 	return getCommandResponse(model.CommandResponseTypeEphemeral, resp, extra), false, nil
 }
 
@@ -619,7 +922,8 @@ func (p *Plugin) runUpgradeHelperCommand(args []string, extra *model.CommandArgs
 }
 
 // authorizedPluginUser returns if a given userID is authorized to use the plugin
-// commands with the current plugin configuration.
+// commands by the allowed email domain. It is only used when no role
+// assignments are configured.
 func (p *Plugin) authorizedPluginUser(userID string) bool {
 	config := p.getConfiguration()
 
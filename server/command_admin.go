@@ -0,0 +1,282 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+func getAdminHelp() string {
+	return codeBlock(fmt.Sprintf(`Available Admin Commands:
+
+installations [flags]
+	Lists the installations managed by the plugin across all owners.
+	Flags:
+%s
+status [--include-clusters]
+	Shows every installation and optionally cluster of the provisioner.
+
+delete [name|ID]
+	Deletes any installation, removing its deletion lock first.
+
+hibernate [name|ID]
+	Hibernates any stable installation.
+
+reassign [name|ID] [username]
+	Transfers the ownership of an installation to another user.
+
+deletion-unlock [name|ID]
+	Removes the deletion lock of any installation.
+
+kv [list|get|delete|repair] [prefix|key|--dry-run]
+	Lists, shows or deletes plugin KV records, or removes installation
+	records and state which are duplicated or no longer exist.
+
+docker-cache [stats|flush]
+	Shows docker registry cache metrics or flushes the cache.
+
+webhooks [queue|dead-letters|replay] [event-id|all]
+	Shows queued or failed webhook events, or queues failed events to be
+	processed again.
+
+webhook-secret [status|generate|retire] [fingerprint]
+	Shows which webhook secrets the provisioner uses, adds a new secret or
+	removes a secret once the provisioner no longer uses it. Only system
+	administrators can add or remove secrets.
+`, getAdminInstallationsFlagSet().FlagUsages()))
+}
+
+// The admin commands are intended for plugin administrators only, so they are
+// not published in the standard help info.
+func (p *Plugin) runAdminCommand(args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+	if !p.authorizedPluginAdmin(extra.UserId) {
+		return nil, true, errors.New("admin commands are restricted to system administrators and plugin admins")
+	}
+
+	if len(args) == 0 {
+		return getCommandResponse(model.CommandResponseTypeEphemeral, getAdminHelp(), extra), false, nil
+	}
+
+	var handler func([]string, *model.CommandArgs) (*model.CommandResponse, bool, error)
+
+	switch args[0] {
+	case "installations":
+		handler = p.runAdminInstallationsCommand
+	case "status":
+		handler = p.runStatusCommand
+	case "delete":
+		handler = p.runAdminDeleteCommand
+	case "hibernate":
+		handler = p.runAdminHibernateCommand
+	case "reassign":
+		handler = p.runAdminReassignCommand
+	case "deletion-unlock":
+		handler = p.runAdminDeletionUnlockCommand
+	case "kv":
+		handler = p.runAdminKVCommand
+	case "docker-cache":
+		handler = p.runAdminDockerCacheCommand
+	case "webhooks":
+		handler = p.runAdminWebhooksCommand
+	case "webhook-secret":
+		handler = p.runAdminWebhookSecretCommand
+	}
+
+	if handler == nil {
+		return getCommandResponse(model.CommandResponseTypeEphemeral, getAdminHelp(), extra), false, nil
+	}
+
+	return handler(args[1:], extra)
+}
+
+func (p *Plugin) runAdminWebhooksCommand(args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+	if p.webhookQueue == nil {
+		return nil, false, errors.New("webhook queue is not running")
+	}
+
+	action := "queue"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	switch action {
+	case "queue":
+		events, err := p.webhookQueue.Events()
+		if err != nil {
+			return nil, false, err
+		}
+		resp := fmt.Sprintf("%d webhook events are queued.\n", len(events))
+		if len(events) > 0 {
+			resp += webhookEventsTable(events)
+		}
+
+		return getCommandResponse(model.CommandResponseTypeEphemeral, resp, extra), false, nil
+	case "dead-letters":
+		events, err := p.webhookQueue.DeadLetters()
+		if err != nil {
+			return nil, false, err
+		}
+		resp := fmt.Sprintf("%d webhook events failed to be processed.\n", len(events))
+		if len(events) > 0 {
+			resp += webhookEventsTable(events)
+		}
+
+		return getCommandResponse(model.CommandResponseTypeEphemeral, resp, extra), false, nil
+	case "replay":
+		if len(args) < 2 {
+			return nil, true, errors.New("must provide a dead letter event ID or all")
+		}
+		eventID := args[1]
+		if eventID == "all" {
+			eventID = ""
+		}
+
+		replayed, err := p.webhookQueue.Replay(eventID)
+		if err != nil {
+			return nil, false, err
+		}
+		if replayed == 0 {
+			return nil, true, errors.Errorf("no dead letter found with event ID %s", args[1])
+		}
+
+		return getCommandResponse(model.CommandResponseTypeEphemeral, fmt.Sprintf("Queued %d webhook events to be processed again.", replayed), extra), false, nil
+	}
+
+	return nil, true, errors.Errorf("invalid webhooks action %s, must be queue, dead-letters or replay", action)
+}
+
+func webhookEventsTable(events []*webhookEvent) string {
+	table := "\n| Event ID | Type | Resource | State | Received | Attempts | Last Error |\n| -- | -- | -- | -- | -- | -- | -- |\n"
+	for _, event := range events {
+		var eventType, resourceID, transition string
+		if event.Payload != nil {
+			eventType = event.Payload.Type.String()
+			resourceID = event.Payload.ID
+			transition = fmt.Sprintf("%s → %s", event.Payload.OldState, event.Payload.NewState)
+		}
+		table += fmt.Sprintf("| %s | %s | %s | %s | %s | %d | %s |\n",
+			event.ID, eventType, resourceID, transition,
+			model.GetTimeForMillis(event.CreateAt).UTC().Format(time.RFC3339),
+			event.Attempts, event.LastError)
+	}
+
+	return table
+}
+
+func (p *Plugin) runAdminWebhookSecretCommand(args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+	action := "status"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	// Generating and retiring secrets rewrites the plugin configuration, which
+	// plugin admins who aren't system administrators must not be able to do.
+	if (action == "generate" || action == "retire") && !p.API.HasPermissionTo(extra.UserId, model.PermissionManageSystem) {
+		return nil, true, errors.New("changing the webhook secrets is restricted to system administrators")
+	}
+
+	secrets := p.getConfiguration().webhookSecrets()
+
+	switch action {
+	case "status":
+		usage, err := p.getWebhookSecretUsage()
+		if err != nil {
+			return nil, false, err
+		}
+
+		resp := "Signed webhooks are optional.\n"
+		if p.getConfiguration().RequireSignedWebhooks {
+			resp = "Signed webhooks are required.\n"
+		}
+		if len(secrets) == 0 {
+			resp += "No webhook secrets are configured, so webhooks are not authenticated."
+			return getCommandResponse(model.CommandResponseTypeEphemeral, resp, extra), false, nil
+		}
+
+		resp += "\n| Secret | Last signed webhook | Last auth token webhook |\n| -- | -- | -- |\n"
+		for _, secret := range secrets {
+			fingerprint := webhookSecretFingerprint(secret)
+			entry := usage[fingerprint]
+			if entry == nil {
+				entry = &webhookSecretUsage{}
+			}
+			resp += fmt.Sprintf("| %s | %s | %s |\n", inlineCode(fingerprint), formatMillis(entry.LastSignedAt), formatMillis(entry.LastTokenAt))
+		}
+
+		return getCommandResponse(model.CommandResponseTypeEphemeral, resp, extra), false, nil
+	case "generate":
+		secret, err := generateWebhookSecret()
+		if err != nil {
+			return nil, false, err
+		}
+		err = p.saveWebhookSecrets(append(secrets, secret))
+		if err != nil {
+			return nil, false, err
+		}
+
+		resp := fmt.Sprintf(`Added webhook secret %s:
+
+%s
+
+Configure the provisioner to sign webhooks with the new secret, then retire the previous secrets with `+"`/cloud admin webhook-secret retire <fingerprint>`"+` once the status shows that they are no longer used.`,
+			inlineCode(webhookSecretFingerprint(secret)), codeBlock(secret))
+
+		return getCommandResponse(model.CommandResponseTypeEphemeral, resp, extra), false, nil
+	case "retire":
+		if len(args) < 2 {
+			return nil, true, errors.New("must provide the fingerprint of the secret to retire")
+		}
+
+		var remaining []string
+		for _, secret := range secrets {
+			if webhookSecretFingerprint(secret) != args[1] {
+				remaining = append(remaining, secret)
+			}
+		}
+		if len(remaining) == len(secrets) {
+			return nil, true, errors.Errorf("no webhook secret found with fingerprint %s", args[1])
+		}
+		if len(remaining) == 0 {
+			return nil, true, errors.New("cannot retire the only webhook secret, generate a new secret first")
+		}
+
+		err := p.saveWebhookSecrets(remaining)
+		if err != nil {
+			return nil, false, err
+		}
+
+		return getCommandResponse(model.CommandResponseTypeEphemeral, fmt.Sprintf("Retired webhook secret %s.", inlineCode(args[1])), extra), false, nil
+	}
+
+	return nil, true, errors.Errorf("invalid webhook-secret action %s, must be status, generate or retire", action)
+}
+
+// authorizedPluginAdmin returns if a given userID is authorized to use the
+// plugin admin commands, either as a system administrator or as one of the
+// configured plugin admins.
+func (p *Plugin) authorizedPluginAdmin(userID string) bool {
+	if p.API.HasPermissionTo(userID, model.PermissionManageSystem) {
+		return true
+	}
+
+	usernames := p.getConfiguration().pluginAdminUsernames()
+	if len(usernames) == 0 {
+		return false
+	}
+
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		p.API.LogError("Failed to get user", "error", appErr)
+		return false
+	}
+	for _, username := range usernames {
+		if strings.EqualFold(user.Username, username) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+// dockerCacheClient is implemented by docker clients that cache registry
+// lookups.
+type dockerCacheClient interface {
+	Flush()
+	Stats() DockerCacheStats
+}
+
+func (p *Plugin) runAdminDockerCacheCommand(args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+	cache, ok := p.dockerClient.(dockerCacheClient)
+	if !ok {
+		return nil, false, errors.New("docker client does not support caching")
+	}
+
+	action := "stats"
+	if len(args) > 0 {
+		action = args[0]
+	}
+
+	switch action {
+	case "stats":
+		stats := cache.Stats()
+		resp := fmt.Sprintf(`Docker registry cache:
+
+| Lookup | Hits | Misses | Cached |
+| -- | -- | -- | -- |
+| Tags | %d | %d | %d repositories |
+| Digests | %d | %d | %d tags |
+`, stats.TagHits, stats.TagMisses, stats.Repositories, stats.DigestHits, stats.DigestMisses, stats.Digests)
+
+		return getCommandResponse(model.CommandResponseTypeEphemeral, resp, extra), false, nil
+	case "flush":
+		cache.Flush()
+		return getCommandResponse(model.CommandResponseTypeEphemeral, "Docker registry cache flushed.", extra), false, nil
+	}
+
+	return nil, true, errors.Errorf("invalid docker-cache action %s, must be stats or flush", action)
+}
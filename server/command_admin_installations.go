@@ -0,0 +1,277 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+	flag "github.com/spf13/pflag"
+)
+
+// installationStateMissing is the state shown for installations managed by
+// the plugin which the provisioner doesn't know about.
+const installationStateMissing = "missing"
+
+func getAdminInstallationsFlagSet() *flag.FlagSet {
+	flagSet := flag.NewFlagSet("admin installations", flag.ContinueOnError)
+	flagSet.String("owner", "", "Only list the installations owned by this user")
+	flagSet.String("state", "", "Only list installations in this state")
+
+	return flagSet
+}
+
+// runAdminInstallationsCommand lists the installations managed by the plugin
+// across all owners.
+func (p *Plugin) runAdminInstallationsCommand(args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+	flagSet := getAdminInstallationsFlagSet()
+	err := flagSet.Parse(args)
+	if err != nil {
+		return nil, true, errors.Wrap(err, "failed to parse flags")
+	}
+	owner, _ := flagSet.GetString("owner")
+	state, _ := flagSet.GetString("state")
+
+	var ownerID string
+	if owner != "" {
+		user, appErr := p.API.GetUserByUsername(strings.TrimPrefix(owner, "@"))
+		if appErr != nil {
+			return nil, true, errors.Errorf("no user with the username %s found", owner)
+		}
+		ownerID = user.Id
+	}
+
+	installs, err := p.getAdminInstallations()
+	if err != nil {
+		return nil, false, err
+	}
+
+	resp := "| Installation | ID | Owner | State | Version | Created | Deletion lock |\n| -- | -- | -- | -- | -- | -- | -- |\n"
+	count := 0
+	for _, install := range installs {
+		if ownerID != "" && install.OwnerID != ownerID {
+			continue
+		}
+		if state != "" && install.State != state {
+			continue
+		}
+		count++
+
+		locked := "unlocked"
+		if install.DeletionLocked {
+			locked = "locked"
+		}
+		resp += fmt.Sprintf("| %s | %s | %s | %s | %s | %s | %s |\n",
+			install.Name, inlineCode(install.ID), p.getActorName(install.OwnerID), install.State,
+			install.Tag, getTimeFromMillis(install.CreateAt).Format("Jan-02-2006"), locked)
+	}
+	resp = fmt.Sprintf("%d installations are managed by the plugin.\n\n", count) + resp
+
+	return getCommandResponse(model.CommandResponseTypeEphemeral, resp, extra), false, nil
+}
+
+// getAdminInstallations returns every installation managed by the plugin
+// with its current provisioner state.
+func (p *Plugin) getAdminInstallations() ([]*Installation, error) {
+	installs, _, err := p.getInstallations()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get installations")
+	}
+
+	cloudInstalls, err := p.cloudClient.GetInstallations(&cloud.GetInstallationsRequest{
+		Paging: cloud.AllPagesWithDeleted(),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get installations from cloud server")
+	}
+	cloudInstallsByID := make(map[string]*cloud.InstallationDTO, len(cloudInstalls))
+	for _, cloudInstall := range cloudInstalls {
+		cloudInstallsByID[cloudInstall.ID] = cloudInstall
+	}
+
+	for _, install := range installs {
+		cloudInstall := cloudInstallsByID[install.ID]
+		if cloudInstall == nil {
+			if install.Installation == nil {
+				install.Installation = &cloud.Installation{}
+			}
+			install.State = installationStateMissing
+			continue
+		}
+		install.Installation = cloudInstall.Installation
+		install.DNSRecords = cloudInstall.DNSRecords
+	}
+
+	sort.Slice(installs, func(i, j int) bool {
+		return installs[i].Name < installs[j].Name
+	})
+
+	return installs, nil
+}
+
+// findAdminInstallation returns the installation with the given ID or name,
+// whoever owns it.
+func (p *Plugin) findAdminInstallation(nameOrID string) (*Installation, bool, error) {
+	installs, err := p.getAdminInstallations()
+	if err != nil {
+		return nil, false, err
+	}
+
+	var matches []*Installation
+	for _, install := range installs {
+		if install.ID == nameOrID {
+			return install, false, nil
+		}
+		if standardizeName(install.Name) == standardizeName(nameOrID) {
+			matches = append(matches, install)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return nil, true, errors.Errorf("no installation with the name or ID %s found", nameOrID)
+	case 1:
+		return matches[0], false, nil
+	}
+
+	return nil, true, errors.Errorf("%d installations are named %s, use the installation ID instead", len(matches), nameOrID)
+}
+
+// notifyOwnerOfAdminAction lets the owner of an installation know that an
+// admin acted on it.
+func (p *Plugin) notifyOwnerOfAdminAction(install *Installation, adminID, action string) {
+	if install.OwnerID == adminID {
+		return
+	}
+
+	err := p.PostBotDM(install.OwnerID, fmt.Sprintf("Your installation %s was %s by %s.", install.Name, action, p.getActorName(adminID)))
+	if err != nil {
+		p.API.LogWarn(errors.Wrap(err, "failed to notify installation owner").Error(), "installation", install.ID)
+	}
+}
+
+// runAdminDeleteCommand deletes any installation, removing its deletion lock
+// first.
+func (p *Plugin) runAdminDeleteCommand(args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+	if len(args) == 0 || len(args[0]) == 0 {
+		return nil, true, errors.New("must provide an installation name or ID")
+	}
+
+	install, isUserError, err := p.findAdminInstallation(args[0])
+	if err != nil {
+		return nil, isUserError, err
+	}
+
+	if install.State != installationStateMissing && install.State != cloud.InstallationStateDeleted {
+		if install.DeletionLocked {
+			err = p.cloudClient.UnlockDeletionLockForInstallation(install.ID)
+			if err != nil {
+				return nil, false, errors.Wrap(err, "failed to remove deletion lock")
+			}
+		}
+
+		err = p.cloudClient.DeleteInstallation(install.ID)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	err = p.deleteInstallation(install.ID)
+	if err != nil {
+		return nil, false, err
+	}
+	p.recordPluginEvent(install.ID, extra.UserId, "admin-delete", "")
+	p.notifyOwnerOfAdminAction(install, extra.UserId, "deleted")
+
+	return getCommandResponse(model.CommandResponseTypeEphemeral, fmt.Sprintf("Installation %s owned by %s deleted.", install.Name, p.getActorName(install.OwnerID)), extra), false, nil
+}
+
+// runAdminHibernateCommand hibernates any stable installation.
+func (p *Plugin) runAdminHibernateCommand(args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+	if len(args) == 0 || len(args[0]) == 0 {
+		return nil, true, errors.New("must provide an installation name or ID")
+	}
+
+	install, isUserError, err := p.findAdminInstallation(args[0])
+	if err != nil {
+		return nil, isUserError, err
+	}
+
+	isUserError, err = p.hibernateInstallation(install, extra.UserId)
+	if err != nil {
+		return nil, isUserError, err
+	}
+	p.notifyOwnerOfAdminAction(install, extra.UserId, "hibernated")
+
+	return getCommandResponse(model.CommandResponseTypeEphemeral, fmt.Sprintf("Hibernation of installation %s owned by %s has begun.", install.Name, p.getActorName(install.OwnerID)), extra), false, nil
+}
+
+// runAdminReassignCommand transfers the ownership of an installation to
+// another user.
+func (p *Plugin) runAdminReassignCommand(args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+	if len(args) < 2 {
+		return nil, true, errors.New("must provide an installation name or ID and the username of the new owner")
+	}
+
+	install, isUserError, err := p.findAdminInstallation(args[0])
+	if err != nil {
+		return nil, isUserError, err
+	}
+	user, appErr := p.API.GetUserByUsername(strings.TrimPrefix(args[1], "@"))
+	if appErr != nil {
+		return nil, true, errors.Errorf("no user with the username %s found", args[1])
+	}
+	if user.Id == install.OwnerID {
+		return nil, true, errors.Errorf("installation %s is already owned by %s", install.Name, args[1])
+	}
+
+	if install.State != installationStateMissing {
+		_, err = p.cloudClient.UpdateInstallation(install.ID, &cloud.PatchInstallationRequest{OwnerID: &user.Id})
+		if err != nil {
+			return nil, false, errors.Wrap(err, "failed to update installation owner")
+		}
+	}
+
+	previousOwner := *install
+	install.OwnerID = user.Id
+	err = p.updateInstallation(install)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to store updated installation metadata")
+	}
+	p.recordPluginEvent(install.ID, extra.UserId, "reassign", fmt.Sprintf("%s to %s", p.getActorName(previousOwner.OwnerID), p.getActorName(user.Id)))
+	p.notifyOwnerOfAdminAction(&previousOwner, extra.UserId, "reassigned to "+p.getActorName(user.Id))
+
+	err = p.PostBotDM(user.Id, fmt.Sprintf("You are now the owner of installation %s. Use `/cloud list` to see it.", install.Name))
+	if err != nil {
+		p.API.LogWarn(errors.Wrap(err, "failed to notify new installation owner").Error(), "installation", install.ID)
+	}
+
+	return getCommandResponse(model.CommandResponseTypeEphemeral, fmt.Sprintf("Installation %s is now owned by %s.", install.Name, p.getActorName(user.Id)), extra), false, nil
+}
+
+// runAdminDeletionUnlockCommand removes the deletion lock of any
+// installation.
+func (p *Plugin) runAdminDeletionUnlockCommand(args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+	if len(args) == 0 || len(args[0]) == 0 {
+		return nil, true, errors.New("must provide an installation name or ID")
+	}
+
+	install, isUserError, err := p.findAdminInstallation(args[0])
+	if err != nil {
+		return nil, isUserError, err
+	}
+	if !install.DeletionLocked {
+		return nil, true, errors.Errorf("installation %s is not locked", install.Name)
+	}
+
+	err = p.cloudClient.UnlockDeletionLockForInstallation(install.ID)
+	if err != nil {
+		return nil, false, err
+	}
+	p.recordPluginEvent(install.ID, extra.UserId, "deletion-unlock", "")
+	p.notifyOwnerOfAdminAction(install, extra.UserId, "unlocked for deletion")
+
+	return getCommandResponse(model.CommandResponseTypeEphemeral, fmt.Sprintf("Removed the deletion lock of installation %s.", install.Name), extra), false, nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	kvListPerPage = 200
+	// kvMaxValueLength is the longest value shown by /cloud admin kv get, to
+	// stay within the post size limit.
+	kvMaxValueLength = 12000
+)
+
+// installationStateKeyPrefixes are the prefixes of the keys holding state for
+// a single installation, which are orphaned once the installation is gone.
+var installationStateKeyPrefixes = []string{
+	setupLockKeyPrefix,
+	setupProgressKeyPrefix,
+	credentialsKeyPrefix,
+	sampleDataJobKeyPrefix,
+	reachabilityKeyPrefix,
+}
+
+// runAdminKVCommand inspects and repairs the KV records of the plugin.
+func (p *Plugin) runAdminKVCommand(args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+	if len(args) == 0 {
+		return nil, true, errors.New("must provide a kv action, must be list, get, delete or repair")
+	}
+
+	switch args[0] {
+	case "list":
+		var prefix string
+		if len(args) > 1 {
+			prefix = args[1]
+		}
+		keys, err := p.listKVKeys(prefix)
+		if err != nil {
+			return nil, false, err
+		}
+
+		resp := fmt.Sprintf("%d keys found.\n", len(keys))
+		if len(keys) > 0 {
+			resp += codeBlock(strings.Join(keys, "\n"))
+		}
+
+		return getCommandResponse(model.CommandResponseTypeEphemeral, resp, extra), false, nil
+	case "get":
+		if len(args) < 2 {
+			return nil, true, errors.New("must provide a key")
+		}
+		key := args[1]
+		if strings.HasPrefix(key, credentialsKeyPrefix) {
+			return nil, true, errors.New("installation credentials can't be shown")
+		}
+
+		value, appErr := p.API.KVGet(key)
+		if appErr != nil {
+			return nil, false, errors.Wrapf(appErr, "failed to get key %s", key)
+		}
+		if value == nil {
+			return nil, true, errors.Errorf("key %s not found", key)
+		}
+
+		var pretty bytes.Buffer
+		if json.Indent(&pretty, value, "", "  ") == nil {
+			value = pretty.Bytes()
+		}
+		resp := fmt.Sprintf("Key %s is %d bytes.\n", inlineCode(key), len(value))
+		if len(value) > kvMaxValueLength {
+			value = value[:kvMaxValueLength]
+			resp += fmt.Sprintf("Only the first %d bytes are shown.\n", kvMaxValueLength)
+		}
+		resp += codeBlock(string(value))
+
+		return getCommandResponse(model.CommandResponseTypeEphemeral, resp, extra), false, nil
+	case "delete":
+		if len(args) < 2 {
+			return nil, true, errors.New("must provide a key")
+		}
+		key := args[1]
+		if key == StoreInstallsKey {
+			return nil, true, errors.New("the installations record can't be deleted, use repair instead")
+		}
+
+		appErr := p.API.KVDelete(key)
+		if appErr != nil {
+			return nil, false, errors.Wrapf(appErr, "failed to delete key %s", key)
+		}
+		p.API.LogInfo("KV record deleted by admin", "key", key, "user", extra.UserId)
+
+		return getCommandResponse(model.CommandResponseTypeEphemeral, fmt.Sprintf("Deleted key %s.", inlineCode(key)), extra), false, nil
+	case "repair":
+		dryRun := len(args) > 1 && args[1] == "--dry-run"
+		fixes, err := p.repairKVRecords(dryRun)
+		if err != nil {
+			return nil, false, err
+		}
+
+		if len(fixes) == 0 {
+			return getCommandResponse(model.CommandResponseTypeEphemeral, "No KV records need to be repaired.", extra), false, nil
+		}
+		resp := fmt.Sprintf("Repaired %d KV records:\n", len(fixes))
+		if dryRun {
+			resp = fmt.Sprintf("Dry run, %d KV records would be repaired:\n", len(fixes))
+		}
+		for _, fix := range fixes {
+			resp += "- " + fix + "\n"
+		}
+
+		return getCommandResponse(model.CommandResponseTypeEphemeral, resp, extra), false, nil
+	}
+
+	return nil, true, errors.Errorf("invalid kv action %s, must be list, get, delete or repair", args[0])
+}
+
+// listKVKeys returns the sorted keys starting with the given prefix.
+func (p *Plugin) listKVKeys(prefix string) ([]string, error) {
+	var keys []string
+	for page := 0; ; page++ {
+		pageKeys, appErr := p.API.KVList(page, kvListPerPage)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "failed to list keys")
+		}
+		for _, key := range pageKeys {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		if len(pageKeys) < kvListPerPage {
+			break
+		}
+	}
+	sort.Strings(keys)
+
+	return keys, nil
+}
+
+// repairKVRecords removes installation records which are duplicated, have no
+// ID or were deleted in the provisioner, and the state kept for installations
+// which no longer exist. It returns a description of each fix, which are only
+// applied when dryRun is false.
+func (p *Plugin) repairKVRecords(dryRun bool) ([]string, error) {
+	installs, originalJSONInstalls, err := p.getInstallations()
+	if err != nil {
+		return nil, errors.Wrap(err, "the installations record is invalid and must be deleted from the KV store directly")
+	}
+
+	cloudInstalls, err := p.cloudClient.GetInstallations(&cloud.GetInstallationsRequest{
+		Paging: cloud.AllPagesWithDeleted(),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get installations from cloud server")
+	}
+	cloudInstallsByID := make(map[string]*cloud.InstallationDTO, len(cloudInstalls))
+	for _, cloudInstall := range cloudInstalls {
+		cloudInstallsByID[cloudInstall.ID] = cloudInstall
+	}
+
+	var fixes []string
+	var kept, deleted []*Installation
+	keptIDs := make(map[string]bool)
+	for _, install := range installs {
+		switch cloudInstall := cloudInstallsByID[install.ID]; {
+		case install.ID == "":
+			fixes = append(fixes, fmt.Sprintf("removed installation record %s without an ID", install.Name))
+		case keptIDs[install.ID]:
+			fixes = append(fixes, fmt.Sprintf("removed duplicate record of installation %s (%s)", install.Name, install.ID))
+		case cloudInstall == nil:
+			fixes = append(fixes, fmt.Sprintf("removed installation %s (%s) unknown to the provisioner", install.Name, install.ID))
+		case cloudInstall.State == cloud.InstallationStateDeleted:
+			fixes = append(fixes, fmt.Sprintf("removed installation %s (%s) deleted in the provisioner", install.Name, install.ID))
+			deleted = append(deleted, install)
+		default:
+			kept = append(kept, install)
+			keptIDs[install.ID] = true
+		}
+	}
+
+	keys, err := p.listKVKeys("")
+	if err != nil {
+		return nil, err
+	}
+	var orphanedKeys []string
+	for _, key := range keys {
+		for _, prefix := range installationStateKeyPrefixes {
+			installationID := strings.TrimPrefix(key, prefix)
+			if !strings.HasPrefix(key, prefix) || !model.IsValidId(installationID) || keptIDs[installationID] {
+				continue
+			}
+			if cloudInstall := cloudInstallsByID[installationID]; cloudInstall != nil && cloudInstall.State != cloud.InstallationStateDeleted {
+				continue
+			}
+			orphanedKeys = append(orphanedKeys, key)
+			fixes = append(fixes, fmt.Sprintf("removed orphaned key %s", key))
+		}
+	}
+
+	if dryRun || len(fixes) == 0 {
+		return fixes, nil
+	}
+
+	if len(kept) != len(installs) {
+		newJSONInstalls, err := json.Marshal(kept)
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to marshal installations")
+		}
+		ok, appErr := p.API.KVCompareAndSet(StoreInstallsKey, originalJSONInstalls, newJSONInstalls)
+		if appErr != nil {
+			return nil, errors.Wrap(appErr, "unable to store installations")
+		}
+		if !ok {
+			return nil, errors.New("installations were updated during the repair, try again")
+		}
+		for _, install := range deleted {
+			if err = p.archiveInstallationUsage(install); err != nil {
+				p.API.LogWarn(errors.Wrap(err, "unable to archive installation usage").Error(), "installation", install.ID)
+			}
+		}
+	}
+
+	for _, key := range orphanedKeys {
+		appErr := p.API.KVDelete(key)
+		if appErr != nil {
+			return nil, errors.Wrapf(appErr, "failed to delete key %s", key)
+		}
+	}
+
+	return fixes, nil
+}
@@ -0,0 +1,422 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminCommand(t *testing.T) {
+	plugin := Plugin{
+		cloudClient:   &MockClient{},
+		configuration: &configuration{},
+	}
+
+	api := &plugintest.API{}
+	api.On("HasPermissionTo", "adminid", mock.Anything).Return(true)
+	api.On("HasPermissionTo", mock.AnythingOfType("string"), mock.Anything).Return(false)
+	plugin.SetAPI(api)
+
+	t.Run("non-admin", func(t *testing.T) {
+		resp, isUserError, err := plugin.runAdminCommand([]string{"docker-cache"}, &model.CommandArgs{UserId: "gabeid"})
+		require.Error(t, err)
+		assert.True(t, isUserError)
+		assert.Nil(t, resp)
+	})
+
+	t.Run("help", func(t *testing.T) {
+		resp, isUserError, err := plugin.runAdminCommand([]string{}, &model.CommandArgs{UserId: "adminid"})
+		require.NoError(t, err)
+		assert.False(t, isUserError)
+		assert.Contains(t, resp.Text, "Available Admin Commands")
+	})
+}
+
+func TestAdminDockerCacheCommand(t *testing.T) {
+	registry := &mockedDockerRegistry{tags: []string{"9.11.1"}, digest: "sha256:abc"}
+	dockerClient := NewCachedDockerClient(registry)
+	plugin := Plugin{
+		dockerClient:  dockerClient,
+		configuration: &configuration{},
+	}
+
+	api := &plugintest.API{}
+	api.On("HasPermissionTo", "adminid", mock.Anything).Return(true)
+	plugin.SetAPI(api)
+
+	_, err := dockerClient.ValidTag("9.11.1", imageEE)
+	require.NoError(t, err)
+
+	t.Run("stats", func(t *testing.T) {
+		resp, isUserError, err := plugin.runAdminCommand([]string{"docker-cache", "stats"}, &model.CommandArgs{UserId: "adminid"})
+		require.NoError(t, err)
+		assert.False(t, isUserError)
+		assert.Contains(t, resp.Text, "| Tags | 0 | 1 | 1 repositories |")
+	})
+
+	t.Run("flush", func(t *testing.T) {
+		resp, isUserError, err := plugin.runAdminCommand([]string{"docker-cache", "flush"}, &model.CommandArgs{UserId: "adminid"})
+		require.NoError(t, err)
+		assert.False(t, isUserError)
+		assert.Contains(t, resp.Text, "Docker registry cache flushed.")
+		assert.Zero(t, dockerClient.Stats().Repositories)
+	})
+
+	t.Run("invalid action", func(t *testing.T) {
+		_, isUserError, err := plugin.runAdminCommand([]string{"docker-cache", "explode"}, &model.CommandArgs{UserId: "adminid"})
+		require.Error(t, err)
+		assert.True(t, isUserError)
+	})
+
+	t.Run("not cached", func(t *testing.T) {
+		uncached := Plugin{dockerClient: &MockedDockerClient{}}
+		uncached.SetAPI(api)
+		_, isUserError, err := uncached.runAdminCommand([]string{"docker-cache"}, &model.CommandArgs{UserId: "adminid"})
+		require.Error(t, err)
+		assert.False(t, isUserError)
+	})
+}
+
+func TestAdminWebhooksCommand(t *testing.T) {
+	plugin := Plugin{configuration: &configuration{}}
+
+	api := &plugintest.API{}
+	newMockedKVStore(api)
+	api.On("HasPermissionTo", "adminid", mock.Anything).Return(true)
+	plugin.SetAPI(api)
+
+	t.Run("queue not running", func(t *testing.T) {
+		_, isUserError, err := plugin.runAdminCommand([]string{"webhooks"}, &model.CommandArgs{UserId: "adminid"})
+		require.Error(t, err)
+		assert.False(t, isUserError)
+	})
+
+	plugin.webhookQueue = newWebhookQueue(&plugin)
+	deadLetter := &webhookEvent{
+		ID:        "eventid",
+		Payload:   &cloud.WebhookPayload{Type: cloud.TypeInstallation, ID: "installid", OldState: cloud.InstallationStateCreationInProgress, NewState: cloud.InstallationStateStable},
+		Attempts:  webhookEventMaxAttempts,
+		LastError: "setup failed",
+	}
+	data, err := json.Marshal([]*webhookEvent{deadLetter})
+	require.NoError(t, err)
+	api.KVSet(StoreWebhookDeadLettersKey, data)
+
+	t.Run("queue", func(t *testing.T) {
+		resp, isUserError, err := plugin.runAdminCommand([]string{"webhooks"}, &model.CommandArgs{UserId: "adminid"})
+		require.NoError(t, err)
+		assert.False(t, isUserError)
+		assert.Contains(t, resp.Text, "0 webhook events are queued.")
+	})
+
+	t.Run("dead letters", func(t *testing.T) {
+		resp, isUserError, err := plugin.runAdminCommand([]string{"webhooks", "dead-letters"}, &model.CommandArgs{UserId: "adminid"})
+		require.NoError(t, err)
+		assert.False(t, isUserError)
+		assert.Contains(t, resp.Text, "1 webhook events failed to be processed.")
+		assert.Contains(t, resp.Text, "| eventid | installation | installid |")
+		assert.Contains(t, resp.Text, "| 5 | setup failed |")
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		_, isUserError, err := plugin.runAdminCommand([]string{"webhooks", "replay"}, &model.CommandArgs{UserId: "adminid"})
+		require.Error(t, err)
+		assert.True(t, isUserError)
+
+		_, isUserError, err = plugin.runAdminCommand([]string{"webhooks", "replay", "unknown"}, &model.CommandArgs{UserId: "adminid"})
+		require.Error(t, err)
+		assert.True(t, isUserError)
+
+		resp, isUserError, err := plugin.runAdminCommand([]string{"webhooks", "replay", "all"}, &model.CommandArgs{UserId: "adminid"})
+		require.NoError(t, err)
+		assert.False(t, isUserError)
+		assert.Contains(t, resp.Text, "Queued 1 webhook events to be processed again.")
+
+		resp, _, err = plugin.runAdminCommand([]string{"webhooks", "queue"}, &model.CommandArgs{UserId: "adminid"})
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, "1 webhook events are queued.")
+		assert.Contains(t, resp.Text, "| eventid |")
+	})
+}
+
+func TestAdminWebhookSecretCommand(t *testing.T) {
+	plugin := Plugin{configuration: &configuration{ProvisioningServerWebhookSecret: "oldsecret"}}
+
+	api := &plugintest.API{}
+	newMockedKVStore(api)
+	api.On("HasPermissionTo", "adminid", mock.Anything).Return(true)
+	api.On("HasPermissionTo", "pluginadminid", mock.Anything).Return(false)
+	api.On("GetUser", "pluginadminid").Return(&model.User{Id: "pluginadminid", Username: "pluginadmin"}, nil)
+	api.On("GetPluginConfig").Return(map[string]interface{}{"provisioningserverwebhooksecret": "oldsecret", "installationdns": "test.mattermost.cloud"})
+	var savedConfig map[string]interface{}
+	api.On("SavePluginConfig", mock.Anything).Run(func(args mock.Arguments) {
+		savedConfig = args.Get(0).(map[string]interface{})
+	}).Return(nil)
+	plugin.SetAPI(api)
+
+	t.Run("status", func(t *testing.T) {
+		plugin.recordWebhookSecretUsage("oldsecret", false)
+
+		resp, isUserError, err := plugin.runAdminCommand([]string{"webhook-secret"}, &model.CommandArgs{UserId: "adminid"})
+		require.NoError(t, err)
+		assert.False(t, isUserError)
+		assert.Contains(t, resp.Text, "Signed webhooks are optional.")
+		assert.Contains(t, resp.Text, fmt.Sprintf("| `%s` | never | 0s ago |", webhookSecretFingerprint("oldsecret")))
+	})
+
+	t.Run("generate", func(t *testing.T) {
+		resp, isUserError, err := plugin.runAdminCommand([]string{"webhook-secret", "generate"}, &model.CommandArgs{UserId: "adminid"})
+		require.NoError(t, err)
+		assert.False(t, isUserError)
+		assert.Contains(t, resp.Text, "Added webhook secret")
+
+		require.NotNil(t, savedConfig)
+		assert.NotContains(t, savedConfig, "provisioningserverwebhooksecret")
+		assert.Equal(t, "test.mattermost.cloud", savedConfig["installationdns"])
+		secrets := strings.Split(savedConfig["ProvisioningServerWebhookSecret"].(string), ",")
+		require.Len(t, secrets, 2)
+		assert.Equal(t, "oldsecret", secrets[0])
+		assert.Contains(t, resp.Text, secrets[1])
+	})
+
+	t.Run("retire", func(t *testing.T) {
+		_, isUserError, err := plugin.runAdminCommand([]string{"webhook-secret", "retire", "unknown"}, &model.CommandArgs{UserId: "adminid"})
+		require.Error(t, err)
+		assert.True(t, isUserError)
+
+		_, isUserError, err = plugin.runAdminCommand([]string{"webhook-secret", "retire", webhookSecretFingerprint("oldsecret")}, &model.CommandArgs{UserId: "adminid"})
+		require.Error(t, err)
+		assert.True(t, isUserError, "the only secret cannot be retired")
+
+		plugin.configuration.ProvisioningServerWebhookSecret = "oldsecret,newsecret"
+		resp, isUserError, err := plugin.runAdminCommand([]string{"webhook-secret", "retire", webhookSecretFingerprint("oldsecret")}, &model.CommandArgs{UserId: "adminid"})
+		require.NoError(t, err)
+		assert.False(t, isUserError)
+		assert.Contains(t, resp.Text, "Retired webhook secret")
+		assert.Equal(t, "newsecret", savedConfig["ProvisioningServerWebhookSecret"])
+	})
+
+	t.Run("plugin admins can't change the secrets", func(t *testing.T) {
+		plugin.configuration.PluginAdminUsers = "pluginadmin"
+		defer func() { plugin.configuration.PluginAdminUsers = "" }()
+		plugin.configuration.ProvisioningServerWebhookSecret = "oldsecret,newsecret"
+		savedConfig = nil
+
+		resp, isUserError, err := plugin.runAdminCommand([]string{"webhook-secret"}, &model.CommandArgs{UserId: "pluginadminid"})
+		require.NoError(t, err)
+		assert.False(t, isUserError)
+		assert.Contains(t, resp.Text, webhookSecretFingerprint("newsecret"))
+
+		for _, args := range [][]string{
+			{"webhook-secret", "generate"},
+			{"webhook-secret", "retire", webhookSecretFingerprint("oldsecret")},
+		} {
+			_, isUserError, err = plugin.runAdminCommand(args, &model.CommandArgs{UserId: "pluginadminid"})
+			require.EqualError(t, err, "changing the webhook secrets is restricted to system administrators", args)
+			assert.True(t, isUserError)
+		}
+		assert.Nil(t, savedConfig)
+	})
+}
+
+func TestAuthorizedPluginAdmin(t *testing.T) {
+	plugin := Plugin{configuration: &configuration{}}
+
+	api := &plugintest.API{}
+	api.On("HasPermissionTo", "adminid", model.PermissionManageSystem).Return(true)
+	api.On("HasPermissionTo", mock.AnythingOfType("string"), model.PermissionManageSystem).Return(false)
+	api.On("GetUser", "joramid").Return(&model.User{Id: "joramid", Username: "Joram"}, nil)
+	api.On("GetUser", "gabeid").Return(&model.User{Id: "gabeid", Username: "gabe"}, nil)
+	plugin.SetAPI(api)
+
+	assert.True(t, plugin.authorizedPluginAdmin("adminid"))
+	assert.False(t, plugin.authorizedPluginAdmin("joramid"))
+
+	plugin.configuration.PluginAdminUsers = " @joram, someone "
+	assert.True(t, plugin.authorizedPluginAdmin("joramid"))
+	assert.False(t, plugin.authorizedPluginAdmin("gabeid"))
+}
+
+func TestAdminFleetCommands(t *testing.T) {
+	joramID := model.NewId()
+	gabeID := model.NewId()
+	joramsID := cloud.NewID()
+	gabesID := cloud.NewID()
+
+	api := &plugintest.API{}
+	store := newMockedKVStore(api)
+	api.On("HasPermissionTo", "adminid", mock.Anything).Return(true)
+	api.On("HasPermissionTo", mock.AnythingOfType("string"), mock.Anything).Return(false)
+	api.On("GetUser", joramID).Return(&model.User{Id: joramID, Username: "joram"}, nil)
+	api.On("GetUser", gabeID).Return(&model.User{Id: gabeID, Username: "gabe"}, nil)
+	api.On("GetUserByUsername", "joram").Return(&model.User{Id: joramID, Username: "joram"}, nil)
+	api.On("GetUserByUsername", "gabe").Return(&model.User{Id: gabeID, Username: "gabe"}, nil)
+	api.On("GetUserByUsername", mock.AnythingOfType("string")).Return(nil, model.NewAppError("GetUserByUsername", "not found", nil, "", 404))
+	api.On("GetDirectChannel", mock.AnythingOfType("string"), "botid").Return(func(userID, botID string) *model.Channel {
+		return &model.Channel{Id: userID + "dm"}
+	}, nil)
+	var posts []*model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		posts = append(posts, args.Get(0).(*model.Post))
+	}).Return(&model.Post{}, nil)
+	api.On("LogInfo", mock.AnythingOfType("string"), mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+
+	mockedCloudClient := &MockClient{
+		mockedCloudInstallationsDTO: []*cloud.InstallationDTO{
+			{Installation: &cloud.Installation{ID: joramsID, OwnerID: joramID, State: cloud.InstallationStateStable, DeletionLocked: true}},
+			{Installation: &cloud.Installation{ID: gabesID, OwnerID: gabeID, State: cloud.InstallationStateHibernating}},
+		},
+	}
+	plugin := &Plugin{
+		BotUserID:     "botid",
+		cloudClient:   mockedCloudClient,
+		configuration: &configuration{},
+	}
+	plugin.SetAPI(api)
+
+	for _, install := range []*Installation{
+		{Name: "joramsinstall", Tag: "10.11.2", InstallationDTO: cloud.InstallationDTO{Installation: &cloud.Installation{ID: joramsID, OwnerID: joramID}}},
+		{Name: "gabesinstall", InstallationDTO: cloud.InstallationDTO{Installation: &cloud.Installation{ID: gabesID, OwnerID: gabeID}}},
+		{Name: "ghost", InstallationDTO: cloud.InstallationDTO{Installation: &cloud.Installation{ID: "ghostid", OwnerID: gabeID}}},
+	} {
+		require.NoError(t, plugin.storeInstallation(install))
+	}
+
+	run := func(args ...string) (*model.CommandResponse, bool, error) {
+		return plugin.runAdminCommand(args, &model.CommandArgs{UserId: "adminid"})
+	}
+
+	t.Run("status is restricted to admins", func(t *testing.T) {
+		_, isUserError, err := plugin.runAdminCommand([]string{"status"}, &model.CommandArgs{UserId: joramID})
+		require.Error(t, err)
+		assert.True(t, isUserError)
+
+		resp, _, err := run("status")
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, installationTableHeader)
+	})
+
+	t.Run("installations", func(t *testing.T) {
+		resp, isUserError, err := run("installations")
+		require.NoError(t, err)
+		assert.False(t, isUserError)
+		assert.Contains(t, resp.Text, "3 installations are managed by the plugin.")
+		assert.Contains(t, resp.Text, fmt.Sprintf("| joramsinstall | `%s` | @joram | stable | 10.11.2 |", joramsID))
+		assert.Contains(t, resp.Text, "| ghost | `ghostid` | @gabe | missing |")
+
+		resp, _, err = run("installations", "--owner", "@gabe", "--state", cloud.InstallationStateHibernating)
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, "1 installations are managed by the plugin.")
+		assert.Contains(t, resp.Text, "| gabesinstall |")
+
+		_, isUserError, err = run("installations", "--owner", "nobody")
+		require.Error(t, err)
+		assert.True(t, isUserError)
+	})
+
+	t.Run("hibernate", func(t *testing.T) {
+		_, isUserError, err := run("hibernate", "gabesinstall")
+		require.EqualError(t, err, "installation state is currently hibernating and must be stable to hibernate")
+		assert.True(t, isUserError)
+
+		posts = nil
+		resp, _, err := run("hibernate", "JoramsInstall")
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, "Hibernation of installation joramsinstall owned by @joram has begun.")
+		require.Len(t, posts, 1)
+		assert.Equal(t, joramID+"dm", posts[0].ChannelId)
+		assert.Equal(t, "Your installation joramsinstall was hibernated by adminid.", posts[0].Message)
+	})
+
+	t.Run("deletion unlock", func(t *testing.T) {
+		_, isUserError, err := run("deletion-unlock", "gabesinstall")
+		require.Error(t, err)
+		assert.True(t, isUserError)
+
+		_, _, err = run("deletion-unlock", joramsID)
+		require.NoError(t, err)
+		assert.Equal(t, joramsID, mockedCloudClient.unlockedInstallationID)
+	})
+
+	t.Run("reassign", func(t *testing.T) {
+		_, isUserError, err := run("reassign", "joramsinstall", "@joram")
+		require.Error(t, err)
+		assert.True(t, isUserError)
+
+		posts = nil
+		resp, _, err := run("reassign", "joramsinstall", "@gabe")
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, "Installation joramsinstall is now owned by @gabe.")
+		require.NotNil(t, mockedCloudClient.patchRequest)
+		assert.Equal(t, gabeID, *mockedCloudClient.patchRequest.OwnerID)
+		install, err := plugin.getInstallation(joramsID)
+		require.NoError(t, err)
+		assert.Equal(t, gabeID, install.OwnerID)
+		require.Len(t, posts, 2, "both owners are notified")
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		mockedCloudClient.unlockedInstallationID = ""
+		resp, _, err := run("delete", "joramsinstall")
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, "Installation joramsinstall owned by @gabe deleted.")
+		assert.Equal(t, joramsID, mockedCloudClient.unlockedInstallationID, "the deletion lock is removed first")
+		assert.Equal(t, joramsID, mockedCloudClient.deletedInstallationID)
+
+		install, err := plugin.getInstallation(joramsID)
+		require.NoError(t, err)
+		assert.Nil(t, install)
+	})
+
+	t.Run("kv", func(t *testing.T) {
+		store.values[credentialsKeyPrefix+gabesID] = []byte("secret")
+		orphanedID := cloud.NewID()
+		store.values[setupProgressKeyPrefix+orphanedID] = []byte(`{"Step":"users"}`)
+
+		resp, _, err := run("kv", "list", "setup_")
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, "1 keys found.")
+		assert.Contains(t, resp.Text, setupProgressKeyPrefix+orphanedID)
+
+		resp, _, err = run("kv", "get", setupProgressKeyPrefix+orphanedID)
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, "\"Step\": \"users\"")
+
+		_, isUserError, err := run("kv", "get", credentialsKeyPrefix+gabesID)
+		require.Error(t, err)
+		assert.True(t, isUserError)
+
+		_, isUserError, err = run("kv", "delete", StoreInstallsKey)
+		require.Error(t, err)
+		assert.True(t, isUserError)
+
+		resp, _, err = run("kv", "repair", "--dry-run")
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, "Dry run, 2 KV records would be repaired:")
+		assert.Contains(t, resp.Text, "- removed installation ghost (ghostid) unknown to the provisioner")
+		assert.Contains(t, resp.Text, "- removed orphaned key "+setupProgressKeyPrefix+orphanedID)
+		assert.NotNil(t, store.values[setupProgressKeyPrefix+orphanedID])
+
+		resp, _, err = run("kv", "repair")
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, "Repaired 2 KV records:")
+		assert.Nil(t, store.values[setupProgressKeyPrefix+orphanedID])
+		assert.NotNil(t, store.values[credentialsKeyPrefix+gabesID], "the state of existing installations is kept")
+		installs, _, err := plugin.getInstallations()
+		require.NoError(t, err)
+		require.Len(t, installs, 1)
+		assert.Equal(t, gabesID, installs[0].ID)
+
+		resp, _, err = run("kv", "repair")
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, "No KV records need to be repaired.")
+	})
+}
@@ -1,15 +1,10 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
 	"regexp"
 	"strings"
-	"time"
 
-	"github.com/blang/semver/v4"
 	cloud "github.com/mattermost/mattermost-cloud/model"
 	"github.com/mattermost/mattermost-server/v6/model"
 	"github.com/pkg/errors"
@@ -23,13 +18,6 @@ const (
 
 var installationNameMatcher = regexp.MustCompile(`^[a-zA-Z0-9-]*$`)
 
-var validInstallationSizes = []string{"miniSingleton", "miniHA"}
-
-type latestMattermostVersionCache struct {
-	version   string
-	timestamp time.Time
-}
-
 func (p *Plugin) getCreateFlagSet() *flag.FlagSet {
 	config := p.getConfiguration()
 	defaultFileStore := config.DefaultFilestore
@@ -42,20 +30,23 @@ func (p *Plugin) getCreateFlagSet() *flag.FlagSet {
 	}
 
 	createFlagSet := flag.NewFlagSet("create", flag.ContinueOnError)
-	createFlagSet.String("size", "miniSingleton", "Size of the Mattermost installation e.g. 'miniSingleton' or 'miniHA'")
-	createFlagSet.String("version", "latest", "Mattermost version to run, e.g. '9.1.0'")
+	createFlagSet.String("size", config.defaultSize(), config.sizeHelpText())
+	createFlagSet.String("version", versionAliasLatest, fmt.Sprintf("Mattermost version to run, e.g. '9.1.0', or one of the aliases %s", versionAliasHelp))
 	createFlagSet.String("affinity", cloud.InstallationAffinityMultiTenant, "Whether the installation is isolated in it's own cluster or shares ones. Can be 'isolated' or 'multitenant'")
-	createFlagSet.String("license", licenseOptionEnterprise, "The Mattermost license to use. Can be 'enterprise', 'professional', 'e20', 'e10', or 'te'")
+	createFlagSet.String("license", config.defaultLicense(), config.licenseHelpText())
 	createFlagSet.String("filestore", defaultFileStore, "Specify the backing file store. Can be 'bifrost' (S3 Shared Bucket), 'aws-multitenant-s3' (S3 Shared Bucket), 'aws-s3' (S3 Bucket).")
 	createFlagSet.String("database", defaultDatabase, "Specify the backing database. Can be 'aws-multitenant-rds-postgres-pgbouncer' (RDS Postgres with pgbouncer proxy connections), 'aws-rds' (RDS MySQL).")
 	createFlagSet.Bool("test-data", false, "Set to pre-load the server with test data")
-	createFlagSet.String("image", defaultImage, fmt.Sprintf("Docker image repository. Can be %s", strings.Join(dockerRepoWhitelist, ", ")))
+	createFlagSet.String("image", config.defaultImage(), config.imageHelpText())
 	createFlagSet.StringSlice("env", []string{}, "Environment variables in form: ENV1=test,ENV2=test")
+	createFlagSet.String("setup-profile", "", "Setup profile applied once the installation is ready. Use /cloud setup-profile list to see the available profiles")
+	addSampleDataFlags(createFlagSet)
 	return createFlagSet
 }
 
 // parseCreateArgs is responsible for reading in arguments and basic input validation
 func (p *Plugin) parseCreateArgs(args []string, install *Installation) error {
+	config := p.getConfiguration()
 	createFlagSet := p.getCreateFlagSet()
 	err := createFlagSet.Parse(args)
 	if err != nil {
@@ -66,7 +57,7 @@ func (p *Plugin) parseCreateArgs(args []string, install *Installation) error {
 	if err != nil {
 		return err
 	}
-	if install.Size != "" && !Contains(validInstallationSizes, install.Size) {
+	if install.Size != "" && !config.validSize(install.Size) {
 		return fmt.Errorf("Invalid size: %s", install.Size)
 	}
 
@@ -75,14 +66,9 @@ func (p *Plugin) parseCreateArgs(args []string, install *Installation) error {
 		return err
 	}
 
-	if install.Version == "latest" {
-		install.Version, err = p.githubLatestVersion()
-		if err != nil {
-			return errors.Wrap(err, "failed to determine latest tag for requested version 'latest'")
-		}
-		if install.Version == "" {
-			return errors.New("failed to determine latest tag for requested version 'latest': got empty version")
-		}
+	install.Version, err = p.resolveVersionAlias(install.Version)
+	if err != nil {
+		return err
 	}
 	install.Tag = install.Version
 
@@ -100,8 +86,8 @@ func (p *Plugin) parseCreateArgs(args []string, install *Installation) error {
 		return err
 	}
 
-	if !validLicenseOption(install.License) {
-		return errors.Errorf("invalid license option %s, valid options are %s", install.License, strings.Join(validLicenseOptions, ", "))
+	if !config.validLicense(install.License) {
+		return errors.Errorf("invalid license option %s, valid options are %s", install.License, strings.Join(config.licenseNames(), ", "))
 	}
 
 	install.Image, err = createFlagSet.GetString("image")
@@ -109,8 +95,8 @@ func (p *Plugin) parseCreateArgs(args []string, install *Installation) error {
 		return err
 	}
 
-	if !validImageName(install.Image) {
-		return errors.Errorf("invalid image name %s, valid options are %s", install.Image, strings.Join(dockerRepoWhitelist, ", "))
+	if !config.validImage(install.Image) {
+		return errors.Errorf("invalid image name %s, valid options are %s", install.Image, strings.Join(config.imageRepositories(), ", "))
 	}
 
 	install.Database, err = createFlagSet.GetString("database")
@@ -142,8 +128,14 @@ func (p *Plugin) parseCreateArgs(args []string, install *Installation) error {
 		)
 	}
 
-	if install.Filestore == cloud.InstallationFilestoreMultiTenantAwsS3 && install.License != licenseOptionEnterprise && install.License != licenseOptionE20 {
-		return errors.Errorf("filestore option %s requires license option %s or %s", cloud.InstallationFilestoreMultiTenantAwsS3, licenseOptionEnterprise, licenseOptionE20)
+	if install.Filestore == cloud.InstallationFilestoreMultiTenantAwsS3 {
+		licenses := config.multitenantFilestoreLicenses()
+		if len(licenses) == 0 {
+			return errors.Errorf("filestore option %s isn't allowed by any license option", cloud.InstallationFilestoreMultiTenantAwsS3)
+		}
+		if !Contains(licenses, install.License) {
+			return errors.Errorf("filestore option %s requires license option %s", cloud.InstallationFilestoreMultiTenantAwsS3, strings.Join(licenses, " or "))
+		}
 	}
 
 	install.TestData, err = createFlagSet.GetBool("test-data")
@@ -151,6 +143,14 @@ func (p *Plugin) parseCreateArgs(args []string, install *Installation) error {
 		return err
 	}
 
+	install.SampleData, err = parseSampleDataFlags(createFlagSet)
+	if err != nil {
+		return err
+	}
+	if install.SampleData != nil {
+		install.TestData = true
+	}
+
 	envVars, err := createFlagSet.GetStringSlice("env")
 	if err != nil {
 		return err
@@ -161,6 +161,11 @@ func (p *Plugin) parseCreateArgs(args []string, install *Installation) error {
 	}
 	install.Installation.PriorityEnv = envVarMap
 
+	install.SetupProfile, err = createFlagSet.GetString("setup-profile")
+	if err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -197,6 +202,22 @@ func (p *Plugin) runCreateCommand(args []string, extra *model.CommandArgs) (*mod
 		return nil, true, err
 	}
 
+	err = p.checkInstallationPermissions(extra.UserId, install.Size, install.Affinity)
+	if err != nil {
+		return nil, true, err
+	}
+
+	if install.SetupProfile != "" {
+		var profile *setupProfile
+		profile, err = p.getSetupProfile(extra.UserId, install.SetupProfile)
+		if err != nil {
+			return nil, false, err
+		}
+		if profile == nil {
+			return nil, true, errors.Errorf("no setup profile with the name %s found, use /cloud setup-profile list to see the available profiles", install.SetupProfile)
+		}
+	}
+
 	err = validVersionOption(install.Version)
 	if err != nil {
 		return nil, true, errors.Wrap(err, "Invalid version number")
@@ -244,11 +265,13 @@ func (p *Plugin) runCreateCommand(args []string, extra *model.CommandArgs) (*mod
 	}
 
 	install.Installation = cloudInstallation.Installation
+	install.TeamID = extra.TeamId
 
 	err = p.storeInstallation(install)
 	if err != nil {
 		return nil, false, err
 	}
+	p.recordPluginEvent(install.ID, extra.UserId, "create", eventArgs(args[1:]))
 
 	install.HideSensitiveFields()
 
@@ -272,87 +295,6 @@ func (p *Plugin) installationWithNameExists(name string) (bool, error) {
 	return false, nil
 }
 
-func validImageName(imageName string) bool {
-	for _, image := range dockerRepoWhitelist {
-		if image == imageName {
-			return true
-		}
-	}
-	return false
-}
-
-type githubReleaseMetadata struct {
-	TagName string `json:"tag_name"`
-}
-
-func (p *Plugin) githubLatestVersion() (string, error) {
-	// avoids Github rate limiting for unauthenticated requests
-	if p.latestMattermostVersion != nil &&
-		p.latestMattermostVersion.version != "" &&
-		p.latestMattermostVersion.timestamp.After(time.Now().Add(time.Minute*time.Duration(-5))) {
-
-		return p.latestMattermostVersion.version, nil
-	}
-
-	// else version is more than five minutes old or doesn't exist, so get it from Github
-	// use the releases endpoint and not releases/latest to avoid getting a dot release
-	resp, err := http.Get("https://api.github.com/repos/mattermost/mattermost-server/releases")
-	if err != nil {
-		return "", errors.Wrap(err, "failed to find latest release from GitHub")
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return "", errors.Errorf("got unexpected status code %d while determining latest release from GitHub", resp.StatusCode)
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", errors.Wrap(err, "failed to read response body")
-	}
-
-	grm := []githubReleaseMetadata{}
-	err = json.Unmarshal(body, &grm)
-	if err != nil {
-		return "", errors.Wrap(err, "failed to unmarshal JSON from GitHub to determine latest release")
-	}
-
-	var (
-		latestTag        string
-		latestTagVersion semver.Version
-	)
-
-	for _, release := range grm {
-		if release.TagName == "" {
-			continue
-		}
-		currentTag := strings.TrimPrefix(release.TagName, "v")
-		currentTagVersion, err := semver.Parse(currentTag)
-		if err != nil {
-			p.API.LogError(err.Error())
-			continue
-		}
-
-		if latestTag == "" || currentTagVersion.GE(latestTagVersion) {
-			latestTag = currentTag
-			latestTagVersion = currentTagVersion
-			continue
-		}
-	}
-
-	if latestTag == "" {
-		return "", errors.New("failed to determine latest version of Mattermost")
-	}
-
-	p.latestMattermostVersion =
-		&latestMattermostVersionCache{
-			timestamp: time.Now(),
-			version:   latestTag,
-		}
-
-	return latestTag, nil
-}
-
 func parseEnvVarInput(rawInput []string, clearEnvs []string) (cloud.EnvVarMap, error) {
 	if len(rawInput) == 0 && len(clearEnvs) == 0 {
 		return nil, nil
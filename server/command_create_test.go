@@ -16,20 +16,22 @@ func TestCreateCommand(t *testing.T) {
 	dockerClient := &MockedDockerClient{tagExists: true}
 	mockCloudClient := &MockClient{}
 	plugin := Plugin{
-		cloudClient:  mockCloudClient,
-		dockerClient: dockerClient,
+		cloudClient:   mockCloudClient,
+		dockerClient:  dockerClient,
+		releaseSource: &mockedReleaseSource{releases: testReleases},
 	}
 
 	api := &plugintest.API{}
 	api.On("KVGet", mock.AnythingOfType("string")).Return(nil, nil)
 	api.On("KVCompareAndSet", mock.AnythingOfType("string"), mock.Anything, mock.Anything).Return(true, nil)
+	api.On("KVSet", StoreReleasesKey, mock.Anything).Return(nil)
 
 	plugin.SetAPI(api)
 
 	t.Run("ensure latest version lookup routine still works", func(t *testing.T) {
-		latest, err := plugin.githubLatestVersion()
+		latest, err := plugin.resolveVersionAlias(versionAliasLatest)
 		require.NoError(t, err)
-		assert.NotEmpty(t, latest)
+		assert.Equal(t, "10.11.2", latest)
 		_, err = semver.Parse(latest)
 		assert.NoError(t, err)
 	})
@@ -67,6 +69,7 @@ func TestCreateCommand(t *testing.T) {
 		require.NoError(t, err)
 		assert.False(t, isUserError)
 		assert.Contains(t, resp.Text, "Installation being created.")
+		assert.Equal(t, "10.11.2", mockCloudClient.creationRequest.Version)
 	})
 
 	t.Run("docker tag", func(t *testing.T) {
@@ -242,6 +245,24 @@ func TestCreateCommand(t *testing.T) {
 			assert.Nil(t, resp)
 		})
 
+		t.Run("license catalog", func(t *testing.T) {
+			plugin.configuration = &configuration{
+				LicenseCatalog: `[{"name": "trial", "license": "triallicense", "multitenant_filestore": true}, {"name": "unlicensed", "default": true}]`,
+			}
+			require.NoError(t, plugin.configuration.loadCatalogs())
+			defer func() { plugin.configuration = nil }()
+
+			resp, isUserError, err := plugin.runCreateCommand([]string{"gabetest", "--filestore", cloud.InstallationFilestoreMultiTenantAwsS3}, &model.CommandArgs{})
+			require.EqualError(t, err, "filestore option aws-multitenant-s3 requires license option trial")
+			assert.True(t, isUserError)
+			assert.Nil(t, resp)
+
+			resp, isUserError, err = plugin.runCreateCommand([]string{"gabetest", "--filestore", cloud.InstallationFilestoreMultiTenantAwsS3, "--license", "trial"}, &model.CommandArgs{})
+			require.NoError(t, err)
+			assert.False(t, isUserError)
+			assert.Contains(t, resp.Text, "Installation being created.")
+		})
+
 		t.Run(cloud.InstallationFilestoreMinioOperator, func(t *testing.T) {
 			resp, isUserError, err := plugin.runCreateCommand([]string{"gabetest", "--filestore", cloud.InstallationFilestoreMinioOperator}, &model.CommandArgs{})
 			require.NoError(t, err)
@@ -299,6 +320,40 @@ func TestCreateCommand(t *testing.T) {
 		})
 	})
 
+	t.Run("setup profile", func(t *testing.T) {
+		plugin.configuration = &configuration{SetupProfiles: `[{"name": "qa-e2e", "users": [{"username": "qa"}]}]`}
+		defer func() { plugin.configuration = nil }()
+
+		t.Run("valid", func(t *testing.T) {
+			resp, isUserError, err := plugin.runCreateCommand([]string{"gabetest", "--setup-profile", "qa-e2e"}, &model.CommandArgs{})
+			require.NoError(t, err)
+			assert.False(t, isUserError)
+			assert.Contains(t, resp.Text, `"SetupProfile": "qa-e2e"`)
+		})
+		t.Run("unknown", func(t *testing.T) {
+			resp, isUserError, err := plugin.runCreateCommand([]string{"gabetest", "--setup-profile", "unknown"}, &model.CommandArgs{})
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), "no setup profile with the name unknown found")
+			assert.True(t, isUserError)
+			assert.Nil(t, resp)
+		})
+	})
+
+	t.Run("test data options", func(t *testing.T) {
+		t.Run("valid", func(t *testing.T) {
+			resp, isUserError, err := plugin.runCreateCommand([]string{"gabetest", "--test-data-profile", "small", "--test-data-seed", "7"}, &model.CommandArgs{})
+			require.NoError(t, err)
+			assert.False(t, isUserError)
+			assert.Contains(t, resp.Text, `"TestData": true`)
+			assert.Contains(t, resp.Text, `"Profile": "small"`)
+		})
+		t.Run("invalid", func(t *testing.T) {
+			_, isUserError, err := plugin.runCreateCommand([]string{"gabetest", "--test-data-users", "100000"}, &model.CommandArgs{})
+			require.Error(t, err)
+			assert.True(t, isUserError)
+		})
+	})
+
 	t.Run("missing installation name", func(t *testing.T) {
 		resp, isUserError, err := plugin.runCreateCommand([]string{""}, &model.CommandArgs{})
 		require.Error(t, err)
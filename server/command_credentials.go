@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+// findCredentialInstallation returns the installation with the given name
+// whose credentials the user may manage.
+func (p *Plugin) findCredentialInstallation(name, userID string) (*Installation, error) {
+	installs, _, err := p.getInstallations()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, install := range installs {
+		if install.Name == name && p.canManageCredentials(install, userID) {
+			// Load the DNS records of the installation.
+			return p.getInstallation(install.ID)
+		}
+	}
+
+	return nil, nil
+}
+
+func (p *Plugin) runCredentialsCommand(args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+	if len(args) == 0 || len(args[0]) == 0 {
+		return nil, true, errors.Errorf("must provide an installation name")
+	}
+
+	name := standardizeName(args[0])
+
+	install, err := p.findCredentialInstallation(name, extra.UserId)
+	if err != nil {
+		return nil, false, err
+	}
+	if install == nil {
+		return nil, true, errors.Errorf("no installation with the name %s found", name)
+	}
+
+	credentials, err := p.getInstallationCredentials(install.ID)
+	if err == errCredentialVaultDisabled {
+		return nil, true, err
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if len(credentials) == 0 {
+		return getCommandResponse(model.CommandResponseTypeEphemeral, fmt.Sprintf("No credentials are stored for installation %s.", name), extra), false, nil
+	}
+
+	p.recordPluginEvent(install.ID, extra.UserId, "credentials-viewed", "")
+
+	var dnsRecord string
+	if len(install.DNSRecords) > 0 {
+		dnsRecord = install.DNSRecords[0].DomainName
+	}
+
+	resp := fmt.Sprintf("Credentials for installation %s (https://%s):\n\n| Username | Password | Note |\n| -- | -- | -- |\n%s", name, dnsRecord, credentialsTable(credentials))
+
+	return getCommandResponse(model.CommandResponseTypeEphemeral, resp, extra), false, nil
+}
+
+func (p *Plugin) runRotatePasswordCommand(args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+	if len(args) < 2 || len(args[0]) == 0 || len(args[1]) == 0 {
+		return nil, true, errors.Errorf("must provide an installation name and a username")
+	}
+
+	name := standardizeName(args[0])
+	username := args[1]
+
+	install, err := p.findCredentialInstallation(name, extra.UserId)
+	if err != nil {
+		return nil, false, err
+	}
+	if install == nil {
+		return nil, true, errors.Errorf("no installation with the name %s found", name)
+	}
+
+	credential, isUserError, err := p.rotateInstallationPassword(install, username)
+	if err == errCredentialVaultDisabled {
+		return nil, true, err
+	}
+	if err != nil {
+		return nil, isUserError, err
+	}
+
+	p.recordPluginEvent(install.ID, extra.UserId, "rotate-password", username)
+
+	return getCommandResponse(model.CommandResponseTypeEphemeral, fmt.Sprintf("The password of user %s on installation %s is now %s", username, name, inlineCode(credential.Password)), extra), false, nil
+}
@@ -41,6 +41,7 @@ func (p *Plugin) runDeleteCommand(args []string, extra *model.CommandArgs) (*mod
 	if err != nil {
 		return nil, false, err
 	}
+	p.recordPluginEvent(installToDelete.ID, extra.UserId, "delete", "")
 
 	return getCommandResponse(model.CommandResponseTypeEphemeral, fmt.Sprintf("Installation %s deleted.", name), extra), false, nil
 }
@@ -47,7 +47,12 @@ func (p *Plugin) lockForDeletion(installationID string, userID string) error {
 	}
 
 	err = p.cloudClient.LockDeletionLockForInstallation(installationToLock.ID)
-	return err
+	if err != nil {
+		return err
+	}
+	p.recordPluginEvent(installationToLock.ID, userID, "deletion-lock", "")
+
+	return nil
 }
 
 func (p *Plugin) unlockForDeletion(installationID string, userID string) error {
@@ -77,7 +82,12 @@ func (p *Plugin) unlockForDeletion(installationID string, userID string) error {
 	}
 
 	err = p.cloudClient.UnlockDeletionLockForInstallation(installationToLock.ID)
-	return err
+	if err != nil {
+		return err
+	}
+	p.recordPluginEvent(installationToLock.ID, userID, "deletion-unlock", "")
+
+	return nil
 }
 
 func (p *Plugin) runDeletionLockCommand(args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+// runDigestCommand manages the weekly installation digest of the user.
+func (p *Plugin) runDigestCommand(args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+	if len(args) == 0 {
+		optedOut, err := p.digestOptedOut(extra.UserId)
+		if err != nil {
+			return nil, false, err
+		}
+		if optedOut {
+			return getCommandResponse(model.CommandResponseTypeEphemeral, "You don't receive the weekly installation digest. Use `/cloud digest on` to receive it.", extra), false, nil
+		}
+		return getCommandResponse(model.CommandResponseTypeEphemeral, "You receive the weekly installation digest. Use `/cloud digest off` to stop receiving it.", extra), false, nil
+	}
+
+	switch args[0] {
+	case "on", "off":
+		err := p.setDigestOptOut(extra.UserId, args[0] == "off")
+		if err != nil {
+			return nil, false, err
+		}
+		if args[0] == "off" {
+			return getCommandResponse(model.CommandResponseTypeEphemeral, "You will no longer receive the weekly installation digest.", extra), false, nil
+		}
+		return getCommandResponse(model.CommandResponseTypeEphemeral, "You will receive the weekly installation digest.", extra), false, nil
+	case "now":
+		installsByOwner, err := p.getDigestInstallations()
+		if err != nil {
+			return nil, false, err
+		}
+		installs := installsByOwner[extra.UserId]
+		if len(installs) == 0 {
+			return nil, true, errors.New("you don't own any installations")
+		}
+
+		latest, err := p.latestRelease()
+		if err != nil {
+			p.API.LogWarn("Failed to get the latest release for the weekly digest", "error", err.Error())
+		}
+		err = p.sendDigest(extra.UserId, installs, latest, time.Now())
+		if err != nil {
+			return nil, false, err
+		}
+
+		return getCommandResponse(model.CommandResponseTypeEphemeral, "Your installation digest has been sent to you as a DM.", extra), false, nil
+	}
+
+	return nil, true, errors.Errorf("invalid digest option %s, valid options are on, off and now", args[0])
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+func (p *Plugin) runHealthCommand(args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+	if len(args) == 0 || len(args[0]) == 0 {
+		return nil, true, errors.Errorf("must provide an installation name")
+	}
+
+	name := standardizeName(args[0])
+
+	installs, _, err := p.getInstallations()
+	if err != nil {
+		return nil, false, err
+	}
+
+	var install *Installation
+	for _, i := range installs {
+		if i.Name == name && p.canViewInstallation(i, extra.UserId) {
+			install = i
+			break
+		}
+	}
+	if install == nil {
+		return nil, true, errors.Errorf("no installation with the name %s found", name)
+	}
+
+	cloudInstall, err := p.cloudClient.GetInstallation(install.ID, &cloud.GetInstallationRequest{})
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "failed to get installation %s from the provisioner", name)
+	}
+	if cloudInstall == nil {
+		return nil, true, errors.Errorf("installation %s no longer exists", name)
+	}
+
+	results := checkInstallationHealth(cloudInstall, install.Tag)
+
+	reachability, err := p.getReachabilityStatus(install.ID)
+	if err != nil {
+		p.API.LogWarn(err.Error(), "installation", install.ID)
+	} else if result := reachability.healthResult(time.Now()); result != nil {
+		results = append(results, result)
+	}
+
+	var failed int
+	for _, result := range results {
+		if result.Result == healthFail {
+			failed++
+		}
+	}
+	summary := fmt.Sprintf("Installation %s is healthy.", name)
+	if failed > 0 {
+		summary = fmt.Sprintf("Installation %s failed %d of %d health checks.", name, failed, len(results))
+	}
+
+	return getCommandResponse(model.CommandResponseTypeEphemeral, fmt.Sprintf("%s\n\n%s", summary, healthTable(results)), extra), false, nil
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"fmt"
 
-	cloud "github.com/mattermost/mattermost-cloud/model"
 	"github.com/mattermost/mattermost-server/v6/model"
 	"github.com/pkg/errors"
 )
@@ -32,13 +31,10 @@ func (p *Plugin) runHibernateCommand(args []string, extra *model.CommandArgs) (*
 	if installToHibernate == nil {
 		return nil, true, errors.Errorf("no installation with the name %s found", name)
 	}
-	if installToHibernate.State != cloud.InstallationStateStable {
-		return nil, true, errors.Errorf("installation state is currently %s and must be %s to hibernate", installToHibernate.State, cloud.InstallationStateStable)
-	}
 
-	_, err = p.cloudClient.HibernateInstallation(installToHibernate.ID)
+	isUserError, err := p.hibernateInstallation(installToHibernate, extra.UserId)
 	if err != nil {
-		return nil, false, err
+		return nil, isUserError, err
 	}
 
 	return getCommandResponse(model.CommandResponseTypeEphemeral, fmt.Sprintf("Hibernation of installation %s has begun. You will receive a notification when it is hibernated. Use /cloud list to check on the status of your installations.", name), extra), false, nil
@@ -14,26 +14,11 @@ func (p *Plugin) runImportCommand(args []string, extra *model.CommandArgs) (*mod
 	if len(args) == 0 {
 		return nil, true, errors.New("must provide an installation DNS")
 	}
-	installationDNS := standardizeName(args[0])
-
-	u, err := url.Parse(installationDNS)
+	hostname, name, err := parseImportDNS(args[0])
 	if err != nil {
-		return nil, true, errors.Wrap(err, "error parsing url")
-	}
-
-	hostname := u.Hostname()
-
-	if hostname == "" {
-		// If the initial DNS does not contain HTTP/HTTPS Hostname() will return an empty string so we use the initial DNS instead
-		hostname = installationDNS
+		return nil, true, err
 	}
 
-	splitDNS := strings.Split(hostname, ".")
-	if len(splitDNS) < 2 {
-		return nil, true, errors.Errorf("failed to parse DNS value: %s", hostname)
-	}
-	name := splitDNS[0]
-
 	cloudInstall, err := p.cloudClient.GetInstallationByDNS(hostname, nil)
 	if err != nil {
 		return nil, false, errors.Wrap(err, "failed to get installation by DNS")
@@ -72,6 +57,7 @@ func (p *Plugin) runImportCommand(args []string, extra *model.CommandArgs) (*mod
 	if err != nil {
 		return nil, false, errors.Wrap(err, "failed to store updated installation")
 	}
+	p.recordPluginEvent(pluginInstall.ID, extra.UserId, "import", "")
 	pluginInstall.HideSensitiveFields()
 
 	dataInstall, err := json.Marshal(pluginInstall)
@@ -82,3 +68,28 @@ func (p *Plugin) runImportCommand(args []string, extra *model.CommandArgs) (*mod
 	return getCommandResponse(model.CommandResponseTypeEphemeral, "Installation imported:\n\n"+jsonCodeBlock(prettyPrintJSON(string(dataInstall))), extra), false, nil
 
 }
+
+// parseImportDNS returns the hostname of the installation DNS or URL given to
+// import, and the name of the imported installation.
+func parseImportDNS(dns string) (hostname, name string, err error) {
+	installationDNS := standardizeName(dns)
+
+	u, err := url.Parse(installationDNS)
+	if err != nil {
+		return "", "", errors.Wrap(err, "error parsing url")
+	}
+
+	hostname = u.Hostname()
+
+	if hostname == "" {
+		// If the initial DNS does not contain HTTP/HTTPS Hostname() will return an empty string so we use the initial DNS instead
+		hostname = installationDNS
+	}
+
+	splitDNS := strings.Split(hostname, ".")
+	if len(splitDNS) < 2 {
+		return "", "", errors.Errorf("failed to parse DNS value: %s", hostname)
+	}
+
+	return hostname, splitDNS[0], nil
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// importAttachmentPostsSearched is how many recent posts of the channel
+	// are searched for an import file.
+	importAttachmentPostsSearched = 30
+	// importJobTimeout is how long an import job is polled before giving up.
+	importJobTimeout = 2 * time.Hour
+	// importDownloadTimeout is how long reading an import file from its
+	// public link may take, including the upload it is streamed to.
+	importDownloadTimeout = 30 * time.Minute
+	// importStopTimeout is how long stopping the plugin waits for running
+	// imports to notice they were interrupted.
+	importStopTimeout = 10 * time.Second
+	// importMaxFileSize is the size of the largest import file accepted.
+	importMaxFileSize = 1 << 30
+	// importUsernamePrefix prefixes the usernames of the temporary accounts
+	// uploading import files to installations.
+	importUsernamePrefix = "cloud-import-"
+)
+
+// importJobPollInterval is how often the status of an import job is checked.
+var importJobPollInterval = 15 * time.Second
+
+// importHTTPClient downloads import files from their public links.
+var importHTTPClient = &http.Client{Timeout: importDownloadTimeout}
+
+var errImportInterrupted = errors.New("the plugin stopped while the import was running")
+
+func (p *Plugin) runImportDataCommand(args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+	if len(args) == 0 || len(args[0]) == 0 {
+		return nil, true, errors.Errorf("must provide an installation name")
+	}
+
+	name := standardizeName(args[0])
+
+	install, err := p.findCredentialInstallation(name, extra.UserId)
+	if err != nil {
+		return nil, false, err
+	}
+	if install == nil {
+		return nil, true, errors.Errorf("no installation with the name %s found", name)
+	}
+	if len(install.DNSRecords) == 0 {
+		return nil, false, errors.Errorf("installation %s doesn't have any DNSRecords", name)
+	}
+
+	fileInfo, err := p.findImportAttachment(extra.ChannelId, extra.UserId)
+	if err != nil {
+		return nil, false, err
+	}
+	if fileInfo == nil {
+		return nil, true, errors.New("no bulk import file found; attach a .jsonl or .zip bulk import file to a post in this channel, then run the command again")
+	}
+
+	if fileInfo.Size > importMaxFileSize {
+		return nil, true, errors.Errorf("import file %s is larger than the limit of %d MB", fileInfo.Name, importMaxFileSize/1024/1024)
+	}
+
+	p.recordPluginEvent(install.ID, extra.UserId, "import-data-started", fileInfo.Name)
+
+	p.startImportJob(install, fileInfo, extra.UserId)
+
+	return getCommandResponse(model.CommandResponseTypeEphemeral, fmt.Sprintf("Importing %s into installation %s. You will receive a DM when the import has finished.", fileInfo.Name, name), extra), false, nil
+}
+
+// startImportJob imports the file into the installation in the background.
+// The user is sent a DM once the import has finished.
+func (p *Plugin) startImportJob(install *Installation, fileInfo *model.FileInfo, userID string) {
+	p.importJobs.start(func(stop <-chan struct{}) {
+		message := fmt.Sprintf("Import of %s into installation %s has completed.", fileInfo.Name, install.Name)
+		err := p.importData(install, fileInfo, stop)
+		switch {
+		case err == errImportInterrupted:
+			p.recordPluginEvent(install.ID, userID, "import-data-failed", err.Error())
+			message = fmt.Sprintf("Import of %s into installation %s was interrupted because the plugin stopped. An import job which already started may still complete on the installation.", fileInfo.Name, install.Name)
+		case err != nil:
+			p.recordPluginEvent(install.ID, userID, "import-data-failed", err.Error())
+			message = fmt.Sprintf("Import of %s into installation %s failed: %s", fileInfo.Name, install.Name, inlineCode(err.Error()))
+		default:
+			p.recordPluginEvent(install.ID, userID, "import-data-completed", fileInfo.Name)
+		}
+		p.PostBotDM(userID, message)
+	})
+}
+
+// findImportAttachment returns the most recent bulk import file attached by a
+// user to a post in a channel, or nil if there is none.
+func (p *Plugin) findImportAttachment(channelID, userID string) (*model.FileInfo, error) {
+	posts, appErr := p.API.GetPostsForChannel(channelID, 0, importAttachmentPostsSearched)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get channel posts")
+	}
+
+	// The order lists the most recent posts first.
+	for _, postID := range posts.Order {
+		post := posts.Posts[postID]
+		if post == nil || post.UserId != userID {
+			continue
+		}
+
+		for _, fileID := range post.FileIds {
+			fileInfo, appErr := p.API.GetFileInfo(fileID)
+			if appErr != nil {
+				return nil, errors.Wrap(appErr, "failed to get file info")
+			}
+			switch strings.ToLower(filepath.Ext(fileInfo.Name)) {
+			case ".jsonl", ".zip":
+				return fileInfo, nil
+			}
+		}
+	}
+
+	return nil, nil
+}
+
+// importData uploads a bulk import file to an installation and processes it.
+// Exec can't send files to the installation, so the file is uploaded through
+// the API in the same way as mmctl import upload, before being processed with
+// mmctl import process. The upload is made with a temporary admin account
+// managed with mmctl in local mode, so no stored password is needed. It
+// returns errImportInterrupted once stop is closed.
+func (p *Plugin) importData(install *Installation, fileInfo *model.FileInfo, stop <-chan struct{}) error {
+	clusterInstallationID, err := p.getClusterInstallationID(install)
+	if err != nil {
+		return err
+	}
+
+	file, err := p.openImportFile(fileInfo)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var data io.Reader = file
+	filename := fileInfo.Name
+	size := fileInfo.Size
+	if strings.ToLower(filepath.Ext(filename)) == ".jsonl" {
+		archive, err := zipImportFile(filename, file)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(archive.Name())
+		defer archive.Close()
+
+		stat, err := archive.Stat()
+		if err != nil {
+			return errors.Wrap(err, "failed to get import archive size")
+		}
+		data = archive
+		filename = strings.TrimSuffix(filename, filepath.Ext(filename)) + ".zip"
+		size = stat.Size()
+	}
+
+	username, password, err := p.createImportAccount(install, clusterInstallationID)
+	if username != "" {
+		defer p.deleteImportAccount(install, clusterInstallationID, username)
+	}
+	if err != nil {
+		return err
+	}
+
+	client := model.NewAPIv4Client(fmt.Sprintf("https://%s", install.DNSRecords[0].DomainName))
+	user, _, err := client.Login(username, password)
+	if err != nil {
+		return errors.Wrap(err, "failed to log in with the temporary import account")
+	}
+	defer client.Logout()
+
+	upload, _, err := client.CreateUpload(&model.UploadSession{
+		Type:     model.UploadTypeImport,
+		UserId:   user.Id,
+		Filename: filename,
+		FileSize: size,
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to create import upload")
+	}
+
+	_, _, err = client.UploadData(upload.Id, data)
+	if err != nil {
+		return errors.Wrap(err, "failed to upload import file")
+	}
+
+	// Uploaded import files are named after their upload session.
+	importFile := upload.Id + "_" + filename
+	output, err := p.cloudClient.ExecClusterInstallationCLI(clusterInstallationID, "mmctl", []string{"import", "process", importFile, "--local", "--format", "json"})
+	if err != nil {
+		return errors.Wrap(err, "failed to start import job")
+	}
+	job, err := parseMmctlJob(output)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(importJobTimeout)
+	for {
+		switch job.Status {
+		case model.JobStatusSuccess, model.JobStatusWarning:
+			return nil
+		case model.JobStatusError, model.JobStatusCanceled:
+			if job.Data["error"] != "" {
+				return errors.Errorf("import job %s: %s", job.Status, job.Data["error"])
+			}
+			return errors.Errorf("import job %s", job.Status)
+		}
+		if time.Now().After(deadline) {
+			return errors.Errorf("import job %s still %s after %s", job.Id, job.Status, importJobTimeout)
+		}
+
+		select {
+		case <-stop:
+			return errImportInterrupted
+		case <-time.After(importJobPollInterval):
+		}
+
+		output, err = p.cloudClient.ExecClusterInstallationCLI(clusterInstallationID, "mmctl", []string{"import", "job", "show", job.Id, "--local", "--format", "json"})
+		if err != nil {
+			return errors.Wrap(err, "failed to get import job")
+		}
+		job, err = parseMmctlJob(output)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// createImportAccount creates the temporary admin account uploading an import
+// file and returns its credentials. mmctl only takes passwords as arguments,
+// which end up in the exec logs of the provisioner, so the account is created
+// without any role and its password is changed through the API before it is
+// made an admin. The username is returned if the account may have been
+// created, even on failure, so it can be deleted.
+func (p *Plugin) createImportAccount(install *Installation, clusterInstallationID string) (string, string, error) {
+	username := importUsernamePrefix + cloud.NewID()[:8]
+	initialPassword := generateRandomPassword(username)
+	_, err := p.cloudClient.ExecClusterInstallationCLI(clusterInstallationID, "mmctl", []string{"user", "create", "--username", username, "--email", username + "@example.com", "--password", initialPassword, "--local"})
+	if err != nil {
+		return username, "", errors.Wrap(err, "failed to create temporary import account")
+	}
+
+	client := model.NewAPIv4Client(fmt.Sprintf("https://%s", install.DNSRecords[0].DomainName))
+	user, _, err := client.Login(username, initialPassword)
+	if err != nil {
+		return username, "", errors.Wrap(err, "failed to log in with the temporary import account")
+	}
+	password := generateRandomPassword(username)
+	_, err = client.UpdateUserPassword(user.Id, initialPassword, password)
+	client.Logout()
+	if err != nil {
+		return username, "", errors.Wrap(err, "failed to change the password of the temporary import account")
+	}
+
+	_, err = p.cloudClient.ExecClusterInstallationCLI(clusterInstallationID, "mmctl", []string{"roles", "system_admin", username, "--local"})
+	if err != nil {
+		return username, "", errors.Wrap(err, "failed to make the temporary import account an admin")
+	}
+
+	return username, password, nil
+}
+
+// deleteImportAccount permanently deletes the temporary import account, so no
+// admin account is left behind.
+func (p *Plugin) deleteImportAccount(install *Installation, clusterInstallationID, username string) {
+	_, err := p.cloudClient.ExecClusterInstallationCLI(clusterInstallationID, "mmctl", []string{"user", "delete", username, "--confirm", "--local"})
+	if err != nil {
+		p.API.LogWarn(errors.Wrap(err, "failed to delete temporary import account").Error(), "installation", install.ID, "username", username)
+	}
+}
+
+// openImportFile returns a reader of an import file. The file is streamed
+// from its public link when public links are enabled, otherwise it's read
+// into memory, which importMaxFileSize bounds.
+func (p *Plugin) openImportFile(fileInfo *model.FileInfo) (io.ReadCloser, error) {
+	link, appErr := p.API.GetFileLink(fileInfo.Id)
+	if appErr == nil {
+		resp, err := importHTTPClient.Get(link)
+		if err == nil && resp.StatusCode == http.StatusOK {
+			return resp.Body, nil
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+
+	data, appErr := p.API.GetFile(fileInfo.Id)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get import file")
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// zipImportFile wraps a JSONL import file in a ZIP archive, which is the
+// format processed by import jobs. The archive is written to a temporary file
+// as the size of an upload must be known before it starts. The caller must
+// close and remove the file.
+func zipImportFile(filename string, data io.Reader) (*os.File, error) {
+	file, err := os.CreateTemp("", "cloud-import-*.zip")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create import archive")
+	}
+
+	err = writeImportArchive(file, filename, data)
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, errors.Wrap(err, "failed to write import archive")
+	}
+
+	return file, nil
+}
+
+func writeImportArchive(w io.Writer, filename string, data io.Reader) error {
+	archive := zip.NewWriter(w)
+	f, err := archive.Create(filename)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, data)
+	if err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+// parseMmctlJob parses a job printed by mmctl in JSON format. mmctl may print
+// other lines, such as deprecation warnings, before the job.
+func parseMmctlJob(output []byte) (*model.Job, error) {
+	start := bytes.IndexByte(output, '{')
+	if start == -1 {
+		return nil, errors.Errorf("unexpected mmctl output: %s", strings.TrimSpace(string(output)))
+	}
+
+	var job model.Job
+	err := json.NewDecoder(bytes.NewReader(output[start:])).Decode(&job)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse mmctl job")
+	}
+	if job.Id == "" {
+		return nil, errors.Errorf("unexpected mmctl output: %s", strings.TrimSpace(string(output)))
+	}
+
+	return &job, nil
+}
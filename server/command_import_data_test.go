@@ -0,0 +1,191 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMmctlJob(t *testing.T) {
+	job, err := parseMmctlJob([]byte("Flag --json has been deprecated\n{\"id\": \"jobid\", \"status\": \"pending\"}\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "jobid", job.Id)
+	assert.Equal(t, model.JobStatusPending, job.Status)
+
+	_, err = parseMmctlJob([]byte("Error: import file not found"))
+	assert.EqualError(t, err, "unexpected mmctl output: Error: import file not found")
+
+	_, err = parseMmctlJob([]byte("{}"))
+	assert.Error(t, err)
+}
+
+func TestZipImportFile(t *testing.T) {
+	file, err := zipImportFile("import.jsonl", strings.NewReader(`{"type": "version", "version": 1}`))
+	require.NoError(t, err)
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	require.NoError(t, err)
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	require.Len(t, archive.File, 1)
+	assert.Equal(t, "import.jsonl", archive.File[0].Name)
+
+	f, err := archive.File[0].Open()
+	require.NoError(t, err)
+	content, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, `{"type": "version", "version": 1}`, string(content))
+}
+
+func TestFindImportAttachment(t *testing.T) {
+	api := &plugintest.API{}
+	api.On("GetPostsForChannel", "channelid", 0, importAttachmentPostsSearched).Return(&model.PostList{
+		Order: []string{"post3", "post2", "post1"},
+		Posts: map[string]*model.Post{
+			"post3": {Id: "post3", UserId: "gabeid", FileIds: []string{"gabesfile"}},
+			"post2": {Id: "post2", UserId: "joramid", FileIds: []string{"image", "import"}},
+			"post1": {Id: "post1", UserId: "joramid", FileIds: []string{"olderimport"}},
+		},
+	}, nil)
+	api.On("GetFileInfo", "image").Return(&model.FileInfo{Id: "image", Name: "screenshot.png"}, nil)
+	api.On("GetFileInfo", "import").Return(&model.FileInfo{Id: "import", Name: "data.JSONL"}, nil)
+
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+
+	fileInfo, err := plugin.findImportAttachment("channelid", "joramid")
+	require.NoError(t, err)
+	require.NotNil(t, fileInfo)
+	assert.Equal(t, "import", fileInfo.Id)
+
+	fileInfo, err = plugin.findImportAttachment("channelid", "otherid")
+	require.NoError(t, err)
+	assert.Nil(t, fileInfo)
+}
+
+func TestImportData(t *testing.T) {
+	mm, server := newMockedMattermostTLSServer(t)
+
+	content := `{"type": "version", "version": 1}`
+	fileServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(content))
+	}))
+	defer fileServer.Close()
+
+	api := &plugintest.API{}
+	newMockedKVStore(api)
+	api.On("GetFile", "fileid").Return([]byte(content), nil)
+	api.On("LogWarn", mock.AnythingOfType("string"), mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+
+	mockedCloudClient := &MockClient{mockedCloudClusterInstallations: []*cloud.ClusterInstallation{{ID: "ciid"}}}
+	plugin := &Plugin{cloudClient: mockedCloudClient}
+	plugin.SetAPI(api)
+
+	install := &Installation{
+		Name: "joramsinstall",
+		InstallationDTO: cloud.InstallationDTO{
+			Installation: &cloud.Installation{ID: "someid"},
+			DNSRecords:   []*cloud.InstallationDNS{{DomainName: strings.TrimPrefix(server.URL, "https://")}},
+		},
+	}
+	fileInfo := &model.FileInfo{Id: "fileid", Name: "data.jsonl", Size: int64(len(content))}
+
+	t.Run("success", func(t *testing.T) {
+		api.On("GetFileLink", "fileid").Return(fileServer.URL+"/files/fileid/public", nil).Once()
+		mockedCloudClient.execOutput = []byte(`{"id": "jobid", "status": "success"}`)
+		mockedCloudClient.execSubcommands = nil
+		err := plugin.importData(install, fileInfo, nil)
+		require.NoError(t, err)
+		assert.Equal(t, 1, mm.countRequests("POST /api/v4/uploads"))
+		assert.Equal(t, 1, mm.countRequests("POST /api/v4/uploads/uploadid"))
+
+		require.Len(t, mockedCloudClient.execSubcommands, 4)
+		create := mockedCloudClient.execSubcommands[0]
+		require.Equal(t, []string{"user", "create", "--username"}, create[:3])
+		username := create[3]
+		assert.True(t, strings.HasPrefix(username, importUsernamePrefix))
+		assert.NotContains(t, create, "--system-admin", "the account is only made an admin once the password from the exec logs no longer works")
+		assert.Contains(t, create, "--local")
+		assert.Equal(t, 1, mm.countRequests("PUT /api/v4/users/adminid/password"))
+		assert.Equal(t, []string{"roles", "system_admin", username, "--local"}, mockedCloudClient.execSubcommands[1])
+		assert.Equal(t, []string{"import", "process", "uploadid_data.zip", "--local", "--format", "json"}, mockedCloudClient.execSubcommands[2])
+		assert.Equal(t, []string{"user", "delete", username, "--confirm", "--local"}, mockedCloudClient.execSubcommands[3], "the temporary account is deleted")
+		api.AssertNotCalled(t, "GetFile", "fileid")
+	})
+
+	t.Run("public links disabled", func(t *testing.T) {
+		api.On("GetFileLink", "fileid").Return("", &model.AppError{Message: "public links are disabled"}).Once()
+		mockedCloudClient.execOutput = []byte(`{"id": "jobid", "status": "success"}`)
+		err := plugin.importData(install, fileInfo, nil)
+		require.NoError(t, err)
+		api.AssertCalled(t, "GetFile", "fileid")
+	})
+
+	t.Run("job error", func(t *testing.T) {
+		api.On("GetFileLink", "fileid").Return(fileServer.URL+"/files/fileid/public", nil).Once()
+		mockedCloudClient.execOutput = []byte(`{"id": "jobid", "status": "error", "data": {"error": "invalid line 2"}}`)
+		mockedCloudClient.execSubcommands = nil
+		err := plugin.importData(install, fileInfo, nil)
+		require.EqualError(t, err, "import job error: invalid line 2")
+		assert.Equal(t, "delete", mockedCloudClient.execSubcommand[1], "the temporary account is deleted after failures")
+	})
+
+	t.Run("interrupted", func(t *testing.T) {
+		defer func(interval time.Duration) { importJobPollInterval = interval }(importJobPollInterval)
+		importJobPollInterval = time.Hour
+
+		api.On("GetFileLink", "fileid").Return(fileServer.URL+"/files/fileid/public", nil).Once()
+		mockedCloudClient.execOutput = []byte(`{"id": "jobid", "status": "pending"}`)
+		stop := make(chan struct{})
+		close(stop)
+		err := plugin.importData(install, fileInfo, stop)
+		require.Equal(t, errImportInterrupted, err)
+		assert.Equal(t, "delete", mockedCloudClient.execSubcommand[1], "the temporary account is deleted when interrupted")
+	})
+
+	t.Run("command", func(t *testing.T) {
+		api.On("HasPermissionTo", mock.AnythingOfType("string"), model.PermissionManageSystem).Return(false)
+		api.On("GetPostsForChannel", "channelid", 0, importAttachmentPostsSearched).Return(&model.PostList{}, nil)
+		plugin.configuration = &configuration{}
+		extra := &model.CommandArgs{UserId: "joramid", ChannelId: "channelid"}
+
+		_, isUserError, err := plugin.runImportDataCommand([]string{"joramsinstall"}, extra)
+		require.EqualError(t, err, "no installation with the name joramsinstall found")
+		assert.True(t, isUserError)
+
+		require.NoError(t, plugin.storeInstallation(&Installation{
+			Name:            "joramsinstall",
+			InstallationDTO: cloud.InstallationDTO{Installation: &cloud.Installation{ID: "someid", OwnerID: "joramid"}, DNSRecords: install.DNSRecords},
+		}))
+
+		_, isUserError, err = plugin.runImportDataCommand([]string{"joramsinstall"}, extra)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "no bulk import file found")
+		assert.True(t, isUserError)
+
+		api.On("GetPostsForChannel", "largechannelid", 0, importAttachmentPostsSearched).Return(&model.PostList{
+			Order: []string{"post"},
+			Posts: map[string]*model.Post{"post": {Id: "post", UserId: "joramid", FileIds: []string{"largefile"}}},
+		}, nil)
+		api.On("GetFileInfo", "largefile").Return(&model.FileInfo{Id: "largefile", Name: "large.zip", Size: importMaxFileSize + 1}, nil)
+		extra.ChannelId = "largechannelid"
+		_, isUserError, err = plugin.runImportDataCommand([]string{"joramsinstall"}, extra)
+		require.EqualError(t, err, "import file large.zip is larger than the limit of 1024 MB")
+		assert.True(t, isUserError)
+	})
+}
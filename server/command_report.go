@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+	flag "github.com/spf13/pflag"
+)
+
+type usageReportConfig struct {
+	By    string
+	Month time.Time
+}
+
+func getUsageReportFlagSet() *flag.FlagSet {
+	flagSet := flag.NewFlagSet("report usage", flag.ContinueOnError)
+	flagSet.String("by", "user", "Groups usage by 'user' or 'team'")
+	flagSet.String("month", "", "The month to report in the YYYY-MM format (default the current month)")
+
+	return flagSet
+}
+
+func parseUsageReportFlagSet(args []string, now time.Time) (*usageReportConfig, error) {
+	flagSet := getUsageReportFlagSet()
+	err := flagSet.Parse(args)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse flags")
+	}
+
+	config := &usageReportConfig{}
+	config.By, err = flagSet.GetString("by")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get by value")
+	}
+	if config.By != "user" && config.By != "team" {
+		return nil, errors.Errorf("invalid --by value %s, valid options are user and team", config.By)
+	}
+
+	month, err := flagSet.GetString("month")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get month value")
+	}
+	if month == "" {
+		config.Month = time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	} else {
+		config.Month, err = time.Parse("2006-01", month)
+		if err != nil {
+			return nil, errors.Errorf("invalid --month value %s, expected a month such as 2026-09", month)
+		}
+	}
+	if config.Month.After(now) {
+		return nil, errors.Errorf("no usage has been recorded for %s yet", config.Month.Format("2006-01"))
+	}
+
+	return config, nil
+}
+
+func (p *Plugin) runReportCommand(args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+	if !p.authorizedPluginAdmin(extra.UserId) {
+		return nil, true, errors.New("reports are restricted to system administrators")
+	}
+
+	if len(args) == 0 || args[0] != "usage" {
+		return nil, true, errors.New("must provide a report type; the available report is usage")
+	}
+
+	now := time.Now().UTC()
+	config, err := parseUsageReportFlagSet(args[1:], now)
+	if err != nil {
+		return nil, true, err
+	}
+
+	report, err := p.buildUsageReport(config.Month, config.By, now)
+	if err != nil {
+		return nil, false, err
+	}
+
+	month := config.Month.Format("2006-01")
+	if len(report.Usages) == 0 {
+		return getCommandResponse(model.CommandResponseTypeEphemeral, fmt.Sprintf("No installation usage was recorded for %s.", month), extra), false, nil
+	}
+
+	data, err := report.CSV(p)
+	if err != nil {
+		return nil, false, err
+	}
+	err = p.postUsageReportCSV(extra.UserId, fmt.Sprintf("usage-%s-by-%s.csv", month, config.By), data)
+	if err != nil {
+		return nil, false, err
+	}
+
+	message := fmt.Sprintf("Installation usage for %s by %s. The hours of each installation in each state have been sent to you as a CSV file.\n\n%s", month, config.By, report.Table())
+
+	return getCommandResponse(model.CommandResponseTypeEphemeral, message, extra), false, nil
+}
+
+// postUsageReportCSV sends a usage report CSV file to the user as a bot DM.
+func (p *Plugin) postUsageReportCSV(userID, filename string, data []byte) error {
+	channel, appErr := p.API.GetDirectChannel(userID, p.BotUserID)
+	if appErr != nil {
+		return errors.Wrap(appErr, "failed to get direct channel")
+	}
+
+	fileInfo, appErr := p.API.UploadFile(data, channel.Id, filename)
+	if appErr != nil {
+		return errors.Wrap(appErr, "failed to upload usage report")
+	}
+
+	_, appErr = p.API.CreatePost(&model.Post{
+		UserId:    p.BotUserID,
+		ChannelId: channel.Id,
+		Message:   fmt.Sprintf("Here is the usage report %s.", filename),
+		FileIds:   []string{fileInfo.Id},
+	})
+	if appErr != nil {
+		return errors.Wrap(appErr, "failed to post usage report")
+	}
+
+	return nil
+}
@@ -60,6 +60,7 @@ func (p *Plugin) runRestartCommand(args []string, extra *model.CommandArgs) (*mo
 	if err != nil {
 		return nil, false, err
 	}
+	p.recordPluginEvent(installToRestart.ID, extra.UserId, "restart", "")
 
 	return getCommandResponse(model.CommandResponseTypeEphemeral, fmt.Sprintf("Installation %s restarting now.", name), extra), false, nil
 }
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+func (p *Plugin) runSetupRetryCommand(args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+	if len(args) == 0 || len(args[0]) == 0 {
+		return nil, true, errors.Errorf("must provide an installation name")
+	}
+
+	name := standardizeName(args[0])
+
+	installs, err := p.getInstallationsForUser(extra.UserId)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var installToRetry *Installation
+	for _, install := range installs {
+		if install.Name == name {
+			installToRetry = install
+			break
+		}
+	}
+	if installToRetry == nil {
+		return nil, true, errors.Errorf("no installation with the name %s found", name)
+	}
+
+	step, isUserError, err := p.resumeInstallationSetup(installToRetry, extra.UserId)
+	if err != nil {
+		return nil, isUserError, err
+	}
+
+	return getCommandResponse(model.CommandResponseTypeEphemeral, fmt.Sprintf("Resuming the setup of installation %s from step `%s`. You will receive a DM when it is done.", name, step), extra), false, nil
+}
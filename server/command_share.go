@@ -70,6 +70,8 @@ func (p *Plugin) runShareInstallationCommand(args []string, extra *model.Command
 		return getCommandResponse(model.CommandResponseTypeEphemeral, err.Error(), extra), false, err
 	}
 
+	p.recordPluginEvent(installationToShare.ID, extra.UserId, "share", fmt.Sprintf("allow updates: %t", config.AllowUpdates))
+
 	sharedUpdateText := "Other plugin users are not permitted to update this installation."
 	if config.AllowUpdates {
 		sharedUpdateText = "Other plugin users will be allowed to update this installation."
@@ -106,6 +108,7 @@ func (p *Plugin) runUnshareInstallationCommand(args []string, extra *model.Comma
 	if err != nil {
 		return getCommandResponse(model.CommandResponseTypeEphemeral, err.Error(), extra), false, err
 	}
+	p.recordPluginEvent(installationToShare.ID, extra.UserId, "unshare", "")
 
 	return getCommandResponse(model.CommandResponseTypeEphemeral, "Installation has been unshared.", extra), false, nil
 }
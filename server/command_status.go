@@ -39,7 +39,7 @@ func parseStatusArgs(args []string) (bool, error) {
 }
 
 // The status command is primarily intended to help the team administrating the
-// cloud infrastructure, so we don't publish the command in the help info.
+// cloud infrastructure, so it is one of the admin commands.
 func (p *Plugin) runStatusCommand(args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
 	includeClusters, err := parseStatusArgs(args)
 	if err != nil {
@@ -18,6 +18,7 @@ type MockClient struct {
 	mockedCloudClusterInstallations []*cloud.ClusterInstallation
 
 	overrideGetInstallationDTO *cloud.InstallationDTO
+	returnNilInstallation      bool
 	returnNilDNSInstalation    bool
 	returnDNSErrorOverride     error
 
@@ -25,12 +26,31 @@ type MockClient struct {
 	creationRequest *cloud.CreateInstallationRequest
 	// Stores latest PatchInstallationRequest passed to mock
 	patchRequest *cloud.PatchInstallationRequest
+	// Stores latest installation ID passed to RetryCreateInstallation
+	retriedInstallationID string
+	// Stores latest installation ID passed to DeleteInstallation
+	deletedInstallationID string
+	// Stores latest installation ID passed to UnlockDeletionLockForInstallation
+	unlockedInstallationID string
+	// Stores latest subcommand passed to ExecClusterInstallationCLI
+	execSubcommand []string
+	// Stores all subcommands passed to ExecClusterInstallationCLI
+	execSubcommands [][]string
+	execOutput      []byte
+	execErr         error
+	// Blocks ExecClusterInstallationCLI until closed, if set
+	execBlock chan struct{}
 
 	err error
 }
 
 func (mc *MockClient) ExecClusterInstallationCLI(clusterInstallationID, command string, subcommand []string) ([]byte, error) {
-	return []byte{}, nil
+	mc.execSubcommand = subcommand
+	mc.execSubcommands = append(mc.execSubcommands, subcommand)
+	if mc.execBlock != nil {
+		<-mc.execBlock
+	}
+	return mc.execOutput, mc.execErr
 }
 
 func (mc *MockClient) GetClusters(request *cloud.GetClustersRequest) ([]*cloud.ClusterDTO, error) {
@@ -39,10 +59,18 @@ func (mc *MockClient) GetClusters(request *cloud.GetClustersRequest) ([]*cloud.C
 
 func (mc *MockClient) CreateInstallation(request *cloud.CreateInstallationRequest) (*cloud.InstallationDTO, error) {
 	mc.creationRequest = request
-	return &cloud.InstallationDTO{Installation: &cloud.Installation{ID: "someid"}}, nil
+	return &cloud.InstallationDTO{Installation: &cloud.Installation{ID: "someid", OwnerID: request.OwnerID}}, nil
+}
+
+func (mc *MockClient) RetryCreateInstallation(installationID string) error {
+	mc.retriedInstallationID = installationID
+	return mc.err
 }
 
 func (mc *MockClient) GetInstallation(installataionID string, request *cloud.GetInstallationRequest) (*cloud.InstallationDTO, error) {
+	if mc.returnNilInstallation {
+		return nil, nil
+	}
 	if mc.overrideGetInstallationDTO != nil {
 		return mc.overrideGetInstallationDTO, nil
 	}
@@ -86,10 +114,12 @@ func (mc *MockClient) LockDeletionLockForInstallation(installationID string) err
 }
 
 func (mc *MockClient) UnlockDeletionLockForInstallation(installationID string) error {
+	mc.unlockedInstallationID = installationID
 	return nil
 }
 
 func (mc *MockClient) DeleteInstallation(installationID string) error {
+	mc.deletedInstallationID = installationID
 	return nil
 }
 
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+	flag "github.com/spf13/pflag"
+)
+
+func getTokenFlagSet() *flag.FlagSet {
+	flagSet := flag.NewFlagSet("token", flag.ContinueOnError)
+	flagSet.String("name", "", "Name of the token")
+	flagSet.StringSlice("scopes", []string{}, fmt.Sprintf("Comma-separated scopes of the token: %s", strings.Join(apiTokenScopes, ", ")))
+
+	return flagSet
+}
+
+// runTokenCommand manages the API tokens of the user.
+func (p *Plugin) runTokenCommand(args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+	if len(args) == 0 {
+		return nil, true, errors.New("must provide a token action, must be create, list or revoke")
+	}
+
+	switch args[0] {
+	case "create":
+		flagSet := getTokenFlagSet()
+		err := flagSet.Parse(args[1:])
+		if err != nil {
+			return nil, true, errors.Wrap(err, "failed to parse flags")
+		}
+		name, _ := flagSet.GetString("name")
+		if name == "" {
+			return nil, true, errors.New("must provide a token name with --name")
+		}
+		rawScopes, _ := flagSet.GetStringSlice("scopes")
+		scopes, err := parseAPITokenScopes(rawScopes)
+		if err != nil {
+			return nil, true, err
+		}
+
+		tokens, err := p.getAPITokensForUser(extra.UserId)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, token := range tokens {
+			if token.Name == name {
+				return nil, true, errors.Errorf("you already have a token named %s", name)
+			}
+		}
+
+		token, secret, err := p.createAPIToken(extra.UserId, name, scopes)
+		if err != nil {
+			return nil, false, err
+		}
+		p.API.LogInfo("API token created", "token", token.ID, "user", extra.UserId, "scopes", strings.Join(scopes, ","))
+
+		resp := fmt.Sprintf("Token %s created with the scopes %s. Copy it now, it won't be shown again:\n", inlineCode(token.Name), strings.Join(scopes, ", "))
+		resp += codeBlock(secret)
+		resp += fmt.Sprintf("\nSend it in the %s header of requests to the plugin REST API. They act on your behalf.", inlineCode(apiTokenHeaderKey))
+
+		return getCommandResponse(model.CommandResponseTypeEphemeral, resp, extra), false, nil
+	case "list":
+		tokens, err := p.getAPITokensForUser(extra.UserId)
+		if err != nil {
+			return nil, false, err
+		}
+		if len(tokens) == 0 {
+			return getCommandResponse(model.CommandResponseTypeEphemeral, "You don't have any API tokens. Use `/cloud token create` to create one.", extra), false, nil
+		}
+
+		resp := "| Name | ID | Scopes | Created |\n| -- | -- | -- | -- |\n"
+		for _, token := range tokens {
+			resp += fmt.Sprintf("| %s | %s | %s | %s |\n", token.Name, inlineCode(token.ID), strings.Join(token.Scopes, ", "), getTimeFromMillis(token.CreateAt).Format("Jan-02-2006"))
+		}
+
+		return getCommandResponse(model.CommandResponseTypeEphemeral, resp, extra), false, nil
+	case "revoke":
+		if len(args) < 2 || len(args[1]) == 0 {
+			return nil, true, errors.New("must provide a token name or ID")
+		}
+
+		token, err := p.revokeAPIToken(extra.UserId, args[1])
+		if err != nil {
+			return nil, false, err
+		}
+		if token == nil {
+			return nil, true, errors.Errorf("no token with the name or ID %s found", args[1])
+		}
+		p.API.LogInfo("API token revoked", "token", token.ID, "user", extra.UserId)
+
+		return getCommandResponse(model.CommandResponseTypeEphemeral, fmt.Sprintf("Token %s revoked.", inlineCode(token.Name)), extra), false, nil
+	}
+
+	return nil, true, errors.Errorf("invalid token action %s, must be create, list or revoke", args[0])
+}
@@ -10,12 +10,14 @@ import (
 	flag "github.com/spf13/pflag"
 )
 
-func getUpdateFlagSet() *flag.FlagSet {
+func (p *Plugin) getUpdateFlagSet() *flag.FlagSet {
+	config := p.getConfiguration()
+
 	updateFlagSet := flag.NewFlagSet("update", flag.ContinueOnError)
-	updateFlagSet.String("version", "", "Mattermost version to run, e.g. '9.1.0'")
-	updateFlagSet.String("license", "", "The enterprise license to use. Can be 'enterprise', 'professional', 'e20', 'e10', or 'te'")
-	updateFlagSet.String("size", "", "Size of the Mattermost installation e.g. 'miniSingleton' or 'miniHA'")
-	updateFlagSet.String("image", "", fmt.Sprintf("Docker image repository, can be %s", strings.Join(dockerRepoWhitelist, ", ")))
+	updateFlagSet.String("version", "", fmt.Sprintf("Mattermost version to run, e.g. '9.1.0', or one of the aliases %s", versionAliasHelp))
+	updateFlagSet.String("license", "", config.licenseHelpText())
+	updateFlagSet.String("size", "", config.sizeHelpText())
+	updateFlagSet.String("image", "", config.imageHelpText())
 	updateFlagSet.StringSlice("env", []string{}, "Environment variables in form: ENV1=test,ENV2=test")
 	updateFlagSet.StringSlice("clear-env", []string{}, "List of custom environment variables to erase, for example: ENV1,ENV2")
 	updateFlagSet.Bool("shared-installation", false, "Set this to true when attempting to update a shared installation")
@@ -23,8 +25,9 @@ func getUpdateFlagSet() *flag.FlagSet {
 	return updateFlagSet
 }
 
-func buildPatchInstallationRequestFromArgs(args []string) (*cloud.PatchInstallationRequest, bool, error) {
-	updateFlagSet := getUpdateFlagSet()
+func (p *Plugin) buildPatchInstallationRequestFromArgs(args []string) (*cloud.PatchInstallationRequest, bool, error) {
+	config := p.getConfiguration()
+	updateFlagSet := p.getUpdateFlagSet()
 	err := updateFlagSet.Parse(args)
 	if err != nil {
 		return nil, false, err
@@ -42,7 +45,7 @@ func buildPatchInstallationRequestFromArgs(args []string) (*cloud.PatchInstallat
 	if err != nil {
 		return nil, false, err
 	}
-	if size != "" && !Contains(validInstallationSizes, size) {
+	if size != "" && !config.validSize(size) {
 		return nil, false, fmt.Errorf("Invalid size: %s", size)
 	}
 
@@ -61,11 +64,11 @@ func buildPatchInstallationRequestFromArgs(args []string) (*cloud.PatchInstallat
 	if version == "" && license == "" && size == "" && image == "" && len(envVars) == 0 && len(envClear) == 0 {
 		return nil, false, errors.New("must specify at least one option: version, license, image, size, env, clear-env")
 	}
-	if license != "" && !validLicenseOption(license) {
-		return nil, false, errors.Errorf("invalid license option %s, valid options are %s", license, strings.Join(validLicenseOptions, ", "))
+	if license != "" && !config.validLicense(license) {
+		return nil, false, errors.Errorf("invalid license option %s, valid options are %s", license, strings.Join(config.licenseNames(), ", "))
 	}
-	if image != "" && !validImageName(image) {
-		return nil, false, errors.Errorf("invalid image name %s, valid options are %s", image, strings.Join(dockerRepoWhitelist, ", "))
+	if image != "" && !config.validImage(image) {
+		return nil, false, errors.Errorf("invalid image name %s, valid options are %s", image, strings.Join(config.imageRepositories(), ", "))
 	}
 
 	envVarMap, err := parseEnvVarInput(envVars, envClear)
@@ -107,10 +110,16 @@ func (p *Plugin) runUpdateCommand(args []string, extra *model.CommandArgs) (*mod
 
 	name := standardizeName(args[0])
 
-	request, shared, err := buildPatchInstallationRequestFromArgs(args)
+	request, shared, err := p.buildPatchInstallationRequestFromArgs(args)
 	if err != nil {
 		return nil, true, err
 	}
+	if request.Size != nil {
+		err = p.checkInstallationPermissions(extra.UserId, *request.Size, "")
+		if err != nil {
+			return nil, true, err
+		}
+	}
 	var installToUpdate *Installation
 
 	installs, err := p.getUpdatableInstallationsForUser(extra.UserId, shared)
@@ -130,6 +139,15 @@ func (p *Plugin) runUpdateCommand(args []string, extra *model.CommandArgs) (*mod
 		return nil, true, errors.Errorf("no installation with the name %s found", name)
 	}
 
+	if request.Version != nil {
+		var version string
+		version, err = p.resolveVersionAlias(*request.Version)
+		if err != nil {
+			return nil, true, err
+		}
+		request.Version = &version
+	}
+
 	if request.Version != nil || request.Image != nil {
 		dockerTag := installToUpdate.Version
 		dockerRepository := installToUpdate.Image
@@ -169,10 +187,16 @@ func (p *Plugin) runUpdateCommand(args []string, extra *model.CommandArgs) (*mod
 		return nil, false, errors.Wrap(err, "failed to update installation")
 	}
 
+	if request.Size != nil && *request.Size != installToUpdate.Size {
+		p.recordSizeChange(installToUpdate.ID, installToUpdate.Size, *request.Size)
+		installToUpdate.Size = *request.Size
+	}
+
 	err = p.updateInstallation(installToUpdate)
 	if err != nil {
 		return nil, false, errors.Wrap(err, "failed to store updated installation metadata")
 	}
+	p.recordPluginEvent(installToUpdate.ID, extra.UserId, "update", eventArgs(args[1:]))
 
 	if shared {
 		// Send a message to the installation owner to let them know an update
@@ -17,12 +17,16 @@ func TestUpdateCommand(t *testing.T) {
 	dockerClient := &MockedDockerClient{tagExists: true}
 	mockCloudClient := &MockClient{}
 	plugin := Plugin{
-		cloudClient:  mockCloudClient,
-		dockerClient: dockerClient,
+		cloudClient:   mockCloudClient,
+		dockerClient:  dockerClient,
+		releaseSource: &mockedReleaseSource{releases: testReleases},
 	}
 
 	api := &plugintest.API{}
+	api.On("KVGet", StoreReleasesKey).Return(nil, nil)
+	api.On("KVSet", StoreReleasesKey, mock.Anything).Return(nil)
 	api.On("KVCompareAndSet", mock.AnythingOfType("string"), mock.Anything, mock.Anything).Return(true, nil)
+	api.On("LogWarn", mock.AnythingOfType("string"), "installation", "someid").Return()
 	plugin.SetAPI(api)
 
 	t.Run("update installation successfully", func(t *testing.T) {
@@ -81,6 +85,17 @@ func TestUpdateCommand(t *testing.T) {
 		assert.Contains(t, resp.Text, "Update of installation")
 	})
 
+	t.Run("version alias", func(t *testing.T) {
+		api.On("KVGet", mock.AnythingOfType("string")).Return([]byte("[{\"ID\": \"someid\", \"OwnerID\": \"gabeid\", \"Name\": \"gabesinstall\"}]"), nil)
+
+		resp, isUserError, err := plugin.runUpdateCommand([]string{"gabesinstall", "--version", "latest-patch:9.11"}, &model.CommandArgs{UserId: "gabeid"})
+		require.NoError(t, err)
+		assert.False(t, isUserError)
+		assert.Contains(t, resp.Text, "Update of installation")
+		require.NotNil(t, mockCloudClient.patchRequest)
+		assert.Equal(t, "9.11.9", *mockCloudClient.patchRequest.Version)
+	})
+
 	t.Run("size only", func(t *testing.T) {
 		api.On("KVGet", mock.AnythingOfType("string")).Return([]byte("[{\"ID\": \"someid\", \"OwnerID\": \"gabeid\", \"Name\": \"gabesinstall\"}]"), nil)
 
@@ -40,6 +40,7 @@ func (p *Plugin) runWakeUpCommand(args []string, extra *model.CommandArgs) (*mod
 	if err != nil {
 		return nil, false, err
 	}
+	p.recordPluginEvent(installToWakeUp.ID, extra.UserId, "wake-up", "")
 
 	return getCommandResponse(model.CommandResponseTypeEphemeral, fmt.Sprintf("Installation %s is waking up. You will receive a notification when it is updated. Use /cloud list to check on the status of your installations.", name), extra), false, nil
 }
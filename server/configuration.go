@@ -3,11 +3,16 @@ package main
 import (
 	"net/url"
 	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
 	cloud "github.com/mattermost/mattermost-cloud/model"
 	"github.com/pkg/errors"
 )
 
+// The license and image names below make up the default catalogs used when
+// no catalog is configured.
 const (
 	licenseOptionEnterprise   = "enterprise"
 	licenseOptionProfessional = "professional"
@@ -23,39 +28,8 @@ const (
 	imageTETest      = "mattermostdevelopment/mm-te-test"
 	imageEEDev       = "mattermostdevelopment/mattermost-enterprise-edition"
 	imageTEDev       = "mattermostdevelopment/mattermost-team-edition"
-
-	defaultImage = "mattermost/mattermost-enterprise-edition"
 )
 
-var validLicenseOptions = []string{
-	licenseOptionEnterprise,
-	licenseOptionProfessional,
-	licenseOptionE20,
-	licenseOptionE10,
-	licenseOptionTE,
-}
-
-// dockerRepoWhitelist is the full list of valid docker repositories which
-// Mattermost servers can be created from.
-var dockerRepoWhitelist = []string{
-	imageEE,
-	imageEECloud,
-	imageTE,
-	imageTeamEdition,
-	imageEETest,
-	imageTETest,
-	imageEEDev,
-	imageTEDev,
-}
-
-// dockerRepoTestImages are repositories that contain artifacts used primarily
-// for internal testing. They may require configuration overrides such as
-// special licenses.
-var dockerRepoTestImages = []string{
-	imageEETest,
-	imageEEDev,
-}
-
 // configuration captures the plugin's external configuration as exposed in the Mattermost server
 // configuration, as well as values computed from the configuration. Any public fields will be
 // deserialized from the Mattermost server configuration in OnConfigurationChange.
@@ -68,22 +42,52 @@ var dockerRepoTestImages = []string{
 // If you add non-reference types to your configuration struct, be sure to rewrite Clone as a deep
 // copy appropriate for your types.
 type configuration struct {
-	ProvisioningServerURL                     string
-	ProvisioningServerAuthToken               string
-	ProvisioningServerClientID                string
-	ProvisioningServerClientSecret            string
-	ProvisioningServerTokenEndpoint           string
-	InstallationDNS                           string
-	AllowedEmailDomain                        string
+	ProvisioningServerURL           string
+	ProvisioningServerAuthToken     string
+	ProvisioningServerClientID      string
+	ProvisioningServerClientSecret  string
+	ProvisioningServerTokenEndpoint string
+	InstallationDNS                 string
+	AllowedEmailDomain              string
+	// PluginAdminUsers lists the usernames allowed to use the admin commands
+	// in addition to system administrators.
+	PluginAdminUsers string
+	// RoleAssignments is a JSON list granting roles to users by email
+	// domain, team, group or username.
+	RoleAssignments                           string
 	DeletionLockInstallationsAllowedPerPerson string
 	ProvisioningServerWebhookSecret           string
+	// RequireSignedWebhooks rejects webhooks which are not signed with one
+	// of the webhook secrets.
+	RequireSignedWebhooks bool
 
 	// License
+	// Note: the individual license settings are only used when the license
+	// catalog is empty.
 	E10License          string
 	E20License          string
 	EnterpriseLicense   string
 	ProfessionalLicense string
 
+	// Catalogs
+	// JSON lists of the images, sizes and licenses installations can be
+	// created with. Built-in defaults are used when a catalog is empty.
+	ImageCatalog      string
+	InstallationSizes string
+	LicenseCatalog    string
+
+	// SetupProfiles is a JSON list of the setup profiles users can apply to
+	// new installations, in addition to the profiles they save themselves.
+	SetupProfiles string
+
+	// CredentialEncryptionKey is used to derive the key encrypting the
+	// credentials of the accounts created during installation setup.
+	CredentialEncryptionKey string
+
+	// MetricsToken is the bearer token required to scrape the metrics
+	// endpoint. Metrics aren't served when it is empty.
+	MetricsToken string
+
 	// Groups
 	GroupID string
 
@@ -98,17 +102,90 @@ type configuration struct {
 	InstallationWebhookAlertsEnable    bool
 	InstallationWebhookAlertsChannelID string
 
+	// StuckStateThresholds overrides how long installations may remain in
+	// each transitional state, as comma-separated state=minutes pairs.
+	StuckStateThresholds string
+
+	// UsageHourlyRates weights the hours reported by /cloud report usage, as
+	// comma-separated key=rate pairs.
+	UsageHourlyRates string
+
+	// ReachabilityFailureThreshold is how many consecutive pings a stable
+	// installation must fail before its owner is alerted. Zero disables
+	// reachability monitoring.
+	ReachabilityFailureThreshold string
+	// ReachabilityAlertsChannelID optionally receives unreachable
+	// installation alerts too.
+	ReachabilityAlertsChannelID string
+
+	// DigestDay is the day the weekly installation digest is sent on. The
+	// digest is disabled when empty.
+	DigestDay string
+	// DigestTime is the UTC time of day the weekly digest is sent at.
+	DigestTime string
+
 	DefaultDatabase  string
 	DefaultFilestore string
 
+	// Releases
+	// ReleasesURL is a GitHub-compatible releases API endpoint used to
+	// resolve version aliases such as "latest".
+	ReleasesURL string
+	// ESRVersions is a comma-separated list of extended support release
+	// minor versions, e.g. "9.5,9.11".
+	ESRVersions string
+	// ReleaseCacheTTLMinutes is how long fetched release metadata is used
+	// before it is refreshed.
+	ReleaseCacheTTLMinutes string
+
 	// EnableCommandAutocompletion determines if the slash command should support autocompletion
 	EnableCommandAutocompletion bool
+
+	// The parsed catalogs; consult getImages, getSizes and getLicenses.
+	images   []imageOption
+	sizes    []sizeOption
+	licenses []licenseOption
+	// The parsed role assignments; consult getRoleAssignments.
+	roleAssignments []*roleAssignment
 }
 
 func (c *configuration) ProvisioningServerAuthIsValid() bool {
 	return len(c.ProvisioningServerClientID) > 0 && len(c.ProvisioningServerClientSecret) > 0 && len(c.ProvisioningServerTokenEndpoint) > 0
 }
 
+// pluginAdminUsernames returns the usernames configured as plugin admins.
+func (c *configuration) pluginAdminUsernames() []string {
+	var usernames []string
+	for _, username := range strings.Split(c.PluginAdminUsers, ",") {
+		username = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(username), "@"))
+		if username != "" {
+			usernames = append(usernames, username)
+		}
+	}
+	return usernames
+}
+
+// esrVersions returns the configured extended support release minor versions.
+func (c *configuration) esrVersions() []string {
+	var versions []string
+	for _, version := range strings.Split(c.ESRVersions, ",") {
+		version = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(version), "v"))
+		if version != "" {
+			versions = append(versions, version)
+		}
+	}
+	return versions
+}
+
+// releaseCacheTTL returns how long release metadata is cached for.
+func (c *configuration) releaseCacheTTL() time.Duration {
+	minutes, err := strconv.Atoi(c.ReleaseCacheTTLMinutes)
+	if err != nil || minutes <= 0 {
+		return defaultReleaseCacheTTL
+	}
+	return time.Duration(minutes) * time.Minute
+}
+
 // ConfigResponse is a struct representing a sanitized configuration object, intended to be passed to the front-end for usage
 type ConfigResponse struct {
 	DeletionLockInstallationsAllowedPerPerson string
@@ -120,8 +197,9 @@ func (c *configuration) ToConfigResponse() *ConfigResponse {
 	}
 }
 
-// Clone shallow copies the configuration. Your implementation may require a deep copy if
-// your configuration has reference types.
+// Clone shallow copies the configuration. The parsed catalogs and role
+// assignments are never modified after being loaded, so they are safe to share
+// between copies.
 func (c *configuration) Clone() *configuration {
 	var clone = *c
 	return &clone
@@ -144,6 +222,58 @@ func (c *configuration) IsValid() error {
 		return errors.Errorf("group IDs are 26 characters long, the provided ID was %d", len(c.GroupID))
 	}
 
+	if len(c.ReleasesURL) != 0 {
+		if _, err := url.ParseRequestURI(c.ReleasesURL); err != nil {
+			return errors.Wrap(err, "invalid ReleasesURL")
+		}
+	}
+
+	if len(c.ReleaseCacheTTLMinutes) != 0 {
+		minutes, err := strconv.Atoi(c.ReleaseCacheTTLMinutes)
+		if err != nil || minutes <= 0 {
+			return errors.Errorf("ReleaseCacheTTLMinutes must be a positive number of minutes, got %q", c.ReleaseCacheTTLMinutes)
+		}
+	}
+
+	if _, err := parseStuckStateThresholds(c.StuckStateThresholds); err != nil {
+		return err
+	}
+
+	if _, err := parseUsageHourlyRates(c.UsageHourlyRates); err != nil {
+		return err
+	}
+
+	if c.ReachabilityFailureThreshold != "" {
+		threshold, err := strconv.Atoi(c.ReachabilityFailureThreshold)
+		if err != nil || threshold < 0 {
+			return errors.Errorf("ReachabilityFailureThreshold must be a number of zero or more, got %q", c.ReachabilityFailureThreshold)
+		}
+	}
+
+	if _, err := parseRoleAssignments(c.RoleAssignments); err != nil {
+		return err
+	}
+
+	if _, _, _, err := parseDigestSchedule(c.DigestDay, c.DigestTime); err != nil {
+		return err
+	}
+
+	if _, err := parseImageCatalog(c.ImageCatalog); err != nil {
+		return err
+	}
+
+	if _, err := parseSizeCatalog(c.InstallationSizes); err != nil {
+		return err
+	}
+
+	if _, err := parseLicenseCatalog(c.LicenseCatalog); err != nil {
+		return err
+	}
+
+	if _, err := parseSetupProfiles(c.SetupProfiles); err != nil {
+		return err
+	}
+
 	if c.ClusterWebhookAlertsEnable {
 		if len(c.ClusterWebhookAlertsChannelID) == 0 {
 			return errors.Errorf("must specify a cluster alerts channel ID when cluster alerts are enabled")
@@ -209,12 +339,29 @@ func (p *Plugin) OnConfigurationChange() error {
 		return errors.Wrap(err, "failed to load plugin configuration")
 	}
 
+	if err := configuration.loadCatalogs(); err != nil {
+		return errors.Wrap(err, "failed to load plugin catalogs")
+	}
+
+	if err := configuration.loadRoleAssignments(); err != nil {
+		return errors.Wrap(err, "failed to load role assignments")
+	}
+
 	if p.configuration != nil {
 		p.setCloudClient()
+		p.setReleaseSource(NewGithubReleaseSource(configuration.ReleasesURL))
 	}
 
 	p.setConfiguration(configuration)
 
+	// The command autocomplete data is built from the configuration, so
+	// register it again once the plugin is active.
+	if p.BotUserID != "" {
+		if err := p.API.RegisterCommand(p.getCommand()); err != nil {
+			return errors.Wrap(err, "failed to register command")
+		}
+	}
+
 	return nil
 }
 
@@ -222,31 +369,24 @@ func (p *Plugin) setCloudClient() {
 	configuration := p.getConfiguration()
 
 	if configuration.ProvisioningServerAuthIsValid() {
-		p.cloudClient = cloud.NewClientWithOAuth(configuration.ProvisioningServerURL, map[string]string{}, configuration.ProvisioningServerClientID, configuration.ProvisioningServerClientSecret, configuration.ProvisioningServerTokenEndpoint)
+		p.cloudClient = newInstrumentedCloudClient(cloud.NewClientWithOAuth(configuration.ProvisioningServerURL, map[string]string{}, configuration.ProvisioningServerClientID, configuration.ProvisioningServerClientSecret, configuration.ProvisioningServerTokenEndpoint), p.metrics)
 		return
 	}
 
 	if configuration.ProvisioningServerAuthToken == "" {
-		p.cloudClient = cloud.NewClient(configuration.ProvisioningServerURL)
+		p.cloudClient = newInstrumentedCloudClient(cloud.NewClient(configuration.ProvisioningServerURL), p.metrics)
 		return
 	}
 
 	authHeaders := map[string]string{"x-api-key": configuration.ProvisioningServerAuthToken}
-	p.cloudClient = cloud.NewClientWithHeaders(configuration.ProvisioningServerURL, authHeaders)
+	p.cloudClient = newInstrumentedCloudClient(cloud.NewClientWithHeaders(configuration.ProvisioningServerURL, authHeaders), p.metrics)
 }
 
 func (p *Plugin) getLicenseValue(licenseOption string) string {
-	config := p.getConfiguration()
-
-	switch licenseOption {
-	case licenseOptionEnterprise:
-		return config.EnterpriseLicense
-	case licenseOptionProfessional:
-		return config.ProfessionalLicense
-	case licenseOptionE20:
-		return config.E20License
-	case licenseOptionE10:
-		return config.E10License
+	for _, license := range p.getConfiguration().getLicenses() {
+		if license.Name == licenseOption {
+			return license.License
+		}
 	}
 
 	return ""
@@ -47,6 +47,32 @@ func TestConfigurationIsValid(t *testing.T) {
 		})
 	})
 
+	t.Run("catalogs", func(t *testing.T) {
+		t.Run("valid", func(t *testing.T) {
+			config := baseConfiguration
+			config.InstallationSizes = `[{"name": "miniHA", "label": "HA"}]`
+			require.NoError(t, config.IsValid())
+		})
+
+		t.Run("invalid image catalog", func(t *testing.T) {
+			config := baseConfiguration
+			config.ImageCatalog = `[{"label": "no repository"}]`
+			require.Error(t, config.IsValid())
+		})
+
+		t.Run("invalid sizes", func(t *testing.T) {
+			config := baseConfiguration
+			config.InstallationSizes = `miniHA`
+			require.Error(t, config.IsValid())
+		})
+
+		t.Run("invalid license catalog", func(t *testing.T) {
+			config := baseConfiguration
+			config.LicenseCatalog = `[]`
+			require.Error(t, config.IsValid())
+		})
+	})
+
 	t.Run("cluster alerts", func(t *testing.T) {
 		config := baseConfiguration
 		config.ClusterWebhookAlertsEnable = true
@@ -70,6 +96,36 @@ func TestConfigurationIsValid(t *testing.T) {
 			require.NoError(t, config.IsValid())
 		})
 	})
+
+	t.Run("reachability failure threshold", func(t *testing.T) {
+		config := baseConfiguration
+		config.ReachabilityFailureThreshold = "0"
+		require.NoError(t, config.IsValid())
+		config.ReachabilityFailureThreshold = "-1"
+		require.Error(t, config.IsValid())
+		config.ReachabilityFailureThreshold = "often"
+		require.Error(t, config.IsValid())
+	})
+
+	t.Run("role assignments", func(t *testing.T) {
+		config := baseConfiguration
+		config.RoleAssignments = `[{"role": "power-user", "groups": ["sre"]}]`
+		require.NoError(t, config.IsValid())
+		config.RoleAssignments = `[{"role": "superuser"}]`
+		require.Error(t, config.IsValid())
+	})
+
+	t.Run("digest schedule", func(t *testing.T) {
+		config := baseConfiguration
+		config.DigestDay = "friday"
+		config.DigestTime = "16:00"
+		require.NoError(t, config.IsValid())
+		config.DigestTime = "4pm"
+		require.Error(t, config.IsValid())
+		config.DigestDay = "someday"
+		config.DigestTime = ""
+		require.Error(t, config.IsValid())
+	})
 }
 
 func TestGetLicenseValue(t *testing.T) {
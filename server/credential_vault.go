@@ -0,0 +1,202 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+// credentialsKeyPrefix prefixes the KV keys storing the encrypted credentials
+// of the accounts created on an installation.
+const credentialsKeyPrefix = "credentials_"
+
+var errCredentialVaultDisabled = errors.New("the credential vault is not configured; ask a system admin to generate a credential encryption key")
+
+// credentialKey returns the AES-256 key of the credential vault, or nil if
+// no encryption key is configured.
+func (c *configuration) credentialKey() []byte {
+	if c.CredentialEncryptionKey == "" {
+		return nil
+	}
+
+	key := sha256.Sum256([]byte(c.CredentialEncryptionKey))
+	return key[:]
+}
+
+// encryptCredentials encrypts credentials with AES-GCM. The installation ID
+// is authenticated with the credentials so that they can't be moved to
+// another installation. The nonce is prepended to the ciphertext.
+func encryptCredentials(key []byte, installationID string, credentials []*setupCredential) ([]byte, error) {
+	plaintext, err := json.Marshal(credentials)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal credentials")
+	}
+
+	gcm, err := newCredentialCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to generate nonce")
+	}
+
+	return gcm.Seal(nonce, nonce, plaintext, []byte(installationID)), nil
+}
+
+func decryptCredentials(key []byte, installationID string, data []byte) ([]*setupCredential, error) {
+	gcm, err := newCredentialCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("stored credentials are too short")
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, []byte(installationID))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decrypt credentials; the credential encryption key may have been changed")
+	}
+
+	var credentials []*setupCredential
+	err = json.Unmarshal(plaintext, &credentials)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal credentials")
+	}
+
+	return credentials, nil
+}
+
+func newCredentialCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create credential cipher")
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create credential cipher")
+	}
+
+	return gcm, nil
+}
+
+// storeInstallationCredentials encrypts and stores the credentials of the
+// accounts created on an installation, replacing any stored before.
+func (p *Plugin) storeInstallationCredentials(installationID string, credentials []*setupCredential) error {
+	key := p.getConfiguration().credentialKey()
+	if key == nil {
+		return errCredentialVaultDisabled
+	}
+
+	data, err := encryptCredentials(key, installationID, credentials)
+	if err != nil {
+		return err
+	}
+
+	appErr := p.API.KVSet(credentialsKeyPrefix+installationID, data)
+	if appErr != nil {
+		return errors.Wrap(appErr, "failed to store credentials")
+	}
+
+	return nil
+}
+
+// getInstallationCredentials returns the stored credentials of an
+// installation, or nil if none are stored.
+func (p *Plugin) getInstallationCredentials(installationID string) ([]*setupCredential, error) {
+	key := p.getConfiguration().credentialKey()
+	if key == nil {
+		return nil, errCredentialVaultDisabled
+	}
+
+	data, appErr := p.API.KVGet(credentialsKeyPrefix + installationID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get credentials")
+	}
+	if data == nil {
+		return nil, nil
+	}
+
+	return decryptCredentials(key, installationID, data)
+}
+
+// canManageCredentials returns if a user may view and rotate the credentials
+// of an installation. Besides the owner, this is only allowed for plugin
+// admins: the credentials grant system admin access to the installation, so
+// sharing it doesn't share them.
+func (p *Plugin) canManageCredentials(install *Installation, userID string) bool {
+	return install.OwnerID == userID || p.authorizedPluginAdmin(userID)
+}
+
+// rotateInstallationPassword resets the password of an account created on an
+// installation using the stored admin credentials. The new credential is
+// returned.
+func (p *Plugin) rotateInstallationPassword(install *Installation, username string) (*setupCredential, bool, error) {
+	if len(install.DNSRecords) == 0 {
+		return nil, false, errors.Errorf("installation %s doesn't have any DNSRecords", install.Name)
+	}
+
+	credentials, err := p.getInstallationCredentials(install.ID)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var credential, admin *setupCredential
+	for _, c := range credentials {
+		if c.Username == username {
+			credential = c
+		}
+		if c.Username == defaultAdminUsername {
+			admin = c
+		}
+	}
+	if credential == nil {
+		return nil, true, errors.Errorf("no credentials are stored for user %s of installation %s", username, install.Name)
+	}
+	if admin == nil {
+		return nil, false, errors.Errorf("no admin credentials are stored for installation %s", install.Name)
+	}
+
+	client := model.NewAPIv4Client(fmt.Sprintf("https://%s", install.DNSRecords[0].DomainName))
+	_, _, err = client.Login(admin.Username, admin.Password)
+	if err != nil {
+		return nil, false, errors.Wrap(err, "failed to log in with the installation admin account")
+	}
+
+	user, _, err := client.GetUserByUsername(username, "")
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "failed to get user %s", username)
+	}
+
+	// Admins can reset the passwords of other users without knowing them, but
+	// must provide their own current password.
+	var currentPassword string
+	if credential == admin {
+		currentPassword = admin.Password
+	}
+	newPassword := generateRandomPassword(username)
+	_, err = client.UpdateUserPassword(user.Id, currentPassword, newPassword)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "failed to update the password of user %s", username)
+	}
+
+	credential.Password = newPassword
+	err = p.storeInstallationCredentials(install.ID, credentials)
+	if err != nil {
+		return nil, false, errors.Wrapf(err, "the password of user %s was changed to %s but could not be stored", username, newPassword)
+	}
+
+	return credential, false, nil
+}
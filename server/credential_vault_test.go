@@ -0,0 +1,153 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptCredentials(t *testing.T) {
+	key := (&configuration{CredentialEncryptionKey: "secret"}).credentialKey()
+	require.Len(t, key, 32)
+	assert.Nil(t, (&configuration{}).credentialKey())
+
+	credentials := []*setupCredential{{Username: "admin", Password: "admin@password", Note: "Admin user"}}
+	data, err := encryptCredentials(key, "someid", credentials)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "admin@password")
+
+	decrypted, err := decryptCredentials(key, "someid", data)
+	require.NoError(t, err)
+	assert.Equal(t, credentials, decrypted)
+
+	_, err = decryptCredentials(key, "otherid", data)
+	assert.Error(t, err, "credentials are bound to their installation")
+
+	otherKey := (&configuration{CredentialEncryptionKey: "other"}).credentialKey()
+	_, err = decryptCredentials(otherKey, "someid", data)
+	assert.Error(t, err)
+
+	_, err = decryptCredentials(key, "someid", []byte("short"))
+	assert.Error(t, err)
+}
+
+func TestCredentialsCommand(t *testing.T) {
+	mm, server := newMockedMattermostTLSServer(t)
+	domain := strings.TrimPrefix(server.URL, "https://")
+
+	api := &plugintest.API{}
+	store := newMockedKVStore(api)
+	store.values[StoreInstallsKey] = []byte(`[
+		{"ID": "someid", "OwnerID": "joramid", "Name": "joramsinstall", "DNSRecords": [{"DomainName": "` + domain + `"}]},
+		{"ID": "sharedid", "OwnerID": "gabeid", "Name": "gabesinstall", "Shared": true, "AllowSharedUpdates": true, "DNSRecords": [{"DomainName": "` + domain + `"}]}
+	]`)
+	api.On("HasPermissionTo", mock.AnythingOfType("string"), model.PermissionManageSystem).Return(false)
+
+	plugin := &Plugin{cloudClient: &MockClient{}, configuration: &configuration{}}
+	plugin.SetAPI(api)
+	extra := &model.CommandArgs{UserId: "joramid"}
+
+	t.Run("vault disabled", func(t *testing.T) {
+		_, isUserError, err := plugin.runCredentialsCommand([]string{"joramsinstall"}, extra)
+		require.Equal(t, errCredentialVaultDisabled, err)
+		assert.True(t, isUserError)
+	})
+
+	plugin.configuration.CredentialEncryptionKey = "secret"
+
+	t.Run("nothing stored", func(t *testing.T) {
+		resp, _, err := plugin.runCredentialsCommand([]string{"joramsinstall"}, extra)
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, "No credentials are stored for installation joramsinstall.")
+	})
+
+	require.NoError(t, plugin.storeInstallationCredentials("someid", []*setupCredential{
+		{Username: "admin", Password: "admin@password", Note: "Admin user"},
+		{Username: "user", Password: "user@password", Note: "Regular user"},
+	}))
+
+	t.Run("owner", func(t *testing.T) {
+		resp, _, err := plugin.runCredentialsCommand([]string{"joramsinstall"}, extra)
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, "https://"+domain)
+		assert.Contains(t, resp.Text, "| `admin` | `admin@password` | Admin user |")
+
+		events, err := plugin.getInstallationEvents("someid")
+		require.NoError(t, err)
+		assert.Equal(t, "credentials-viewed", events[len(events)-1].Action)
+	})
+
+	t.Run("other users", func(t *testing.T) {
+		_, isUserError, err := plugin.runCredentialsCommand([]string{"joramsinstall"}, &model.CommandArgs{UserId: "gabeid"})
+		require.EqualError(t, err, "no installation with the name joramsinstall found")
+		assert.True(t, isUserError)
+
+		_, isUserError, err = plugin.runCredentialsCommand([]string{"gabesinstall"}, extra)
+		require.EqualError(t, err, "no installation with the name gabesinstall found", "sharing doesn't share credentials, even with updates allowed")
+		assert.True(t, isUserError)
+
+		_, isUserError, err = plugin.runRotatePasswordCommand([]string{"gabesinstall", "admin"}, extra)
+		require.EqualError(t, err, "no installation with the name gabesinstall found")
+		assert.True(t, isUserError)
+	})
+
+	t.Run("rotate user password", func(t *testing.T) {
+		resp, _, err := plugin.runRotatePasswordCommand([]string{"joramsinstall", "user"}, extra)
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, "The password of user user on installation joramsinstall is now `user@")
+		assert.Equal(t, 1, mm.countRequests("PUT /api/v4/users/userid/password"))
+
+		credentials, err := plugin.getInstallationCredentials("someid")
+		require.NoError(t, err)
+		assert.NotEqual(t, "user@password", credentials[1].Password)
+		assert.Contains(t, resp.Text, credentials[1].Password)
+		assert.Equal(t, "admin@password", credentials[0].Password)
+	})
+
+	t.Run("rotate admin password", func(t *testing.T) {
+		_, _, err := plugin.runRotatePasswordCommand([]string{"joramsinstall", "admin"}, extra)
+		require.NoError(t, err)
+
+		credentials, err := plugin.getInstallationCredentials("someid")
+		require.NoError(t, err)
+		assert.NotEqual(t, "admin@password", credentials[0].Password)
+	})
+
+	t.Run("rotate unknown user", func(t *testing.T) {
+		_, isUserError, err := plugin.runRotatePasswordCommand([]string{"joramsinstall", "nobody"}, extra)
+		require.EqualError(t, err, "no credentials are stored for user nobody of installation joramsinstall")
+		assert.True(t, isUserError)
+
+		_, isUserError, err = plugin.runRotatePasswordCommand([]string{"joramsinstall"}, extra)
+		require.Error(t, err)
+		assert.True(t, isUserError)
+	})
+
+	t.Run("deleted installations", func(t *testing.T) {
+		plugin.cleanupWebhookState("someid")
+		assert.NotContains(t, store.values, credentialsKeyPrefix+"someid")
+	})
+}
+
+func TestCanManageCredentials(t *testing.T) {
+	api := &plugintest.API{}
+	api.On("HasPermissionTo", "adminid", model.PermissionManageSystem).Return(true)
+	api.On("HasPermissionTo", mock.AnythingOfType("string"), model.PermissionManageSystem).Return(false)
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+
+	install := &Installation{InstallationDTO: cloud.InstallationDTO{Installation: &cloud.Installation{OwnerID: "joramid"}}}
+	assert.True(t, plugin.canManageCredentials(install, "joramid"))
+	assert.True(t, plugin.canManageCredentials(install, "adminid"))
+	assert.False(t, plugin.canManageCredentials(install, "gabeid"))
+
+	install.Shared = true
+	install.AllowSharedUpdates = true
+	assert.False(t, plugin.canManageCredentials(install, "gabeid"), "sharing an installation doesn't share its admin credentials")
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blang/semver/v4"
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// StoreDigestLastSentKey is the key used to store when the weekly digest
+	// was last sent. It ensures only one plugin instance sends the digest.
+	StoreDigestLastSentKey = "digest_last_sent"
+	// digestOptOutKeyPrefix prefixes the keys marking users who don't want
+	// to receive the weekly digest.
+	digestOptOutKeyPrefix = "digest_optout_"
+
+	// digestSchedulerInterval is how often the digest schedule is checked.
+	digestSchedulerInterval = 10 * time.Minute
+	// digestSendWindow is how long after its scheduled time a digest is still
+	// sent, so that a plugin activated mid-week doesn't send a late digest.
+	digestSendWindow = 24 * time.Hour
+	// digestIdleThreshold is how long a stable installation may go without
+	// any plugin action before hibernation is suggested.
+	digestIdleThreshold = 14 * 24 * time.Hour
+
+	actionHibernatePath         = "/api/v1/actions/hibernate"
+	actionUpgradePath           = "/api/v1/actions/upgrade"
+	actionDigestUnsubscribePath = "/api/v1/actions/digest-unsubscribe"
+)
+
+// parseDigestSchedule parses the day and UTC time of day the weekly digest is
+// sent at. The digest is disabled when the day is empty.
+func parseDigestSchedule(day, timeOfDay string) (time.Weekday, time.Duration, bool, error) {
+	if day == "" {
+		return 0, 0, false, nil
+	}
+
+	weekday := -1
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		if strings.EqualFold(d.String(), day) {
+			weekday = int(d)
+		}
+	}
+	if weekday == -1 {
+		return 0, 0, false, errors.Errorf("invalid digest day %s", day)
+	}
+
+	if timeOfDay == "" {
+		timeOfDay = "09:00"
+	}
+	at, err := time.Parse("15:04", timeOfDay)
+	if err != nil {
+		return 0, 0, false, errors.Errorf("invalid digest time %s, expected a UTC time such as 09:00", timeOfDay)
+	}
+
+	return time.Weekday(weekday), time.Duration(at.Hour())*time.Hour + time.Duration(at.Minute())*time.Minute, true, nil
+}
+
+// lastDigestTime returns the most recent time the digest was scheduled at.
+func lastDigestTime(now time.Time, weekday time.Weekday, timeOfDay time.Duration) time.Time {
+	now = now.UTC()
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	scheduled := day.AddDate(0, 0, -((int(now.Weekday())-int(weekday))+7)%7).Add(timeOfDay)
+	if scheduled.After(now) {
+		scheduled = scheduled.AddDate(0, 0, -7)
+	}
+
+	return scheduled
+}
+
+// digestScheduler sends the weekly installation digest at the configured
+// time.
+type digestScheduler struct {
+	plugin *Plugin
+	now    func() time.Time
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newDigestScheduler(p *Plugin) *digestScheduler {
+	return &digestScheduler{
+		plugin: p,
+		now:    time.Now,
+	}
+}
+
+// Start starts checking the digest schedule.
+func (s *digestScheduler) Start() {
+	s.stop = make(chan struct{})
+	s.wg.Add(1)
+	go s.run()
+}
+
+// Stop stops checking the digest schedule.
+func (s *digestScheduler) Stop() {
+	if s.stop == nil {
+		return
+	}
+	close(s.stop)
+	s.wg.Wait()
+	s.stop = nil
+}
+
+func (s *digestScheduler) run() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(digestSchedulerInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := s.check()
+		if err != nil {
+			s.plugin.API.LogError(errors.Wrap(err, "failed to send weekly digest").Error())
+		}
+	}
+}
+
+// check sends the digest if it is due and hasn't been sent by another plugin
+// instance yet.
+func (s *digestScheduler) check() error {
+	config := s.plugin.getConfiguration()
+	weekday, timeOfDay, enabled, err := parseDigestSchedule(config.DigestDay, config.DigestTime)
+	if err != nil || !enabled {
+		return err
+	}
+
+	now := s.now()
+	scheduled := lastDigestTime(now, weekday, timeOfDay)
+	if now.Sub(scheduled) > digestSendWindow {
+		return nil
+	}
+
+	claimed, err := s.claim(scheduled)
+	if err != nil || !claimed {
+		return err
+	}
+
+	return s.plugin.sendDigests(now)
+}
+
+// claim records that the digest scheduled at the given time is being sent,
+// returning false if it already has been.
+func (s *digestScheduler) claim(scheduled time.Time) (bool, error) {
+	lastSent, appErr := s.plugin.API.KVGet(StoreDigestLastSentKey)
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "failed to get when the digest was last sent")
+	}
+	if lastSent != nil {
+		sentAt, err := strconv.ParseInt(string(lastSent), 10, 64)
+		if err == nil && sentAt >= model.GetMillisForTime(scheduled) {
+			return false, nil
+		}
+	}
+
+	ok, appErr := s.plugin.API.KVCompareAndSet(StoreDigestLastSentKey, lastSent, []byte(strconv.FormatInt(model.GetMillisForTime(scheduled), 10)))
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "failed to store when the digest was sent")
+	}
+
+	return ok, nil
+}
+
+// sendDigests sends the digest to the owner of every installation, unless
+// they opted out.
+func (p *Plugin) sendDigests(now time.Time) error {
+	installsByOwner, err := p.getDigestInstallations()
+	if err != nil {
+		return err
+	}
+
+	latest, err := p.latestRelease()
+	if err != nil {
+		p.API.LogWarn("Failed to get the latest release for the weekly digest", "error", err.Error())
+	}
+
+	for ownerID, installs := range installsByOwner {
+		optedOut, err := p.digestOptedOut(ownerID)
+		if err != nil {
+			p.API.LogWarn(err.Error(), "user", ownerID)
+			continue
+		}
+		if optedOut || !p.hasPermission(ownerID, permissionReceiveDigest) {
+			continue
+		}
+
+		err = p.sendDigest(ownerID, installs, latest, now)
+		if err != nil {
+			p.API.LogWarn(errors.Wrap(err, "failed to send weekly digest").Error(), "user", ownerID)
+		}
+	}
+
+	return nil
+}
+
+// getDigestInstallations returns the installations of each owner with their
+// current provisioner state.
+func (p *Plugin) getDigestInstallations() (map[string][]*Installation, error) {
+	installs, _, err := p.getInstallations()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get installations")
+	}
+
+	cloudInstalls, err := p.cloudClient.GetInstallations(&cloud.GetInstallationsRequest{
+		Paging: cloud.AllPagesNotDeleted(),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get installations from cloud server")
+	}
+	cloudInstallsByID := make(map[string]*cloud.InstallationDTO, len(cloudInstalls))
+	for _, cloudInstall := range cloudInstalls {
+		cloudInstallsByID[cloudInstall.ID] = cloudInstall
+	}
+
+	installsByOwner := make(map[string][]*Installation)
+	for _, install := range installs {
+		cloudInstall := cloudInstallsByID[install.ID]
+		if cloudInstall == nil {
+			continue
+		}
+		install.Installation = cloudInstall.Installation
+		installsByOwner[install.OwnerID] = append(installsByOwner[install.OwnerID], install)
+	}
+
+	return installsByOwner, nil
+}
+
+// sendDigest sends a user the digest of their installations.
+func (p *Plugin) sendDigest(userID string, installs []*Installation, latest *mattermostRelease, now time.Time) error {
+	message, attachments := p.buildDigest(installs, latest, now)
+	return p.PostBotDMWithAttachments(userID, message, attachments)
+}
+
+// buildDigest returns the digest message for a user's installations, with an
+// attachment for each suggestion.
+func (p *Plugin) buildDigest(installs []*Installation, latest *mattermostRelease, now time.Time) (string, []*model.SlackAttachment) {
+	sort.Slice(installs, func(i, j int) bool {
+		return installs[i].Name < installs[j].Name
+	})
+
+	var attachments []*model.SlackAttachment
+	table := "| Installation | State | Age | Version | Last update | Deletion lock |\n| -- | -- | --: | -- | --: | -- |\n"
+	for _, install := range installs {
+		lastActivity, lastUpdate := install.CreateAt, install.CreateAt
+		events, err := p.getInstallationEvents(install.ID)
+		if err != nil {
+			p.API.LogWarn(err.Error(), "installation", install.ID)
+		}
+		for _, event := range events {
+			if event.Source != eventSourcePlugin || event.ActorID == "" {
+				continue
+			}
+			lastActivity = max(lastActivity, event.Timestamp)
+			if event.Action == "update" {
+				lastUpdate = max(lastUpdate, event.Timestamp)
+			}
+		}
+
+		version, behind := digestVersionStatus(install.Tag, latest)
+		locked := "unlocked"
+		if install.DeletionLocked {
+			locked = "locked"
+		}
+		table += fmt.Sprintf("| %s | %s | %s | %s | %s | %s |\n",
+			install.Name, install.State, digestDays(now, install.CreateAt), version, digestDays(now, lastUpdate), locked)
+
+		if install.State != cloud.InstallationStateStable {
+			continue
+		}
+		if idle := now.Sub(model.GetTimeForMillis(lastActivity)); idle >= digestIdleThreshold {
+			attachments = append(attachments, &model.SlackAttachment{
+				Text:    fmt.Sprintf("%s has been awake for %d days with no activity: hibernate?", install.Name, int(idle.Hours()/24)),
+				Actions: []*model.PostAction{newInstallationAction("hibernate", "Hibernate", actionHibernatePath, install.ID)},
+			})
+		}
+		if behind != "" {
+			action := newInstallationAction("upgrade", "Upgrade to "+latest.tag, actionUpgradePath, install.ID)
+			action.Integration.Context["version"] = latest.tag
+			attachments = append(attachments, &model.SlackAttachment{
+				Text:    fmt.Sprintf("%s is %s: upgrade to %s?", install.Name, behind, latest.tag),
+				Actions: []*model.PostAction{action},
+			})
+		}
+	}
+
+	attachments = append(attachments, &model.SlackAttachment{
+		Text: "You receive this digest every week because you own cloud installations. You can also turn it off with `/cloud digest off`.",
+		Actions: []*model.PostAction{{
+			Id:   "unsubscribe",
+			Name: "Unsubscribe",
+			Type: model.PostActionTypeButton,
+			Integration: &model.PostActionIntegration{
+				URL: fmt.Sprintf("/plugins/%s%s", manifest.ID, actionDigestUnsubscribePath),
+			},
+		}},
+	})
+
+	message := fmt.Sprintf("#### Weekly installation digest\nYou own %d installations.\n\n%s", len(installs), table)
+
+	return message, attachments
+}
+
+// digestVersionStatus describes the version of an installation compared with
+// the latest release. The returned description of how far behind the latest
+// release the installation is, is empty when no upgrade is suggested.
+func digestVersionStatus(tag string, latest *mattermostRelease) (string, string) {
+	if tag == "" {
+		return "unknown", ""
+	}
+	version, err := semver.Parse(strings.TrimPrefix(tag, "v"))
+	if err != nil || latest == nil {
+		return tag, ""
+	}
+	if !version.LT(latest.version) {
+		return tag + " (latest)", ""
+	}
+
+	var behind string
+	switch {
+	case version.Major < latest.version.Major:
+		behind = fmt.Sprintf("%d major versions behind", latest.version.Major-version.Major)
+		if latest.version.Major-version.Major == 1 {
+			behind = "1 major version behind"
+		}
+	case version.Minor < latest.version.Minor:
+		behind = fmt.Sprintf("%d minor versions behind", latest.version.Minor-version.Minor)
+		if latest.version.Minor-version.Minor == 1 {
+			behind = "1 minor version behind"
+		}
+	default:
+		behind = "missing the latest patch release"
+	}
+
+	return fmt.Sprintf("%s (latest %s)", tag, latest.tag), behind
+}
+
+func digestDays(now time.Time, millis int64) string {
+	if millis == 0 {
+		return "unknown"
+	}
+
+	days := int(now.Sub(model.GetTimeForMillis(millis)).Hours() / 24)
+	if days == 1 {
+		return "1 day"
+	}
+	return fmt.Sprintf("%d days", days)
+}
+
+// digestOptedOut returns if the user doesn't want to receive the digest.
+func (p *Plugin) digestOptedOut(userID string) (bool, error) {
+	data, appErr := p.API.KVGet(digestOptOutKeyPrefix + userID)
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "failed to get digest subscription")
+	}
+
+	return data != nil, nil
+}
+
+// setDigestOptOut sets if the user receives the digest.
+func (p *Plugin) setDigestOptOut(userID string, optOut bool) error {
+	var appErr *model.AppError
+	if optOut {
+		appErr = p.API.KVSet(digestOptOutKeyPrefix+userID, []byte("true"))
+	} else {
+		appErr = p.API.KVDelete(digestOptOutKeyPrefix + userID)
+	}
+	if appErr != nil {
+		return errors.Wrap(appErr, "failed to store digest subscription")
+	}
+
+	return nil
+}
+
+func (p *Plugin) handleDigestUnsubscribe(w http.ResponseWriter, r *http.Request, userID string) {
+	err := p.setDigestOptOut(userID, true)
+	if err != nil {
+		p.API.LogError(err.Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	writeActionResponse(w, "You will no longer receive the weekly installation digest. Use `/cloud digest on` to receive it again.")
+}
+
+// hibernateInstallation hibernates a stable installation.
+func (p *Plugin) hibernateInstallation(install *Installation, userID string) (bool, error) {
+	if install.State != cloud.InstallationStateStable {
+		return true, errors.Errorf("installation state is currently %s and must be %s to hibernate", install.State, cloud.InstallationStateStable)
+	}
+
+	_, err := p.cloudClient.HibernateInstallation(install.ID)
+	if err != nil {
+		return false, err
+	}
+	p.recordPluginEvent(install.ID, userID, "hibernate", "")
+
+	return false, nil
+}
+
+// upgradeInstallation updates a stable installation to a release version.
+func (p *Plugin) upgradeInstallation(install *Installation, version, userID string) (bool, error) {
+	if install.State != cloud.InstallationStateStable {
+		return true, errors.Errorf("installation state is currently %s and must be %s to upgrade", install.State, cloud.InstallationStateStable)
+	}
+
+	exists, err := p.dockerClient.ValidTag(version, install.Image)
+	if err != nil {
+		p.API.LogError(errors.Wrapf(err, "unable to check if %s:%s exists", install.Image, version).Error())
+	}
+	if !exists {
+		return true, errors.Errorf("%s is not a valid docker tag for repository %s", version, install.Image)
+	}
+	digest, err := p.dockerClient.GetDigestForTag(version, install.Image)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to find a manifest digest for version %s", version)
+	}
+
+	_, err = p.cloudClient.UpdateInstallation(install.ID, &cloud.PatchInstallationRequest{Version: &digest})
+	if err != nil {
+		return false, errors.Wrap(err, "failed to update installation")
+	}
+
+	install.Tag = version
+	err = p.updateInstallation(install)
+	if err != nil {
+		return false, errors.Wrap(err, "failed to store updated installation metadata")
+	}
+	p.recordPluginEvent(install.ID, userID, "update", "--version "+version)
+
+	return false, nil
+}
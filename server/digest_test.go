@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseDigestSchedule(t *testing.T) {
+	weekday, timeOfDay, enabled, err := parseDigestSchedule("Wednesday", "17:30")
+	require.NoError(t, err)
+	assert.True(t, enabled)
+	assert.Equal(t, time.Wednesday, weekday)
+	assert.Equal(t, 17*time.Hour+30*time.Minute, timeOfDay)
+
+	_, _, enabled, err = parseDigestSchedule("", "")
+	require.NoError(t, err)
+	assert.False(t, enabled)
+
+	_, timeOfDay, _, err = parseDigestSchedule("monday", "")
+	require.NoError(t, err)
+	assert.Equal(t, 9*time.Hour, timeOfDay)
+
+	_, _, _, err = parseDigestSchedule("someday", "09:00")
+	assert.Error(t, err)
+	_, _, _, err = parseDigestSchedule("monday", "9am")
+	assert.Error(t, err)
+}
+
+func TestLastDigestTime(t *testing.T) {
+	// 2026-10-19 is a Monday.
+	monday := time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+
+	assert.Equal(t, monday.Add(9*time.Hour), lastDigestTime(monday.Add(10*time.Hour), time.Monday, 9*time.Hour))
+	assert.Equal(t, monday.AddDate(0, 0, -7).Add(9*time.Hour), lastDigestTime(monday.Add(8*time.Hour), time.Monday, 9*time.Hour))
+	assert.Equal(t, monday.AddDate(0, 0, -4).Add(9*time.Hour), lastDigestTime(monday.Add(10*time.Hour), time.Thursday, 9*time.Hour))
+	assert.Equal(t, monday.AddDate(0, 0, 1), lastDigestTime(monday.AddDate(0, 0, 3), time.Tuesday, 0))
+}
+
+func TestDigest(t *testing.T) {
+	joramID := model.NewId()
+	gabeID := model.NewId()
+	now := time.Now()
+	daysAgo := func(days int) int64 { return model.GetMillisForTime(now.AddDate(0, 0, -days)) }
+
+	api := &plugintest.API{}
+	store := newMockedKVStore(api)
+	api.On("GetDirectChannel", mock.AnythingOfType("string"), "botid").Return(func(userID, botID string) *model.Channel {
+		return &model.Channel{Id: userID + "dm"}
+	}, nil)
+	var posts []*model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		posts = append(posts, args.Get(0).(*model.Post))
+	}).Return(&model.Post{}, nil)
+
+	mockedCloudClient := &MockClient{
+		mockedCloudInstallationsDTO: []*cloud.InstallationDTO{
+			{Installation: &cloud.Installation{ID: "idleid", OwnerID: joramID, State: cloud.InstallationStateStable, CreateAt: daysAgo(30)}},
+			{Installation: &cloud.Installation{ID: "activeid", OwnerID: joramID, State: cloud.InstallationStateStable, CreateAt: daysAgo(30), DeletionLocked: true}},
+			{Installation: &cloud.Installation{ID: "hibernatingid", OwnerID: joramID, State: cloud.InstallationStateHibernating, CreateAt: daysAgo(30)}},
+			{Installation: &cloud.Installation{ID: "gabesid", OwnerID: gabeID, State: cloud.InstallationStateStable, CreateAt: daysAgo(1)}},
+		},
+	}
+	plugin := &Plugin{
+		BotUserID:     "botid",
+		cloudClient:   mockedCloudClient,
+		releaseSource: &mockedReleaseSource{releases: testReleases},
+		configuration: &configuration{DigestDay: "monday", DigestTime: "09:00"},
+	}
+	plugin.SetAPI(api)
+
+	for _, install := range []*Installation{
+		{Name: "idle", Tag: "10.10.3", InstallationDTO: cloud.InstallationDTO{Installation: &cloud.Installation{ID: "idleid", OwnerID: joramID}}},
+		{Name: "active", Tag: "9.11.9", InstallationDTO: cloud.InstallationDTO{Installation: &cloud.Installation{ID: "activeid", OwnerID: joramID}}},
+		{Name: "hibernating", Tag: "9.11.9", InstallationDTO: cloud.InstallationDTO{Installation: &cloud.Installation{ID: "hibernatingid", OwnerID: joramID}}},
+		{Name: "gabes", Tag: "10.11.2", InstallationDTO: cloud.InstallationDTO{Installation: &cloud.Installation{ID: "gabesid", OwnerID: gabeID}}},
+	} {
+		require.NoError(t, plugin.storeInstallation(install))
+	}
+	plugin.recordPluginEvent("activeid", joramID, "update", "--version 9.11.9")
+
+	require.NoError(t, plugin.setDigestOptOut(gabeID, true))
+	require.NoError(t, plugin.sendDigests(now))
+
+	require.Len(t, posts, 1, "users who opted out don't receive the digest")
+	post := posts[0]
+	assert.Equal(t, joramID+"dm", post.ChannelId)
+	assert.Contains(t, post.Message, "You own 3 installations.")
+	assert.Contains(t, post.Message, "| active | stable | 30 days | 9.11.9 (latest 10.11.2) | 0 days | locked |")
+	assert.Contains(t, post.Message, "| hibernating | hibernating | 30 days | 9.11.9 (latest 10.11.2) | 30 days | unlocked |")
+	assert.Contains(t, post.Message, "| idle | stable | 30 days | 10.10.3 (latest 10.11.2) | 30 days | unlocked |")
+
+	attachments := post.Attachments()
+	require.Len(t, attachments, 4)
+	assert.Equal(t, "active is 1 major version behind: upgrade to 10.11.2?", attachments[0].Text)
+	assert.Equal(t, "idle has been awake for 30 days with no activity: hibernate?", attachments[1].Text)
+	assert.Equal(t, "hibernate", attachments[1].Actions[0].Id)
+	assert.Equal(t, "idleid", attachments[1].Actions[0].Integration.Context["installation_id"])
+	assert.Equal(t, "idle is 1 minor version behind: upgrade to 10.11.2?", attachments[2].Text)
+	assert.Equal(t, "10.11.2", attachments[2].Actions[0].Integration.Context["version"])
+	assert.Equal(t, "unsubscribe", attachments[3].Actions[0].Id)
+
+	t.Run("scheduler sends once per week", func(t *testing.T) {
+		posts = nil
+		scheduler := newDigestScheduler(plugin)
+		monday := time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+
+		scheduler.now = func() time.Time { return monday.Add(8 * time.Hour) }
+		require.NoError(t, scheduler.check())
+		assert.Empty(t, posts, "last week's digest is outside the send window")
+
+		scheduler.now = func() time.Time { return monday.Add(9*time.Hour + 5*time.Minute) }
+		require.NoError(t, scheduler.check())
+		assert.Len(t, posts, 1)
+		require.NoError(t, scheduler.check())
+		assert.Len(t, posts, 1, "the digest was already sent this week")
+		assert.NotNil(t, store.values[StoreDigestLastSentKey])
+	})
+
+	t.Run("command", func(t *testing.T) {
+		run := func(args ...string) (*model.CommandResponse, bool, error) {
+			return plugin.runDigestCommand(args, &model.CommandArgs{UserId: gabeID})
+		}
+
+		resp, _, err := run()
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, "You don't receive the weekly installation digest.")
+
+		_, _, err = run("on")
+		require.NoError(t, err)
+		optedOut, err := plugin.digestOptedOut(gabeID)
+		require.NoError(t, err)
+		assert.False(t, optedOut)
+
+		posts = nil
+		_, _, err = run("now")
+		require.NoError(t, err)
+		require.Len(t, posts, 1)
+		assert.Contains(t, posts[0].Message, "| gabes | stable | 1 day | 10.11.2 (latest) | 1 day | unlocked |")
+		assert.Len(t, posts[0].Attachments(), 1, "only the unsubscribe button is shown without suggestions")
+
+		_, isUserError, err := run("weekly")
+		require.Error(t, err)
+		assert.True(t, isUserError)
+	})
+
+	t.Run("unsubscribe", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, actionDigestUnsubscribePath, nil)
+		r.Header.Set("Mattermost-User-ID", joramID)
+		plugin.handleDigestUnsubscribe(w, r, joramID)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		optedOut, err := plugin.digestOptedOut(joramID)
+		require.NoError(t, err)
+		assert.True(t, optedOut)
+	})
+}
+
+func TestDigestActions(t *testing.T) {
+	mockedCloudClient := &MockClient{}
+	plugin := &Plugin{
+		cloudClient:  mockedCloudClient,
+		dockerClient: &MockedDockerClient{tagExists: true},
+	}
+
+	api := &plugintest.API{}
+	store := newMockedKVStore(api)
+	store.values[StoreInstallsKey] = []byte(`[{"ID": "someid", "OwnerID": "joramid", "Name": "joramsinstall", "Tag": "10.10.3"}]`)
+	plugin.SetAPI(api)
+
+	doAction := func(path string, context map[string]interface{}) string {
+		body, err := json.Marshal(&model.PostActionIntegrationRequest{Context: context})
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+		r.Header.Set("Mattermost-User-ID", "joramid")
+		plugin.handleInstallationAction(w, r, "joramid")
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp model.PostActionIntegrationResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.EphemeralText
+	}
+
+	t.Run("upgrade", func(t *testing.T) {
+		text := doAction(actionUpgradePath, map[string]interface{}{"installation_id": "someid", "version": "10.11.2"})
+		assert.Equal(t, "Upgrade of installation joramsinstall to 10.11.2 has begun. You will receive a notification when it is done.", text)
+		require.NotNil(t, mockedCloudClient.patchRequest)
+		assert.Equal(t, "10.11.2", *mockedCloudClient.patchRequest.Version)
+
+		install, err := plugin.getInstallation("someid")
+		require.NoError(t, err)
+		assert.Equal(t, "10.11.2", install.Tag)
+	})
+
+	t.Run("hibernate", func(t *testing.T) {
+		text := doAction(actionHibernatePath, map[string]interface{}{"installation_id": "someid"})
+		assert.Contains(t, text, "Hibernation of installation joramsinstall has begun.")
+
+		events, err := plugin.getInstallationEvents("someid")
+		require.NoError(t, err)
+		require.Len(t, events, 2)
+		assert.Equal(t, "hibernate", events[1].Action)
+	})
+
+	t.Run("no longer stable", func(t *testing.T) {
+		mockedCloudClient.overrideGetInstallationDTO = &cloud.InstallationDTO{Installation: &cloud.Installation{ID: "someid", OwnerID: "joramid", State: cloud.InstallationStateHibernating}}
+		text := doAction(actionHibernatePath, map[string]interface{}{"installation_id": "someid"})
+		assert.Equal(t, "Unable to hibernate: installation state is currently hibernating and must be stable to hibernate", text)
+	})
+}
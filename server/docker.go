@@ -29,12 +29,7 @@ func NewDockerClient() *DockerClient {
 
 // ValidTag returns if a given tag exists for the given repository.
 func (dc *DockerClient) ValidTag(desiredTag, repository string) (bool, error) {
-	hub, err := registry.New(dc.registryURL, dc.username, dc.password)
-	if err != nil {
-		return false, err
-	}
-
-	tags, err := hub.Tags(repository)
+	tags, err := dc.Tags(repository)
 	if err != nil {
 		return false, err
 	}
@@ -48,6 +43,16 @@ func (dc *DockerClient) ValidTag(desiredTag, repository string) (bool, error) {
 	return false, nil
 }
 
+// Tags returns the full list of tags for the given repository.
+func (dc *DockerClient) Tags(repository string) ([]string, error) {
+	hub, err := registry.New(dc.registryURL, dc.username, dc.password)
+	if err != nil {
+		return nil, err
+	}
+
+	return hub.Tags(repository)
+}
+
 // GetDigestForTag fetches the digest for the image. Sadly, this
 // functionality is not present in the Heroku docker client, which
 // will only get digests for v1 manifests, which contain the wrong
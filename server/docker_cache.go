@@ -0,0 +1,199 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// defaultDockerTagCacheTTL is how long a repository tag list is served
+	// from the cache before it is downloaded again.
+	defaultDockerTagCacheTTL = 10 * time.Minute
+	// defaultDockerDigestCacheTTL is how long a tag digest is served from the
+	// cache. Tags such as "master" are mutable, so this is kept short.
+	defaultDockerDigestCacheTTL = 2 * time.Minute
+	// defaultDockerTagRefreshInterval is the minimum time between refreshes
+	// of a cached tag list when a requested tag is not found in it. This
+	// allows freshly pushed tags to be picked up without waiting for the
+	// full TTL to expire.
+	defaultDockerTagRefreshInterval = 30 * time.Second
+	// defaultDockerTagMaxStaleness is how old a cached tag list can be and
+	// still be served when the registry cannot be reached.
+	defaultDockerTagMaxStaleness = time.Hour
+)
+
+// dockerRegistry is the set of registry lookups that can be cached.
+type dockerRegistry interface {
+	Tags(repository string) ([]string, error)
+	GetDigestForTag(desiredTag, repository string) (string, error)
+}
+
+// DockerCacheStats is a point-in-time snapshot of the docker cache metrics.
+type DockerCacheStats struct {
+	TagHits      uint64
+	TagMisses    uint64
+	DigestHits   uint64
+	DigestMisses uint64
+	Repositories int
+	Digests      int
+}
+
+type tagCacheEntry struct {
+	tags      map[string]struct{}
+	fetchedAt time.Time
+}
+
+type digestCacheEntry struct {
+	digest    string
+	fetchedAt time.Time
+}
+
+// CachedDockerClient is a DockerClientInterface which caches repository tag
+// lists and tag digests. Concurrent lookups of the same uncached value are
+// de-duplicated so that only one registry request is in flight at a time.
+type CachedDockerClient struct {
+	registry dockerRegistry
+
+	tagTTL             time.Duration
+	digestTTL          time.Duration
+	tagRefreshInterval time.Duration
+	tagMaxStaleness    time.Duration
+
+	lock    sync.Mutex
+	tags    map[string]*tagCacheEntry
+	digests map[string]*digestCacheEntry
+
+	calls singleflight.Group
+
+	tagHits      atomic.Uint64
+	tagMisses    atomic.Uint64
+	digestHits   atomic.Uint64
+	digestMisses atomic.Uint64
+
+	now func() time.Time
+}
+
+// NewCachedDockerClient returns a new caching docker client wrapping the
+// provided registry.
+func NewCachedDockerClient(registry dockerRegistry) *CachedDockerClient {
+	return &CachedDockerClient{
+		registry:           registry,
+		tagTTL:             defaultDockerTagCacheTTL,
+		digestTTL:          defaultDockerDigestCacheTTL,
+		tagRefreshInterval: defaultDockerTagRefreshInterval,
+		tagMaxStaleness:    defaultDockerTagMaxStaleness,
+		tags:               make(map[string]*tagCacheEntry),
+		digests:            make(map[string]*digestCacheEntry),
+		now:                time.Now,
+	}
+}
+
+// ValidTag returns if a given tag exists for the given repository.
+func (c *CachedDockerClient) ValidTag(desiredTag, repository string) (bool, error) {
+	c.lock.Lock()
+	entry := c.tags[repository]
+	c.lock.Unlock()
+
+	if entry != nil {
+		age := c.now().Sub(entry.fetchedAt)
+		_, found := entry.tags[desiredTag]
+		if age < c.tagTTL && (found || age < c.tagRefreshInterval) {
+			c.tagHits.Add(1)
+			return found, nil
+		}
+	}
+
+	c.tagMisses.Add(1)
+	result, err, _ := c.calls.Do("tags:"+repository, func() (any, error) {
+		tags, err := c.registry.Tags(repository)
+		if err != nil {
+			return nil, err
+		}
+
+		entry := &tagCacheEntry{
+			tags:      make(map[string]struct{}, len(tags)),
+			fetchedAt: c.now(),
+		}
+		for _, tag := range tags {
+			entry.tags[tag] = struct{}{}
+		}
+
+		c.lock.Lock()
+		c.tags[repository] = entry
+		c.lock.Unlock()
+
+		return entry, nil
+	})
+	if err != nil {
+		if entry != nil && c.now().Sub(entry.fetchedAt) < c.tagMaxStaleness {
+			// Serve the stale tag list rather than failing the lookup.
+			_, found := entry.tags[desiredTag]
+			return found, nil
+		}
+		return false, err
+	}
+
+	_, found := result.(*tagCacheEntry).tags[desiredTag]
+	return found, nil
+}
+
+// GetDigestForTag returns the manifest digest for the given repository tag.
+func (c *CachedDockerClient) GetDigestForTag(desiredTag, repository string) (string, error) {
+	key := repository + ":" + desiredTag
+
+	c.lock.Lock()
+	entry := c.digests[key]
+	c.lock.Unlock()
+
+	if entry != nil && c.now().Sub(entry.fetchedAt) < c.digestTTL {
+		c.digestHits.Add(1)
+		return entry.digest, nil
+	}
+
+	c.digestMisses.Add(1)
+	result, err, _ := c.calls.Do("digest:"+key, func() (any, error) {
+		digest, err := c.registry.GetDigestForTag(desiredTag, repository)
+		if err != nil {
+			return nil, err
+		}
+
+		c.lock.Lock()
+		c.digests[key] = &digestCacheEntry{digest: digest, fetchedAt: c.now()}
+		c.lock.Unlock()
+
+		return digest, nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return result.(string), nil
+}
+
+// Flush removes all cached tag lists and digests.
+func (c *CachedDockerClient) Flush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.tags = make(map[string]*tagCacheEntry)
+	c.digests = make(map[string]*digestCacheEntry)
+}
+
+// Stats returns the current cache metrics.
+func (c *CachedDockerClient) Stats() DockerCacheStats {
+	c.lock.Lock()
+	repositories, digests := len(c.tags), len(c.digests)
+	c.lock.Unlock()
+
+	return DockerCacheStats{
+		TagHits:      c.tagHits.Load(),
+		TagMisses:    c.tagMisses.Load(),
+		DigestHits:   c.digestHits.Load(),
+		DigestMisses: c.digestMisses.Load(),
+		Repositories: repositories,
+		Digests:      digests,
+	}
+}
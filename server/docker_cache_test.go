@@ -0,0 +1,173 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockedDockerRegistry struct {
+	tags       []string
+	digest     string
+	err        error
+	tagCalls   atomic.Int32
+	digestCall atomic.Int32
+	delay      time.Duration
+}
+
+func (mr *mockedDockerRegistry) Tags(repository string) ([]string, error) {
+	mr.tagCalls.Add(1)
+	time.Sleep(mr.delay)
+	return mr.tags, mr.err
+}
+
+func (mr *mockedDockerRegistry) GetDigestForTag(desiredTag, repository string) (string, error) {
+	mr.digestCall.Add(1)
+	time.Sleep(mr.delay)
+	return mr.digest, mr.err
+}
+
+func TestCachedDockerClient(t *testing.T) {
+	now := time.Now()
+	setup := func() (*CachedDockerClient, *mockedDockerRegistry) {
+		registry := &mockedDockerRegistry{tags: []string{"9.11.1", "10.0.0"}, digest: "sha256:abc"}
+		client := NewCachedDockerClient(registry)
+		client.now = func() time.Time { return now }
+		return client, registry
+	}
+
+	t.Run("tags are cached", func(t *testing.T) {
+		client, registry := setup()
+
+		valid, err := client.ValidTag("9.11.1", "mattermost/mattermost-enterprise-edition")
+		require.NoError(t, err)
+		assert.True(t, valid)
+
+		valid, err = client.ValidTag("10.0.0", "mattermost/mattermost-enterprise-edition")
+		require.NoError(t, err)
+		assert.True(t, valid)
+
+		assert.EqualValues(t, 1, registry.tagCalls.Load())
+		stats := client.Stats()
+		assert.EqualValues(t, 1, stats.TagHits)
+		assert.EqualValues(t, 1, stats.TagMisses)
+		assert.Equal(t, 1, stats.Repositories)
+	})
+
+	t.Run("missing tag refreshes after the refresh interval", func(t *testing.T) {
+		client, registry := setup()
+
+		valid, err := client.ValidTag("10.1.0", "mattermost/mattermost-enterprise-edition")
+		require.NoError(t, err)
+		assert.False(t, valid)
+
+		valid, err = client.ValidTag("10.1.0", "mattermost/mattermost-enterprise-edition")
+		require.NoError(t, err)
+		assert.False(t, valid)
+		assert.EqualValues(t, 1, registry.tagCalls.Load())
+
+		registry.tags = append(registry.tags, "10.1.0")
+		client.now = func() time.Time { return now.Add(defaultDockerTagRefreshInterval) }
+
+		valid, err = client.ValidTag("10.1.0", "mattermost/mattermost-enterprise-edition")
+		require.NoError(t, err)
+		assert.True(t, valid)
+		assert.EqualValues(t, 2, registry.tagCalls.Load())
+	})
+
+	t.Run("expired tags are fetched again", func(t *testing.T) {
+		client, registry := setup()
+
+		_, err := client.ValidTag("9.11.1", "mattermost/mattermost-enterprise-edition")
+		require.NoError(t, err)
+
+		client.now = func() time.Time { return now.Add(defaultDockerTagCacheTTL) }
+		_, err = client.ValidTag("9.11.1", "mattermost/mattermost-enterprise-edition")
+		require.NoError(t, err)
+		assert.EqualValues(t, 2, registry.tagCalls.Load())
+	})
+
+	t.Run("stale tags are served on registry errors", func(t *testing.T) {
+		client, registry := setup()
+
+		_, err := client.ValidTag("9.11.1", "mattermost/mattermost-enterprise-edition")
+		require.NoError(t, err)
+
+		registry.err = errors.New("rate limited")
+		client.now = func() time.Time { return now.Add(defaultDockerTagCacheTTL) }
+		valid, err := client.ValidTag("9.11.1", "mattermost/mattermost-enterprise-edition")
+		require.NoError(t, err)
+		assert.True(t, valid)
+
+		_, err = client.ValidTag("9.11.1", "mattermost/mm-te")
+		require.Error(t, err)
+
+		client.now = func() time.Time { return now.Add(defaultDockerTagMaxStaleness) }
+		_, err = client.ValidTag("9.11.1", "mattermost/mattermost-enterprise-edition")
+		require.Error(t, err, "tags older than the maximum staleness are not served")
+	})
+
+	t.Run("digests are cached", func(t *testing.T) {
+		client, registry := setup()
+
+		digest, err := client.GetDigestForTag("9.11.1", "mattermost/mattermost-enterprise-edition")
+		require.NoError(t, err)
+		assert.Equal(t, "sha256:abc", digest)
+
+		digest, err = client.GetDigestForTag("9.11.1", "mattermost/mattermost-enterprise-edition")
+		require.NoError(t, err)
+		assert.Equal(t, "sha256:abc", digest)
+		assert.EqualValues(t, 1, registry.digestCall.Load())
+
+		client.now = func() time.Time { return now.Add(defaultDockerDigestCacheTTL) }
+		_, err = client.GetDigestForTag("9.11.1", "mattermost/mattermost-enterprise-edition")
+		require.NoError(t, err)
+		assert.EqualValues(t, 2, registry.digestCall.Load())
+
+		stats := client.Stats()
+		assert.EqualValues(t, 1, stats.DigestHits)
+		assert.EqualValues(t, 2, stats.DigestMisses)
+	})
+
+	t.Run("concurrent lookups are de-duplicated", func(t *testing.T) {
+		client, registry := setup()
+		registry.delay = 50 * time.Millisecond
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				valid, err := client.ValidTag("9.11.1", "mattermost/mattermost-enterprise-edition")
+				assert.NoError(t, err)
+				assert.True(t, valid)
+			}()
+		}
+		wg.Wait()
+
+		assert.EqualValues(t, 1, registry.tagCalls.Load())
+	})
+
+	t.Run("flush", func(t *testing.T) {
+		client, registry := setup()
+
+		_, err := client.ValidTag("9.11.1", "mattermost/mattermost-enterprise-edition")
+		require.NoError(t, err)
+		_, err = client.GetDigestForTag("9.11.1", "mattermost/mattermost-enterprise-edition")
+		require.NoError(t, err)
+
+		client.Flush()
+		stats := client.Stats()
+		assert.Zero(t, stats.Repositories)
+		assert.Zero(t, stats.Digests)
+
+		_, err = client.ValidTag("9.11.1", "mattermost/mattermost-enterprise-edition")
+		require.NoError(t, err)
+		assert.EqualValues(t, 2, registry.tagCalls.Load())
+	})
+}
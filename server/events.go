@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// installationEventsKeyPrefix prefixes the keys storing the event
+	// timeline of each installation in the plugin KV store.
+	installationEventsKeyPrefix = "events_"
+	// maxInstallationEvents limits how many events are kept per installation.
+	maxInstallationEvents = 200
+
+	eventSourceWebhook = "webhook"
+	eventSourcePlugin  = "plugin"
+)
+
+// installationEvent is an entry in the timeline of an installation. Events
+// are either state transitions reported by the provisioner webhook or
+// actions taken by the plugin.
+type installationEvent struct {
+	Timestamp int64  `json:"timestamp"`
+	Source    string `json:"source"`
+	OldState  string `json:"old_state,omitempty"`
+	NewState  string `json:"new_state,omitempty"`
+	Action    string `json:"action,omitempty"`
+	ActorID   string `json:"actor_id,omitempty"`
+	Details   string `json:"details,omitempty"`
+}
+
+// Description returns a short description of what happened.
+func (e *installationEvent) Description() string {
+	if e.Source == eventSourceWebhook {
+		return fmt.Sprintf("%s → %s", e.OldState, e.NewState)
+	}
+	return e.Action
+}
+
+// webhookTimestampMillis converts a webhook timestamp to milliseconds. The
+// provisioner sends timestamps in either nanoseconds or milliseconds.
+func webhookTimestampMillis(timestamp int64) int64 {
+	if timestamp > 1e15 {
+		return timestamp / int64(time.Millisecond)
+	}
+	return timestamp
+}
+
+// recordWebhookEvent adds a webhook transition to the timeline of the
+// installation, if the installation is managed by the plugin.
+func (p *Plugin) recordWebhookEvent(payload *cloud.WebhookPayload) {
+	if payload.Type != cloud.TypeInstallation {
+		return
+	}
+
+	installs, _, err := p.getInstallations()
+	if err != nil {
+		p.API.LogWarn(errors.Wrap(err, "failed to get installations").Error())
+		return
+	}
+	tracked := false
+	for _, install := range installs {
+		if install.ID == payload.ID {
+			tracked = true
+			break
+		}
+	}
+	if !tracked {
+		return
+	}
+
+	timestamp := webhookTimestampMillis(payload.Timestamp)
+	if timestamp == 0 {
+		timestamp = model.GetMillis()
+	}
+
+	event := &installationEvent{
+		Timestamp: timestamp,
+		Source:    eventSourceWebhook,
+		OldState:  payload.OldState,
+		NewState:  payload.NewState,
+		ActorID:   payload.ExtraData["actor_id"],
+	}
+	// The state history is seeded from the timeline the first time, so the
+	// transition is added to it first.
+	if event.NewState != "" {
+		p.recordStateTransition(payload.ID, event)
+	}
+	p.recordInstallationEvent(payload.ID, event)
+}
+
+// recordPluginEvent adds an action taken by the plugin to the timeline of the
+// installation.
+func (p *Plugin) recordPluginEvent(installationID, actorID, action, details string) {
+	p.recordInstallationEvent(installationID, &installationEvent{
+		Timestamp: model.GetMillis(),
+		Source:    eventSourcePlugin,
+		Action:    action,
+		ActorID:   actorID,
+		Details:   details,
+	})
+}
+
+// eventArgs returns command arguments as event details, hiding environment
+// variable values which may contain secrets.
+func eventArgs(args []string) string {
+	details := make([]string, 0, len(args))
+	hideNext := false
+	for _, arg := range args {
+		switch {
+		case hideNext:
+			arg = "<hidden>"
+			hideNext = false
+		case arg == "--env":
+			hideNext = true
+		case strings.HasPrefix(arg, "--env="):
+			arg = "--env=<hidden>"
+		}
+		details = append(details, arg)
+	}
+	return strings.Join(details, " ")
+}
+
+// recordInstallationEvent adds an event to the timeline of the installation.
+// Failures are logged, since the timeline is informational only.
+func (p *Plugin) recordInstallationEvent(installationID string, event *installationEvent) {
+	key := installationEventsKeyPrefix + installationID
+	for i := 0; i < StoreInstallRetries; i++ {
+		events, originalJSON, err := p.getInstallationEventsWithJSON(installationID)
+		if err != nil {
+			p.API.LogWarn(err.Error(), "installation", installationID)
+			return
+		}
+
+		events = append(events, event)
+		if len(events) > maxInstallationEvents {
+			events = events[len(events)-maxInstallationEvents:]
+		}
+
+		newJSON, err := json.Marshal(events)
+		if err != nil {
+			p.API.LogWarn(errors.Wrap(err, "failed to marshal installation events").Error(), "installation", installationID)
+			return
+		}
+
+		ok, appErr := p.API.KVCompareAndSet(key, originalJSON, newJSON)
+		if appErr != nil {
+			p.API.LogWarn(errors.Wrap(appErr, "failed to store installation events").Error(), "installation", installationID)
+			return
+		}
+		if ok {
+			return
+		}
+	}
+
+	p.API.LogWarn(fmt.Sprintf("failed %d times to store installation event", StoreInstallRetries), "installation", installationID)
+}
+
+// getInstallationEvents returns the timeline of an installation, oldest
+// first.
+func (p *Plugin) getInstallationEvents(installationID string) ([]*installationEvent, error) {
+	events, _, err := p.getInstallationEventsWithJSON(installationID)
+	return events, err
+}
+
+func (p *Plugin) getInstallationEventsWithJSON(installationID string) ([]*installationEvent, []byte, error) {
+	data, appErr := p.API.KVGet(installationEventsKeyPrefix + installationID)
+	if appErr != nil {
+		return nil, nil, errors.Wrap(appErr, "failed to get installation events")
+	}
+	if data == nil {
+		return []*installationEvent{}, nil, nil
+	}
+
+	var events []*installationEvent
+	err := json.Unmarshal(data, &events)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to unmarshal installation events")
+	}
+
+	return events, data, nil
+}
+
+// canViewInstallation returns if the user may view details such as the event
+// timeline of an installation.
+func (p *Plugin) canViewInstallation(install *Installation, userID string) bool {
+	return install.OwnerID == userID || install.Shared || p.authorizedPluginAdmin(userID)
+}
+
+// getActorName returns a readable name for the actor of an event.
+func (p *Plugin) getActorName(actorID string) string {
+	if actorID == "" {
+		return ""
+	}
+	if !model.IsValidId(actorID) {
+		return actorID
+	}
+
+	user, appErr := p.API.GetUser(actorID)
+	if appErr != nil {
+		return actorID
+	}
+	return "@" + user.Username
+}
+
+func (p *Plugin) runEventsCommand(args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+	if len(args) == 0 || len(args[0]) == 0 {
+		return nil, true, errors.Errorf("must provide an installation name")
+	}
+
+	name := standardizeName(args[0])
+
+	installs, _, err := p.getInstallations()
+	if err != nil {
+		return nil, false, err
+	}
+
+	var install *Installation
+	for _, i := range installs {
+		if i.Name == name && p.canViewInstallation(i, extra.UserId) {
+			install = i
+			break
+		}
+	}
+	if install == nil {
+		return nil, true, errors.Errorf("no installation with the name %s found", name)
+	}
+
+	events, err := p.getInstallationEvents(install.ID)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(events) == 0 {
+		return getCommandResponse(model.CommandResponseTypeEphemeral, fmt.Sprintf("No events have been recorded for installation %s.", name), extra), false, nil
+	}
+
+	resp := fmt.Sprintf("Events for installation %s:\n\n| Time (UTC) | Elapsed | Source | Event | Actor | Details |\n| -- | -- | -- | -- | -- | -- |\n", name)
+	var previous int64
+	for _, event := range events {
+		var elapsed string
+		if previous != 0 {
+			elapsed = "+" + (time.Duration(event.Timestamp-previous) * time.Millisecond).Round(time.Second).String()
+		}
+		previous = event.Timestamp
+
+		resp += fmt.Sprintf("| %s | %s | %s | %s | %s | %s |\n",
+			model.GetTimeForMillis(event.Timestamp).UTC().Format("2006-01-02 15:04:05"),
+			elapsed,
+			event.Source,
+			event.Description(),
+			p.getActorName(event.ActorID),
+			strings.ReplaceAll(event.Details, "|", "\\|"),
+		)
+	}
+
+	return getCommandResponse(model.CommandResponseTypeEphemeral, resp, extra), false, nil
+}
+
+// parseInstallationEventsPath returns the installation ID from a request path
+// of the form /api/v1/installations/{id}/events.
+func parseInstallationEventsPath(path string) (string, bool) {
+	parts := strings.Split(strings.TrimPrefix(path, "/api/v1/installations/"), "/")
+	if !strings.HasPrefix(path, "/api/v1/installations/") || len(parts) != 2 || parts[1] != "events" || parts[0] == "" {
+		return "", false
+	}
+	return parts[0], true
+}
+
+func (p *Plugin) handleInstallationEvents(w http.ResponseWriter, r *http.Request, userID, installationID string) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	installs, _, err := p.getInstallations()
+	if err != nil {
+		p.API.LogError(errors.Wrap(err, "Unable to get installations").Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	var install *Installation
+	for _, i := range installs {
+		if i.ID == installationID {
+			install = i
+			break
+		}
+	}
+	if install == nil || !p.canViewInstallation(install, userID) {
+		http.NotFound(w, r)
+		return
+	}
+
+	events, err := p.getInstallationEvents(install.ID)
+	if err != nil {
+		p.API.LogError(errors.Wrap(err, "Unable to get installation events").Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	data, err := json.Marshal(events)
+	if err != nil {
+		p.API.LogError(errors.Wrap(err, "Unable to marshal installation events").Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(data)
+}
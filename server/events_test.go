@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstallationEvents(t *testing.T) {
+	ownerID := model.NewId()
+	setup := func() (*Plugin, *mockedKVStore) {
+		api := &plugintest.API{}
+		store := newMockedKVStore(api)
+		api.On("HasPermissionTo", "adminid", mock.Anything).Return(true)
+		api.On("HasPermissionTo", mock.AnythingOfType("string"), mock.Anything).Return(false)
+		api.On("GetUser", ownerID).Return(&model.User{Id: ownerID, Username: "joram"}, nil)
+		api.On("LogWarn", mock.AnythingOfType("string"), mock.Anything, mock.Anything).Return()
+
+		plugin := &Plugin{configuration: &configuration{}}
+		plugin.SetAPI(api)
+
+		store.values[StoreInstallsKey] = []byte(`[{"ID": "someid", "OwnerID": "` + ownerID + `", "Name": "joramsinstall"}]`)
+
+		return plugin, store
+	}
+
+	t.Run("webhook transitions are recorded for tracked installations", func(t *testing.T) {
+		plugin, _ := setup()
+
+		plugin.recordWebhookEvent(&cloud.WebhookPayload{
+			Type:      cloud.TypeInstallation,
+			ID:        "someid",
+			OldState:  cloud.InstallationStateCreationRequested,
+			NewState:  cloud.InstallationStateStable,
+			Timestamp: 1600000000000000000,
+			ExtraData: map[string]string{"actor_id": "provisioner"},
+		})
+		plugin.recordWebhookEvent(&cloud.WebhookPayload{
+			Type:     cloud.TypeInstallation,
+			ID:       "otherid",
+			NewState: cloud.InstallationStateStable,
+		})
+		plugin.recordWebhookEvent(&cloud.WebhookPayload{
+			Type:     cloud.TypeCluster,
+			ID:       "someid",
+			NewState: cloud.ClusterStateStable,
+		})
+
+		events, err := plugin.getInstallationEvents("someid")
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, int64(1600000000000), events[0].Timestamp)
+		assert.Equal(t, eventSourceWebhook, events[0].Source)
+		assert.Equal(t, "provisioner", events[0].ActorID)
+		assert.Equal(t, "creation-requested → stable", events[0].Description())
+
+		events, err = plugin.getInstallationEvents("otherid")
+		require.NoError(t, err)
+		assert.Empty(t, events)
+	})
+
+	t.Run("events are capped", func(t *testing.T) {
+		plugin, _ := setup()
+
+		for i := 0; i < maxInstallationEvents+5; i++ {
+			plugin.recordPluginEvent("someid", ownerID, "restart", "")
+		}
+
+		events, err := plugin.getInstallationEvents("someid")
+		require.NoError(t, err)
+		assert.Len(t, events, maxInstallationEvents)
+	})
+
+	t.Run("command", func(t *testing.T) {
+		plugin, _ := setup()
+		plugin.recordPluginEvent("someid", ownerID, "create", "--size miniSingleton")
+		plugin.recordPluginEvent("someid", ownerID, "hibernate", "")
+
+		resp, isUserError, err := plugin.runEventsCommand([]string{"joramsinstall"}, &model.CommandArgs{UserId: ownerID})
+		require.NoError(t, err)
+		assert.False(t, isUserError)
+		assert.Contains(t, resp.Text, "| plugin | create | @joram | --size miniSingleton |")
+		assert.Contains(t, resp.Text, "| plugin | hibernate | @joram |  |")
+
+		_, isUserError, err = plugin.runEventsCommand([]string{"joramsinstall"}, &model.CommandArgs{UserId: "gabeid"})
+		require.Error(t, err)
+		assert.True(t, isUserError)
+
+		resp, _, err = plugin.runEventsCommand([]string{"joramsinstall"}, &model.CommandArgs{UserId: "adminid"})
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, "Events for installation joramsinstall")
+
+		_, isUserError, err = plugin.runEventsCommand([]string{}, &model.CommandArgs{UserId: ownerID})
+		require.Error(t, err)
+		assert.True(t, isUserError)
+	})
+
+	t.Run("api", func(t *testing.T) {
+		plugin, _ := setup()
+		plugin.recordPluginEvent("someid", ownerID, "restart", "")
+
+		get := func(userID, path string) *httptest.ResponseRecorder {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, path, nil)
+			id, ok := parseInstallationEventsPath(r.URL.Path)
+			require.True(t, ok)
+			plugin.handleInstallationEvents(w, r, userID, id)
+			return w
+		}
+
+		w := get(ownerID, "/api/v1/installations/someid/events")
+		require.Equal(t, http.StatusOK, w.Code)
+		var events []*installationEvent
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &events))
+		require.Len(t, events, 1)
+		assert.Equal(t, "restart", events[0].Action)
+
+		assert.Equal(t, http.StatusOK, get("adminid", "/api/v1/installations/someid/events").Code)
+		assert.Equal(t, http.StatusNotFound, get("gabeid", "/api/v1/installations/someid/events").Code)
+		assert.Equal(t, http.StatusNotFound, get(ownerID, "/api/v1/installations/otherid/events").Code)
+	})
+}
+
+func TestParseInstallationEventsPath(t *testing.T) {
+	id, ok := parseInstallationEventsPath("/api/v1/installations/someid/events")
+	assert.True(t, ok)
+	assert.Equal(t, "someid", id)
+
+	for _, path := range []string{
+		"/api/v1/installations//events",
+		"/api/v1/installations/someid",
+		"/api/v1/installations/someid/logs",
+		"/api/v1/installations/someid/events/more",
+	} {
+		_, ok = parseInstallationEventsPath(path)
+		assert.False(t, ok, path)
+	}
+}
+
+func TestEventArgs(t *testing.T) {
+	assert.Equal(t, "--size miniSingleton --env <hidden> --env=<hidden>", eventArgs([]string{"--size", "miniSingleton", "--env", "KEY=secret", "--env=OTHER=secret"}))
+	assert.Empty(t, eventArgs(nil))
+}
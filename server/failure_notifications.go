@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	actionDebugPacketPath = "/api/v1/actions/debug-packet"
+	actionRetryPath       = "/api/v1/actions/retry"
+)
+
+// installationFailureStates maps the installation states reporting a failure
+// to the operation that failed.
+var installationFailureStates = map[string]string{
+	cloud.InstallationStateCreationFailed:               "creation",
+	cloud.InstallationStateCreationNoCompatibleClusters: "creation",
+	cloud.InstallationStateUpdateFailed:                 "update",
+	cloud.InstallationStateDeletionFailed:               "deletion",
+	cloud.InstallationStateDBRestorationFailed:          "database restoration",
+	cloud.InstallationStateDBMigrationFailed:            "database migration",
+}
+
+// failedOperation returns the operation that failed for an installation which
+// moved to a failure state. Hibernation and wake-up failures are reported by
+// the provisioner as update failures, so the last plugin action on the
+// installation is used to tell them apart.
+func (p *Plugin) failedOperation(installationID string, payload *cloud.WebhookPayload) string {
+	operation := installationFailureStates[payload.NewState]
+	switch payload.OldState {
+	case cloud.InstallationStateHibernationRequested, cloud.InstallationStateHibernationInProgress:
+		return "hibernation"
+	case cloud.InstallationStateWakeUpRequested:
+		return "wake-up"
+	}
+	if operation != "update" {
+		return operation
+	}
+
+	events, err := p.getInstallationEvents(installationID)
+	if err != nil {
+		p.API.LogWarn(err.Error(), "installation", installationID)
+		return operation
+	}
+	for i := len(events) - 1; i >= 0; i-- {
+		switch events[i].Action {
+		case "hibernate":
+			return "hibernation"
+		case "wake-up":
+			return "wake-up"
+		case "update":
+			return operation
+		}
+	}
+
+	return operation
+}
+
+// retryableState returns if the failed operation of an installation in the
+// given state can be retried from the failure notification. Failed updates
+// can't be retried, as the provisioner already stores the requested
+// configuration and ignores an update which doesn't change it.
+func retryableState(state string) bool {
+	return state == cloud.InstallationStateCreationFailed
+}
+
+// notifyInstallationFailure sends the owner of an installation a DM about a
+// failed transition with links to the logs and buttons to gather a debug
+// packet or retry.
+func (p *Plugin) notifyInstallationFailure(payload *cloud.WebhookPayload) error {
+	install, err := p.getInstallation(payload.ID)
+	if err != nil {
+		return errors.Wrapf(err, "failed to get installation %s", payload.ID)
+	}
+	if install == nil {
+		return nil
+	}
+
+	installationLogsURL, err := getStringFromTemplate(installationLogsURLTmpl, install)
+	if err != nil {
+		return err
+	}
+
+	provisionerLogsURL, err := getStringFromTemplate(provisionerLogsURLTmpl, install)
+	if err != nil {
+		return err
+	}
+
+	message := fmt.Sprintf(`
+The %s of installation %s has failed.
+
+Transition: from %s to %s
+
+Grafana logs for this installation:
+
+- [Installation logs](%s)
+- [Provisioner logs](%s)
+`,
+		p.failedOperation(install.ID, payload), install.Name,
+		inlineCode(payload.OldState), inlineCode(payload.NewState),
+		installationLogsURL, provisionerLogsURL,
+	)
+	if payload.NewState == cloud.InstallationStateUpdateFailed {
+		message += fmt.Sprintf("\nTo try again, request the update with a different configuration using `/cloud update %s`.\n", install.Name)
+	}
+
+	actions := []*model.PostAction{
+		newInstallationAction("debugpacket", "Get debug packet", actionDebugPacketPath, install.ID),
+	}
+	if retryableState(payload.NewState) {
+		actions = append(actions, newInstallationAction("retry", "Retry", actionRetryPath, install.ID))
+	}
+
+	err = p.PostBotDMWithAttachments(install.OwnerID, message, []*model.SlackAttachment{{Actions: actions}})
+	if err != nil {
+		p.API.LogError(errors.Wrap(err, "failed to send installation failure notification").Error(), "installation", install.ID)
+	}
+
+	return nil
+}
+
+// newInstallationAction returns a message button calling a plugin action
+// endpoint for an installation.
+func newInstallationAction(id, name, path, installationID string) *model.PostAction {
+	return &model.PostAction{
+		Id:   id,
+		Name: name,
+		Type: model.PostActionTypeButton,
+		Integration: &model.PostActionIntegration{
+			URL: fmt.Sprintf("/plugins/%s%s", manifest.ID, path),
+			Context: map[string]interface{}{
+				"installation_id": installationID,
+			},
+		},
+	}
+}
+
+// retryInstallation retries the failed operation of an installation.
+func (p *Plugin) retryInstallation(install *Installation, userID string) (bool, error) {
+	installation, err := p.cloudClient.GetInstallation(install.ID, &cloud.GetInstallationRequest{})
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to get installation %s from the provisioner", install.Name)
+	}
+	if installation == nil {
+		return false, errors.Errorf("failed to find installation %s", install.Name)
+	}
+
+	switch installation.State {
+	case cloud.InstallationStateCreationFailed:
+		err = p.cloudClient.RetryCreateInstallation(install.ID)
+	case cloud.InstallationStateUpdateFailed:
+		return true, errors.Errorf("failed updates can't be retried, use /cloud update %s to request the update with a different configuration", install.Name)
+	default:
+		return true, errors.Errorf("installation state is currently %s and can't be retried", installation.State)
+	}
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to retry installation %s", install.Name)
+	}
+	p.recordPluginEvent(install.ID, userID, "retry", installation.State)
+
+	return false, nil
+}
+
+func (p *Plugin) handleInstallationAction(w http.ResponseWriter, r *http.Request, userID string) {
+	req := &model.PostActionIntegrationRequest{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		p.API.LogError(errors.Wrap(err, "Unable to decode post action request").Error())
+		http.Error(w, "Invalid request", http.StatusBadRequest)
+		return
+	}
+	installationID, _ := req.Context["installation_id"].(string)
+
+	install, err := p.getInstallation(installationID)
+	if err != nil {
+		p.API.LogError(errors.Wrap(err, "Unable to get installation").Error())
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	if install == nil || install.OwnerID != userID {
+		writeActionResponse(w, "Only the owner of the installation can do this.")
+		return
+	}
+
+	switch r.URL.Path {
+	case actionDebugPacketPath:
+		// Gathering a debug packet is slow, so it is sent once it is ready.
+		go func() {
+			if err := p.execGetDebugPacket(install.ID, userID, install.Name); err != nil {
+				p.API.LogError(errors.Wrap(err, "Unable to get debug packet").Error(), "installation", install.ID)
+				p.PostBotDM(userID, fmt.Sprintf("Failed to gather a debug packet for installation %s: %s", install.Name, err.Error()))
+			}
+		}()
+		writeActionResponse(w, fmt.Sprintf("Gathering debug data for `%s` now. The debug packet will be sent to you when it is ready.", install.Name))
+	case actionRetryPath:
+		isUserError, err := p.retryInstallation(install, userID)
+		if err != nil {
+			if !isUserError {
+				p.API.LogError(err.Error())
+			}
+			writeActionResponse(w, "Unable to retry: "+err.Error())
+			return
+		}
+		writeActionResponse(w, fmt.Sprintf("Retrying installation %s. You will receive a notification when its state changes.", install.Name))
+	case actionSetupRetryPath:
+		step, isUserError, err := p.resumeInstallationSetup(install, userID)
+		if err != nil {
+			if !isUserError {
+				p.API.LogError(err.Error())
+			}
+			writeActionResponse(w, "Unable to retry setup: "+err.Error())
+			return
+		}
+		writeActionResponse(w, fmt.Sprintf("Resuming the setup of installation %s from step `%s`. You will receive a DM when it is done.", install.Name, step))
+	case actionHibernatePath, actionUpgradePath:
+		cloudInstall, err := p.cloudClient.GetInstallation(install.ID, &cloud.GetInstallationRequest{})
+		if err != nil {
+			p.API.LogError(errors.Wrap(err, "Unable to get installation from the provisioner").Error(), "installation", install.ID)
+			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			return
+		}
+		if cloudInstall == nil {
+			writeActionResponse(w, fmt.Sprintf("Installation %s not found, it may have been deleted.", install.Name))
+			return
+		}
+		install.Installation = cloudInstall.Installation
+
+		if r.URL.Path == actionHibernatePath {
+			isUserError, err := p.hibernateInstallation(install, userID)
+			if err != nil {
+				if !isUserError {
+					p.API.LogError(err.Error())
+				}
+				writeActionResponse(w, "Unable to hibernate: "+err.Error())
+				return
+			}
+			writeActionResponse(w, fmt.Sprintf("Hibernation of installation %s has begun. You will receive a notification when it is hibernated.", install.Name))
+			return
+		}
+
+		version, _ := req.Context["version"].(string)
+		isUserError, err := p.upgradeInstallation(install, version, userID)
+		if err != nil {
+			if !isUserError {
+				p.API.LogError(err.Error())
+			}
+			writeActionResponse(w, "Unable to upgrade: "+err.Error())
+			return
+		}
+		writeActionResponse(w, fmt.Sprintf("Upgrade of installation %s to %s has begun. You will receive a notification when it is done.", install.Name, version))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func writeActionResponse(w http.ResponseWriter, text string) {
+	data, _ := json.Marshal(&model.PostActionIntegrationResponse{EphemeralText: text})
+	w.Write(data)
+}
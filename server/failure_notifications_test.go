@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFailedOperation(t *testing.T) {
+	api := &plugintest.API{}
+	store := newMockedKVStore(api)
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+
+	assert.Equal(t, "creation", plugin.failedOperation("someid", &cloud.WebhookPayload{OldState: cloud.InstallationStateCreationInProgress, NewState: cloud.InstallationStateCreationFailed}))
+	assert.Equal(t, "hibernation", plugin.failedOperation("someid", &cloud.WebhookPayload{OldState: cloud.InstallationStateHibernationInProgress, NewState: cloud.InstallationStateUpdateFailed}))
+	assert.Equal(t, "update", plugin.failedOperation("someid", &cloud.WebhookPayload{OldState: cloud.InstallationStateUpdateInProgress, NewState: cloud.InstallationStateUpdateFailed}))
+
+	store.values[installationEventsKeyPrefix+"someid"] = []byte(`[{"source": "plugin", "action": "wake-up"}, {"source": "webhook", "new_state": "update-in-progress"}]`)
+	assert.Equal(t, "wake-up", plugin.failedOperation("someid", &cloud.WebhookPayload{OldState: cloud.InstallationStateUpdateInProgress, NewState: cloud.InstallationStateUpdateFailed}))
+}
+
+func TestNotifyInstallationFailure(t *testing.T) {
+	api := &plugintest.API{}
+	store := newMockedKVStore(api)
+	store.values[StoreInstallsKey] = []byte(`[{"ID": "someid", "OwnerID": "joramid", "Name": "joramsinstall"}]`)
+	api.On("GetDirectChannel", "joramid", "botid").Return(&model.Channel{Id: "dmid"}, nil)
+
+	var post *model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		post = args.Get(0).(*model.Post)
+	}).Return(&model.Post{}, nil)
+
+	plugin := &Plugin{BotUserID: "botid", cloudClient: &MockClient{}}
+	plugin.SetAPI(api)
+
+	t.Run("retryable failure", func(t *testing.T) {
+		err := plugin.notifyInstallationFailure(&cloud.WebhookPayload{ID: "someid", OldState: cloud.InstallationStateCreationInProgress, NewState: cloud.InstallationStateCreationFailed})
+		require.NoError(t, err)
+		require.NotNil(t, post)
+		assert.Equal(t, "dmid", post.ChannelId)
+		assert.Contains(t, post.Message, "The creation of installation joramsinstall has failed.")
+		assert.Contains(t, post.Message, "[Provisioner logs](")
+
+		attachments := post.Attachments()
+		require.Len(t, attachments, 1)
+		require.Len(t, attachments[0].Actions, 2)
+		assert.Equal(t, "/plugins/"+manifest.ID+actionDebugPacketPath, attachments[0].Actions[0].Integration.URL)
+		assert.Equal(t, "someid", attachments[0].Actions[1].Integration.Context["installation_id"])
+	})
+
+	t.Run("failure which can't be retried", func(t *testing.T) {
+		err := plugin.notifyInstallationFailure(&cloud.WebhookPayload{ID: "someid", OldState: cloud.InstallationStateCreationInProgress, NewState: cloud.InstallationStateCreationNoCompatibleClusters})
+		require.NoError(t, err)
+		require.Len(t, post.Attachments()[0].Actions, 1)
+	})
+
+	t.Run("failed update", func(t *testing.T) {
+		err := plugin.notifyInstallationFailure(&cloud.WebhookPayload{ID: "someid", OldState: cloud.InstallationStateUpdateInProgress, NewState: cloud.InstallationStateUpdateFailed})
+		require.NoError(t, err)
+		require.Len(t, post.Attachments()[0].Actions, 1, "failed updates can't be retried")
+		assert.Contains(t, post.Message, "`/cloud update joramsinstall`")
+	})
+
+	t.Run("untracked installation", func(t *testing.T) {
+		post = nil
+		err := plugin.notifyInstallationFailure(&cloud.WebhookPayload{ID: "otherid", NewState: cloud.InstallationStateCreationFailed})
+		require.NoError(t, err)
+		assert.Nil(t, post)
+	})
+}
+
+func TestHandleInstallationAction(t *testing.T) {
+	mockedCloudClient := &MockClient{}
+	plugin := &Plugin{cloudClient: mockedCloudClient}
+
+	api := &plugintest.API{}
+	store := newMockedKVStore(api)
+	store.values[StoreInstallsKey] = []byte(`[{"ID": "someid", "OwnerID": "joramid", "Name": "joramsinstall"}]`)
+	api.On("LogWarn", mock.AnythingOfType("string"), mock.Anything, mock.Anything).Return()
+	plugin.SetAPI(api)
+
+	doAction := func(userID, path string) string {
+		body, err := json.Marshal(&model.PostActionIntegrationRequest{
+			Context: map[string]interface{}{"installation_id": "someid"},
+		})
+		require.NoError(t, err)
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, path, bytes.NewReader(body))
+		r.Header.Set("Mattermost-User-ID", userID)
+		plugin.handleInstallationAction(w, r, userID)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp model.PostActionIntegrationResponse
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.EphemeralText
+	}
+
+	t.Run("not the owner", func(t *testing.T) {
+		text := doAction("gabeid", actionRetryPath)
+		assert.Equal(t, "Only the owner of the installation can do this.", text)
+		assert.Empty(t, mockedCloudClient.retriedInstallationID)
+	})
+
+	t.Run("retry creation", func(t *testing.T) {
+		mockedCloudClient.overrideGetInstallationDTO = &cloud.InstallationDTO{Installation: &cloud.Installation{ID: "someid", State: cloud.InstallationStateCreationFailed}}
+		text := doAction("joramid", actionRetryPath)
+		assert.Contains(t, text, "Retrying installation joramsinstall.")
+		assert.Equal(t, "someid", mockedCloudClient.retriedInstallationID)
+
+		events, err := plugin.getInstallationEvents("someid")
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, "retry", events[0].Action)
+	})
+
+	t.Run("retry update", func(t *testing.T) {
+		mockedCloudClient.overrideGetInstallationDTO = &cloud.InstallationDTO{Installation: &cloud.Installation{ID: "someid", State: cloud.InstallationStateUpdateFailed, Version: "9.11.1", Image: imageEE}}
+		text := doAction("joramid", actionRetryPath)
+		assert.Equal(t, "Unable to retry: failed updates can't be retried, use /cloud update joramsinstall to request the update with a different configuration", text)
+		assert.Nil(t, mockedCloudClient.patchRequest, "an update which doesn't change anything leaves the installation in update-failed")
+		assert.Equal(t, cloud.InstallationStateUpdateFailed, mockedCloudClient.overrideGetInstallationDTO.State)
+
+		events, err := plugin.getInstallationEvents("someid")
+		require.NoError(t, err)
+		assert.Len(t, events, 1, "only the creation retry is recorded")
+	})
+
+	t.Run("retry in a state which can't be retried", func(t *testing.T) {
+		mockedCloudClient.overrideGetInstallationDTO = &cloud.InstallationDTO{Installation: &cloud.Installation{ID: "someid", State: cloud.InstallationStateStable}}
+		text := doAction("joramid", actionRetryPath)
+		assert.Equal(t, "Unable to retry: installation state is currently stable and can't be retried", text)
+	})
+
+	t.Run("hibernate a deleted installation", func(t *testing.T) {
+		store.values[StoreInstallsKey] = []byte(`[{"ID": "someid", "OwnerID": "joramid", "Name": "joramsinstall", "DNSRecords": [{"DomainName": "joramsinstall.test.mattermost.cloud"}]}]`)
+		mockedCloudClient.returnNilInstallation = true
+		defer func() { mockedCloudClient.returnNilInstallation = false }()
+
+		for _, path := range []string{actionHibernatePath, actionUpgradePath} {
+			text := doAction("joramid", path)
+			assert.Equal(t, "Installation joramsinstall not found, it may have been deleted.", text, path)
+		}
+	})
+}
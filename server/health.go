@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blang/semver/v4"
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	healthCheckTimeout = 10 * time.Second
+	// certificateExpiryWarning is how long before its expiry a certificate
+	// is reported as expiring soon.
+	certificateExpiryWarning = 14 * 24 * time.Hour
+
+	healthPass = "PASS"
+	healthWarn = "WARN"
+	healthFail = "FAIL"
+)
+
+// healthCheckTLSConfig is the TLS configuration used to check installation
+// certificates.
+var healthCheckTLSConfig = &tls.Config{}
+
+// healthCheckResult is the result of a single installation health check.
+type healthCheckResult struct {
+	Check   string
+	Result  string
+	Details string
+}
+
+// newInstallationClient returns a client for the API of an installation which
+// gives up on requests after the health check timeout.
+func newInstallationClient(domainName string) *model.Client4 {
+	client := model.NewAPIv4Client(fmt.Sprintf("https://%s", domainName))
+	client.HTTPClient = &http.Client{Timeout: healthCheckTimeout}
+	return client
+}
+
+// checkInstallationHealth runs the health checks of an installation.
+func checkInstallationHealth(install *cloud.InstallationDTO, expectedVersion string) []*healthCheckResult {
+	var results []*healthCheckResult
+
+	if install.State == cloud.InstallationStateStable {
+		results = append(results, &healthCheckResult{"Provisioner state", healthPass, install.State})
+	} else {
+		results = append(results, &healthCheckResult{"Provisioner state", healthWarn, install.State})
+	}
+
+	if len(install.DNSRecords) == 0 {
+		return append(results, &healthCheckResult{"DNS", healthFail, "the installation has no DNS records"})
+	}
+
+	for _, record := range install.DNSRecords {
+		results = append(results, checkDNS(record.DomainName), checkTLS(record.DomainName))
+	}
+
+	client := newInstallationClient(install.DNSRecords[0].DomainName)
+	start := time.Now()
+	status, serverVersion, err := getServerStatus(client)
+	latency := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		return append(results, &healthCheckResult{"Ping", healthFail, err.Error()})
+	}
+
+	if status["status"] == model.StatusOk {
+		results = append(results, &healthCheckResult{"Ping", healthPass, fmt.Sprintf("responded in %s", latency)})
+	} else {
+		results = append(results, &healthCheckResult{"Ping", healthFail, fmt.Sprintf("status %s", status["status"])})
+	}
+
+	// The reported statuses depend on the server version, so every status
+	// returned is checked.
+	var keys []string
+	for key := range status {
+		if strings.HasSuffix(key, "_status") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		result := healthPass
+		if status[key] != model.StatusOk {
+			result = healthFail
+		}
+		check := strings.ReplaceAll(strings.TrimSuffix(key, "_status"), "_", " ")
+		check = strings.ToUpper(check[:1]) + check[1:]
+		results = append(results, &healthCheckResult{check, result, status[key]})
+	}
+
+	return append(results, checkVersion(serverVersion, expectedVersion))
+}
+
+// getServerStatus returns the full server status reported by an installation
+// and its version. Unhealthy installations respond with status 500, whose
+// body Client4 discards, so the ping request is made directly to report which
+// statuses failed.
+func getServerStatus(client *model.Client4) (map[string]string, string, error) {
+	resp, err := client.HTTPClient.Get(client.APIURL + "/system/ping?get_server_status=true")
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusInternalServerError {
+		return nil, "", errors.Errorf("got unexpected status code %d", resp.StatusCode)
+	}
+
+	var values map[string]interface{}
+	err = json.NewDecoder(resp.Body).Decode(&values)
+	if err != nil && resp.StatusCode == http.StatusOK {
+		return nil, "", errors.Wrap(err, "failed to parse server status")
+	}
+
+	status := make(map[string]string, len(values))
+	for key, value := range values {
+		status[key] = fmt.Sprint(value)
+	}
+	if status["status"] == "" && resp.StatusCode == http.StatusInternalServerError {
+		status["status"] = model.StatusUnhealthy
+	}
+
+	return status, resp.Header.Get(model.HeaderVersionId), nil
+}
+
+func checkDNS(domainName string) *healthCheckResult {
+	check := "DNS " + domainName
+	host := domainName
+	if h, _, err := net.SplitHostPort(domainName); err == nil {
+		host = h
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	addresses, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil {
+		return &healthCheckResult{check, healthFail, err.Error()}
+	}
+
+	return &healthCheckResult{check, healthPass, strings.Join(addresses, ", ")}
+}
+
+func checkTLS(domainName string) *healthCheckResult {
+	check := "TLS " + domainName
+	address := domainName
+	if _, _, err := net.SplitHostPort(domainName); err != nil {
+		address = net.JoinHostPort(domainName, "443")
+	}
+
+	dialer := &net.Dialer{Timeout: healthCheckTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", address, healthCheckTLSConfig)
+	if err != nil {
+		return &healthCheckResult{check, healthFail, err.Error()}
+	}
+	defer conn.Close()
+
+	certificates := conn.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return &healthCheckResult{check, healthFail, "no certificate presented"}
+	}
+
+	expiry := certificates[0].NotAfter
+	details := fmt.Sprintf("certificate valid until %s", expiry.UTC().Format("2006-01-02"))
+	if time.Until(expiry) < certificateExpiryWarning {
+		return &healthCheckResult{check, healthWarn, details}
+	}
+
+	return &healthCheckResult{check, healthPass, details}
+}
+
+// checkVersion compares the version reported by an installation with the tag
+// it was deployed with. The reported version, such as 9.11.0.9.11.1.abc.true,
+// includes both the schema version and the build number of the release.
+func checkVersion(serverVersion, expectedVersion string) *healthCheckResult {
+	details := fmt.Sprintf("running %s, expected %s", serverVersion, expectedVersion)
+	if serverVersion == "" || expectedVersion == "" {
+		return &healthCheckResult{"Version", healthWarn, details}
+	}
+
+	expected := strings.TrimPrefix(expectedVersion, "v")
+	if strings.Contains("."+serverVersion+".", "."+expected+".") {
+		return &healthCheckResult{"Version", healthPass, details}
+	}
+
+	if _, err := semver.Parse(expected); err != nil {
+		// Tags such as master can't be compared with the running version.
+		return &healthCheckResult{"Version", healthWarn, details}
+	}
+
+	return &healthCheckResult{"Version", healthFail, details}
+}
+
+// healthTable renders health check results as a markdown table.
+func healthTable(results []*healthCheckResult) string {
+	table := "| Check | Result | Details |\n| -- | -- | -- |\n"
+	for _, result := range results {
+		table += fmt.Sprintf("| %s | %s | %s |\n", result.Check, result.Result, result.Details)
+	}
+	return table
+}
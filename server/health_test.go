@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"strings"
+	"testing"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckVersion(t *testing.T) {
+	assert.Equal(t, healthPass, checkVersion("9.11.0.9.11.1.abc.true", "9.11.1").Result)
+	assert.Equal(t, healthPass, checkVersion("9.11.0.9.11.1.abc.true", "v9.11.1").Result)
+	assert.Equal(t, healthFail, checkVersion("9.11.0.9.11.1.abc.true", "9.11.2").Result)
+	assert.Equal(t, healthWarn, checkVersion("9.11.0.12345.abc.true", "master").Result)
+	assert.Equal(t, healthWarn, checkVersion("", "9.11.1").Result)
+}
+
+func TestHealthCommand(t *testing.T) {
+	mm, server := newMockedMattermostTLSServer(t)
+	mm.version = "9.11.0.9.11.1.abc.true"
+	domain := strings.TrimPrefix(server.URL, "https://")
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	defaultTLSConfig := healthCheckTLSConfig
+	healthCheckTLSConfig = &tls.Config{RootCAs: roots}
+	defer func() { healthCheckTLSConfig = defaultTLSConfig }()
+
+	api := &plugintest.API{}
+	store := newMockedKVStore(api)
+	store.values[StoreInstallsKey] = []byte(`[{"ID": "someid", "OwnerID": "joramid", "Name": "joramsinstall", "Tag": "9.11.1"}]`)
+	api.On("HasPermissionTo", "gabeid", model.PermissionManageSystem).Return(false)
+
+	mockedCloudClient := &MockClient{overrideGetInstallationDTO: &cloud.InstallationDTO{
+		Installation: &cloud.Installation{ID: "someid", State: cloud.InstallationStateStable},
+		DNSRecords:   []*cloud.InstallationDNS{{DomainName: domain}},
+	}}
+	plugin := &Plugin{cloudClient: mockedCloudClient}
+	plugin.SetAPI(api)
+
+	resp, isUserError, err := plugin.runHealthCommand([]string{"joramsinstall"}, &model.CommandArgs{UserId: "joramid"})
+	require.NoError(t, err)
+	assert.False(t, isUserError)
+	assert.Contains(t, resp.Text, "Installation joramsinstall failed 1 of 7 health checks.")
+	assert.Contains(t, resp.Text, "| Provisioner state | PASS | stable |")
+	assert.Contains(t, resp.Text, "| DNS "+domain+" | PASS | 127.0.0.1 |")
+	assert.Contains(t, resp.Text, "| TLS "+domain+" | PASS | certificate valid until ")
+	assert.Contains(t, resp.Text, "| Ping | PASS | responded in ")
+	assert.Contains(t, resp.Text, "| Database | PASS | OK |")
+	assert.Contains(t, resp.Text, "| Filestore | FAIL | UNHEALTHY |")
+	assert.Contains(t, resp.Text, "| Version | PASS | running 9.11.0.9.11.1.abc.true, expected 9.11.1 |")
+
+	t.Run("unhealthy", func(t *testing.T) {
+		mm.lock.Lock()
+		mm.unhealthy = true
+		mm.lock.Unlock()
+		defer func() {
+			mm.lock.Lock()
+			mm.unhealthy = false
+			mm.lock.Unlock()
+		}()
+
+		resp, _, err := plugin.runHealthCommand([]string{"joramsinstall"}, &model.CommandArgs{UserId: "joramid"})
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, "| Ping | FAIL | status UNHEALTHY |")
+		assert.Contains(t, resp.Text, "| Database | FAIL | UNHEALTHY |", "the statuses of unhealthy installations are reported")
+		assert.Contains(t, resp.Text, "| Filestore | PASS | OK |")
+		assert.Contains(t, resp.Text, "| Version | PASS |")
+	})
+
+	_, isUserError, err = plugin.runHealthCommand([]string{"joramsinstall"}, &model.CommandArgs{UserId: "gabeid"})
+	require.EqualError(t, err, "no installation with the name joramsinstall found")
+	assert.True(t, isUserError)
+}
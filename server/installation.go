@@ -24,6 +24,15 @@ type Installation struct {
 	TestData           bool
 	Shared             bool
 	AllowSharedUpdates bool
+	// SetupProfile is the name of the setup profile applied once the
+	// installation is ready. The default profile is applied when empty.
+	SetupProfile string `json:",omitempty"`
+	// SampleData configures the test data generated when TestData is set.
+	// The mmctl sampledata defaults are used when nil.
+	SampleData *sampleDataOptions `json:",omitempty"`
+	// TeamID is the team the installation was created from, which usage is
+	// reported by.
+	TeamID string `json:",omitempty"`
 }
 
 // ToPrettyJSON will return a JSON string installation with indentation and new lines
@@ -145,6 +154,10 @@ func (p *Plugin) deleteInstallation(installationID string) error {
 				indexToDelete = index
 			}
 		}
+		if indexToDelete == -1 {
+			return nil
+		}
+		deleted := installs[indexToDelete]
 
 		installs = append(installs[:indexToDelete], installs[indexToDelete+1:]...)
 
@@ -163,6 +176,9 @@ func (p *Plugin) deleteInstallation(installationID string) error {
 		// If err is nil but ok is false, then something else updated the installs between the get and set above
 		// so we need to try again, otherwise we can break
 		if ok {
+			if err = p.archiveInstallationUsage(deleted); err != nil {
+				p.API.LogWarn(errors.Wrap(err, "unable to archive installation usage").Error(), "installation", installationID)
+			}
 			return nil
 		}
 		p.API.LogWarn("unable to store installs due to another process making an update first")
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	metricsPath      = "/metrics"
+	metricsNamespace = "mattermost_plugin_cloud"
+
+	metricsOutcomeSuccess   = "success"
+	metricsOutcomeUserError = "user_error"
+	metricsOutcomeError     = "error"
+)
+
+// setupDurationBuckets are the histogram buckets, in seconds, used for
+// installation setup durations.
+var setupDurationBuckets = []float64{30, 60, 120, 300, 600, 1200, 1800, 3600}
+
+// metrics are the Prometheus metrics published by the plugin. A nil *metrics
+// records nothing, so code paths don't need to check whether metrics are
+// enabled.
+type metrics struct {
+	registry *prometheus.Registry
+
+	commands             *prometheus.CounterVec
+	commandDuration      *prometheus.HistogramVec
+	cloudClientDuration  *prometheus.HistogramVec
+	cloudClientErrors    *prometheus.CounterVec
+	dockerLookups        *prometheus.CounterVec
+	dockerLookupDuration *prometheus.HistogramVec
+	webhookEvents        *prometheus.CounterVec
+	setupDuration        *prometheus.HistogramVec
+}
+
+func newMetrics() *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		commands: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "commands_total",
+			Help:      "Slash command invocations by subcommand and outcome.",
+		}, []string{"command", "outcome"}),
+		commandDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "command_duration_seconds",
+			Help:      "Slash command duration by subcommand.",
+		}, []string{"command"}),
+		cloudClientDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "cloud_client_request_duration_seconds",
+			Help:      "Provisioner API request latency by client method.",
+		}, []string{"method"}),
+		cloudClientErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "cloud_client_errors_total",
+			Help:      "Failed provisioner API requests by client method.",
+		}, []string{"method"}),
+		dockerLookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "docker_registry_lookups_total",
+			Help:      "Docker registry lookups by operation and outcome.",
+		}, []string{"operation", "outcome"}),
+		dockerLookupDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "docker_registry_lookup_duration_seconds",
+			Help:      "Docker registry lookup latency by operation.",
+		}, []string{"operation"}),
+		webhookEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "webhook_events_total",
+			Help:      "Provisioner webhook events received by type and new state.",
+		}, []string{"type", "state"}),
+		setupDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "setup_duration_seconds",
+			Help:      "Installation setup duration by outcome.",
+			Buckets:   setupDurationBuckets,
+		}, []string{"outcome"}),
+	}
+
+	m.registry.MustRegister(
+		m.commands,
+		m.commandDuration,
+		m.cloudClientDuration,
+		m.cloudClientErrors,
+		m.dockerLookups,
+		m.dockerLookupDuration,
+		m.webhookEvents,
+		m.setupDuration,
+	)
+
+	return m
+}
+
+func (m *metrics) observeCommand(command, outcome string, elapsed time.Duration) {
+	if m == nil {
+		return
+	}
+	m.commands.WithLabelValues(command, outcome).Inc()
+	m.commandDuration.WithLabelValues(command).Observe(elapsed.Seconds())
+}
+
+func (m *metrics) observeCloudClientRequest(method string, elapsed time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.cloudClientDuration.WithLabelValues(method).Observe(elapsed.Seconds())
+	if err != nil {
+		m.cloudClientErrors.WithLabelValues(method).Inc()
+	}
+}
+
+func (m *metrics) observeDockerLookup(operation string, elapsed time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	outcome := metricsOutcomeSuccess
+	if err != nil {
+		outcome = metricsOutcomeError
+	}
+	m.dockerLookups.WithLabelValues(operation, outcome).Inc()
+	m.dockerLookupDuration.WithLabelValues(operation).Observe(elapsed.Seconds())
+}
+
+func (m *metrics) observeWebhookEvent(eventType, state string) {
+	if m == nil {
+		return
+	}
+	m.webhookEvents.WithLabelValues(eventType, state).Inc()
+}
+
+func (m *metrics) observeSetup(elapsed time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	outcome := metricsOutcomeSuccess
+	if err != nil {
+		outcome = metricsOutcomeError
+	}
+	m.setupDuration.WithLabelValues(outcome).Observe(elapsed.Seconds())
+}
+
+// stateCollector collects the metrics read from the plugin state when metrics
+// are scraped.
+type stateCollector struct {
+	p *Plugin
+}
+
+var (
+	webhookQueueDepthDesc       = newStateDesc("webhook_queue_depth", "Webhook events waiting to be processed.")
+	webhookDeadLettersDesc      = newStateDesc("webhook_dead_letters", "Webhook events which failed processing too many times.")
+	dockerCacheTagHitsDesc      = newStateDesc("docker_cache_tag_hits_total", "Docker tag lookups served from the cache since activation.")
+	dockerCacheTagMissesDesc    = newStateDesc("docker_cache_tag_misses_total", "Docker tag lookups not served from the cache since activation.")
+	dockerCacheDigestHitsDesc   = newStateDesc("docker_cache_digest_hits_total", "Docker digest lookups served from the cache since activation.")
+	dockerCacheDigestMissesDesc = newStateDesc("docker_cache_digest_misses_total", "Docker digest lookups not served from the cache since activation.")
+)
+
+func newStateDesc(name, help string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "", name), help, nil, nil)
+}
+
+// Describe sends nothing, making the collector unchecked: its metrics are only
+// collected when the state they are read from is available.
+func (c *stateCollector) Describe(chan<- *prometheus.Desc) {}
+
+func (c *stateCollector) Collect(ch chan<- prometheus.Metric) {
+	p := c.p
+	if p.webhookQueue != nil {
+		events, err := p.webhookQueue.Events()
+		if err != nil {
+			p.API.LogWarn("Failed to get webhook queue depth for metrics", "error", err.Error())
+		} else {
+			ch <- prometheus.MustNewConstMetric(webhookQueueDepthDesc, prometheus.GaugeValue, float64(len(events)))
+		}
+
+		deadLetters, err := p.webhookQueue.DeadLetters()
+		if err != nil {
+			p.API.LogWarn("Failed to get webhook dead letters for metrics", "error", err.Error())
+		} else {
+			ch <- prometheus.MustNewConstMetric(webhookDeadLettersDesc, prometheus.GaugeValue, float64(len(deadLetters)))
+		}
+	}
+
+	if cache, ok := p.dockerClient.(dockerCacheClient); ok {
+		stats := cache.Stats()
+		ch <- prometheus.MustNewConstMetric(dockerCacheTagHitsDesc, prometheus.CounterValue, float64(stats.TagHits))
+		ch <- prometheus.MustNewConstMetric(dockerCacheTagMissesDesc, prometheus.CounterValue, float64(stats.TagMisses))
+		ch <- prometheus.MustNewConstMetric(dockerCacheDigestHitsDesc, prometheus.CounterValue, float64(stats.DigestHits))
+		ch <- prometheus.MustNewConstMetric(dockerCacheDigestMissesDesc, prometheus.CounterValue, float64(stats.DigestMisses))
+	}
+}
+
+// handleMetrics serves the plugin metrics in the Prometheus text format.
+// Requests must present the configured metrics token as a bearer token.
+func (p *Plugin) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	token := p.getConfiguration().MetricsToken
+	if token == "" || p.metrics == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	provided := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// The state collector is registered for each scrape, as the metrics are
+	// created before the plugin state they read from.
+	state := prometheus.NewRegistry()
+	state.MustRegister(&stateCollector{p: p})
+
+	promhttp.HandlerFor(prometheus.Gatherers{p.metrics.registry, state}, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
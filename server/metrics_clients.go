@@ -0,0 +1,172 @@
+package main
+
+import (
+	"time"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+)
+
+// instrumentedCloudClient is a CloudClient recording the latency and errors of
+// every provisioner request.
+type instrumentedCloudClient struct {
+	client  CloudClient
+	metrics *metrics
+}
+
+func newInstrumentedCloudClient(client CloudClient, metrics *metrics) CloudClient {
+	if metrics == nil {
+		return client
+	}
+	return &instrumentedCloudClient{client: client, metrics: metrics}
+}
+
+func (c *instrumentedCloudClient) observe(method string, start time.Time, err error) {
+	c.metrics.observeCloudClientRequest(method, time.Since(start), err)
+}
+
+func (c *instrumentedCloudClient) GetClusters(request *cloud.GetClustersRequest) ([]*cloud.ClusterDTO, error) {
+	start := time.Now()
+	clusters, err := c.client.GetClusters(request)
+	c.observe("GetClusters", start, err)
+	return clusters, err
+}
+
+func (c *instrumentedCloudClient) CreateInstallation(request *cloud.CreateInstallationRequest) (*cloud.InstallationDTO, error) {
+	start := time.Now()
+	installation, err := c.client.CreateInstallation(request)
+	c.observe("CreateInstallation", start, err)
+	return installation, err
+}
+
+func (c *instrumentedCloudClient) RetryCreateInstallation(installationID string) error {
+	start := time.Now()
+	err := c.client.RetryCreateInstallation(installationID)
+	c.observe("RetryCreateInstallation", start, err)
+	return err
+}
+
+func (c *instrumentedCloudClient) GetInstallation(installationID string, request *cloud.GetInstallationRequest) (*cloud.InstallationDTO, error) {
+	start := time.Now()
+	installation, err := c.client.GetInstallation(installationID, request)
+	c.observe("GetInstallation", start, err)
+	return installation, err
+}
+
+func (c *instrumentedCloudClient) GetInstallationByDNS(DNS string, request *cloud.GetInstallationRequest) (*cloud.InstallationDTO, error) {
+	start := time.Now()
+	installation, err := c.client.GetInstallationByDNS(DNS, request)
+	c.observe("GetInstallationByDNS", start, err)
+	return installation, err
+}
+
+func (c *instrumentedCloudClient) GetInstallations(request *cloud.GetInstallationsRequest) ([]*cloud.InstallationDTO, error) {
+	start := time.Now()
+	installations, err := c.client.GetInstallations(request)
+	c.observe("GetInstallations", start, err)
+	return installations, err
+}
+
+func (c *instrumentedCloudClient) UpdateInstallation(installationID string, request *cloud.PatchInstallationRequest) (*cloud.InstallationDTO, error) {
+	start := time.Now()
+	installation, err := c.client.UpdateInstallation(installationID, request)
+	c.observe("UpdateInstallation", start, err)
+	return installation, err
+}
+
+func (c *instrumentedCloudClient) HibernateInstallation(installationID string) (*cloud.InstallationDTO, error) {
+	start := time.Now()
+	installation, err := c.client.HibernateInstallation(installationID)
+	c.observe("HibernateInstallation", start, err)
+	return installation, err
+}
+
+func (c *instrumentedCloudClient) WakeupInstallation(installationID string, request *cloud.PatchInstallationRequest) (*cloud.InstallationDTO, error) {
+	start := time.Now()
+	installation, err := c.client.WakeupInstallation(installationID, request)
+	c.observe("WakeupInstallation", start, err)
+	return installation, err
+}
+
+func (c *instrumentedCloudClient) DeleteInstallation(installationID string) error {
+	start := time.Now()
+	err := c.client.DeleteInstallation(installationID)
+	c.observe("DeleteInstallation", start, err)
+	return err
+}
+
+func (c *instrumentedCloudClient) LockDeletionLockForInstallation(installationID string) error {
+	start := time.Now()
+	err := c.client.LockDeletionLockForInstallation(installationID)
+	c.observe("LockDeletionLockForInstallation", start, err)
+	return err
+}
+
+func (c *instrumentedCloudClient) UnlockDeletionLockForInstallation(installationID string) error {
+	start := time.Now()
+	err := c.client.UnlockDeletionLockForInstallation(installationID)
+	c.observe("UnlockDeletionLockForInstallation", start, err)
+	return err
+}
+
+func (c *instrumentedCloudClient) GetClusterInstallations(request *cloud.GetClusterInstallationsRequest) ([]*cloud.ClusterInstallation, error) {
+	start := time.Now()
+	clusterInstallations, err := c.client.GetClusterInstallations(request)
+	c.observe("GetClusterInstallations", start, err)
+	return clusterInstallations, err
+}
+
+func (c *instrumentedCloudClient) RunMattermostCLICommandOnClusterInstallation(clusterInstallationID string, subcommand []string) ([]byte, error) {
+	start := time.Now()
+	output, err := c.client.RunMattermostCLICommandOnClusterInstallation(clusterInstallationID, subcommand)
+	c.observe("RunMattermostCLICommandOnClusterInstallation", start, err)
+	return output, err
+}
+
+func (c *instrumentedCloudClient) ExecClusterInstallationCLI(clusterInstallationID, command string, subcommand []string) ([]byte, error) {
+	start := time.Now()
+	output, err := c.client.ExecClusterInstallationCLI(clusterInstallationID, command, subcommand)
+	c.observe("ExecClusterInstallationCLI", start, err)
+	return output, err
+}
+
+func (c *instrumentedCloudClient) ExecClusterInstallationPPROF(clusterInstallationID string) ([]byte, error) {
+	start := time.Now()
+	output, err := c.client.ExecClusterInstallationPPROF(clusterInstallationID)
+	c.observe("ExecClusterInstallationPPROF", start, err)
+	return output, err
+}
+
+func (c *instrumentedCloudClient) GetGroup(groupID string) (*cloud.GroupDTO, error) {
+	start := time.Now()
+	group, err := c.client.GetGroup(groupID)
+	c.observe("GetGroup", start, err)
+	return group, err
+}
+
+// instrumentedDockerRegistry is a dockerRegistry recording the latency and
+// outcome of every registry lookup.
+type instrumentedDockerRegistry struct {
+	registry dockerRegistry
+	metrics  *metrics
+}
+
+func newInstrumentedDockerRegistry(registry dockerRegistry, metrics *metrics) dockerRegistry {
+	if metrics == nil {
+		return registry
+	}
+	return &instrumentedDockerRegistry{registry: registry, metrics: metrics}
+}
+
+func (r *instrumentedDockerRegistry) Tags(repository string) ([]string, error) {
+	start := time.Now()
+	tags, err := r.registry.Tags(repository)
+	r.metrics.observeDockerLookup("tags", time.Since(start), err)
+	return tags, err
+}
+
+func (r *instrumentedDockerRegistry) GetDigestForTag(desiredTag, repository string) (string, error) {
+	start := time.Now()
+	digest, err := r.registry.GetDigestForTag(desiredTag, repository)
+	r.metrics.observeDockerLookup("digest", time.Since(start), err)
+	return digest, err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/pkg/errors"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// findMetric returns the metric of the family with the given label values,
+// failing the test if there is none.
+func findMetric(t *testing.T, families map[string]*dto.MetricFamily, name string, labels map[string]string) *dto.Metric {
+	t.Helper()
+
+	family := families[name]
+	require.NotNil(t, family, "no metric family %s", name)
+	for _, metric := range family.GetMetric() {
+		values := make(map[string]string)
+		for _, label := range metric.GetLabel() {
+			values[label.GetName()] = label.GetValue()
+		}
+		if assert.ObjectsAreEqual(labels, values) {
+			return metric
+		}
+	}
+	require.Failf(t, "metric not found", "no metric %s with the labels %v", name, labels)
+	return nil
+}
+
+func TestNilMetrics(t *testing.T) {
+	var m *metrics
+	m.observeCommand("list", metricsOutcomeSuccess, time.Second)
+	m.observeCloudClientRequest("GetInstallations", time.Second, nil)
+	m.observeDockerLookup("tag", time.Second, nil)
+	m.observeWebhookEvent("installation", cloud.InstallationStateStable)
+	m.observeSetup(time.Second, nil)
+}
+
+func TestInstrumentedCloudClient(t *testing.T) {
+	m := newMetrics()
+	mockedCloudClient := &MockClient{}
+	client := newInstrumentedCloudClient(mockedCloudClient, m)
+
+	_, err := client.GetInstallations(&cloud.GetInstallationsRequest{})
+	require.NoError(t, err)
+
+	mockedCloudClient.err = errors.New("provisioner unavailable")
+	_, err = client.GetInstallations(&cloud.GetInstallationsRequest{})
+	require.Error(t, err)
+
+	gathered, err := m.registry.Gather()
+	require.NoError(t, err)
+	families := make(map[string]*dto.MetricFamily)
+	for _, family := range gathered {
+		families[family.GetName()] = family
+	}
+	labels := map[string]string{"method": "GetInstallations"}
+	assert.EqualValues(t, 2, findMetric(t, families, "mattermost_plugin_cloud_cloud_client_request_duration_seconds", labels).GetHistogram().GetSampleCount())
+	assert.EqualValues(t, 1, findMetric(t, families, "mattermost_plugin_cloud_cloud_client_errors_total", labels).GetCounter().GetValue())
+
+	assert.Equal(t, mockedCloudClient, newInstrumentedCloudClient(mockedCloudClient, nil), "clients aren't wrapped without metrics")
+}
+
+func TestHandleMetrics(t *testing.T) {
+	api := &plugintest.API{}
+	plugin := &Plugin{metrics: newMetrics(), configuration: &configuration{}}
+	plugin.SetAPI(api)
+	plugin.metrics.observeCommand("list", metricsOutcomeUserError, time.Millisecond)
+	plugin.metrics.observeWebhookEvent("installation", cloud.InstallationStateStable)
+
+	get := func(authorization string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, metricsPath, nil)
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		plugin.handleMetrics(w, r)
+		return w
+	}
+
+	assert.Equal(t, http.StatusNotFound, get("").Code, "metrics are disabled without a token")
+
+	plugin.configuration.MetricsToken = "metricstoken"
+	assert.Equal(t, http.StatusUnauthorized, get("").Code)
+	assert.Equal(t, http.StatusUnauthorized, get("Bearer wrongtoken").Code)
+
+	w := get("Bearer metricstoken")
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Header().Get("Content-Type"), "text/plain")
+
+	var parser expfmt.TextParser
+	families, err := parser.TextToMetricFamilies(w.Body)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, findMetric(t, families, "mattermost_plugin_cloud_commands_total", map[string]string{"command": "list", "outcome": metricsOutcomeUserError}).GetCounter().GetValue())
+	assert.EqualValues(t, 1, findMetric(t, families, "mattermost_plugin_cloud_command_duration_seconds", map[string]string{"command": "list"}).GetHistogram().GetSampleCount())
+	assert.EqualValues(t, 1, findMetric(t, families, "mattermost_plugin_cloud_webhook_events_total", map[string]string{"type": "installation", "state": cloud.InstallationStateStable}).GetCounter().GetValue())
+	assert.NotContains(t, families, "mattermost_plugin_cloud_webhook_queue_depth", "state metrics are only collected when available")
+
+	plugin.dockerClient = NewCachedDockerClient(&mockedDockerRegistry{})
+	families, err = parser.TextToMetricFamilies(get("Bearer metricstoken").Body)
+	require.NoError(t, err)
+	assert.Zero(t, findMetric(t, families, "mattermost_plugin_cloud_docker_cache_tag_hits_total", map[string]string{}).GetCounter().GetValue())
+}
@@ -30,8 +30,20 @@ type Plugin struct {
 	// setConfiguration for usage.
 	configuration *configuration
 
-	appBarIconData          string
-	latestMattermostVersion *latestMattermostVersionCache
+	appBarIconData string
+
+	releaseSource ReleaseSource
+	releases      releasesCache
+
+	webhookQueue        *webhookQueue
+	stuckWatchdog       *stuckWatchdog
+	reachabilityMonitor *reachabilityMonitor
+	digestScheduler     *digestScheduler
+	sampleDataJobs      sampleDataJobs
+	importJobs          backgroundJobs
+	setupJobs           backgroundJobs
+
+	metrics *metrics
 }
 
 // CloudClient is the interface for managing cloud installations.
@@ -39,6 +51,7 @@ type CloudClient interface {
 	GetClusters(*cloud.GetClustersRequest) ([]*cloud.ClusterDTO, error)
 
 	CreateInstallation(request *cloud.CreateInstallationRequest) (*cloud.InstallationDTO, error)
+	RetryCreateInstallation(installationID string) error
 	GetInstallation(installationID string, request *cloud.GetInstallationRequest) (*cloud.InstallationDTO, error)
 	GetInstallationByDNS(DNS string, request *cloud.GetInstallationRequest) (*cloud.InstallationDTO, error)
 	GetInstallations(*cloud.GetInstallationsRequest) ([]*cloud.InstallationDTO, error)
@@ -136,6 +149,48 @@ func (p *Plugin) OnActivate() error {
 	p.appBarIconData = "data:image/png;base64," + base64.StdEncoding.EncodeToString(appBarIcon)
 
 	p.setCloudClient()
-	p.dockerClient = NewDockerClient()
+	p.setReleaseSource(NewGithubReleaseSource(config.ReleasesURL))
+	p.dockerClient = NewCachedDockerClient(newInstrumentedDockerRegistry(NewDockerClient(), p.metrics))
+
+	p.webhookQueue = newWebhookQueue(p)
+	p.webhookQueue.Start(webhookQueueWorkers)
+
+	p.stuckWatchdog = newStuckWatchdog(p)
+	p.stuckWatchdog.Start()
+
+	p.reachabilityMonitor = newReachabilityMonitor(p)
+	p.reachabilityMonitor.Start()
+
+	p.digestScheduler = newDigestScheduler(p)
+	p.digestScheduler.Start()
+
 	return p.API.RegisterCommand(p.getCommand())
 }
+
+// OnDeactivate stops background processing. Queued webhook events are
+// processed after the plugin is activated again. Running sample data jobs,
+// imports and resumed setups are waited for briefly, then marked as
+// interrupted.
+func (p *Plugin) OnDeactivate() error {
+	if p.webhookQueue != nil {
+		p.webhookQueue.Stop()
+	}
+	if p.stuckWatchdog != nil {
+		p.stuckWatchdog.Stop()
+	}
+	if p.reachabilityMonitor != nil {
+		p.reachabilityMonitor.Stop()
+	}
+	if p.digestScheduler != nil {
+		p.digestScheduler.Stop()
+	}
+	p.stopSampleDataJobs(sampleDataStopTimeout)
+	if !p.importJobs.stopAndWait(importStopTimeout) {
+		p.API.LogWarn("Imports still running after the plugin stopped")
+	}
+	if !p.setupJobs.stopAndWait(setupStopTimeout) {
+		p.API.LogWarn("Installation setups still running after the plugin stopped")
+	}
+
+	return nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+// pluginRole is the level of access a user has to the plugin. Each role
+// includes the permissions of the roles before it.
+type pluginRole int
+
+const (
+	roleNone pluginRole = iota
+	roleViewer
+	roleUser
+	rolePowerUser
+	roleAdmin
+)
+
+var roleNames = map[pluginRole]string{
+	roleNone:      "none",
+	roleViewer:    "viewer",
+	roleUser:      "user",
+	rolePowerUser: "power-user",
+	roleAdmin:     "admin",
+}
+
+func (r pluginRole) String() string {
+	return roleNames[r]
+}
+
+func parsePluginRole(name string) (pluginRole, error) {
+	for role, roleName := range roleNames {
+		if role != roleNone && roleName == name {
+			return role, nil
+		}
+	}
+
+	return roleNone, errors.Errorf("invalid role %q, must be viewer, user, power-user or admin", name)
+}
+
+// permission is an action on the plugin which requires a minimum role.
+type permission string
+
+const (
+	permissionViewInstallations   permission = "view-installations"
+	permissionManageInstallations permission = "manage-installations"
+	// permissionRunCLI allows running CLI commands on owned installations.
+	permissionRunCLI            permission = "run-cli"
+	permissionCreateIsolated    permission = "create-isolated"
+	permissionUsePowerUserSizes permission = "use-power-user-sizes"
+	permissionAdministerPlugin  permission = "administer-plugin"
+	permissionReceiveDigest     permission = "receive-digest"
+)
+
+// permissionRoles is the minimum role required for each permission.
+var permissionRoles = map[permission]pluginRole{
+	permissionViewInstallations:   roleViewer,
+	permissionReceiveDigest:       roleViewer,
+	permissionManageInstallations: roleUser,
+	permissionRunCLI:              roleUser,
+	permissionCreateIsolated:      rolePowerUser,
+	permissionUsePowerUserSizes:   rolePowerUser,
+	permissionAdministerPlugin:    roleAdmin,
+}
+
+// commandPermissions is the permission required by each slash command.
+// Commands not listed only show the help, which requires viewing access.
+var commandPermissions = map[string]permission{
+	"list":            permissionViewInstallations,
+	"events":          permissionViewInstallations,
+	"health":          permissionViewInstallations,
+	"info":            permissionViewInstallations,
+	"digest":          permissionReceiveDigest,
+	"token":           permissionManageInstallations,
+	"create":          permissionManageInstallations,
+	"update":          permissionManageInstallations,
+	"upgrade":         permissionManageInstallations,
+	"delete":          permissionManageInstallations,
+	"restart":         permissionManageInstallations,
+	"hibernate":       permissionManageInstallations,
+	"wake-up":         permissionManageInstallations,
+	"share":           permissionManageInstallations,
+	"unshare":         permissionManageInstallations,
+	"import":          permissionManageInstallations,
+	"import-data":     permissionManageInstallations,
+	"deletion-lock":   permissionManageInstallations,
+	"deletion-unlock": permissionManageInstallations,
+	"setup-profile":   permissionManageInstallations,
+	"setup-retry":     permissionManageInstallations,
+	"credentials":     permissionManageInstallations,
+	"rotate-password": permissionManageInstallations,
+	"debug-packet":    permissionManageInstallations,
+	"mmcli":           permissionRunCLI,
+	"mmctl":           permissionRunCLI,
+	"status":          permissionAdministerPlugin,
+	"admin":           permissionAdministerPlugin,
+	"report":          permissionAdministerPlugin,
+}
+
+// roleAssignment grants a role to the users matching any of its selectors. An
+// assignment without selectors matches every user.
+type roleAssignment struct {
+	Role         string   `json:"role"`
+	EmailDomains []string `json:"email_domains"`
+	Teams        []string `json:"teams"`
+	Groups       []string `json:"groups"`
+	Users        []string `json:"users"`
+
+	role pluginRole
+}
+
+func (a *roleAssignment) matchesEveryone() bool {
+	return len(a.EmailDomains) == 0 && len(a.Teams) == 0 && len(a.Groups) == 0 && len(a.Users) == 0
+}
+
+func parseRoleAssignments(raw string) ([]*roleAssignment, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+
+	var assignments []*roleAssignment
+	err := json.Unmarshal([]byte(raw), &assignments)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse role assignments")
+	}
+	for _, assignment := range assignments {
+		assignment.role, err = parsePluginRole(assignment.Role)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return assignments, nil
+}
+
+// loadRoleAssignments parses the role assignments once, so that permission
+// checks don't parse them on every request.
+func (c *configuration) loadRoleAssignments() error {
+	var err error
+	c.roleAssignments, err = parseRoleAssignments(c.RoleAssignments)
+	return err
+}
+
+// getRoleAssignments returns the parsed role assignments, parsing them if
+// they weren't loaded.
+func (c *configuration) getRoleAssignments() []*roleAssignment {
+	if c.roleAssignments != nil {
+		return c.roleAssignments
+	}
+	assignments, err := parseRoleAssignments(c.RoleAssignments)
+	if err != nil {
+		return nil
+	}
+	return assignments
+}
+
+// userRoleSubject holds the user attributes roles are assigned by. Teams and
+// groups are only fetched when an assignment selects by them.
+type userRoleSubject struct {
+	plugin *Plugin
+	user   *model.User
+	teams  map[string]bool
+	groups map[string]bool
+}
+
+func (s *userRoleSubject) inTeam(name string) bool {
+	if s.teams == nil {
+		s.teams = map[string]bool{}
+		teams, appErr := s.plugin.API.GetTeamsForUser(s.user.Id)
+		if appErr != nil {
+			s.plugin.API.LogWarn("Failed to get teams of user", "user", s.user.Id, "error", appErr.Error())
+		}
+		for _, team := range teams {
+			s.teams[strings.ToLower(team.Name)] = true
+		}
+	}
+
+	return s.teams[strings.ToLower(name)]
+}
+
+func (s *userRoleSubject) inGroup(name string) bool {
+	if s.groups == nil {
+		s.groups = map[string]bool{}
+		groups, appErr := s.plugin.API.GetGroupsForUser(s.user.Id)
+		if appErr != nil {
+			s.plugin.API.LogWarn("Failed to get groups of user", "user", s.user.Id, "error", appErr.Error())
+		}
+		for _, group := range groups {
+			if group.Name != nil {
+				s.groups[strings.ToLower(*group.Name)] = true
+			}
+		}
+	}
+
+	return s.groups[strings.ToLower(strings.TrimPrefix(name, "@"))]
+}
+
+func (s *userRoleSubject) matches(assignment *roleAssignment) bool {
+	if assignment.matchesEveryone() {
+		return true
+	}
+	for _, domain := range assignment.EmailDomains {
+		if strings.HasSuffix(strings.ToLower(s.user.Email), "@"+strings.ToLower(strings.TrimPrefix(domain, "@"))) {
+			return true
+		}
+	}
+	for _, username := range assignment.Users {
+		if strings.EqualFold(s.user.Username, strings.TrimPrefix(username, "@")) {
+			return true
+		}
+	}
+	for _, team := range assignment.Teams {
+		if s.inTeam(team) {
+			return true
+		}
+	}
+	for _, group := range assignment.Groups {
+		if s.inGroup(group) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getUserRole returns the role of a user. Without role assignments, users
+// allowed by the email domain setting are power users, as they could use
+// every non-admin command before roles were introduced.
+func (p *Plugin) getUserRole(userID string) pluginRole {
+	if p.authorizedPluginAdmin(userID) {
+		return roleAdmin
+	}
+
+	assignments := p.getConfiguration().getRoleAssignments()
+	if len(assignments) == 0 {
+		if p.authorizedPluginUser(userID) {
+			return rolePowerUser
+		}
+		return roleNone
+	}
+
+	user, appErr := p.API.GetUser(userID)
+	if appErr != nil {
+		p.API.LogError("Failed to get user", "error", appErr)
+		return roleNone
+	}
+
+	subject := &userRoleSubject{plugin: p, user: user}
+	role := roleNone
+	for _, assignment := range assignments {
+		if assignment.role > role && subject.matches(assignment) {
+			role = assignment.role
+		}
+	}
+
+	return role
+}
+
+// hasPermission returns if the user has a role granting the permission.
+func (p *Plugin) hasPermission(userID string, perm permission) bool {
+	required, ok := permissionRoles[perm]
+	if !ok {
+		return false
+	}
+	if required == roleAdmin {
+		return p.authorizedPluginAdmin(userID)
+	}
+	if len(p.getConfiguration().getRoleAssignments()) == 0 {
+		// Avoid looking up admin permissions when they don't matter.
+		return p.authorizedPluginUser(userID)
+	}
+
+	return p.getUserRole(userID) >= required
+}
+
+// checkInstallationPermissions returns an error if the user isn't allowed to
+// use the size or affinity of an installation.
+func (p *Plugin) checkInstallationPermissions(userID, size, affinity string) error {
+	if affinity == cloud.InstallationAffinityIsolated && !p.hasPermission(userID, permissionCreateIsolated) {
+		return errors.Wrap(permissionDeniedError(permissionCreateIsolated), "isolated installations are restricted")
+	}
+	if size != "" && p.getConfiguration().powerUserSize(size) && !p.hasPermission(userID, permissionUsePowerUserSizes) {
+		return errors.Wrapf(permissionDeniedError(permissionUsePowerUserSizes), "size %s is restricted", size)
+	}
+
+	return nil
+}
+
+// permissionDeniedError returns the error shown when a user lacks a
+// permission.
+func permissionDeniedError(perm permission) error {
+	return errors.Errorf("permission denied, this requires the %s role", permissionRoles[perm])
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseRoleAssignments(t *testing.T) {
+	assignments, err := parseRoleAssignments(`[{"role": "viewer"}, {"role": "power-user", "teams": ["qa"]}]`)
+	require.NoError(t, err)
+	require.Len(t, assignments, 2)
+	assert.Equal(t, roleViewer, assignments[0].role)
+	assert.True(t, assignments[0].matchesEveryone())
+	assert.Equal(t, rolePowerUser, assignments[1].role)
+
+	assignments, err = parseRoleAssignments(" ")
+	require.NoError(t, err)
+	assert.Empty(t, assignments)
+
+	_, err = parseRoleAssignments(`[{"role": "owner"}]`)
+	assert.EqualError(t, err, `invalid role "owner", must be viewer, user, power-user or admin`)
+	_, err = parseRoleAssignments(`{"role": "user"}`)
+	assert.Error(t, err)
+}
+
+func newRBACTestPlugin(roleAssignments string) *Plugin {
+	api := &plugintest.API{}
+	newMockedKVStore(api)
+	api.On("HasPermissionTo", "adminid", model.PermissionManageSystem).Return(true)
+	api.On("HasPermissionTo", mock.AnythingOfType("string"), model.PermissionManageSystem).Return(false)
+	api.On("GetUser", "viewerid").Return(&model.User{Id: "viewerid", Username: "viewer", Email: "viewer@example.com"}, nil)
+	api.On("GetUser", "userid").Return(&model.User{Id: "userid", Username: "user", Email: "user@mattermost.com"}, nil)
+	api.On("GetUser", "qaid").Return(&model.User{Id: "qaid", Username: "qa", Email: "qa@example.com"}, nil)
+	api.On("GetUser", "sreid").Return(&model.User{Id: "sreid", Username: "sre", Email: "sre@example.com"}, nil)
+	api.On("GetUser", "joramid").Return(&model.User{Id: "joramid", Username: "joram", Email: "joram@example.com"}, nil)
+	api.On("GetTeamsForUser", "qaid").Return([]*model.Team{{Name: "QA"}}, nil)
+	api.On("GetTeamsForUser", mock.AnythingOfType("string")).Return([]*model.Team{}, nil)
+	api.On("LogError", mock.AnythingOfType("string")).Return()
+	sreGroup := "sre"
+	api.On("GetGroupsForUser", "sreid").Return([]*model.Group{{Name: &sreGroup}}, nil)
+	api.On("GetGroupsForUser", mock.AnythingOfType("string")).Return([]*model.Group{}, nil)
+
+	plugin := &Plugin{
+		cloudClient:   &MockClient{},
+		dockerClient:  &MockedDockerClient{tagExists: true},
+		releaseSource: &mockedReleaseSource{releases: testReleases},
+		configuration: &configuration{RoleAssignments: roleAssignments, InstallationDNS: "test.mattermost.cloud"},
+	}
+	plugin.SetAPI(api)
+
+	return plugin
+}
+
+func TestGetUserRole(t *testing.T) {
+	plugin := newRBACTestPlugin(`[
+		{"role": "viewer"},
+		{"role": "user", "email_domains": ["mattermost.com"]},
+		{"role": "power-user", "teams": ["qa"], "groups": ["sre"]},
+		{"role": "admin", "users": ["@joram"]}
+	]`)
+
+	for userID, expected := range map[string]pluginRole{
+		"viewerid": roleViewer,
+		"userid":   roleUser,
+		"qaid":     rolePowerUser,
+		"sreid":    rolePowerUser,
+		"joramid":  roleAdmin,
+		"adminid":  roleAdmin,
+	} {
+		assert.Equal(t, expected, plugin.getUserRole(userID), userID)
+	}
+
+	assert.True(t, plugin.hasPermission("viewerid", permissionViewInstallations))
+	assert.False(t, plugin.hasPermission("viewerid", permissionManageInstallations))
+	assert.True(t, plugin.hasPermission("userid", permissionRunCLI))
+	assert.False(t, plugin.hasPermission("userid", permissionCreateIsolated))
+	assert.True(t, plugin.hasPermission("qaid", permissionUsePowerUserSizes))
+	assert.False(t, plugin.hasPermission("qaid", permissionAdministerPlugin))
+	assert.True(t, plugin.hasPermission("adminid", permissionAdministerPlugin))
+
+	t.Run("without role assignments", func(t *testing.T) {
+		plugin := newRBACTestPlugin("")
+		plugin.configuration.AllowedEmailDomain = "mattermost.com"
+
+		assert.Equal(t, rolePowerUser, plugin.getUserRole("userid"))
+		assert.Equal(t, roleNone, plugin.getUserRole("viewerid"))
+		assert.True(t, plugin.hasPermission("userid", permissionCreateIsolated))
+		assert.False(t, plugin.hasPermission("userid", permissionAdministerPlugin))
+	})
+
+	t.Run("every command declares a permission", func(t *testing.T) {
+		for _, subCommand := range plugin.getCommand().AutocompleteData.SubCommands {
+			_, ok := commandPermissions[subCommand.Trigger]
+			assert.True(t, ok || subCommand.Trigger == "help", subCommand.Trigger)
+		}
+	})
+}
+
+func TestLoadedRoleAssignments(t *testing.T) {
+	plugin := newRBACTestPlugin(`[{"role": "viewer"}, {"role": "user", "email_domains": ["mattermost.com"]}]`)
+	require.NoError(t, plugin.configuration.loadRoleAssignments())
+	plugin.configuration.RoleAssignments = "invalid"
+
+	assert.Equal(t, roleUser, plugin.getUserRole("userid"), "the role assignments are only parsed once")
+	assert.Equal(t, roleViewer, plugin.getUserRole("viewerid"))
+	assert.True(t, plugin.hasPermission("viewerid", permissionViewInstallations))
+
+	api := plugin.API.(*plugintest.API)
+	api.AssertNotCalled(t, "GetTeamsForUser", mock.Anything)
+	api.AssertNotCalled(t, "GetGroupsForUser", mock.Anything)
+}
+
+func TestCommandPermissions(t *testing.T) {
+	plugin := newRBACTestPlugin(`[{"role": "viewer"}, {"role": "user", "email_domains": ["mattermost.com"]}]`)
+
+	execute := func(userID, command string) string {
+		resp, appErr := plugin.ExecuteCommand(nil, &model.CommandArgs{UserId: userID, Command: command})
+		require.Nil(t, appErr)
+		return resp.Text
+	}
+
+	assert.Contains(t, execute("viewerid", "/cloud info"), "Mattermost Cloud plugin version")
+	assert.Contains(t, execute("viewerid", "/cloud create test"), "Permission denied. The create command requires the user role.")
+	assert.Contains(t, execute("userid", "/cloud admin"), "Permission denied. The admin command requires the admin role.")
+
+	t.Run("power user installation options", func(t *testing.T) {
+		args := &model.CommandArgs{UserId: "userid"}
+		_, isUserError, err := plugin.runCreateCommand([]string{"test", "--affinity", cloud.InstallationAffinityIsolated}, args)
+		require.EqualError(t, err, "isolated installations are restricted: permission denied, this requires the power-user role")
+		assert.True(t, isUserError)
+
+		_, isUserError, err = plugin.runCreateCommand([]string{"test", "--size", "miniHA"}, args)
+		require.EqualError(t, err, "size miniHA is restricted: permission denied, this requires the power-user role")
+		assert.True(t, isUserError)
+
+		_, isUserError, err = plugin.runUpdateCommand([]string{"test", "--size", "miniHA"}, args)
+		require.Error(t, err)
+		assert.True(t, isUserError)
+	})
+
+	t.Run("no role", func(t *testing.T) {
+		plugin.configuration.RoleAssignments = `[{"role": "user", "email_domains": ["mattermost.com"]}]`
+		assert.Contains(t, execute("viewerid", "/cloud create test"), "Permission denied. Please talk to your system administrator to get access.")
+	})
+}
+
+func TestEndpointPermissions(t *testing.T) {
+	plugin := newRBACTestPlugin(`[{"role": "viewer"}, {"role": "user", "email_domains": ["mattermost.com"]}]`)
+	plugin.configuration.ProvisioningServerURL = "https://provisioner"
+	plugin.configuration.ProvisioningServerAuthToken = "token"
+
+	serve := func(userID, path string) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, path, nil)
+		if userID != "" {
+			r.Header.Set("Mattermost-User-ID", userID)
+		}
+		plugin.ServeHTTP(nil, w, r)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, serve("", "/api/v1/config"))
+	assert.Equal(t, http.StatusOK, serve("viewerid", "/api/v1/config"))
+	assert.Equal(t, http.StatusForbidden, serve("viewerid", "/api/v1/deletion-lock"))
+	assert.Equal(t, http.StatusBadRequest, serve("userid", "/api/v1/deletion-lock"), "users pass the permission check")
+	assert.Equal(t, http.StatusForbidden, serve("viewerid", actionRetryPath))
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// reachabilityKeyPrefix prefixes the KV keys storing the reachability
+	// history of an installation.
+	reachabilityKeyPrefix = "reachability_"
+	// reachabilityMonitorLockKey is the cluster mutex ensuring only one
+	// plugin instance pings installations per interval.
+	reachabilityMonitorLockKey = "reachability_monitor_lock"
+
+	// reachabilityMonitorInterval is how often installations are pinged.
+	reachabilityMonitorInterval = 5 * time.Minute
+	// reachabilityHistorySize is how many checks are kept per installation,
+	// which is a day of checks.
+	reachabilityHistorySize = 288
+	// reachabilityWorkers is how many installations are pinged at once.
+	reachabilityWorkers = 10
+
+	defaultReachabilityFailureThreshold = 3
+)
+
+// reachabilityFailureThreshold returns how many consecutive pings a stable
+// installation must fail before its owner is alerted.
+func (c *configuration) reachabilityFailureThreshold() int {
+	if c.ReachabilityFailureThreshold == "" {
+		return defaultReachabilityFailureThreshold
+	}
+	threshold, err := strconv.Atoi(c.ReachabilityFailureThreshold)
+	if err != nil || threshold < 0 {
+		return defaultReachabilityFailureThreshold
+	}
+	return threshold
+}
+
+// reachabilityCheck is the result of pinging an installation.
+type reachabilityCheck struct {
+	Timestamp int64
+	Up        bool
+	LatencyMS int64  `json:",omitempty"`
+	Error     string `json:",omitempty"`
+}
+
+// reachabilityStatus is the reachability history of an installation.
+type reachabilityStatus struct {
+	ConsecutiveFailures int
+	// AlertedAt is set while the owner has been alerted that the
+	// installation is unreachable.
+	AlertedAt int64 `json:",omitempty"`
+	History   []*reachabilityCheck
+}
+
+// summary describes the checks of the status which were made since a time.
+func (s *reachabilityStatus) summary(since time.Time) (int, int, time.Duration) {
+	var checks, up int
+	var latency int64
+	for _, check := range s.History {
+		if check.Timestamp < model.GetMillisForTime(since) {
+			continue
+		}
+		checks++
+		if check.Up {
+			up++
+			latency += check.LatencyMS
+		}
+	}
+
+	var average time.Duration
+	if up > 0 {
+		average = time.Duration(latency/int64(up)) * time.Millisecond
+	}
+
+	return checks, up, average
+}
+
+// healthResult summarizes the checks of the last day as a health check result,
+// or returns nil if the installation wasn't checked during the last day.
+func (s *reachabilityStatus) healthResult(now time.Time) *healthCheckResult {
+	checks, up, latency := s.summary(now.Add(-24 * time.Hour))
+	if checks == 0 {
+		return nil
+	}
+
+	details := fmt.Sprintf("%d of %d checks in the last 24h succeeded", up, checks)
+	if up > 0 {
+		details += fmt.Sprintf(", average latency %s", latency)
+	}
+
+	result := healthPass
+	if s.AlertedAt != 0 {
+		result = healthFail
+	} else if up < checks {
+		result = healthWarn
+	}
+
+	return &healthCheckResult{"Reachability", result, details}
+}
+
+func (p *Plugin) getReachabilityStatus(installationID string) (*reachabilityStatus, error) {
+	data, appErr := p.API.KVGet(reachabilityKeyPrefix + installationID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get reachability status")
+	}
+
+	status := &reachabilityStatus{}
+	if data == nil {
+		return status, nil
+	}
+
+	err := json.Unmarshal(data, status)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal reachability status")
+	}
+
+	return status, nil
+}
+
+func (p *Plugin) storeReachabilityStatus(installationID string, status *reachabilityStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal reachability status")
+	}
+
+	appErr := p.API.KVSet(reachabilityKeyPrefix+installationID, data)
+	if appErr != nil {
+		return errors.Wrap(appErr, "failed to store reachability status")
+	}
+
+	return nil
+}
+
+// pingInstallation pings an installation and returns how long it took to
+// respond.
+func pingInstallation(domainName string) (time.Duration, error) {
+	client := newInstallationClient(domainName)
+
+	start := time.Now()
+	status, _, err := client.GetPing()
+	latency := time.Since(start)
+	if err != nil {
+		return latency, err
+	}
+	if status != model.StatusOk {
+		return latency, errors.Errorf("ping returned status %s", status)
+	}
+
+	return latency, nil
+}
+
+// reachabilityMonitor periodically pings the installations the provisioner
+// reports as stable, and alerts their owners when they are unreachable.
+type reachabilityMonitor struct {
+	plugin *Plugin
+	now    func() time.Time
+	ping   func(domainName string) (time.Duration, error)
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newReachabilityMonitor(p *Plugin) *reachabilityMonitor {
+	return &reachabilityMonitor{
+		plugin: p,
+		now:    time.Now,
+		ping:   pingInstallation,
+	}
+}
+
+// Start starts monitoring installations.
+func (m *reachabilityMonitor) Start() {
+	m.stop = make(chan struct{})
+	m.wg.Add(1)
+	go m.run()
+}
+
+// Stop stops monitoring installations.
+func (m *reachabilityMonitor) Stop() {
+	if m.stop == nil {
+		return
+	}
+	close(m.stop)
+	m.wg.Wait()
+	m.stop = nil
+}
+
+func (m *reachabilityMonitor) run() {
+	defer m.wg.Done()
+
+	ticker := time.NewTicker(reachabilityMonitorInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+		}
+
+		if m.plugin.getConfiguration().reachabilityFailureThreshold() == 0 {
+			continue
+		}
+
+		locked, err := m.tryLock()
+		if err != nil {
+			m.plugin.API.LogError(err.Error())
+			continue
+		}
+		if !locked {
+			continue
+		}
+
+		err = m.check()
+		if err != nil {
+			m.plugin.API.LogError(errors.Wrap(err, "failed to check installation reachability").Error())
+		}
+	}
+}
+
+// tryLock acquires the monitor lock for the current interval. The lock is left
+// to expire so that other plugin instances skip the interval.
+func (m *reachabilityMonitor) tryLock() (bool, error) {
+	ok, appErr := m.plugin.API.KVSetWithOptions(reachabilityMonitorLockKey, []byte(model.NewId()), model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        nil,
+		ExpireInSeconds: int64((reachabilityMonitorInterval - time.Second).Seconds()),
+	})
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "failed to lock reachability monitor")
+	}
+
+	return ok, nil
+}
+
+// check pings every stable installation and records the result.
+func (m *reachabilityMonitor) check() error {
+	p := m.plugin
+
+	installs, _, err := p.getInstallations()
+	if err != nil {
+		return errors.Wrap(err, "failed to get installations")
+	}
+	if len(installs) == 0 {
+		return nil
+	}
+
+	cloudInstalls, err := p.cloudClient.GetInstallations(&cloud.GetInstallationsRequest{
+		Paging: cloud.AllPagesNotDeleted(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to get installations from cloud server")
+	}
+	cloudInstallsByID := make(map[string]*cloud.InstallationDTO, len(cloudInstalls))
+	for _, cloudInstall := range cloudInstalls {
+		cloudInstallsByID[cloudInstall.ID] = cloudInstall
+	}
+
+	threshold := p.getConfiguration().reachabilityFailureThreshold()
+
+	var wg sync.WaitGroup
+	installsToCheck := make(chan *Installation)
+	for i := 0; i < reachabilityWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for install := range installsToCheck {
+				err := m.checkInstallation(install, threshold)
+				if err != nil {
+					p.API.LogWarn(err.Error(), "installation", install.ID)
+				}
+			}
+		}()
+	}
+
+	for _, install := range installs {
+		cloudInstall := cloudInstallsByID[install.ID]
+		if cloudInstall == nil || cloudInstall.State != cloud.InstallationStateStable || len(cloudInstall.DNSRecords) == 0 {
+			continue
+		}
+		install.InstallationDTO = *cloudInstall
+		installsToCheck <- install
+	}
+	close(installsToCheck)
+	wg.Wait()
+
+	return nil
+}
+
+// checkInstallation pings an installation, records the result and alerts its
+// owner when it becomes unreachable or recovers.
+func (m *reachabilityMonitor) checkInstallation(install *Installation, threshold int) error {
+	p := m.plugin
+
+	status, err := p.getReachabilityStatus(install.ID)
+	if err != nil {
+		return err
+	}
+
+	latency, pingErr := m.ping(install.DNSRecords[0].DomainName)
+	check := &reachabilityCheck{
+		Timestamp: model.GetMillisForTime(m.now()),
+		Up:        pingErr == nil,
+	}
+	if pingErr == nil {
+		check.LatencyMS = latency.Milliseconds()
+	} else {
+		check.Error = pingErr.Error()
+	}
+
+	status.History = append(status.History, check)
+	if len(status.History) > reachabilityHistorySize {
+		status.History = status.History[len(status.History)-reachabilityHistorySize:]
+	}
+
+	if check.Up {
+		if status.AlertedAt != 0 {
+			p.alertInstallationReachability(install, fmt.Sprintf("Installation %s is reachable again after %d failed checks.", install.Name, status.ConsecutiveFailures), "")
+			p.recordPluginEvent(install.ID, "", "reachable-again", "")
+		}
+		status.ConsecutiveFailures = 0
+		status.AlertedAt = 0
+	} else {
+		status.ConsecutiveFailures++
+		if status.ConsecutiveFailures >= threshold && status.AlertedAt == 0 {
+			message := fmt.Sprintf("Installation %s has been unreachable for %d consecutive checks, although the provisioner reports it as stable. The last error was: %s\n\nUse %s for more details.", install.Name, status.ConsecutiveFailures, inlineCode(check.Error), inlineCode("/cloud health "+install.Name))
+			p.alertInstallationReachability(install, message, check.Error)
+			p.recordPluginEvent(install.ID, "", "unreachable-detected", check.Error)
+			status.AlertedAt = check.Timestamp
+		}
+	}
+
+	return p.storeReachabilityStatus(install.ID, status)
+}
+
+// alertInstallationReachability notifies the owner of an installation about a
+// change in its reachability and posts to the reachability alerts channel, if
+// one is configured.
+func (p *Plugin) alertInstallationReachability(install *Installation, message, lastError string) {
+	err := p.PostBotDM(install.OwnerID, message)
+	if err != nil {
+		p.API.LogError(errors.Wrap(err, "failed to send reachability alert").Error(), "installation", install.ID)
+	}
+
+	channelID := p.getConfiguration().ReachabilityAlertsChannelID
+	if channelID == "" {
+		return
+	}
+
+	state := "Unreachable"
+	if lastError == "" {
+		state = "Reachable again"
+	}
+	alert := fmt.Sprintf(`
+[ Cloud Monitor ] %s Installation
+---
+ID: %s
+Name: %s
+DNS: %s
+Owner: %s
+`, state, inlineCode(install.ID), inlineCode(install.Name), inlineCode(install.DNSRecords[0].DomainName), p.getActorName(install.OwnerID))
+	if lastError != "" {
+		alert += fmt.Sprintf("Error: %s\n", inlineCode(lastError))
+	}
+
+	err = p.PostToChannelByIDAsBot(channelID, alert)
+	if err != nil {
+		p.API.LogError(errors.Wrap(err, "failed to post reachability alert").Error(), "installation", install.ID)
+	}
+}
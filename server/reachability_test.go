@@ -0,0 +1,159 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReachabilityFailureThreshold(t *testing.T) {
+	assert.Equal(t, 3, (&configuration{}).reachabilityFailureThreshold())
+	assert.Equal(t, 5, (&configuration{ReachabilityFailureThreshold: "5"}).reachabilityFailureThreshold())
+	assert.Equal(t, 0, (&configuration{ReachabilityFailureThreshold: "0"}).reachabilityFailureThreshold())
+}
+
+func TestReachabilityMonitor(t *testing.T) {
+	now := time.Now()
+	setup := func(state string) (*reachabilityMonitor, *[]*model.Post, *error) {
+		api := &plugintest.API{}
+		store := newMockedKVStore(api)
+		store.values[StoreInstallsKey] = []byte(`[{"ID": "someid", "OwnerID": "joramid", "Name": "joramsinstall"}]`)
+		api.On("GetDirectChannel", "joramid", "botid").Return(&model.Channel{Id: "dmid"}, nil)
+		api.On("GetUser", "joramid").Return(&model.User{Username: "joram"}, nil)
+
+		var lock sync.Mutex
+		var posts []*model.Post
+		api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+			lock.Lock()
+			defer lock.Unlock()
+			posts = append(posts, args.Get(0).(*model.Post))
+		}).Return(&model.Post{}, nil)
+
+		mockedCloudClient := &MockClient{
+			mockedCloudInstallationsDTO: []*cloud.InstallationDTO{
+				{
+					Installation: &cloud.Installation{ID: "someid", OwnerID: "joramid", State: state},
+					DNSRecords:   []*cloud.InstallationDNS{{DomainName: "joramsinstall.test.mattermost.cloud"}},
+				},
+				{
+					Installation: &cloud.Installation{ID: "untrackedid", State: state},
+					DNSRecords:   []*cloud.InstallationDNS{{DomainName: "untracked.test.mattermost.cloud"}},
+				},
+			},
+		}
+
+		plugin := &Plugin{
+			BotUserID:     "botid",
+			cloudClient:   mockedCloudClient,
+			configuration: &configuration{ReachabilityAlertsChannelID: "alertsid"},
+		}
+		plugin.SetAPI(api)
+
+		var pingErr error
+		monitor := newReachabilityMonitor(plugin)
+		monitor.now = func() time.Time { return now }
+		monitor.ping = func(domainName string) (time.Duration, error) {
+			assert.Equal(t, "joramsinstall.test.mattermost.cloud", domainName, "only tracked installations are pinged")
+			return 120 * time.Millisecond, pingErr
+		}
+
+		return monitor, &posts, &pingErr
+	}
+
+	t.Run("alerts once after consecutive failures and on recovery", func(t *testing.T) {
+		monitor, posts, pingErr := setup(cloud.InstallationStateStable)
+		*pingErr = errors.New("connection refused")
+
+		require.NoError(t, monitor.check())
+		require.NoError(t, monitor.check())
+		assert.Empty(t, *posts)
+
+		require.NoError(t, monitor.check())
+		require.Len(t, *posts, 2)
+		assert.Equal(t, "dmid", (*posts)[0].ChannelId)
+		assert.Contains(t, (*posts)[0].Message, "Installation joramsinstall has been unreachable for 3 consecutive checks")
+		assert.Equal(t, "alertsid", (*posts)[1].ChannelId)
+		assert.Contains(t, (*posts)[1].Message, "[ Cloud Monitor ] Unreachable Installation")
+
+		require.NoError(t, monitor.check())
+		assert.Len(t, *posts, 2, "an unreachable installation is only alerted once")
+
+		*pingErr = nil
+		require.NoError(t, monitor.check())
+		require.Len(t, *posts, 4)
+		assert.Contains(t, (*posts)[2].Message, "Installation joramsinstall is reachable again after 4 failed checks.")
+		assert.Contains(t, (*posts)[3].Message, "[ Cloud Monitor ] Reachable again Installation")
+
+		status, err := monitor.plugin.getReachabilityStatus("someid")
+		require.NoError(t, err)
+		assert.Equal(t, 0, status.ConsecutiveFailures)
+		assert.Zero(t, status.AlertedAt)
+		require.Len(t, status.History, 5)
+		assert.True(t, status.History[4].Up)
+		assert.Equal(t, int64(120), status.History[4].LatencyMS)
+		assert.Equal(t, "connection refused", status.History[0].Error)
+
+		events, err := monitor.plugin.getInstallationEvents("someid")
+		require.NoError(t, err)
+		require.Len(t, events, 2)
+		assert.Equal(t, "unreachable-detected", events[0].Action)
+		assert.Equal(t, "reachable-again", events[1].Action)
+	})
+
+	t.Run("history is capped", func(t *testing.T) {
+		monitor, _, _ := setup(cloud.InstallationStateStable)
+		require.NoError(t, monitor.plugin.storeReachabilityStatus("someid", &reachabilityStatus{
+			History: make([]*reachabilityCheck, reachabilityHistorySize),
+		}))
+
+		require.NoError(t, monitor.check())
+
+		status, err := monitor.plugin.getReachabilityStatus("someid")
+		require.NoError(t, err)
+		require.Len(t, status.History, reachabilityHistorySize)
+		assert.True(t, status.History[reachabilityHistorySize-1].Up)
+	})
+
+	t.Run("unstable installations are not pinged", func(t *testing.T) {
+		monitor, posts, _ := setup(cloud.InstallationStateHibernationInProgress)
+		monitor.ping = func(domainName string) (time.Duration, error) {
+			t.Fatal("unstable installations must not be pinged")
+			return 0, nil
+		}
+
+		require.NoError(t, monitor.check())
+		assert.Empty(t, *posts)
+	})
+}
+
+func TestReachabilityHealthResult(t *testing.T) {
+	now := time.Now()
+	status := &reachabilityStatus{
+		History: []*reachabilityCheck{
+			{Timestamp: model.GetMillisForTime(now.Add(-25 * time.Hour)), Error: "too old"},
+			{Timestamp: model.GetMillisForTime(now.Add(-time.Hour)), Up: true, LatencyMS: 100},
+			{Timestamp: model.GetMillisForTime(now), Up: true, LatencyMS: 200},
+		},
+	}
+
+	result := status.healthResult(now)
+	require.NotNil(t, result)
+	assert.Equal(t, healthPass, result.Result)
+	assert.Equal(t, "2 of 2 checks in the last 24h succeeded, average latency 150ms", result.Details)
+
+	status.History = append(status.History, &reachabilityCheck{Timestamp: model.GetMillisForTime(now), Error: "timeout"})
+	assert.Equal(t, healthWarn, status.healthResult(now).Result)
+
+	status.AlertedAt = model.GetMillisForTime(now)
+	assert.Equal(t, healthFail, status.healthResult(now).Result)
+
+	assert.Nil(t, (&reachabilityStatus{}).healthResult(now))
+}
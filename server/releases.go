@@ -0,0 +1,468 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blang/semver/v4"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	defaultReleasesURL = "https://api.github.com/repos/mattermost/mattermost-server/releases"
+
+	// maxReleasePages limits how many pages of releases are requested from
+	// the release source.
+	maxReleasePages = 3
+
+	// defaultReleaseCacheTTL is used when no release cache TTL is configured.
+	defaultReleaseCacheTTL = 5 * time.Minute
+
+	// StoreReleasesKey is the key used to share release metadata between
+	// plugin instances in the plugin KV store.
+	StoreReleasesKey = "releases"
+
+	versionAliasLatest        = "latest"
+	versionAliasLatestESR     = "latest-esr"
+	versionAliasLatestRC      = "latest-rc"
+	versionAliasLatestPatch   = "latest-patch:"
+	versionAliasPreviousMinor = "previous-minor"
+	versionAliasMaster        = "master"
+	versionAliasNightly       = "nightly"
+
+	// nightlyTag is the docker tag that nightly builds are published under.
+	nightlyTag = "master"
+)
+
+var linkNextMatcher = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+
+// versionAliasHelp describes the supported version aliases.
+const versionAliasHelp = "latest, latest-esr, latest-rc, latest-patch:<major.minor>, previous-minor, master or nightly"
+
+// ReleaseSource provides metadata about published Mattermost releases.
+type ReleaseSource interface {
+	GetReleases() ([]*githubReleaseMetadata, error)
+}
+
+type githubReleaseMetadata struct {
+	TagName    string `json:"tag_name"`
+	Name       string `json:"name"`
+	Draft      bool   `json:"draft"`
+	Prerelease bool   `json:"prerelease"`
+}
+
+// GithubReleaseSource is a ReleaseSource backed by a GitHub-compatible
+// releases API endpoint.
+type GithubReleaseSource struct {
+	url    string
+	client *http.Client
+}
+
+// NewGithubReleaseSource returns a new release source for the given releases
+// URL. The default GitHub releases URL is used when the URL is empty.
+func NewGithubReleaseSource(releasesURL string) *GithubReleaseSource {
+	if releasesURL == "" {
+		releasesURL = defaultReleasesURL
+	}
+
+	return &GithubReleaseSource{
+		url:    releasesURL,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// GetReleases returns the releases published at the release source URL,
+// following pagination links up to maxReleasePages pages.
+func (s *GithubReleaseSource) GetReleases() ([]*githubReleaseMetadata, error) {
+	u, err := url.Parse(s.url)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse releases URL")
+	}
+	query := u.Query()
+	query.Set("per_page", "100")
+	u.RawQuery = query.Encode()
+
+	var releases []*githubReleaseMetadata
+	next := u.String()
+	for i := 0; i < maxReleasePages && next != ""; i++ {
+		var page []*githubReleaseMetadata
+		page, next, err = s.getReleasesPage(next)
+		if err != nil {
+			return nil, err
+		}
+		releases = append(releases, page...)
+	}
+
+	return releases, nil
+}
+
+func (s *GithubReleaseSource) getReleasesPage(pageURL string) ([]*githubReleaseMetadata, string, error) {
+	resp, err := s.client.Get(pageURL)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to find releases from release source")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", errors.Errorf("got unexpected status code %d while requesting releases", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to read response body")
+	}
+
+	releases := []*githubReleaseMetadata{}
+	err = json.Unmarshal(body, &releases)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to unmarshal releases JSON")
+	}
+
+	var next string
+	if matches := linkNextMatcher.FindStringSubmatch(resp.Header.Get("Link")); len(matches) == 2 {
+		next = matches[1]
+	}
+
+	return releases, next, nil
+}
+
+// releasesCache holds the most recently fetched release metadata. The cached
+// value is shared with other plugin instances through the KV store.
+type releasesCache struct {
+	lock sync.Mutex
+
+	releases  []*githubReleaseMetadata
+	timestamp time.Time
+	// lastError is the error from the most recent failed refresh, if the
+	// cached releases are being served because of it.
+	lastError error
+	// failedAt is when the most recent refresh failed. The release source
+	// isn't requested again until the TTL has passed since.
+	failedAt time.Time
+
+	// refresh de-duplicates concurrent requests to the release source.
+	refresh singleflight.Group
+}
+
+// storedReleases is the KV representation of the release cache.
+type storedReleases struct {
+	Releases  []*githubReleaseMetadata
+	Timestamp time.Time
+}
+
+// releasesCacheStatus describes the cached release metadata.
+type releasesCacheStatus struct {
+	Count     int
+	Timestamp time.Time
+	LastError error
+}
+
+// mattermostRelease is a parsed, non-draft release.
+type mattermostRelease struct {
+	tag     string
+	version semver.Version
+	esr     bool
+}
+
+func (r *mattermostRelease) sameMinor(other semver.Version) bool {
+	return r.version.Major == other.Major && r.version.Minor == other.Minor
+}
+
+func (r *mattermostRelease) stable() bool {
+	return len(r.version.Pre) == 0
+}
+
+func (r *mattermostRelease) releaseCandidate() bool {
+	return len(r.version.Pre) > 0 && strings.HasPrefix(r.version.Pre[0].String(), "rc")
+}
+
+// parseReleases converts release metadata into releases which can be
+// compared. Drafts and tags which are not semantic versions are skipped.
+func parseReleases(metadata []*githubReleaseMetadata, esrVersions []string) []*mattermostRelease {
+	var releases []*mattermostRelease
+	for _, release := range metadata {
+		if release.TagName == "" || release.Draft {
+			continue
+		}
+		tag := strings.TrimPrefix(release.TagName, "v")
+		version, err := semver.Parse(tag)
+		if err != nil {
+			continue
+		}
+
+		name := strings.ToUpper(release.Name)
+		minor := fmt.Sprintf("%d.%d", version.Major, version.Minor)
+		releases = append(releases, &mattermostRelease{
+			tag:     tag,
+			version: version,
+			esr:     strings.Contains(name, "ESR") || strings.Contains(name, "EXTENDED SUPPORT") || Contains(esrVersions, minor),
+		})
+	}
+
+	return releases
+}
+
+// newestRelease returns the newest release that matches the filter.
+func newestRelease(releases []*mattermostRelease, filter func(*mattermostRelease) bool) *mattermostRelease {
+	var newest *mattermostRelease
+	for _, release := range releases {
+		if !filter(release) {
+			continue
+		}
+		if newest == nil || release.version.GT(newest.version) {
+			newest = release
+		}
+	}
+
+	return newest
+}
+
+// latestRelease returns the newest stable release, or nil if no release is
+// known.
+func (p *Plugin) latestRelease() (*mattermostRelease, error) {
+	metadata, err := p.getReleases()
+	if err != nil {
+		return nil, err
+	}
+
+	return newestRelease(parseReleases(metadata, p.getConfiguration().esrVersions()), (*mattermostRelease).stable), nil
+}
+
+// isVersionAlias returns if the version is an alias that must be resolved to a
+// concrete version.
+func isVersionAlias(version string) bool {
+	switch version {
+	case versionAliasLatest, versionAliasLatestESR, versionAliasLatestRC,
+		versionAliasPreviousMinor, versionAliasMaster, versionAliasNightly:
+		return true
+	}
+
+	return strings.HasPrefix(version, versionAliasLatestPatch)
+}
+
+// resolveVersionAlias resolves a version alias such as "latest" to a concrete
+// version. Versions which are not aliases are returned unchanged.
+func (p *Plugin) resolveVersionAlias(version string) (string, error) {
+	if !isVersionAlias(version) {
+		return version, nil
+	}
+
+	if version == versionAliasMaster || version == versionAliasNightly {
+		return nightlyTag, nil
+	}
+
+	metadata, err := p.getReleases()
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to determine version for alias '%s'", version)
+	}
+	releases := parseReleases(metadata, p.getConfiguration().esrVersions())
+
+	var resolved *mattermostRelease
+	switch {
+	case version == versionAliasLatest:
+		resolved = newestRelease(releases, (*mattermostRelease).stable)
+	case version == versionAliasLatestESR:
+		resolved = newestRelease(releases, func(r *mattermostRelease) bool {
+			return r.stable() && r.esr
+		})
+	case version == versionAliasLatestRC:
+		resolved = newestRelease(releases, (*mattermostRelease).releaseCandidate)
+	case version == versionAliasPreviousMinor:
+		latest := newestRelease(releases, (*mattermostRelease).stable)
+		if latest == nil {
+			break
+		}
+		resolved = newestRelease(releases, func(r *mattermostRelease) bool {
+			return r.stable() && !r.sameMinor(latest.version) && r.version.LT(latest.version)
+		})
+	case strings.HasPrefix(version, versionAliasLatestPatch):
+		minor, parseErr := semver.ParseTolerant(strings.TrimPrefix(version, versionAliasLatestPatch))
+		if parseErr != nil {
+			return "", errors.Errorf("invalid version alias '%s', expected a version such as %s9.11", version, versionAliasLatestPatch)
+		}
+		resolved = newestRelease(releases, func(r *mattermostRelease) bool {
+			return r.stable() && r.sameMinor(minor)
+		})
+	}
+
+	if resolved == nil {
+		return "", errors.Errorf("failed to determine version for alias '%s': no matching release found", version)
+	}
+
+	return resolved.tag, nil
+}
+
+// getReleases returns the releases from the release source. Releases are
+// cached for the configured TTL to avoid GitHub rate limiting for
+// unauthenticated requests, and the last good value is served when the
+// release source fails.
+func (p *Plugin) getReleases() ([]*githubReleaseMetadata, error) {
+	ttl := p.getConfiguration().releaseCacheTTL()
+
+	releases, cached, err := p.cachedReleases(ttl)
+	if cached {
+		return releases, err
+	}
+
+	// The release source is requested without holding the releases lock, as
+	// fetching every page can take a while. Concurrent lookups share the
+	// same request.
+	result, err, _ := p.releases.refresh.Do("releases", func() (any, error) {
+		releases, cached, err := p.cachedReleases(ttl)
+		if cached {
+			return releases, err
+		}
+		return p.refreshReleases()
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result.([]*githubReleaseMetadata), nil
+}
+
+// cachedReleases returns the cached releases, or the error of the last
+// failed refresh, unless the release source should be requested again.
+func (p *Plugin) cachedReleases(ttl time.Duration) ([]*githubReleaseMetadata, bool, error) {
+	p.releases.lock.Lock()
+	defer p.releases.lock.Unlock()
+
+	if p.releasesFresh(ttl) {
+		return p.releases.releases, true, nil
+	}
+
+	p.loadStoredReleases()
+	if p.releasesFresh(ttl) {
+		return p.releases.releases, true, nil
+	}
+
+	if p.releases.lastError != nil && time.Since(p.releases.failedAt) < ttl {
+		if len(p.releases.releases) == 0 {
+			return nil, true, p.releases.lastError
+		}
+		return p.releases.releases, true, nil
+	}
+
+	return nil, false, nil
+}
+
+// refreshReleases requests the releases from the release source and replaces
+// the cached releases with them. The last good releases are returned if the
+// release source fails.
+func (p *Plugin) refreshReleases() ([]*githubReleaseMetadata, error) {
+	p.releases.lock.Lock()
+	source := p.releaseSource
+	p.releases.lock.Unlock()
+
+	if source == nil {
+		source = NewGithubReleaseSource(p.getConfiguration().ReleasesURL)
+	}
+
+	releases, err := source.GetReleases()
+	if err == nil && len(releases) == 0 {
+		err = errors.New("release source returned no releases")
+	}
+
+	p.releases.lock.Lock()
+	if err != nil {
+		p.releases.lastError = err
+		p.releases.failedAt = time.Now()
+		cached, timestamp := p.releases.releases, p.releases.timestamp
+		p.releases.lock.Unlock()
+
+		if len(cached) == 0 {
+			return nil, err
+		}
+		p.API.LogWarn("Failed to refresh releases, using cached releases", "error", err.Error(), "cached_at", timestamp.String())
+		return cached, nil
+	}
+
+	timestamp := time.Now()
+	p.releases.releases = releases
+	p.releases.timestamp = timestamp
+	p.releases.lastError = nil
+	p.releases.lock.Unlock()
+
+	p.storeReleases(releases, timestamp)
+
+	return releases, nil
+}
+
+// setReleaseSource replaces the release source, which is requested again on
+// the next lookup.
+func (p *Plugin) setReleaseSource(source ReleaseSource) {
+	p.releases.lock.Lock()
+	defer p.releases.lock.Unlock()
+
+	p.releaseSource = source
+	p.releases.lastError = nil
+}
+
+// releasesFresh returns if the cached releases are younger than the TTL. The
+// releases lock must be held.
+func (p *Plugin) releasesFresh(ttl time.Duration) bool {
+	return len(p.releases.releases) != 0 && time.Since(p.releases.timestamp) < ttl
+}
+
+// loadStoredReleases replaces the cached releases with the ones stored by
+// any plugin instance if they are newer. The releases lock must be held.
+func (p *Plugin) loadStoredReleases() {
+	data, appErr := p.API.KVGet(StoreReleasesKey)
+	if appErr != nil {
+		p.API.LogWarn("Failed to get stored releases", "error", appErr.Error())
+		return
+	}
+	if data == nil {
+		return
+	}
+
+	var stored storedReleases
+	err := json.Unmarshal(data, &stored)
+	if err != nil {
+		p.API.LogWarn("Failed to unmarshal stored releases", "error", err.Error())
+		return
+	}
+
+	if len(stored.Releases) != 0 && stored.Timestamp.After(p.releases.timestamp) {
+		p.releases.releases = stored.Releases
+		p.releases.timestamp = stored.Timestamp
+		p.releases.lastError = nil
+	}
+}
+
+// storeReleases shares the fetched releases with other plugin instances.
+func (p *Plugin) storeReleases(releases []*githubReleaseMetadata, timestamp time.Time) {
+	data, err := json.Marshal(&storedReleases{
+		Releases:  releases,
+		Timestamp: timestamp,
+	})
+	if err != nil {
+		p.API.LogWarn("Failed to marshal releases", "error", err.Error())
+		return
+	}
+
+	appErr := p.API.KVSet(StoreReleasesKey, data)
+	if appErr != nil {
+		p.API.LogWarn("Failed to store releases", "error", appErr.Error())
+	}
+}
+
+// getReleasesCacheStatus returns the state of the release cache.
+func (p *Plugin) getReleasesCacheStatus() releasesCacheStatus {
+	p.releases.lock.Lock()
+	defer p.releases.lock.Unlock()
+
+	return releasesCacheStatus{
+		Count:     len(p.releases.releases),
+		Timestamp: p.releases.timestamp,
+		LastError: p.releases.lastError,
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+var testReleases = []*githubReleaseMetadata{
+	{TagName: "v10.12.0-rc2", Name: "v10.12.0-rc2", Prerelease: true},
+	{TagName: "v10.12.0", Name: "v10.12.0", Draft: true},
+	{TagName: "v10.11.2", Name: "v10.11.2 (Extended Support Release)"},
+	{TagName: "v10.11.1", Name: "v10.11.1 (Extended Support Release)"},
+	{TagName: "v10.10.3", Name: "v10.10.3"},
+	{TagName: "v10.10.2", Name: "v10.10.2"},
+	{TagName: "v9.11.9", Name: "v9.11.9"},
+	{TagName: "v9.11.8", Name: "v9.11.8"},
+	{TagName: "not-a-version", Name: "Something else"},
+}
+
+type mockedReleaseSource struct {
+	releases []*githubReleaseMetadata
+	err      error
+	calls    atomic.Int32
+	// wait, if set, blocks requests until it is closed.
+	wait chan struct{}
+}
+
+func (mr *mockedReleaseSource) GetReleases() ([]*githubReleaseMetadata, error) {
+	mr.calls.Add(1)
+	if mr.wait != nil {
+		<-mr.wait
+	}
+	return mr.releases, mr.err
+}
+
+func TestResolveVersionAlias(t *testing.T) {
+	api := &plugintest.API{}
+	api.On("KVGet", StoreReleasesKey).Return(nil, nil)
+	api.On("KVSet", StoreReleasesKey, mock.Anything).Return(nil)
+
+	source := &mockedReleaseSource{releases: testReleases}
+	plugin := Plugin{
+		releaseSource: source,
+		configuration: &configuration{ESRVersions: "9.11"},
+	}
+	plugin.SetAPI(api)
+
+	for alias, expected := range map[string]string{
+		"latest":             "10.11.2",
+		"latest-esr":         "10.11.2",
+		"latest-rc":          "10.12.0-rc2",
+		"latest-patch:10.10": "10.10.3",
+		"latest-patch:9.11":  "9.11.9",
+		"previous-minor":     "10.10.3",
+		"master":             "master",
+		"nightly":            "master",
+		"9.11.1":             "9.11.1",
+	} {
+		t.Run(alias, func(t *testing.T) {
+			version, err := plugin.resolveVersionAlias(alias)
+			require.NoError(t, err)
+			assert.Equal(t, expected, version)
+		})
+	}
+
+	t.Run("configured ESR versions", func(t *testing.T) {
+		esrPlugin := Plugin{
+			releaseSource: &mockedReleaseSource{releases: testReleases[4:]},
+			configuration: &configuration{ESRVersions: "9.11"},
+		}
+		esrPlugin.SetAPI(api)
+		version, err := esrPlugin.resolveVersionAlias(versionAliasLatestESR)
+		require.NoError(t, err)
+		assert.Equal(t, "9.11.9", version)
+	})
+
+	t.Run("no matching release", func(t *testing.T) {
+		_, err := plugin.resolveVersionAlias("latest-patch:8.1")
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "no matching release found")
+	})
+
+	t.Run("invalid patch alias", func(t *testing.T) {
+		_, err := plugin.resolveVersionAlias("latest-patch:banana")
+		require.Error(t, err)
+	})
+
+	t.Run("releases are cached", func(t *testing.T) {
+		assert.EqualValues(t, 1, source.calls.Load())
+	})
+
+	t.Run("release source error", func(t *testing.T) {
+		failing := Plugin{releaseSource: &mockedReleaseSource{err: errors.New("rate limited")}}
+		failing.SetAPI(api)
+		_, err := failing.resolveVersionAlias(versionAliasLatest)
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "rate limited")
+	})
+}
+
+func TestReleasesCache(t *testing.T) {
+	setup := func() (*Plugin, *mockedReleaseSource, map[string][]byte) {
+		kv := map[string][]byte{}
+		var kvLock sync.Mutex
+
+		api := &plugintest.API{}
+		api.On("KVGet", StoreReleasesKey).Return(func(key string) []byte {
+			kvLock.Lock()
+			defer kvLock.Unlock()
+			return kv[key]
+		}, nil)
+		api.On("KVSet", StoreReleasesKey, mock.Anything).Return(func(key string, value []byte) *model.AppError {
+			kvLock.Lock()
+			defer kvLock.Unlock()
+			kv[key] = value
+			return nil
+		})
+		api.On("LogWarn", mock.AnythingOfType("string"), mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+
+		source := &mockedReleaseSource{releases: testReleases}
+		plugin := &Plugin{releaseSource: source, configuration: &configuration{}}
+		plugin.SetAPI(api)
+
+		return plugin, source, kv
+	}
+
+	t.Run("concurrent lookups fetch once", func(t *testing.T) {
+		plugin, source, kv := setup()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				releases, err := plugin.getReleases()
+				assert.NoError(t, err)
+				assert.Len(t, releases, len(testReleases))
+			}()
+		}
+		wg.Wait()
+
+		assert.EqualValues(t, 1, source.calls.Load())
+		assert.NotEmpty(t, kv[StoreReleasesKey])
+	})
+
+	t.Run("the cache isn't locked while fetching", func(t *testing.T) {
+		plugin, source, _ := setup()
+		source.wait = make(chan struct{})
+
+		var wg sync.WaitGroup
+		for i := 0; i < 2; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				releases, err := plugin.getReleases()
+				assert.NoError(t, err)
+				assert.Len(t, releases, len(testReleases))
+			}()
+		}
+		require.Eventually(t, func() bool { return source.calls.Load() == 1 }, time.Second, time.Millisecond)
+
+		status := make(chan releasesCacheStatus)
+		go func() { status <- plugin.getReleasesCacheStatus() }()
+		select {
+		case s := <-status:
+			assert.Zero(t, s.Count)
+		case <-time.After(time.Second):
+			t.Fatal("the cache status is blocked by the fetch")
+		}
+
+		close(source.wait)
+		wg.Wait()
+		assert.EqualValues(t, 1, source.calls.Load())
+		assert.Equal(t, len(testReleases), plugin.getReleasesCacheStatus().Count)
+	})
+
+	t.Run("expired releases are fetched again", func(t *testing.T) {
+		plugin, source, kv := setup()
+		plugin.configuration.ReleaseCacheTTLMinutes = "1"
+
+		_, err := plugin.getReleases()
+		require.NoError(t, err)
+
+		plugin.releases.timestamp = time.Now().Add(-time.Minute)
+		delete(kv, StoreReleasesKey)
+		_, err = plugin.getReleases()
+		require.NoError(t, err)
+		assert.EqualValues(t, 2, source.calls.Load())
+	})
+
+	t.Run("releases are shared through the KV store", func(t *testing.T) {
+		plugin, source, kv := setup()
+		_, err := plugin.getReleases()
+		require.NoError(t, err)
+
+		other, otherSource, _ := setup()
+		other.SetAPI(plugin.API)
+		releases, err := other.getReleases()
+		require.NoError(t, err)
+		assert.Len(t, releases, len(testReleases))
+		assert.EqualValues(t, 1, source.calls.Load())
+		assert.Zero(t, otherSource.calls.Load())
+		assert.NotEmpty(t, kv[StoreReleasesKey])
+	})
+
+	t.Run("stale releases are served when the source fails", func(t *testing.T) {
+		plugin, source, kv := setup()
+		_, err := plugin.getReleases()
+		require.NoError(t, err)
+
+		source.err = errors.New("rate limited")
+		plugin.releases.timestamp = time.Now().Add(-time.Hour)
+		delete(kv, StoreReleasesKey)
+
+		releases, err := plugin.getReleases()
+		require.NoError(t, err)
+		assert.Len(t, releases, len(testReleases))
+
+		status := plugin.getReleasesCacheStatus()
+		assert.Equal(t, len(testReleases), status.Count)
+		require.Error(t, status.LastError)
+
+		resp, _, err := plugin.runInfoCommand([]string{}, &model.CommandArgs{})
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, "Release metadata: 9 releases, fetched 1h0m0s ago")
+		assert.Contains(t, resp.Text, "the last refresh failed: rate limited")
+	})
+
+	t.Run("failed refreshes back off", func(t *testing.T) {
+		plugin, source, kv := setup()
+		_, err := plugin.getReleases()
+		require.NoError(t, err)
+
+		source.err = errors.New("rate limited")
+		plugin.releases.timestamp = time.Now().Add(-time.Hour)
+		delete(kv, StoreReleasesKey)
+		for i := 0; i < 3; i++ {
+			releases, err := plugin.getReleases()
+			require.NoError(t, err)
+			assert.Len(t, releases, len(testReleases))
+		}
+		assert.EqualValues(t, 2, source.calls.Load(), "the source isn't requested again until the TTL has passed")
+
+		plugin.releases.failedAt = time.Now().Add(-time.Hour)
+		_, err = plugin.getReleases()
+		require.NoError(t, err)
+		assert.EqualValues(t, 3, source.calls.Load())
+	})
+
+	t.Run("failed first fetches back off", func(t *testing.T) {
+		plugin, source, _ := setup()
+		source.err = errors.New("rate limited")
+		for i := 0; i < 3; i++ {
+			_, err := plugin.getReleases()
+			require.EqualError(t, err, "rate limited")
+		}
+		assert.EqualValues(t, 1, source.calls.Load())
+
+		newSource := &mockedReleaseSource{releases: testReleases}
+		plugin.setReleaseSource(newSource)
+		releases, err := plugin.getReleases()
+		require.NoError(t, err)
+		assert.Len(t, releases, len(testReleases))
+		assert.EqualValues(t, 1, newSource.calls.Load(), "a new source is requested right away")
+	})
+}
+
+func TestGithubReleaseSource(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "100", r.URL.Query().Get("per_page"))
+
+		var page []*githubReleaseMetadata
+		switch r.URL.Query().Get("page") {
+		case "":
+			page = testReleases[:4]
+			w.Header().Set("Link", fmt.Sprintf(`<%s/releases?per_page=100&page=2>; rel="next", <%s/releases?per_page=100&page=2>; rel="last"`, server.URL, server.URL))
+		case "2":
+			page = testReleases[4:]
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(page)
+	}))
+	defer server.Close()
+
+	t.Run("follows pagination", func(t *testing.T) {
+		releases, err := NewGithubReleaseSource(server.URL + "/releases").GetReleases()
+		require.NoError(t, err)
+		assert.Len(t, releases, len(testReleases))
+	})
+
+	t.Run("unexpected status code", func(t *testing.T) {
+		_, err := NewGithubReleaseSource(server.URL + "/releases?page=3").GetReleases()
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), "unexpected status code 404")
+	})
+}
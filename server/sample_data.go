@@ -0,0 +1,378 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+	flag "github.com/spf13/pflag"
+)
+
+const (
+	// sampleDataJobKeyPrefix prefixes the KV keys tracking the sample data
+	// generation job of an installation.
+	sampleDataJobKeyPrefix = "sample_data_job_"
+
+	sampleDataJobRunning   = "running"
+	sampleDataJobSucceeded = "succeeded"
+	sampleDataJobFailed    = "failed"
+
+	defaultSampleDataProfile = "medium"
+
+	// sampleDataJobTimeout is how long a job may run before it is considered
+	// interrupted, such as by a plugin restart, and can be started again.
+	sampleDataJobTimeout = time.Hour
+	// sampleDataStopTimeout is how long stopping the plugin waits for running
+	// jobs before marking them as interrupted.
+	sampleDataStopTimeout = 10 * time.Second
+)
+
+// sampleDataOptions configures the sample data generated with mmctl
+// sampledata. Zero counts fall back to the counts of the profile.
+type sampleDataOptions struct {
+	Profile         string `json:",omitempty"`
+	Teams           int    `json:",omitempty"`
+	ChannelsPerTeam int    `json:",omitempty"`
+	Users           int    `json:",omitempty"`
+	PostsPerChannel int    `json:",omitempty"`
+	Seed            int64  `json:",omitempty"`
+}
+
+// sampleDataProfiles are the predefined sample data sizes. The medium profile
+// matches the mmctl sampledata defaults.
+var sampleDataProfiles = map[string]sampleDataOptions{
+	"small":  {Teams: 1, ChannelsPerTeam: 5, Users: 10, PostsPerChannel: 20},
+	"medium": {Teams: 2, ChannelsPerTeam: 10, Users: 15, PostsPerChannel: 100},
+	"large":  {Teams: 5, ChannelsPerTeam: 20, Users: 100, PostsPerChannel: 500},
+}
+
+// Generation runs in a single mmctl call, which fails once the exec request
+// times out. The total number of posts, which dominates the generation time,
+// is capped to that of the large profile, the largest size offered. The other
+// maximum counts bound what can be combined with fewer posts.
+const (
+	maxSampleDataTeams           = 10
+	maxSampleDataChannelsPerTeam = 50
+	maxSampleDataUsers           = 500
+	maxSampleDataPostsPerChannel = 2000
+	maxSampleDataPosts           = 50000
+)
+
+func addSampleDataFlags(flagSet *flag.FlagSet) {
+	flagSet.String("test-data-profile", "", "Size of the test data: 'small', 'medium' or 'large'. Implies --test-data (default \"medium\")")
+	flagSet.Int("test-data-teams", 0, "Number of test data teams, overriding the profile. Implies --test-data")
+	flagSet.Int("test-data-channels-per-team", 0, "Number of test data channels per team, overriding the profile. Implies --test-data")
+	flagSet.Int("test-data-users", 0, "Number of test data users, overriding the profile. Implies --test-data")
+	flagSet.Int("test-data-posts-per-channel", 0, "Number of test data posts per channel, overriding the profile. Implies --test-data")
+	flagSet.Int64("test-data-seed", 0, "Seed making the generated test data deterministic. Implies --test-data")
+}
+
+// parseSampleDataFlags returns the sample data options set with flags, or nil
+// if none were set.
+func parseSampleDataFlags(flagSet *flag.FlagSet) (*sampleDataOptions, error) {
+	options := &sampleDataOptions{}
+	var set bool
+	var err error
+
+	if flagSet.Changed("test-data-profile") {
+		set = true
+		options.Profile, err = flagSet.GetString("test-data-profile")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for name, value := range map[string]*int{
+		"test-data-teams":             &options.Teams,
+		"test-data-channels-per-team": &options.ChannelsPerTeam,
+		"test-data-users":             &options.Users,
+		"test-data-posts-per-channel": &options.PostsPerChannel,
+	} {
+		if !flagSet.Changed(name) {
+			continue
+		}
+		set = true
+		*value, err = flagSet.GetInt(name)
+		if err != nil {
+			return nil, err
+		}
+		if *value <= 0 {
+			return nil, errors.Errorf("--%s must be greater than 0", name)
+		}
+	}
+
+	if flagSet.Changed("test-data-seed") {
+		set = true
+		options.Seed, err = flagSet.GetInt64("test-data-seed")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !set {
+		return nil, nil
+	}
+
+	err = options.IsValid()
+	if err != nil {
+		return nil, err
+	}
+
+	return options, nil
+}
+
+// IsValid returns an error if the options can't be used.
+func (o *sampleDataOptions) IsValid() error {
+	if o.Profile != "" {
+		if _, ok := sampleDataProfiles[o.Profile]; !ok {
+			return errors.Errorf("invalid test data profile %s, valid options are small, medium and large", o.Profile)
+		}
+	}
+
+	resolved := o.resolve()
+	if resolved.Teams > maxSampleDataTeams {
+		return errors.Errorf("at most %d test data teams can be generated", maxSampleDataTeams)
+	}
+	if resolved.ChannelsPerTeam > maxSampleDataChannelsPerTeam {
+		return errors.Errorf("at most %d test data channels per team can be generated", maxSampleDataChannelsPerTeam)
+	}
+	if resolved.Users > maxSampleDataUsers {
+		return errors.Errorf("at most %d test data users can be generated", maxSampleDataUsers)
+	}
+	if resolved.PostsPerChannel > maxSampleDataPostsPerChannel {
+		return errors.Errorf("at most %d test data posts per channel can be generated", maxSampleDataPostsPerChannel)
+	}
+	if posts := resolved.Teams * resolved.ChannelsPerTeam * resolved.PostsPerChannel; posts > maxSampleDataPosts {
+		return errors.Errorf("at most %d test data posts can be generated, but %d teams with %d channels of %d posts make %d", maxSampleDataPosts, resolved.Teams, resolved.ChannelsPerTeam, resolved.PostsPerChannel, posts)
+	}
+
+	return nil
+}
+
+// resolve returns the options with the counts of the profile filled in.
+func (o *sampleDataOptions) resolve() sampleDataOptions {
+	profile := o.Profile
+	if profile == "" {
+		profile = defaultSampleDataProfile
+	}
+
+	resolved := sampleDataProfiles[profile]
+	resolved.Profile = profile
+	resolved.Seed = o.Seed
+	if o.Teams > 0 {
+		resolved.Teams = o.Teams
+	}
+	if o.ChannelsPerTeam > 0 {
+		resolved.ChannelsPerTeam = o.ChannelsPerTeam
+	}
+	if o.Users > 0 {
+		resolved.Users = o.Users
+	}
+	if o.PostsPerChannel > 0 {
+		resolved.PostsPerChannel = o.PostsPerChannel
+	}
+
+	return resolved
+}
+
+// mmctlArgs returns the arguments of the mmctl command generating the sample
+// data.
+func (o *sampleDataOptions) mmctlArgs() []string {
+	resolved := o.resolve()
+	args := []string{
+		"sampledata",
+		"--teams", strconv.Itoa(resolved.Teams),
+		"--channels-per-team", strconv.Itoa(resolved.ChannelsPerTeam),
+		"--users", strconv.Itoa(resolved.Users),
+		"--posts-per-channel", strconv.Itoa(resolved.PostsPerChannel),
+	}
+	if resolved.Seed != 0 {
+		args = append(args, "--seed", strconv.FormatInt(resolved.Seed, 10))
+	}
+
+	return append(args, "--local")
+}
+
+// sampleDataJob tracks the generation of the sample data of an installation.
+type sampleDataJob struct {
+	InstallationID string
+	State          string
+	Command        string
+	StartAt        int64
+	EndAt          int64  `json:",omitempty"`
+	Error          string `json:",omitempty"`
+}
+
+// sampleDataJobs tracks the sample data jobs running in this plugin instance.
+type sampleDataJobs struct {
+	lock    sync.Mutex
+	running map[string]*runningSampleDataJob
+	wg      sync.WaitGroup
+}
+
+type runningSampleDataJob struct {
+	install *Installation
+	job     sampleDataJob
+}
+
+// getSampleDataJob returns the sample data job of an installation. Jobs which
+// have been running for longer than sampleDataJobTimeout are returned as
+// failed, as they were interrupted without their state being updated.
+func (p *Plugin) getSampleDataJob(installationID string) (*sampleDataJob, error) {
+	data, appErr := p.API.KVGet(sampleDataJobKeyPrefix + installationID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get sample data job")
+	}
+	if data == nil {
+		return nil, nil
+	}
+
+	var job *sampleDataJob
+	err := json.Unmarshal(data, &job)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal sample data job")
+	}
+	if job.State == sampleDataJobRunning && model.GetMillis()-job.StartAt > sampleDataJobTimeout.Milliseconds() {
+		job.State = sampleDataJobFailed
+		job.Error = fmt.Sprintf("the job didn't finish within %s", sampleDataJobTimeout)
+	}
+
+	return job, nil
+}
+
+func (p *Plugin) storeSampleDataJob(job *sampleDataJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal sample data job")
+	}
+
+	appErr := p.API.KVSet(sampleDataJobKeyPrefix+job.InstallationID, data)
+	if appErr != nil {
+		return errors.Wrap(appErr, "failed to store sample data job")
+	}
+
+	return nil
+}
+
+// startSampleDataJob starts generating the sample data of an installation in
+// the background. The owner is sent a DM once generation has finished.
+func (p *Plugin) startSampleDataJob(install *Installation) error {
+	if !install.TestData {
+		return nil
+	}
+
+	job, err := p.getSampleDataJob(install.ID)
+	if err != nil {
+		return err
+	}
+	if job != nil && job.State == sampleDataJobRunning {
+		p.API.LogDebug("Sample data is already being generated", "installation", install.ID)
+		return nil
+	}
+
+	clusterInstallationID, err := p.getClusterInstallationID(install)
+	if err != nil {
+		return err
+	}
+
+	options := install.SampleData
+	if options == nil {
+		options = &sampleDataOptions{}
+	}
+	args := options.mmctlArgs()
+
+	job = &sampleDataJob{
+		InstallationID: install.ID,
+		State:          sampleDataJobRunning,
+		Command:        "mmctl " + strings.Join(args, " "),
+		StartAt:        model.GetMillis(),
+	}
+	err = p.storeSampleDataJob(job)
+	if err != nil {
+		return err
+	}
+	p.recordPluginEvent(install.ID, "", "sample-data-started", job.Command)
+
+	p.sampleDataJobs.lock.Lock()
+	if p.sampleDataJobs.running == nil {
+		p.sampleDataJobs.running = make(map[string]*runningSampleDataJob)
+	}
+	p.sampleDataJobs.running[install.ID] = &runningSampleDataJob{install: install, job: *job}
+	p.sampleDataJobs.wg.Add(1)
+	p.sampleDataJobs.lock.Unlock()
+
+	go func() {
+		defer p.sampleDataJobs.wg.Done()
+		p.runSampleDataJob(install, job, clusterInstallationID, args)
+
+		p.sampleDataJobs.lock.Lock()
+		delete(p.sampleDataJobs.running, install.ID)
+		p.sampleDataJobs.lock.Unlock()
+	}()
+
+	return nil
+}
+
+// stopSampleDataJobs waits up to the timeout for the running sample data jobs
+// to finish. Jobs still running after it are stored as failed and their
+// owners are notified, since the CLI call generating the data can't be
+// stopped and its result would be lost with the plugin.
+func (p *Plugin) stopSampleDataJobs(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		p.sampleDataJobs.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+
+	p.sampleDataJobs.lock.Lock()
+	defer p.sampleDataJobs.lock.Unlock()
+
+	for _, running := range p.sampleDataJobs.running {
+		job := running.job
+		job.State = sampleDataJobFailed
+		job.EndAt = model.GetMillis()
+		job.Error = "the plugin stopped while the test data was being generated"
+		if err := p.storeSampleDataJob(&job); err != nil {
+			p.API.LogWarn(err.Error(), "installation", job.InstallationID)
+		}
+		p.recordPluginEvent(job.InstallationID, "", "sample-data-failed", job.Error)
+		p.PostBotDM(running.install.OwnerID, fmt.Sprintf("Generating test data for installation %s was interrupted because the plugin stopped. The generation may still complete on the installation. The command used was %s.", running.install.Name, inlineCode(job.Command)))
+	}
+	p.sampleDataJobs.running = nil
+}
+
+func (p *Plugin) runSampleDataJob(install *Installation, job *sampleDataJob, clusterInstallationID string, args []string) {
+	_, err := p.cloudClient.ExecClusterInstallationCLI(clusterInstallationID, "mmctl", args)
+
+	job.EndAt = model.GetMillis()
+	duration := (time.Duration(job.EndAt-job.StartAt) * time.Millisecond).Round(time.Second).String()
+
+	var message string
+	if err != nil {
+		job.State = sampleDataJobFailed
+		job.Error = err.Error()
+		p.recordPluginEvent(install.ID, "", "sample-data-failed", err.Error())
+		message = fmt.Sprintf("Generating test data for installation %s failed after %s: %s\n\nThe generation may have timed out while still running on the installation. The command used was %s.", install.Name, duration, inlineCode(err.Error()), inlineCode(job.Command))
+	} else {
+		job.State = sampleDataJobSucceeded
+		p.recordPluginEvent(install.ID, "", "sample-data-completed", "")
+		message = fmt.Sprintf("Test data for installation %s has been generated in %s.", install.Name, duration)
+	}
+
+	if storeErr := p.storeSampleDataJob(job); storeErr != nil {
+		p.API.LogWarn(storeErr.Error(), "installation", install.ID)
+	}
+
+	p.PostBotDM(install.OwnerID, message)
+}
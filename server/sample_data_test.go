@@ -0,0 +1,175 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/pkg/errors"
+	flag "github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseSampleDataFlags(t *testing.T) {
+	parse := func(args ...string) (*sampleDataOptions, error) {
+		flagSet := flag.NewFlagSet("test", flag.ContinueOnError)
+		addSampleDataFlags(flagSet)
+		require.NoError(t, flagSet.Parse(args))
+		return parseSampleDataFlags(flagSet)
+	}
+
+	options, err := parse()
+	require.NoError(t, err)
+	assert.Nil(t, options)
+
+	options, err = parse("--test-data-profile", "large", "--test-data-users", "250", "--test-data-seed", "42")
+	require.NoError(t, err)
+	assert.Equal(t, &sampleDataOptions{Profile: "large", Users: 250, Seed: 42}, options)
+	assert.Equal(t, []string{
+		"sampledata",
+		"--teams", "5",
+		"--channels-per-team", "20",
+		"--users", "250",
+		"--posts-per-channel", "500",
+		"--seed", "42",
+		"--local",
+	}, options.mmctlArgs())
+
+	for _, args := range [][]string{
+		{"--test-data-profile", "huge"},
+		{"--test-data-teams", "0"},
+		{"--test-data-users", "5000"},
+		{"--test-data-profile", "large", "--test-data-posts-per-channel", "2001"},
+		{"--test-data-profile", "large", "--test-data-posts-per-channel", "501"},
+	} {
+		_, err = parse(args...)
+		assert.Error(t, err, args)
+	}
+
+	_, err = parse("--test-data-teams", "10", "--test-data-channels-per-team", "50", "--test-data-posts-per-channel", "2000")
+	assert.EqualError(t, err, "at most 50000 test data posts can be generated, but 10 teams with 50 channels of 2000 posts make 1000000")
+
+	options, err = parse("--test-data-profile", "small", "--test-data-posts-per-channel", "2000")
+	require.NoError(t, err, "fewer channels allow more posts per channel")
+	assert.Equal(t, 2000, options.PostsPerChannel)
+}
+
+func TestSampleDataOptionsDefaults(t *testing.T) {
+	options := &sampleDataOptions{}
+	assert.Equal(t, []string{
+		"sampledata",
+		"--teams", "2",
+		"--channels-per-team", "10",
+		"--users", "15",
+		"--posts-per-channel", "100",
+		"--local",
+	}, options.mmctlArgs())
+}
+
+func TestSampleDataJob(t *testing.T) {
+	api := &plugintest.API{}
+	newMockedKVStore(api)
+	api.On("GetDirectChannel", "joramid", "botid").Return(&model.Channel{Id: "dmid"}, nil)
+
+	var post *model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		post = args.Get(0).(*model.Post)
+	}).Return(&model.Post{}, nil)
+
+	mockedCloudClient := &MockClient{mockedCloudClusterInstallations: []*cloud.ClusterInstallation{{ID: "ciid"}}}
+	plugin := &Plugin{BotUserID: "botid", cloudClient: mockedCloudClient}
+	plugin.SetAPI(api)
+
+	install := &Installation{
+		Name:            "joramsinstall",
+		TestData:        true,
+		SampleData:      &sampleDataOptions{Profile: "small"},
+		InstallationDTO: cloud.InstallationDTO{Installation: &cloud.Installation{ID: "someid", OwnerID: "joramid"}},
+	}
+	args := install.SampleData.mmctlArgs()
+
+	t.Run("succeeded", func(t *testing.T) {
+		job := &sampleDataJob{InstallationID: "someid", State: sampleDataJobRunning, StartAt: model.GetMillis()}
+		plugin.runSampleDataJob(install, job, "ciid", args)
+		assert.Equal(t, args, mockedCloudClient.execSubcommand)
+
+		job, err := plugin.getSampleDataJob("someid")
+		require.NoError(t, err)
+		assert.Equal(t, sampleDataJobSucceeded, job.State)
+		assert.NotZero(t, job.EndAt)
+		require.NotNil(t, post)
+		assert.Contains(t, post.Message, "Test data for installation joramsinstall has been generated")
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		mockedCloudClient.execErr = errors.New("context deadline exceeded")
+		defer func() { mockedCloudClient.execErr = nil }()
+
+		job := &sampleDataJob{InstallationID: "someid", State: sampleDataJobRunning, StartAt: model.GetMillis()}
+		plugin.runSampleDataJob(install, job, "ciid", args)
+
+		job, err := plugin.getSampleDataJob("someid")
+		require.NoError(t, err)
+		assert.Equal(t, sampleDataJobFailed, job.State)
+		assert.Equal(t, "context deadline exceeded", job.Error)
+		assert.Contains(t, post.Message, "Generating test data for installation joramsinstall failed")
+
+		events, err := plugin.getInstallationEvents("someid")
+		require.NoError(t, err)
+		assert.Equal(t, "sample-data-failed", events[len(events)-1].Action)
+	})
+
+	t.Run("not started twice", func(t *testing.T) {
+		require.NoError(t, plugin.storeSampleDataJob(&sampleDataJob{InstallationID: "someid", State: sampleDataJobRunning, StartAt: model.GetMillis()}))
+		api.On("LogDebug", mock.AnythingOfType("string"), mock.Anything, mock.Anything).Return()
+		mockedCloudClient.execSubcommand = nil
+
+		require.NoError(t, plugin.startSampleDataJob(install))
+		assert.Nil(t, mockedCloudClient.execSubcommand)
+	})
+
+	t.Run("stale jobs are started again", func(t *testing.T) {
+		startAt := model.GetMillisForTime(time.Now().Add(-sampleDataJobTimeout - time.Minute))
+		require.NoError(t, plugin.storeSampleDataJob(&sampleDataJob{InstallationID: "someid", State: sampleDataJobRunning, StartAt: startAt}))
+
+		job, err := plugin.getSampleDataJob("someid")
+		require.NoError(t, err)
+		assert.Equal(t, sampleDataJobFailed, job.State)
+		assert.Contains(t, job.Error, "didn't finish within")
+
+		require.NoError(t, plugin.startSampleDataJob(install))
+		plugin.stopSampleDataJobs(5 * time.Second)
+		job, err = plugin.getSampleDataJob("someid")
+		require.NoError(t, err)
+		assert.Equal(t, sampleDataJobSucceeded, job.State)
+	})
+
+	t.Run("interrupted by stopping", func(t *testing.T) {
+		mockedCloudClient.execBlock = make(chan struct{})
+		defer func() { mockedCloudClient.execBlock = nil }()
+		require.NoError(t, plugin.storeSampleDataJob(&sampleDataJob{InstallationID: "someid", State: sampleDataJobSucceeded}))
+
+		require.NoError(t, plugin.startSampleDataJob(install))
+		plugin.stopSampleDataJobs(10 * time.Millisecond)
+
+		job, err := plugin.getSampleDataJob("someid")
+		require.NoError(t, err)
+		assert.Equal(t, sampleDataJobFailed, job.State)
+		assert.Equal(t, "the plugin stopped while the test data was being generated", job.Error)
+		assert.Contains(t, post.Message, "Generating test data for installation joramsinstall was interrupted")
+
+		close(mockedCloudClient.execBlock)
+		plugin.sampleDataJobs.wg.Wait()
+	})
+
+	t.Run("no test data", func(t *testing.T) {
+		require.NoError(t, plugin.startSampleDataJob(&Installation{InstallationDTO: cloud.InstallationDTO{Installation: &cloud.Installation{ID: "otherid"}}}))
+		job, err := plugin.getSampleDataJob("otherid")
+		require.NoError(t, err)
+		assert.Nil(t, job)
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	cloud "github.com/mattermost/mattermost-cloud/model"
@@ -19,50 +20,200 @@ const (
 	defaultUserEmail    = "success+user@simulator.amazonses.com"
 )
 
-func (p *Plugin) setupInstallation(install *Installation, adminPassword, userPassword string) error {
+// waitForDNSInterval is how often an installation is pinged while waiting for
+// its DNS.
+var waitForDNSInterval = 10 * time.Second
+
+// setupCredential is the login of an account created during setup.
+type setupCredential struct {
+	Username string
+	Password string
+	Note     string
+}
+
+// getInstallationSetupProfile returns the setup profile an installation was
+// created with.
+func (p *Plugin) getInstallationSetupProfile(install *Installation) (*setupProfile, error) {
+	if install.SetupProfile == "" {
+		return defaultSetupProfile, nil
+	}
+
+	profile, err := p.getSetupProfile(install.OwnerID, install.SetupProfile)
+	if err != nil {
+		return nil, err
+	}
+	if profile == nil {
+		return nil, errors.Errorf("setup profile %s no longer exists", install.SetupProfile)
+	}
+
+	return profile, nil
+}
+
+// errSetupInterrupted is returned when setup is stopped while waiting for
+// the installation, because the plugin is stopping.
+var errSetupInterrupted = errors.New("setup was interrupted because the plugin is stopping")
+
+// setupInstallation creates the admin account of a ready installation and
+// applies its setup profile. The logins of the created accounts are returned.
+// Progress is stored after each step so that a failed setup resumes from the
+// step that failed. Closing stop interrupts waiting for the installation DNS.
+func (p *Plugin) setupInstallation(install *Installation, stop <-chan struct{}) ([]*setupCredential, error) {
 	if len(install.DNSRecords) == 0 {
-		return fmt.Errorf("Installation %s doesn't have any DNSRecords", install.ID)
+		return nil, fmt.Errorf("Installation %s doesn't have any DNSRecords", install.ID)
+	}
+
+	profile, err := p.getInstallationSetupProfile(install)
+	if err != nil {
+		return nil, err
+	}
+
+	progress, err := p.getSetupProgress(install.ID)
+	if err != nil {
+		return nil, err
 	}
 
 	client := model.NewAPIv4Client(fmt.Sprintf("https://%s", install.DNSRecords[0].DomainName))
 	if client == nil {
-		return errors.New("got nil APIv4 Mattermost client for some reason")
+		return nil, errors.New("got nil APIv4 Mattermost client for some reason")
+	}
+
+	runStep := func(step string, fn func() error) error {
+		if progress.isCompleted(step) {
+			return nil
+		}
+
+		err := fn()
+		if errors.Cause(err) == errSetupInterrupted {
+			return err
+		}
+		if err != nil {
+			progress.FailedStep = step
+			progress.LastError = err.Error()
+			if storeErr := p.storeSetupProgress(install.ID, progress); storeErr != nil {
+				p.API.LogWarn(storeErr.Error(), "installation", install.ID)
+			}
+			return err
+		}
+
+		progress.Completed = append(progress.Completed, step)
+		progress.FailedStep = ""
+		progress.LastError = ""
+		return p.storeSetupProgress(install.ID, progress)
+	}
+
+	err = runStep(setupStepDNSReady, func() error {
+		return errors.Wrap(p.waitForDNS(client, stop), "encountered an error waiting for installation DNS")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if progress.AdminPassword == "" && progress.isCompleted(setupStepAdminCreated) {
+		// The password isn't stored without a credential encryption key, so
+		// it is reset to resume setup.
+		progress.AdminPassword, err = p.resetSetupAdminPassword(install, client)
+		if err != nil {
+			return nil, errors.Wrap(err, "encountered an error resetting the password of the installation admin account")
+		}
+	}
+	if progress.AdminPassword == "" {
+		// The password is stored before the account is created so that a
+		// resumed setup can log in if only the login failed.
+		progress.AdminPassword = generateRandomPassword(defaultAdminUsername)
+		err = p.storeSetupProgress(install.ID, progress)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	err := p.waitForDNS(client)
+	err = runStep(setupStepAdminCreated, func() error {
+		return errors.Wrap(p.createUser(client, defaultAdminUsername, progress.AdminPassword, defaultAdminEmail), "encountered an error creating installation admin account")
+	})
 	if err != nil {
-		return errors.Wrap(err, "encountered an error waiting for installation DNS")
+		return nil, err
 	}
 
-	err = p.createAndLoginAdminUser(client, adminPassword)
+	_, _, err = client.Login(defaultAdminUsername, progress.AdminPassword)
 	if err != nil {
-		return errors.Wrap(err, "encountered an error creating installation admin account")
+		return nil, errors.Wrap(err, "encountered an error logging in with the installation admin account")
 	}
 
-	err = p.setupInstallationConfiguration(client, install)
+	err = runStep(setupStepConfigApplied, func() error {
+		return errors.Wrap(p.setupInstallationConfiguration(client, profile), "encountered an error configuring the installation")
+	})
 	if err != nil {
-		return errors.Wrap(err, "encountered an error configuring the installation")
+		return nil, err
 	}
 
-	// Create normal user
-	err = p.createUser(client, defaultUserUsername, userPassword, defaultUserEmail)
+	err = runStep(setupStepUsersCreated, func() error {
+		return errors.Wrapf(p.createSetupProfileUsers(client, profile, progress), "encountered an error creating the users of setup profile %s", profile.Name)
+	})
 	if err != nil {
-		return errors.Wrap(err, "encountered an error creating installation user account")
+		return nil, err
 	}
 
-	return nil
+	err = runStep(setupStepProfileApplied, func() error {
+		return errors.Wrapf(p.applySetupProfile(client, install, profile, progress), "encountered an error applying setup profile %s", profile.Name)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = runStep(setupStepTestDataStarted, func() error {
+		return errors.Wrap(p.startSampleDataJob(install), "unable to start generating installation sample data")
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return progress.allCredentials(), nil
+}
+
+// resetSetupAdminPassword resets the password of the admin account created
+// by setup and returns the new one. mmctl only takes passwords as arguments,
+// which end up in the exec logs of the provisioner, so the password set with
+// mmctl is replaced through the API.
+func (p *Plugin) resetSetupAdminPassword(install *Installation, client *model.Client4) (string, error) {
+	clusterInstallationID, err := p.getClusterInstallationID(install)
+	if err != nil {
+		return "", err
+	}
+
+	temporaryPassword := generateRandomPassword(defaultAdminUsername)
+	_, err = p.cloudClient.ExecClusterInstallationCLI(clusterInstallationID, "mmctl", []string{"user", "change-password", defaultAdminUsername, "--password", temporaryPassword, "--local"})
+	if err != nil {
+		return "", errors.Wrap(err, "failed to reset password")
+	}
+
+	user, _, err := client.Login(defaultAdminUsername, temporaryPassword)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to log in with the reset password")
+	}
+	defer client.Logout()
+
+	password := generateRandomPassword(defaultAdminUsername)
+	_, err = client.UpdateUserPassword(user.Id, temporaryPassword, password)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to change the reset password")
+	}
+
+	return password, nil
 }
 
-func (p *Plugin) waitForDNS(client *model.Client4) error {
+func (p *Plugin) waitForDNS(client *model.Client4, stop <-chan struct{}) error {
 	for i := 0; i < 60; i++ {
 		_, resp, err := client.GetPing()
-		if resp.StatusCode == http.StatusOK {
+		if resp != nil && resp.StatusCode == http.StatusOK {
 			return nil
 		}
 		if err != nil {
 			p.API.LogDebug(err.Error())
 		}
-		time.Sleep(time.Second * 10)
+		select {
+		case <-stop:
+			return errSetupInterrupted
+		case <-time.After(waitForDNSInterval):
+		}
 	}
 
 	return errors.New("timed out waiting for installation DNS")
@@ -79,21 +230,7 @@ func (p *Plugin) createUser(client *model.Client4, username, password, email str
 	return err
 }
 
-func (p *Plugin) createAndLoginAdminUser(client *model.Client4, password string) error {
-	err := p.createUser(client, defaultAdminUsername, password, defaultAdminEmail)
-	if err != nil {
-		return err
-	}
-
-	_, _, err = client.Login(defaultAdminUsername, password)
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-func (p *Plugin) setupInstallationConfiguration(client *model.Client4, install *Installation) error {
+func (p *Plugin) setupInstallationConfiguration(client *model.Client4, profile *setupProfile) error {
 	config, resp, err := client.GetConfig()
 	if err != nil {
 		return errors.Wrap(err, "failed to get Mattermost config")
@@ -104,6 +241,7 @@ func (p *Plugin) setupInstallationConfiguration(client *model.Client4, install *
 
 	pluginConfig := p.getConfiguration()
 
+	updateConfig := false
 	if pluginConfig.GroupID == "" {
 		// Set some basic config due to not being in a group.
 		p.configureEmail(config, pluginConfig)
@@ -111,21 +249,187 @@ func (p *Plugin) setupInstallationConfiguration(client *model.Client4, install *
 		config.ServiceSettings.EnableDeveloper = NewBool(true)
 		config.TeamSettings.EnableOpenServer = NewBool(true)
 		config.PluginSettings.EnableUploads = NewBool(true)
+		updateConfig = true
+	}
+
+	if len(profile.Config) > 0 {
+		// Unmarshalling over the current config only changes the settings
+		// present in the patch.
+		err = json.Unmarshal(profile.Config, config)
+		if err != nil {
+			return errors.Wrap(err, "invalid setup profile config patch")
+		}
+		updateConfig = true
+	}
 
+	if updateConfig {
 		_, _, err = client.UpdateConfig(config)
 		if err != nil {
 			return errors.Wrap(err, "unable to update installation config")
 		}
 	}
 
-	err = p.createTestData(client, install)
-	if err != nil {
-		return errors.Wrap(err, "unable to generate installation sample data")
+	return nil
+}
+
+// createSetupProfileUsers creates the users of a setup profile. Created users
+// are recorded in the setup progress so that they are only created once.
+func (p *Plugin) createSetupProfileUsers(client *model.Client4, profile *setupProfile, progress *setupProgress) error {
+	for _, profileUser := range profile.Users {
+		userID, ok := progress.UserIDs[profileUser.Username]
+		if !ok {
+			password := generateRandomPassword(profileUser.Username)
+			user, _, err := client.CreateUser(&model.User{
+				Username: profileUser.Username,
+				Password: password,
+				Email:    profileUser.email(),
+			})
+			if err != nil {
+				return errors.Wrapf(err, "failed to create user %s", profileUser.Username)
+			}
+			userID = user.Id
+			progress.UserIDs[profileUser.Username] = userID
+
+			note := "Regular user"
+			if len(profileUser.Roles) > 0 {
+				note = strings.Join(profileUser.Roles, ", ")
+			}
+			progress.Credentials = append(progress.Credentials, &setupCredential{Username: profileUser.Username, Password: password, Note: note})
+		}
+
+		// Updating roles is idempotent, so it is always done in case a
+		// previous attempt failed after creating the user.
+		if len(profileUser.Roles) > 0 {
+			roles := append([]string{model.SystemUserRoleId}, profileUser.Roles...)
+			_, err := client.UpdateUserRoles(userID, strings.Join(roles, " "))
+			if err != nil {
+				return errors.Wrapf(err, "failed to update the roles of user %s", profileUser.Username)
+			}
+		}
+	}
+
+	return nil
+}
+
+// applySetupProfile creates the teams and channels of a setup profile, enables
+// its plugins and runs its mmctl commands. The client must be logged in as an
+// admin and the profile users must have been created.
+func (p *Plugin) applySetupProfile(client *model.Client4, install *Installation, profile *setupProfile, progress *setupProgress) error {
+	for _, profileTeam := range profile.Teams {
+		err := p.createSetupProfileTeam(client, profile, &profileTeam, progress)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, pluginID := range profile.Plugins {
+		_, err := client.EnablePlugin(pluginID)
+		if err != nil {
+			return errors.Wrapf(err, "failed to enable plugin %s", pluginID)
+		}
+	}
+
+	if progress.CommandsRun < len(profile.MmctlCommands) {
+		clusterInstallationID, err := p.getClusterInstallationID(install)
+		if err != nil {
+			return err
+		}
+		// Commands may not be idempotent, so those which already ran are
+		// skipped.
+		for _, command := range profile.MmctlCommands[progress.CommandsRun:] {
+			subcommand := append(strings.Fields(command), "--local")
+			_, err = p.cloudClient.ExecClusterInstallationCLI(clusterInstallationID, "mmctl", subcommand)
+			if err != nil {
+				return errors.Wrapf(err, "failed to run mmctl %s", command)
+			}
+			progress.CommandsRun++
+		}
+	}
+
+	return nil
+}
+
+func (p *Plugin) createSetupProfileTeam(client *model.Client4, profile *setupProfile, profileTeam *setupProfileTeam, progress *setupProgress) error {
+	teamID, ok := progress.TeamIDs[profileTeam.Name]
+	if !ok {
+		teamType := model.TeamOpen
+		if profileTeam.InviteOnly {
+			teamType = model.TeamInvite
+		}
+		team, _, err := client.CreateTeam(&model.Team{
+			Name:        profileTeam.Name,
+			DisplayName: displayNameOrName(profileTeam.DisplayName, profileTeam.Name),
+			Type:        teamType,
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to create team %s", profileTeam.Name)
+		}
+		teamID = team.Id
+		progress.TeamIDs[profileTeam.Name] = teamID
+	}
+
+	members := profileTeam.Members
+	if len(members) == 0 {
+		for _, profileUser := range profile.Users {
+			members = append(members, profileUser.Username)
+		}
+	}
+
+	// Adding members is idempotent, so they are added again when a team is
+	// resumed.
+	var memberIDs []string
+	for _, member := range members {
+		userID, ok := progress.UserIDs[member]
+		if !ok {
+			// The admin account created the team, so it is already a member.
+			continue
+		}
+		_, _, err := client.AddTeamMember(teamID, userID)
+		if err != nil {
+			return errors.Wrapf(err, "failed to add %s to team %s", member, profileTeam.Name)
+		}
+		memberIDs = append(memberIDs, userID)
+	}
+
+	for _, profileChannel := range profileTeam.Channels {
+		channelKey := profileTeam.Name + "/" + profileChannel.Name
+		channelID, ok := progress.ChannelIDs[channelKey]
+		if !ok {
+			channelType := model.ChannelTypeOpen
+			if profileChannel.Private {
+				channelType = model.ChannelTypePrivate
+			}
+			channel, _, err := client.CreateChannel(&model.Channel{
+				TeamId:      teamID,
+				Name:        profileChannel.Name,
+				DisplayName: displayNameOrName(profileChannel.DisplayName, profileChannel.Name),
+				Type:        channelType,
+			})
+			if err != nil {
+				return errors.Wrapf(err, "failed to create channel %s in team %s", profileChannel.Name, profileTeam.Name)
+			}
+			channelID = channel.Id
+			progress.ChannelIDs[channelKey] = channelID
+		}
+
+		for _, userID := range memberIDs {
+			_, _, err := client.AddChannelMember(channelID, userID)
+			if err != nil {
+				return errors.Wrapf(err, "failed to add members to channel %s", profileChannel.Name)
+			}
+		}
 	}
 
 	return nil
 }
 
+func displayNameOrName(displayName, name string) string {
+	if displayName != "" {
+		return displayName
+	}
+	return name
+}
+
 func (p *Plugin) configureEmail(config *model.Config, pluginConfig *configuration) {
 	if pluginConfig.EmailSettings == "" {
 		p.API.LogWarn("emailsettings is blank; skipping email configuration")
@@ -138,30 +442,22 @@ func (p *Plugin) configureEmail(config *model.Config, pluginConfig *configuratio
 	}
 }
 
-func (p *Plugin) createTestData(client *model.Client4, install *Installation) error {
-	if !install.TestData {
-		return nil
-	}
-
+// getClusterInstallationID returns the ID of the only cluster installation of
+// an installation.
+func (p *Plugin) getClusterInstallationID(install *Installation) (string, error) {
 	clusterInstallations, err := p.cloudClient.GetClusterInstallations(
 		&cloud.GetClusterInstallationsRequest{
 			Paging:         cloud.AllPagesNotDeleted(),
 			InstallationID: install.ID,
 		})
 	if err != nil {
-		return errors.Wrap(err, "failed to get ClusterInstallations for Installation")
+		return "", errors.Wrap(err, "failed to get ClusterInstallations for Installation")
 	}
 	if len(clusterInstallations) != 1 {
-		return errors.Errorf("got unexpected number of ClusterInstallations (%d)", len(clusterInstallations))
+		return "", errors.Errorf("got unexpected number of ClusterInstallations (%d)", len(clusterInstallations))
 	}
 
-	_, err = p.cloudClient.ExecClusterInstallationCLI(clusterInstallations[0].ID, "mmctl", []string{"sampledata", "--local"})
-	if err != nil {
-		// Hitting a timeout is likely, so log and continue.
-		p.API.LogWarn(errors.Wrapf(err, "Unable to finish generating test data for cloud installation %s", install.Name).Error())
-	}
-
-	return nil
+	return clusterInstallations[0].ID, nil
 }
 
 func generateRandomPassword(prefix string) string {
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// setupProfilesKeyPrefix prefixes the keys storing the setup profiles of
+	// each user in the plugin KV store.
+	setupProfilesKeyPrefix = "setup_profiles_"
+	// maxUserSetupProfiles limits how many setup profiles a user can save.
+	maxUserSetupProfiles = 20
+)
+
+// validSetupProfileRoles are the system roles profile users can be given.
+var validSetupProfileRoles = []string{
+	model.SystemUserRoleId,
+	model.SystemAdminRoleId,
+	model.SystemManagerRoleId,
+	model.SystemUserManagerRoleId,
+	model.SystemReadOnlyAdminRoleId,
+}
+
+// setupProfile describes how an installation is set up once it is ready.
+type setupProfile struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// Users are created in addition to the admin account used for setup.
+	Users []setupProfileUser `json:"users,omitempty"`
+	Teams []setupProfileTeam `json:"teams,omitempty"`
+	// Config is a partial Mattermost config applied on top of the
+	// installation config.
+	Config json.RawMessage `json:"config,omitempty"`
+	// Plugins are the IDs of installed plugins to enable.
+	Plugins []string `json:"plugins,omitempty"`
+	// MmctlCommands are run in local mode once everything else is set up.
+	// Arguments are separated by whitespace.
+	MmctlCommands []string `json:"mmctl_commands,omitempty"`
+}
+
+// setupProfileUser is a user account created by a setup profile.
+type setupProfileUser struct {
+	Username string `json:"username"`
+	// Email defaults to a simulator address that never bounces.
+	Email string `json:"email,omitempty"`
+	// Roles are system roles in addition to system_user.
+	Roles []string `json:"roles,omitempty"`
+}
+
+// setupProfileTeam is a team created by a setup profile.
+type setupProfileTeam struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name,omitempty"`
+	InviteOnly  bool   `json:"invite_only,omitempty"`
+	// Members are the usernames added to the team and all of its channels.
+	// All profile users are added when empty.
+	Members  []string              `json:"members,omitempty"`
+	Channels []setupProfileChannel `json:"channels,omitempty"`
+}
+
+// setupProfileChannel is a channel created by a setup profile.
+type setupProfileChannel struct {
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name,omitempty"`
+	Private     bool   `json:"private,omitempty"`
+}
+
+// defaultSetupProfile is applied to installations created without a setup
+// profile.
+var defaultSetupProfile = &setupProfile{
+	Name:        "default",
+	Description: "A regular user account",
+	Users:       []setupProfileUser{{Username: defaultUserUsername, Email: defaultUserEmail}},
+}
+
+// email returns the email address of a profile user.
+func (u *setupProfileUser) email() string {
+	if u.Email != "" {
+		return u.Email
+	}
+	return fmt.Sprintf("success+%s@simulator.amazonses.com", u.Username)
+}
+
+// IsValid checks that the setup profile can be applied.
+func (sp *setupProfile) IsValid() error {
+	if !catalogNameMatcher.MatchString(sp.Name) {
+		return errors.Errorf("setup profile name %q is invalid", sp.Name)
+	}
+
+	usernames := map[string]bool{defaultAdminUsername: true}
+	for _, user := range sp.Users {
+		if !model.IsValidUsername(user.Username) {
+			return errors.Errorf("setup profile %s: username %q is invalid", sp.Name, user.Username)
+		}
+		if usernames[user.Username] {
+			return errors.Errorf("setup profile %s: user %s is defined more than once", sp.Name, user.Username)
+		}
+		usernames[user.Username] = true
+		if user.Email != "" && !model.IsValidEmail(user.Email) {
+			return errors.Errorf("setup profile %s: email %q is invalid", sp.Name, user.Email)
+		}
+		for _, role := range user.Roles {
+			if !slices.Contains(validSetupProfileRoles, role) {
+				return errors.Errorf("setup profile %s: role %q is invalid, valid roles are %s", sp.Name, role, strings.Join(validSetupProfileRoles, ", "))
+			}
+		}
+	}
+
+	teams := map[string]bool{}
+	for _, team := range sp.Teams {
+		if !model.IsValidTeamName(team.Name) {
+			return errors.Errorf("setup profile %s: team name %q is invalid", sp.Name, team.Name)
+		}
+		if teams[team.Name] {
+			return errors.Errorf("setup profile %s: team %s is defined more than once", sp.Name, team.Name)
+		}
+		teams[team.Name] = true
+		for _, member := range team.Members {
+			if !usernames[member] {
+				return errors.Errorf("setup profile %s: team %s member %s is not a profile user", sp.Name, team.Name, member)
+			}
+		}
+		for _, channel := range team.Channels {
+			if !model.IsValidChannelIdentifier(channel.Name) {
+				return errors.Errorf("setup profile %s: channel name %q is invalid", sp.Name, channel.Name)
+			}
+		}
+	}
+
+	if len(sp.Config) > 0 {
+		var config model.Config
+		err := json.Unmarshal(sp.Config, &config)
+		if err != nil {
+			return errors.Wrapf(err, "setup profile %s: invalid config patch", sp.Name)
+		}
+	}
+
+	for _, command := range sp.MmctlCommands {
+		if len(strings.Fields(command)) == 0 {
+			return errors.Errorf("setup profile %s: mmctl commands must not be empty", sp.Name)
+		}
+	}
+
+	return nil
+}
+
+func parseSetupProfiles(raw string) ([]*setupProfile, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+
+	var profiles []*setupProfile
+	err := json.Unmarshal([]byte(raw), &profiles)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse setup profiles")
+	}
+
+	seen := map[string]bool{}
+	for _, profile := range profiles {
+		err = profile.IsValid()
+		if err != nil {
+			return nil, err
+		}
+		if seen[profile.Name] {
+			return nil, errors.Errorf("setup profile %s is defined more than once", profile.Name)
+		}
+		seen[profile.Name] = true
+	}
+
+	return profiles, nil
+}
+
+// getSetupProfiles returns the setup profiles configured by admins.
+func (c *configuration) getSetupProfiles() []*setupProfile {
+	profiles, err := parseSetupProfiles(c.SetupProfiles)
+	if err != nil {
+		return nil
+	}
+	return profiles
+}
+
+// getUserSetupProfiles returns the setup profiles saved by a user.
+func (p *Plugin) getUserSetupProfiles(userID string) ([]*setupProfile, error) {
+	data, appErr := p.API.KVGet(setupProfilesKeyPrefix + userID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get setup profiles")
+	}
+	if data == nil {
+		return nil, nil
+	}
+
+	var profiles []*setupProfile
+	err := json.Unmarshal(data, &profiles)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal setup profiles")
+	}
+
+	return profiles, nil
+}
+
+func (p *Plugin) storeUserSetupProfiles(userID string, profiles []*setupProfile) error {
+	data, err := json.Marshal(profiles)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal setup profiles")
+	}
+
+	appErr := p.API.KVSet(setupProfilesKeyPrefix+userID, data)
+	if appErr != nil {
+		return errors.Wrap(appErr, "failed to store setup profiles")
+	}
+
+	return nil
+}
+
+// getSetupProfile returns the setup profile with the given name available to
+// a user, or nil if there is none. Profiles configured by admins take
+// precedence over profiles saved by the user.
+func (p *Plugin) getSetupProfile(userID, name string) (*setupProfile, error) {
+	for _, profile := range p.getConfiguration().getSetupProfiles() {
+		if profile.Name == name {
+			return profile, nil
+		}
+	}
+
+	profiles, err := p.getUserSetupProfiles(userID)
+	if err != nil {
+		return nil, err
+	}
+	for _, profile := range profiles {
+		if profile.Name == name {
+			return profile, nil
+		}
+	}
+
+	return nil, nil
+}
+
+func (p *Plugin) runSetupProfileCommand(args []string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+	if len(args) == 0 {
+		return nil, true, errors.New("must provide a subcommand: list, show, save or delete")
+	}
+
+	switch args[0] {
+	case "list":
+		return p.runSetupProfileListCommand(extra)
+	case "show":
+		if len(args) < 2 {
+			return nil, true, errors.New("must provide a setup profile name")
+		}
+		profile, err := p.getSetupProfile(extra.UserId, args[1])
+		if err != nil {
+			return nil, false, err
+		}
+		if profile == nil {
+			return nil, true, errors.Errorf("no setup profile with the name %s found", args[1])
+		}
+		data, err := json.MarshalIndent(profile, "", "\t")
+		if err != nil {
+			return nil, false, errors.Wrap(err, "failed to marshal setup profile")
+		}
+		return getCommandResponse(model.CommandResponseTypeEphemeral, jsonCodeBlock(string(data)), extra), false, nil
+	case "save":
+		if len(args) < 3 {
+			return nil, true, errors.New("must provide a setup profile name and its JSON definition")
+		}
+		return p.runSetupProfileSaveCommand(args[1], strings.Join(args[2:], " "), extra)
+	case "delete":
+		if len(args) < 2 {
+			return nil, true, errors.New("must provide a setup profile name")
+		}
+		return p.runSetupProfileDeleteCommand(args[1], extra)
+	}
+
+	return nil, true, errors.Errorf("invalid subcommand %s, must be one of list, show, save or delete", args[0])
+}
+
+func (p *Plugin) runSetupProfileListCommand(extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+	userProfiles, err := p.getUserSetupProfiles(extra.UserId)
+	if err != nil {
+		return nil, false, err
+	}
+
+	resp := "| Name | Description | Owner |\n| -- | -- | -- |\n"
+	resp += fmt.Sprintf("| %s | %s | built-in, used when no profile is given |\n", defaultSetupProfile.Name, defaultSetupProfile.Description)
+	for _, profile := range p.getConfiguration().getSetupProfiles() {
+		resp += fmt.Sprintf("| %s | %s | admin |\n", profile.Name, profile.Description)
+	}
+	for _, profile := range userProfiles {
+		resp += fmt.Sprintf("| %s | %s | you |\n", profile.Name, profile.Description)
+	}
+
+	return getCommandResponse(model.CommandResponseTypeEphemeral, resp, extra), false, nil
+}
+
+func (p *Plugin) runSetupProfileSaveCommand(name, definition string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+	var profile setupProfile
+	err := json.Unmarshal([]byte(definition), &profile)
+	if err != nil {
+		return nil, true, errors.Wrap(err, "setup profile must be valid JSON")
+	}
+	profile.Name = name
+
+	err = profile.IsValid()
+	if err != nil {
+		return nil, true, err
+	}
+	if name == defaultSetupProfile.Name {
+		return nil, true, errors.Errorf("setup profile name %s is reserved", name)
+	}
+	for _, adminProfile := range p.getConfiguration().getSetupProfiles() {
+		if adminProfile.Name == name {
+			return nil, true, errors.Errorf("setup profile name %s is already used by a profile configured by admins", name)
+		}
+	}
+
+	profiles, err := p.getUserSetupProfiles(extra.UserId)
+	if err != nil {
+		return nil, false, err
+	}
+
+	replaced := false
+	for i, existing := range profiles {
+		if existing.Name == name {
+			profiles[i] = &profile
+			replaced = true
+			break
+		}
+	}
+	if !replaced {
+		if len(profiles) >= maxUserSetupProfiles {
+			return nil, true, errors.Errorf("you can't save more than %d setup profiles", maxUserSetupProfiles)
+		}
+		profiles = append(profiles, &profile)
+	}
+
+	err = p.storeUserSetupProfiles(extra.UserId, profiles)
+	if err != nil {
+		return nil, false, err
+	}
+
+	return getCommandResponse(model.CommandResponseTypeEphemeral, fmt.Sprintf("Setup profile %s saved. Use it with `/cloud create [name] --setup-profile %s`.", name, name), extra), false, nil
+}
+
+func (p *Plugin) runSetupProfileDeleteCommand(name string, extra *model.CommandArgs) (*model.CommandResponse, bool, error) {
+	profiles, err := p.getUserSetupProfiles(extra.UserId)
+	if err != nil {
+		return nil, false, err
+	}
+
+	for i, profile := range profiles {
+		if profile.Name == name {
+			err = p.storeUserSetupProfiles(extra.UserId, append(profiles[:i], profiles[i+1:]...))
+			if err != nil {
+				return nil, false, err
+			}
+			return getCommandResponse(model.CommandResponseTypeEphemeral, fmt.Sprintf("Setup profile %s deleted.", name), extra), false, nil
+		}
+	}
+
+	return nil, true, errors.Errorf("no setup profile with the name %s found", name)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testSetupProfile = `{
+	"description": "E2E test users",
+	"users": [{"username": "sysadmin", "roles": ["system_admin"]}, {"username": "user-1"}],
+	"teams": [{"name": "ad-1", "channels": [{"name": "e2e", "private": true}]}],
+	"config": {"ServiceSettings": {"EnableTesting": true}},
+	"plugins": ["com.mattermost.calls"],
+	"mmctl_commands": ["config set TeamSettings.MaxUsersPerTeam 1000"]
+}`
+
+func TestParseSetupProfiles(t *testing.T) {
+	profiles, err := parseSetupProfiles("")
+	require.NoError(t, err)
+	assert.Nil(t, profiles)
+
+	profiles, err = parseSetupProfiles(`[{"name": "qa-e2e", "users": [{"username": "qa", "roles": ["system_admin"]}], "teams": [{"name": "qa", "members": ["qa"]}]}]`)
+	require.NoError(t, err)
+	require.Len(t, profiles, 1)
+	assert.Equal(t, "success+qa@simulator.amazonses.com", profiles[0].Users[0].email())
+
+	for name, raw := range map[string]string{
+		"invalid json":      `{`,
+		"invalid name":      `[{"name": "qa e2e"}]`,
+		"duplicate profile": `[{"name": "qa"}, {"name": "qa"}]`,
+		"admin username":    `[{"name": "qa", "users": [{"username": "admin"}]}]`,
+		"invalid role":      `[{"name": "qa", "users": [{"username": "qa", "roles": ["root"]}]}]`,
+		"invalid email":     `[{"name": "qa", "users": [{"username": "qa", "email": "qa"}]}]`,
+		"invalid team":      `[{"name": "qa", "teams": [{"name": "Q"}]}]`,
+		"unknown member":    `[{"name": "qa", "teams": [{"name": "qa", "members": ["nobody"]}]}]`,
+		"invalid channel":   `[{"name": "qa", "teams": [{"name": "qa", "channels": [{"name": "no spaces"}]}]}]`,
+		"invalid config":    `[{"name": "qa", "config": {"ServiceSettings": {"EnableTesting": "yes"}}}]`,
+		"empty command":     `[{"name": "qa", "mmctl_commands": [" "]}]`,
+	} {
+		_, err = parseSetupProfiles(raw)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestSetupProfileCommand(t *testing.T) {
+	api := &plugintest.API{}
+	newMockedKVStore(api)
+	plugin := &Plugin{configuration: &configuration{SetupProfiles: `[{"name": "qa-e2e", "description": "Shared QA profile"}]`}}
+	plugin.SetAPI(api)
+	extra := &model.CommandArgs{UserId: "joramid"}
+
+	t.Run("save", func(t *testing.T) {
+		resp, isUserError, err := plugin.runSetupProfileCommand(append([]string{"save", "mine"}, strings.Fields(testSetupProfile)...), extra)
+		require.NoError(t, err)
+		assert.False(t, isUserError)
+		assert.Contains(t, resp.Text, "Setup profile mine saved.")
+
+		profile, err := plugin.getSetupProfile("joramid", "mine")
+		require.NoError(t, err)
+		require.NotNil(t, profile)
+		assert.Len(t, profile.Users, 2)
+
+		profile, err = plugin.getSetupProfile("gabeid", "mine")
+		require.NoError(t, err)
+		assert.Nil(t, profile, "user profiles are private")
+	})
+
+	t.Run("save invalid", func(t *testing.T) {
+		_, isUserError, err := plugin.runSetupProfileCommand([]string{"save", "mine", "{"}, extra)
+		require.Error(t, err)
+		assert.True(t, isUserError)
+
+		_, isUserError, err = plugin.runSetupProfileCommand([]string{"save", "qa-e2e", "{}"}, extra)
+		require.Error(t, err)
+		assert.True(t, isUserError)
+		assert.Contains(t, err.Error(), "already used by a profile configured by admins")
+
+		_, isUserError, err = plugin.runSetupProfileCommand([]string{"save", "default", "{}"}, extra)
+		require.Error(t, err)
+		assert.True(t, isUserError)
+	})
+
+	t.Run("list", func(t *testing.T) {
+		resp, _, err := plugin.runSetupProfileCommand([]string{"list"}, extra)
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, "| default |")
+		assert.Contains(t, resp.Text, "| qa-e2e | Shared QA profile | admin |")
+		assert.Contains(t, resp.Text, "| mine | E2E test users | you |")
+	})
+
+	t.Run("show", func(t *testing.T) {
+		resp, _, err := plugin.runSetupProfileCommand([]string{"show", "mine"}, extra)
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, `"username": "sysadmin"`)
+
+		_, isUserError, err := plugin.runSetupProfileCommand([]string{"show", "unknown"}, extra)
+		require.Error(t, err)
+		assert.True(t, isUserError)
+	})
+
+	t.Run("delete", func(t *testing.T) {
+		resp, _, err := plugin.runSetupProfileCommand([]string{"delete", "mine"}, extra)
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, "Setup profile mine deleted.")
+
+		_, isUserError, err := plugin.runSetupProfileCommand([]string{"delete", "mine"}, extra)
+		require.Error(t, err)
+		assert.True(t, isUserError)
+	})
+}
+
+// mockedMattermostServer records the Mattermost API requests made while
+// applying a setup profile.
+type mockedMattermostServer struct {
+	lock     sync.Mutex
+	requests []string
+	config   *model.Config
+	// failUsers are the usernames for which user creation fails.
+	failUsers map[string]bool
+	// version is reported in the X-Version-Id header.
+	version string
+	// unhealthy makes pings fail with the status of each service.
+	unhealthy bool
+}
+
+func newMockedMattermostServer(t *testing.T) (*mockedMattermostServer, *httptest.Server) {
+	mm := &mockedMattermostServer{config: &model.Config{}, failUsers: map[string]bool{}}
+	mm.config.SetDefaults()
+
+	return mm, httptest.NewServer(mm.handler(t))
+}
+
+// newMockedMattermostTLSServer starts a fake Mattermost server over HTTPS, which
+// is how installations are reached, and trusts it for the rest of the test.
+func newMockedMattermostTLSServer(t *testing.T) (*mockedMattermostServer, *httptest.Server) {
+	mm := &mockedMattermostServer{config: &model.Config{}, failUsers: map[string]bool{}}
+	mm.config.SetDefaults()
+	server := httptest.NewTLSServer(mm.handler(t))
+
+	defaultTransport := http.DefaultTransport
+	http.DefaultTransport = server.Client().Transport
+	t.Cleanup(func() {
+		http.DefaultTransport = defaultTransport
+		server.Close()
+	})
+
+	return mm, server
+}
+
+func (mm *mockedMattermostServer) handler(t *testing.T) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		mm.lock.Lock()
+		defer mm.lock.Unlock()
+		mm.requests = append(mm.requests, r.Method+" "+r.URL.Path)
+		if mm.version != "" {
+			w.Header().Set(model.HeaderVersionId, mm.version)
+		}
+
+		switch {
+		case r.URL.Path == "/api/v4/config" && r.Method == http.MethodGet:
+			json.NewEncoder(w).Encode(mm.config)
+		case r.URL.Path == "/api/v4/config" && r.Method == http.MethodPut:
+			require.NoError(t, json.NewDecoder(r.Body).Decode(mm.config))
+			json.NewEncoder(w).Encode(mm.config)
+		case r.URL.Path == "/api/v4/users":
+			var user model.User
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&user))
+			if mm.failUsers[user.Username] {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"id": "api.user.create_user.save.app_error", "message": "unable to save user", "status_code": 500}`))
+				return
+			}
+			user.Id = user.Username + "id"
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(&user)
+		case r.URL.Path == "/api/v4/teams":
+			var team model.Team
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&team))
+			team.Id = team.Name + "id"
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(&team)
+		case r.URL.Path == "/api/v4/channels":
+			var channel model.Channel
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&channel))
+			channel.Id = channel.Name + "id"
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(&channel)
+		case r.URL.Path == "/api/v4/system/ping" && mm.unhealthy:
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"status": "UNHEALTHY", "database_status": "UNHEALTHY", "filestore_status": "OK"}`))
+		case r.URL.Path == "/api/v4/system/ping":
+			w.Write([]byte(`{"status": "OK", "database_status": "OK", "filestore_status": "UNHEALTHY"}`))
+		case r.URL.Path == "/api/v4/users/login":
+			w.Write([]byte(`{"id": "adminid", "username": "admin"}`))
+		case r.URL.Path == "/api/v4/uploads":
+			var upload model.UploadSession
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&upload))
+			upload.Id = "uploadid"
+			w.WriteHeader(http.StatusCreated)
+			json.NewEncoder(w).Encode(&upload)
+		case strings.HasPrefix(r.URL.Path, "/api/v4/users/username/"):
+			username := strings.TrimPrefix(r.URL.Path, "/api/v4/users/username/")
+			json.NewEncoder(w).Encode(&model.User{Id: username + "id", Username: username})
+		case strings.HasSuffix(r.URL.Path, "/members"):
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{}`))
+		default:
+			w.Write([]byte(`{"status": "OK"}`))
+		}
+	}
+}
+
+func (mm *mockedMattermostServer) countRequests(request string) int {
+	mm.lock.Lock()
+	defer mm.lock.Unlock()
+
+	var count int
+	for _, r := range mm.requests {
+		if r == request {
+			count++
+		}
+	}
+	return count
+}
+
+func TestApplySetupProfile(t *testing.T) {
+	mm, server := newMockedMattermostServer(t)
+	defer server.Close()
+	client := model.NewAPIv4Client(server.URL)
+
+	mockedCloudClient := &MockClient{mockedCloudClusterInstallations: []*cloud.ClusterInstallation{{ID: "ciid"}}}
+	plugin := &Plugin{cloudClient: mockedCloudClient}
+	plugin.SetAPI(&plugintest.API{})
+
+	var profile setupProfile
+	require.NoError(t, json.Unmarshal([]byte(testSetupProfile), &profile))
+	profile.Name = "qa-e2e"
+	require.NoError(t, profile.IsValid())
+
+	install := &Installation{InstallationDTO: cloud.InstallationDTO{Installation: &cloud.Installation{ID: "someid"}}}
+	plugin.configuration = &configuration{GroupID: model.NewId()}
+
+	t.Run("config patch", func(t *testing.T) {
+		err := plugin.setupInstallationConfiguration(client, &profile)
+		require.NoError(t, err)
+		assert.True(t, *mm.config.ServiceSettings.EnableTesting)
+		assert.False(t, *mm.config.ServiceSettings.EnableDeveloper, "settings outside the patch are kept")
+	})
+
+	t.Run("users, teams, channels, plugins and commands", func(t *testing.T) {
+		progress := newSetupProgress()
+		err := plugin.createSetupProfileUsers(client, &profile, progress)
+		require.NoError(t, err)
+		require.Len(t, progress.Credentials, 2)
+		assert.Equal(t, "sysadmin", progress.Credentials[0].Username)
+		assert.Equal(t, "system_admin", progress.Credentials[0].Note)
+		assert.Equal(t, "Regular user", progress.Credentials[1].Note)
+
+		err = plugin.applySetupProfile(client, install, &profile, progress)
+		require.NoError(t, err)
+		assert.Equal(t, 1, progress.CommandsRun)
+
+		assert.Subset(t, mm.requests, []string{
+			"POST /api/v4/users",
+			"PUT /api/v4/users/sysadminid/roles",
+			"POST /api/v4/teams",
+			"POST /api/v4/teams/ad-1id/members",
+			"POST /api/v4/channels",
+			"POST /api/v4/channels/e2eid/members",
+			"POST /api/v4/plugins/com.mattermost.calls/enable",
+		})
+	})
+}
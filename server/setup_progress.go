@@ -0,0 +1,318 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// setupProgressKeyPrefix prefixes the KV keys tracking the setup of an
+	// installation until it completes.
+	setupProgressKeyPrefix = "setup_progress_"
+
+	actionSetupRetryPath = "/api/v1/actions/setup-retry"
+
+	// setupStopTimeout is how long stopping the plugin waits for resumed
+	// setups to notice they were interrupted.
+	setupStopTimeout = 10 * time.Second
+)
+
+// The steps of installation setup, in the order they are run.
+const (
+	setupStepDNSReady        = "dns-ready"
+	setupStepAdminCreated    = "admin-created"
+	setupStepConfigApplied   = "config-applied"
+	setupStepUsersCreated    = "users-created"
+	setupStepProfileApplied  = "profile-applied"
+	setupStepTestDataStarted = "test-data-started"
+)
+
+var setupSteps = []string{
+	setupStepDNSReady,
+	setupStepAdminCreated,
+	setupStepConfigApplied,
+	setupStepUsersCreated,
+	setupStepProfileApplied,
+	setupStepTestDataStarted,
+}
+
+// setupProgress tracks the setup of an installation so that a failed setup can
+// be resumed from the step that failed. The resources created within a step
+// are recorded as they are created so that a resumed step doesn't create them
+// twice. The passwords of the created accounts are only stored encrypted with
+// the credential vault key, and aren't stored at all without one, in which
+// case the admin password is reset when setup resumes.
+type setupProgress struct {
+	Completed            []string
+	AdminPassword        string             `json:"-"`
+	Credentials          []*setupCredential `json:"-"`
+	EncryptedCredentials []byte             `json:",omitempty"`
+	// LegacyAdminPassword and LegacyCredentials hold the passwords stored in
+	// plaintext by earlier versions, which are encrypted when the progress is
+	// next stored.
+	LegacyAdminPassword string             `json:"AdminPassword,omitempty"`
+	LegacyCredentials   []*setupCredential `json:"Credentials,omitempty"`
+	UserIDs             map[string]string
+	TeamIDs             map[string]string
+	ChannelIDs          map[string]string
+	CommandsRun         int
+	FailedStep          string
+	LastError           string
+	UpdateAt            int64
+}
+
+func newSetupProgress() *setupProgress {
+	return &setupProgress{
+		UserIDs:    map[string]string{},
+		TeamIDs:    map[string]string{},
+		ChannelIDs: map[string]string{},
+	}
+}
+
+func (sp *setupProgress) isCompleted(step string) bool {
+	for _, completed := range sp.Completed {
+		if completed == step {
+			return true
+		}
+	}
+	return false
+}
+
+// nextStep returns the first step which hasn't been completed.
+func (sp *setupProgress) nextStep() string {
+	for _, step := range setupSteps {
+		if !sp.isCompleted(step) {
+			return step
+		}
+	}
+	return ""
+}
+
+func (p *Plugin) getSetupProgress(installationID string) (*setupProgress, error) {
+	data, appErr := p.API.KVGet(setupProgressKeyPrefix + installationID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get setup progress")
+	}
+
+	progress := newSetupProgress()
+	if data == nil {
+		return progress, nil
+	}
+
+	err := json.Unmarshal(data, progress)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal setup progress")
+	}
+
+	progress.AdminPassword, progress.Credentials = progress.LegacyAdminPassword, progress.LegacyCredentials
+	if len(progress.EncryptedCredentials) > 0 {
+		key := p.getConfiguration().credentialKey()
+		if key == nil {
+			return nil, errCredentialVaultDisabled
+		}
+		credentials, err := decryptCredentials(key, installationID, progress.EncryptedCredentials)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to decrypt the passwords of the setup progress")
+		}
+		progress.setCredentials(credentials)
+	}
+
+	return progress, nil
+}
+
+// allCredentials returns the credentials of the admin and of the other
+// accounts created during setup.
+func (sp *setupProgress) allCredentials() []*setupCredential {
+	var credentials []*setupCredential
+	if sp.AdminPassword != "" {
+		credentials = append(credentials, &setupCredential{Username: defaultAdminUsername, Password: sp.AdminPassword, Note: "Admin user"})
+	}
+	return append(credentials, sp.Credentials...)
+}
+
+func (sp *setupProgress) setCredentials(credentials []*setupCredential) {
+	sp.AdminPassword, sp.Credentials = "", nil
+	for _, credential := range credentials {
+		if credential.Username == defaultAdminUsername {
+			sp.AdminPassword = credential.Password
+			continue
+		}
+		sp.Credentials = append(sp.Credentials, credential)
+	}
+}
+
+// storeSetupProgress stores the setup progress of an installation. Only the
+// holder of the setup lock writes the progress, so no compare and set is
+// needed.
+func (p *Plugin) storeSetupProgress(installationID string, progress *setupProgress) error {
+	progress.UpdateAt = model.GetMillis()
+	progress.LegacyAdminPassword, progress.LegacyCredentials = "", nil
+	progress.EncryptedCredentials = nil
+	if key := p.getConfiguration().credentialKey(); key != nil {
+		encrypted, err := encryptCredentials(key, installationID, progress.allCredentials())
+		if err != nil {
+			return errors.Wrap(err, "failed to encrypt the passwords of the setup progress")
+		}
+		progress.EncryptedCredentials = encrypted
+	}
+
+	data, err := json.Marshal(progress)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal setup progress")
+	}
+
+	appErr := p.API.KVSet(setupProgressKeyPrefix+installationID, data)
+	if appErr != nil {
+		return errors.Wrap(appErr, "failed to store setup progress")
+	}
+
+	return nil
+}
+
+// deleteSetupProgress removes the setup progress of an installation, which
+// includes the passwords of the created accounts, once setup has completed.
+func (p *Plugin) deleteSetupProgress(installationID string) {
+	appErr := p.API.KVDelete(setupProgressKeyPrefix + installationID)
+	if appErr != nil {
+		p.API.LogWarn("Failed to delete setup progress", "installation", installationID, "error", appErr.Error())
+	}
+}
+
+// runInstallationSetup sets up an installation and notifies its owner of the
+// result. The caller must hold the setup lock, which is refreshed while setup
+// runs and released afterwards. If setup is interrupted by closing stop,
+// errSetupInterrupted is returned without notifying the owner, so that setup
+// can run again.
+func (p *Plugin) runInstallationSetup(install *Installation, actorID string, stop <-chan struct{}) error {
+	p.recordPluginEvent(install.ID, actorID, "setup-started", install.SetupProfile)
+	start := time.Now()
+	refreshDone := make(chan struct{})
+	refreshStopped := make(chan struct{})
+	go func() {
+		defer close(refreshStopped)
+		p.refreshInstallationSetupLock(install.ID, refreshDone)
+	}()
+	credentials, err := p.setupInstallation(install, stop)
+	close(refreshDone)
+	<-refreshStopped
+	if errors.Cause(err) == errSetupInterrupted {
+		p.unlockInstallationSetup(install.ID, false)
+		p.recordPluginEvent(install.ID, actorID, "setup-interrupted", "")
+		return err
+	}
+	p.metrics.observeSetup(time.Since(start), err)
+	p.unlockInstallationSetup(install.ID, err == nil)
+	if err != nil {
+		p.recordPluginEvent(install.ID, actorID, "setup-failed", err.Error())
+		if notifyErr := p.notifySetupFailure(install, err); notifyErr != nil {
+			p.API.LogError(errors.Wrap(notifyErr, "failed to notify owner of setup failure").Error(), "installation", install.ID)
+		}
+		return errors.Wrapf(err, "failed to set up installation %s", install.Name)
+	}
+	p.recordPluginEvent(install.ID, actorID, "setup-completed", "")
+
+	err = p.storeInstallationCredentials(install.ID, credentials)
+	if err != nil {
+		p.API.LogWarn("Failed to store installation credentials", "installation", install.ID, "error", err.Error())
+	}
+
+	err = p.postInstallationReady(install, credentials, err == nil)
+	if err != nil {
+		return err
+	}
+	p.deleteSetupProgress(install.ID)
+
+	return nil
+}
+
+// notifySetupFailure sends the owner of an installation a DM with the setup
+// step that failed and a button to resume setup from it.
+func (p *Plugin) notifySetupFailure(install *Installation, setupErr error) error {
+	progress, err := p.getSetupProgress(install.ID)
+	if err != nil {
+		return err
+	}
+
+	failedStep := progress.FailedStep
+	if failedStep == "" {
+		failedStep = progress.nextStep()
+	}
+	completed := "none"
+	if len(progress.Completed) > 0 {
+		completed = strings.Join(progress.Completed, ", ")
+	}
+
+	message := fmt.Sprintf(`
+The setup of installation %s failed at step %s.
+
+Error: %s
+
+Completed steps: %s
+
+Setup can be resumed from the failed step with the button below or with %s.
+`, install.Name, inlineCode(failedStep), inlineCode(setupErr.Error()), completed, inlineCode("/cloud setup-retry "+install.Name))
+
+	attachment := &model.SlackAttachment{
+		Actions: []*model.PostAction{
+			newInstallationAction("setupretry", "Retry setup", actionSetupRetryPath, install.ID),
+		},
+	}
+
+	return p.PostBotDMWithAttachments(install.OwnerID, message, []*model.SlackAttachment{attachment})
+}
+
+// resumeInstallationSetup resumes the setup of an installation in the
+// background, until the plugin stops. The name of the step setup resumes from
+// is returned.
+func (p *Plugin) resumeInstallationSetup(install *Installation, userID string) (string, bool, error) {
+	installation, err := p.cloudClient.GetInstallation(install.ID, &cloud.GetInstallationRequest{})
+	if err != nil {
+		return "", false, errors.Wrapf(err, "failed to get installation %s from the provisioner", install.Name)
+	}
+	if installation == nil {
+		return "", true, errors.Errorf("installation %s no longer exists", install.Name)
+	}
+	if installation.State != cloud.InstallationStateStable {
+		return "", true, errors.Errorf("installation state is currently %s and must be %s to retry setup", installation.State, cloud.InstallationStateStable)
+	}
+	install.InstallationDTO = *installation
+
+	progress, err := p.getSetupProgress(install.ID)
+	if err != nil {
+		return "", false, err
+	}
+
+	locked, err := p.tryLockInstallationSetup(install.ID)
+	if err != nil {
+		return "", false, err
+	}
+	if !locked {
+		value, appErr := p.API.KVGet(setupLockKeyPrefix + install.ID)
+		if appErr != nil {
+			return "", false, errors.Wrap(appErr, "failed to get setup lock")
+		}
+		if string(value) == setupCompleteValue {
+			return "", true, errors.Errorf("installation %s has already been set up", install.Name)
+		}
+		return "", true, errors.Errorf("installation %s is already being set up", install.Name)
+	}
+
+	p.setupJobs.start(func(stop <-chan struct{}) {
+		err := p.runInstallationSetup(install, userID, stop)
+		if errors.Cause(err) == errSetupInterrupted {
+			p.PostBotDM(install.OwnerID, fmt.Sprintf("The setup of installation %s was interrupted because the plugin stopped. Resume it with %s.", install.Name, inlineCode("/cloud setup-retry "+install.Name)))
+			return
+		}
+		if err != nil {
+			p.API.LogError(err.Error(), "installation", install.ID)
+		}
+	})
+
+	return progress.nextStep(), false, nil
+}
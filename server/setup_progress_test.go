@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSetupInstallationResume(t *testing.T) {
+	mm, server := newMockedMattermostTLSServer(t)
+	mm.failUsers["user-1"] = true
+
+	api := &plugintest.API{}
+	store := newMockedKVStore(api)
+	api.On("LogWarn", mock.AnythingOfType("string"), mock.Anything, mock.Anything).Return()
+
+	profiles := fmt.Sprintf(`[%s]`, strings.Replace(testSetupProfile, "{", `{"name": "qa-e2e",`, 1))
+	plugin := &Plugin{
+		cloudClient:   &MockClient{mockedCloudClusterInstallations: []*cloud.ClusterInstallation{{ID: "ciid"}}},
+		configuration: &configuration{GroupID: model.NewId(), SetupProfiles: profiles, CredentialEncryptionKey: "somekey"},
+	}
+	plugin.SetAPI(api)
+
+	install := &Installation{
+		SetupProfile: "qa-e2e",
+		InstallationDTO: cloud.InstallationDTO{
+			Installation: &cloud.Installation{ID: "someid", OwnerID: "joramid"},
+			DNSRecords:   []*cloud.InstallationDNS{{DomainName: strings.TrimPrefix(server.URL, "https://")}},
+		},
+	}
+
+	_, err := plugin.setupInstallation(install, nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "failed to create user user-1")
+
+	progress, err := plugin.getSetupProgress("someid")
+	require.NoError(t, err)
+	assert.Equal(t, []string{setupStepDNSReady, setupStepAdminCreated, setupStepConfigApplied}, progress.Completed)
+	assert.Equal(t, setupStepUsersCreated, progress.FailedStep)
+	assert.Equal(t, "sysadminid", progress.UserIDs["sysadmin"])
+	adminPassword := progress.AdminPassword
+	require.NotEmpty(t, adminPassword)
+	assert.NotContains(t, string(store.values[setupProgressKeyPrefix+"someid"]), adminPassword, "passwords are only stored encrypted")
+
+	mm.failUsers = map[string]bool{}
+	credentials, err := plugin.setupInstallation(install, nil)
+	require.NoError(t, err)
+	require.Len(t, credentials, 3)
+	assert.Equal(t, adminPassword, credentials[0].Password, "the admin password is kept across attempts")
+	assert.Equal(t, "sysadmin", credentials[1].Username)
+	assert.Equal(t, "user-1", credentials[2].Username)
+
+	assert.Equal(t, 1, mm.countRequests("GET /api/v4/config"), "completed steps are skipped")
+	assert.Equal(t, 4, mm.countRequests("POST /api/v4/users"), "created users are not created again")
+	assert.Equal(t, 2, mm.countRequests("POST /api/v4/users/login"))
+
+	progress, err = plugin.getSetupProgress("someid")
+	require.NoError(t, err)
+	assert.Len(t, progress.Completed, len(setupSteps))
+	assert.Empty(t, progress.FailedStep)
+	assert.Empty(t, progress.nextStep())
+
+	plugin.deleteSetupProgress("someid")
+	assert.NotContains(t, store.values, setupProgressKeyPrefix+"someid")
+}
+
+func TestSetupInstallationInterrupted(t *testing.T) {
+	api := &plugintest.API{}
+	store := newMockedKVStore(api)
+	api.On("LogDebug", mock.AnythingOfType("string")).Return()
+
+	plugin := &Plugin{configuration: &configuration{}}
+	plugin.SetAPI(api)
+
+	install := &Installation{
+		InstallationDTO: cloud.InstallationDTO{
+			Installation: &cloud.Installation{ID: "someid", OwnerID: "joramid"},
+			DNSRecords:   []*cloud.InstallationDNS{{DomainName: "127.0.0.1:1"}},
+		},
+	}
+	locked, err := plugin.tryLockInstallationSetup("someid")
+	require.NoError(t, err)
+	require.True(t, locked)
+
+	stop := make(chan struct{})
+	close(stop)
+	err = plugin.runInstallationSetup(install, "", stop)
+	assert.Equal(t, errSetupInterrupted, errors.Cause(err))
+
+	assert.NotContains(t, store.values, setupLockKeyPrefix+"someid", "the setup lock is released so setup runs again")
+	progress, err := plugin.getSetupProgress("someid")
+	require.NoError(t, err)
+	assert.Empty(t, progress.FailedStep, "interruptions aren't setup failures")
+}
+
+func TestNotifySetupFailure(t *testing.T) {
+	api := &plugintest.API{}
+	store := newMockedKVStore(api)
+	store.values[setupProgressKeyPrefix+"someid"] = []byte(`{"Completed": ["dns-ready"], "FailedStep": "admin-created"}`)
+	api.On("GetDirectChannel", "joramid", "botid").Return(&model.Channel{Id: "dmid"}, nil)
+
+	var post *model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		post = args.Get(0).(*model.Post)
+	}).Return(&model.Post{}, nil)
+
+	plugin := &Plugin{BotUserID: "botid"}
+	plugin.SetAPI(api)
+
+	install := &Installation{Name: "joramsinstall", InstallationDTO: cloud.InstallationDTO{Installation: &cloud.Installation{ID: "someid", OwnerID: "joramid"}}}
+	err := plugin.notifySetupFailure(install, fmt.Errorf("unable to create admin"))
+	require.NoError(t, err)
+	require.NotNil(t, post)
+	assert.Contains(t, post.Message, "The setup of installation joramsinstall failed at step `admin-created`.")
+	assert.Contains(t, post.Message, "Completed steps: dns-ready")
+	assert.Contains(t, post.Message, "`/cloud setup-retry joramsinstall`")
+
+	attachments := post.Attachments()
+	require.Len(t, attachments, 1)
+	require.Len(t, attachments[0].Actions, 1)
+	assert.Equal(t, "/plugins/"+manifest.ID+actionSetupRetryPath, attachments[0].Actions[0].Integration.URL)
+}
+
+func TestSetupRetryCommand(t *testing.T) {
+	api := &plugintest.API{}
+	store := newMockedKVStore(api)
+	store.values[StoreInstallsKey] = []byte(`[{"ID": "someid", "OwnerID": "joramid", "Name": "joramsinstall"}]`)
+
+	mockedCloudClient := &MockClient{}
+	plugin := &Plugin{cloudClient: mockedCloudClient}
+	plugin.SetAPI(api)
+	extra := &model.CommandArgs{UserId: "joramid"}
+
+	t.Run("no name", func(t *testing.T) {
+		_, isUserError, err := plugin.runSetupRetryCommand([]string{}, extra)
+		require.Error(t, err)
+		assert.True(t, isUserError)
+	})
+
+	t.Run("not the owner", func(t *testing.T) {
+		_, isUserError, err := plugin.runSetupRetryCommand([]string{"joramsinstall"}, &model.CommandArgs{UserId: "gabeid"})
+		require.EqualError(t, err, "no installation with the name joramsinstall found")
+		assert.True(t, isUserError)
+	})
+
+	t.Run("not stable", func(t *testing.T) {
+		mockedCloudClient.overrideGetInstallationDTO = &cloud.InstallationDTO{Installation: &cloud.Installation{ID: "someid", State: cloud.InstallationStateCreationInProgress}}
+		_, isUserError, err := plugin.runSetupRetryCommand([]string{"joramsinstall"}, extra)
+		require.EqualError(t, err, "installation state is currently creation-in-progress and must be stable to retry setup")
+		assert.True(t, isUserError)
+	})
+
+	mockedCloudClient.overrideGetInstallationDTO = &cloud.InstallationDTO{Installation: &cloud.Installation{ID: "someid", State: cloud.InstallationStateStable}}
+
+	t.Run("already being set up", func(t *testing.T) {
+		store.values[setupLockKeyPrefix+"someid"] = []byte(model.NewId())
+		_, isUserError, err := plugin.runSetupRetryCommand([]string{"joramsinstall"}, extra)
+		require.EqualError(t, err, "installation joramsinstall is already being set up")
+		assert.True(t, isUserError)
+	})
+
+	t.Run("already set up", func(t *testing.T) {
+		store.values[setupLockKeyPrefix+"someid"] = []byte(setupCompleteValue)
+		_, isUserError, err := plugin.runSetupRetryCommand([]string{"joramsinstall"}, extra)
+		require.EqualError(t, err, "installation joramsinstall has already been set up")
+		assert.True(t, isUserError)
+	})
+
+	t.Run("interrupted when the plugin stops", func(t *testing.T) {
+		defer func(interval time.Duration) { waitForDNSInterval = interval }(waitForDNSInterval)
+		waitForDNSInterval = time.Hour
+
+		api.On("LogDebug", mock.AnythingOfType("string")).Return()
+		api.On("GetDirectChannel", "joramid", "botid").Return(&model.Channel{Id: "dmid"}, nil)
+		var post *model.Post
+		api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+			post = args.Get(0).(*model.Post)
+		}).Return(&model.Post{}, nil)
+		plugin.BotUserID = "botid"
+		plugin.configuration = &configuration{}
+
+		delete(store.values, setupLockKeyPrefix+"someid")
+		mockedCloudClient.overrideGetInstallationDTO = &cloud.InstallationDTO{
+			Installation: &cloud.Installation{ID: "someid", OwnerID: "joramid", State: cloud.InstallationStateStable},
+			DNSRecords:   []*cloud.InstallationDNS{{DomainName: "127.0.0.1:1"}},
+		}
+		resp, _, err := plugin.runSetupRetryCommand([]string{"joramsinstall"}, extra)
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, "dns-ready")
+
+		require.True(t, plugin.setupJobs.stopAndWait(10*time.Second), "the resumed setup is waited for")
+		assert.NotContains(t, store.values, setupLockKeyPrefix+"someid", "the setup lock is released so setup can be resumed again")
+		require.NotNil(t, post)
+		assert.Contains(t, post.Message, "The setup of installation joramsinstall was interrupted because the plugin stopped.")
+	})
+}
+
+func TestSetupProgressPasswords(t *testing.T) {
+	api := &plugintest.API{}
+	store := newMockedKVStore(api)
+	plugin := &Plugin{configuration: &configuration{}}
+	plugin.SetAPI(api)
+
+	progress := newSetupProgress()
+	progress.Completed = []string{setupStepDNSReady, setupStepAdminCreated}
+	progress.AdminPassword = "adminpassword"
+	progress.Credentials = []*setupCredential{{Username: "user-1", Password: "userpassword"}}
+
+	t.Run("not stored without a credential encryption key", func(t *testing.T) {
+		require.NoError(t, plugin.storeSetupProgress("someid", progress))
+		assert.NotContains(t, string(store.values[setupProgressKeyPrefix+"someid"]), "password")
+
+		stored, err := plugin.getSetupProgress("someid")
+		require.NoError(t, err)
+		assert.Empty(t, stored.AdminPassword)
+		assert.Empty(t, stored.Credentials)
+
+	})
+
+	t.Run("admin password reset on resume without a credential encryption key", func(t *testing.T) {
+		mm, server := newMockedMattermostTLSServer(t)
+		api.On("LogWarn", mock.AnythingOfType("string")).Return()
+		api.On("LogWarn", mock.AnythingOfType("string"), mock.Anything, mock.Anything).Return()
+		mockedCloudClient := &MockClient{mockedCloudClusterInstallations: []*cloud.ClusterInstallation{{ID: "ciid"}}}
+		plugin.cloudClient = mockedCloudClient
+		defer func() { plugin.cloudClient = nil }()
+
+		credentials, err := plugin.setupInstallation(&Installation{InstallationDTO: cloud.InstallationDTO{
+			Installation: &cloud.Installation{ID: "someid"},
+			DNSRecords:   []*cloud.InstallationDNS{{DomainName: strings.TrimPrefix(server.URL, "https://")}},
+		}}, nil)
+		require.NoError(t, err)
+		require.NotEmpty(t, credentials)
+		assert.Equal(t, defaultAdminUsername, credentials[0].Username)
+
+		require.Len(t, mockedCloudClient.execSubcommands, 1)
+		reset := mockedCloudClient.execSubcommands[0]
+		require.Equal(t, []string{"user", "change-password", defaultAdminUsername, "--password"}, reset[:4])
+		assert.NotEqual(t, reset[4], credentials[0].Password, "the password in the exec logs is replaced")
+		assert.Equal(t, 1, mm.countRequests("PUT /api/v4/users/adminid/password"))
+		assert.Equal(t, len(credentials)-1, mm.countRequests("POST /api/v4/users"), "only the profile users are created, not the admin account")
+	})
+
+	t.Run("legacy plaintext passwords are encrypted", func(t *testing.T) {
+		plugin.configuration.CredentialEncryptionKey = "somekey"
+		store.values[setupProgressKeyPrefix+"someid"] = []byte(`{"Completed": ["dns-ready"], "AdminPassword": "adminpassword", "Credentials": [{"Username": "user-1", "Password": "userpassword"}]}`)
+
+		stored, err := plugin.getSetupProgress("someid")
+		require.NoError(t, err)
+		assert.Equal(t, "adminpassword", stored.AdminPassword)
+		require.NoError(t, plugin.storeSetupProgress("someid", stored))
+		assert.NotContains(t, string(store.values[setupProgressKeyPrefix+"someid"]), "password")
+
+		stored, err = plugin.getSetupProgress("someid")
+		require.NoError(t, err)
+		assert.Equal(t, "adminpassword", stored.AdminPassword)
+		require.Len(t, stored.Credentials, 1)
+		assert.Equal(t, "userpassword", stored.Credentials[0].Password)
+	})
+}
+
+func TestPostInstallationReady(t *testing.T) {
+	api := &plugintest.API{}
+	api.On("GetDirectChannel", "joramid", "botid").Return(&model.Channel{Id: "dmid"}, nil)
+
+	var post *model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		post = args.Get(0).(*model.Post)
+	}).Return(&model.Post{}, nil)
+
+	plugin := &Plugin{BotUserID: "botid"}
+	plugin.SetAPI(api)
+
+	install := &Installation{Name: "joramsinstall", InstallationDTO: cloud.InstallationDTO{Installation: &cloud.Installation{ID: "someid", OwnerID: "joramid"}}}
+	credentials := []*setupCredential{{Username: defaultAdminUsername, Password: "adminpassword", Note: "Admin user"}}
+
+	require.NoError(t, plugin.postInstallationReady(install, credentials, true))
+	require.NotNil(t, post)
+	assert.Contains(t, post.Message, "`/cloud credentials joramsinstall`")
+
+	require.NoError(t, plugin.postInstallationReady(install, credentials, false))
+	assert.NotContains(t, post.Message, "/cloud credentials")
+	assert.Contains(t, post.Message, "The logins aren't stored by the plugin")
+}
@@ -0,0 +1,696 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// StoreUsageArchiveKey is the key used to store the usage records of
+	// installations which are no longer tracked by the plugin.
+	StoreUsageArchiveKey = "usage_archive"
+	// stateHistoryKeyPrefix prefixes the keys storing the state transitions
+	// of each installation. Unlike the event timeline, the history isn't
+	// capped, only transitions older than usageArchiveRetention are dropped.
+	stateHistoryKeyPrefix = "statehistory_"
+
+	// usageArchiveRetention is how long the usage records of deleted
+	// installations are kept.
+	usageArchiveRetention = 400 * 24 * time.Hour
+
+	// usageRateHibernating is the rate key applied to hibernated hours.
+	usageRateHibernating = "hibernating"
+	// usageRateDefault is the rate key applied to running hours when no rate
+	// is set for the size of the installation.
+	usageRateDefault = "default"
+)
+
+// usageRecord describes an installation for usage reporting. Records of
+// installations which are no longer tracked are archived with their deletion
+// time.
+type usageRecord struct {
+	ID       string
+	Name     string
+	OwnerID  string
+	TeamID   string `json:",omitempty"`
+	Size     string
+	Affinity string
+	State    string
+	CreateAt int64
+	DeleteAt int64 `json:",omitempty"`
+}
+
+func newUsageRecord(install *Installation) *usageRecord {
+	return &usageRecord{
+		ID:       install.ID,
+		Name:     install.Name,
+		OwnerID:  install.OwnerID,
+		TeamID:   install.TeamID,
+		Size:     install.Size,
+		Affinity: install.Affinity,
+		State:    install.State,
+		CreateAt: install.CreateAt,
+	}
+}
+
+// parseUsageHourlyRates parses comma-separated key=rate pairs. Keys are either
+// an installation size, a size and affinity such as miniHA:isolated, or one of
+// hibernating and default.
+func parseUsageHourlyRates(value string) (map[string]float64, error) {
+	rates := make(map[string]float64)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, errors.Errorf("invalid hourly rate %q, expected size=rate", pair)
+		}
+		rate, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		if err != nil || rate < 0 {
+			return nil, errors.Errorf("invalid hourly rate %q, the rate must be a number of zero or more", pair)
+		}
+
+		rates[strings.TrimSpace(parts[0])] = rate
+	}
+
+	return rates, nil
+}
+
+// usageHourlyRates returns the configured hourly rates.
+func (c *configuration) usageHourlyRates() map[string]float64 {
+	rates, err := parseUsageHourlyRates(c.UsageHourlyRates)
+	if err != nil {
+		return map[string]float64{}
+	}
+	return rates
+}
+
+// isHibernatedState returns if an installation in the state doesn't run any
+// servers.
+func isHibernatedState(state string) bool {
+	return state == cloud.InstallationStateHibernating || strings.HasPrefix(state, cloud.InstallationStateDeletionPending)
+}
+
+// stateHistory holds the state transitions and size changes of an
+// installation used to compute its usage.
+type stateHistory struct {
+	// CompleteSince is when the transitions start being complete, zero if
+	// every transition since the creation of the installation is known.
+	CompleteSince int64
+	Transitions   []*installationEvent
+	// SizeChanges are the size updates requested through the plugin. The
+	// installation is assumed to have had the old size of the oldest change
+	// until then, or its current size if it was never resized.
+	SizeChanges []*sizeChange `json:",omitempty"`
+}
+
+// sizeChange is an update of the size of an installation.
+type sizeChange struct {
+	Timestamp int64
+	OldSize   string
+	NewSize   string
+}
+
+// recordStateTransition adds a webhook transition to the state history of the
+// installation.
+func (p *Plugin) recordStateTransition(installationID string, transition *installationEvent) {
+	p.updateStateHistory(installationID, func(history *stateHistory) {
+		history.Transitions = append(history.Transitions, transition)
+	})
+}
+
+// recordSizeChange adds a size update to the state history of the
+// installation.
+func (p *Plugin) recordSizeChange(installationID, oldSize, newSize string) {
+	p.updateStateHistory(installationID, func(history *stateHistory) {
+		history.SizeChanges = append(history.SizeChanges, &sizeChange{
+			Timestamp: model.GetMillis(),
+			OldSize:   oldSize,
+			NewSize:   newSize,
+		})
+	})
+}
+
+// updateStateHistory applies an update to the state history of the
+// installation and drops the entries older than usageArchiveRetention. The
+// history of installations which predate it is seeded from their event
+// timeline. Failures are logged, like those of the timeline.
+func (p *Plugin) updateStateHistory(installationID string, update func(history *stateHistory)) {
+	key := stateHistoryKeyPrefix + installationID
+	retainAfter := model.GetMillisForTime(time.Now().Add(-usageArchiveRetention))
+	for i := 0; i < StoreInstallRetries; i++ {
+		originalJSON, appErr := p.API.KVGet(key)
+		if appErr != nil {
+			p.API.LogWarn(errors.Wrap(appErr, "failed to get state history").Error(), "installation", installationID)
+			return
+		}
+
+		var history *stateHistory
+		var err error
+		if originalJSON == nil {
+			history, err = p.getStateHistoryFromEvents(installationID)
+		} else {
+			history = &stateHistory{}
+			err = json.Unmarshal(originalJSON, history)
+		}
+		if err != nil {
+			p.API.LogWarn(errors.Wrap(err, "failed to get state history").Error(), "installation", installationID)
+			return
+		}
+
+		update(history)
+		for len(history.Transitions) > 1 && history.Transitions[0].Timestamp < retainAfter {
+			history.CompleteSince = history.Transitions[0].Timestamp
+			history.Transitions = history.Transitions[1:]
+		}
+		for len(history.SizeChanges) > 1 && history.SizeChanges[0].Timestamp < retainAfter {
+			history.SizeChanges = history.SizeChanges[1:]
+		}
+
+		newJSON, err := json.Marshal(history)
+		if err != nil {
+			p.API.LogWarn(errors.Wrap(err, "failed to marshal state history").Error(), "installation", installationID)
+			return
+		}
+
+		ok, appErr := p.API.KVCompareAndSet(key, originalJSON, newJSON)
+		if appErr != nil {
+			p.API.LogWarn(errors.Wrap(appErr, "failed to store state history").Error(), "installation", installationID)
+			return
+		}
+		if ok {
+			return
+		}
+	}
+
+	p.API.LogWarn(fmt.Sprintf("failed %d times to store state history", StoreInstallRetries), "installation", installationID)
+}
+
+// getStateHistory returns the state history of an installation. Installations
+// without a history fall back to their event timeline.
+func (p *Plugin) getStateHistory(installationID string) (*stateHistory, error) {
+	data, appErr := p.API.KVGet(stateHistoryKeyPrefix + installationID)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get state history")
+	}
+	if data == nil {
+		return p.getStateHistoryFromEvents(installationID)
+	}
+
+	history := &stateHistory{}
+	err := json.Unmarshal(data, history)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal state history")
+	}
+
+	return history, nil
+}
+
+// getStateHistoryFromEvents returns the webhook transitions of the event
+// timeline of an installation. The timeline is capped at
+// maxInstallationEvents, so once full, the history is only complete since its
+// oldest event.
+func (p *Plugin) getStateHistoryFromEvents(installationID string) (*stateHistory, error) {
+	events, err := p.getInstallationEvents(installationID)
+	if err != nil {
+		return nil, err
+	}
+
+	history := &stateHistory{}
+	if len(events) >= maxInstallationEvents {
+		history.CompleteSince = events[0].Timestamp
+	}
+	for _, event := range events {
+		if event.Source == eventSourceWebhook && event.NewState != "" {
+			history.Transitions = append(history.Transitions, event)
+		}
+	}
+
+	return history, nil
+}
+
+// installationUsage is the usage of an installation during a period.
+// Approximate usages were computed from an incomplete state history, which
+// assumes the installation was in the state preceding the oldest known
+// transition until then.
+type installationUsage struct {
+	Record          *usageRecord
+	Approximate     bool
+	StateHours      map[string]float64
+	Rows            []*usageRow
+	RunningHours    float64
+	HibernatedHours float64
+	Cost            float64
+}
+
+// usageRow is the time an installation spent in a state with a given size,
+// and the hourly rate applied to it.
+type usageRow struct {
+	Size  string
+	State string
+	Hours float64
+	Rate  float64
+}
+
+// computeInstallationUsage computes the hours an installation spent in each
+// state between start and end from its state history, and weights them with
+// the hourly rate of the size the installation had at the time.
+func computeInstallationUsage(record *usageRecord, history *stateHistory, start, end time.Time, rates map[string]float64) *installationUsage {
+	usage := &installationUsage{
+		Record:      record,
+		StateHours:  make(map[string]float64),
+		Approximate: history.CompleteSince > max(record.CreateAt, model.GetMillisForTime(start)),
+	}
+
+	transitions := append([]*installationEvent{}, history.Transitions...)
+	sort.SliceStable(transitions, func(i, j int) bool {
+		return transitions[i].Timestamp < transitions[j].Timestamp
+	})
+	sizeChanges := append([]*sizeChange{}, history.SizeChanges...)
+	sort.SliceStable(sizeChanges, func(i, j int) bool {
+		return sizeChanges[i].Timestamp < sizeChanges[j].Timestamp
+	})
+
+	state := record.State
+	if len(transitions) > 0 {
+		state = transitions[0].OldState
+	}
+	if state == "" {
+		state = cloud.InstallationStateCreationRequested
+	}
+
+	stop := model.GetMillisForTime(end)
+	if record.DeleteAt != 0 && record.DeleteAt < stop {
+		stop = record.DeleteAt
+	}
+
+	rows := make(map[string]*usageRow)
+	addHours := func(state, size string, from, to int64) {
+		hours := float64(to-from) / float64(time.Hour/time.Millisecond)
+		rate := rates[usageRateHibernating]
+		if !isHibernatedState(state) {
+			rate = runningRate(size, record.Affinity, rates)
+		}
+
+		row := rows[size+"|"+state]
+		if row == nil {
+			row = &usageRow{Size: size, State: state, Rate: rate}
+			rows[size+"|"+state] = row
+			usage.Rows = append(usage.Rows, row)
+		}
+		row.Hours += hours
+		usage.StateHours[state] += hours
+		if isHibernatedState(state) {
+			usage.HibernatedHours += hours
+		} else {
+			usage.RunningHours += hours
+		}
+		usage.Cost += hours * rate
+	}
+
+	// sizeAt returns the size of the installation at the given time.
+	sizeAt := func(timestamp int64) string {
+		size := record.Size
+		if len(sizeChanges) > 0 && sizeChanges[0].OldSize != "" {
+			size = sizeChanges[0].OldSize
+		}
+		for _, change := range sizeChanges {
+			if change.Timestamp > timestamp {
+				break
+			}
+			size = change.NewSize
+		}
+		return size
+	}
+
+	addInterval := func(state string, from, to int64) {
+		from = max(from, model.GetMillisForTime(start))
+		to = min(to, stop)
+		if to <= from || state == cloud.InstallationStateDeleted {
+			return
+		}
+
+		size := sizeAt(from)
+		for _, change := range sizeChanges {
+			if change.Timestamp <= from {
+				continue
+			}
+			if change.Timestamp >= to {
+				break
+			}
+			addHours(state, size, from, change.Timestamp)
+			size, from = change.NewSize, change.Timestamp
+		}
+		addHours(state, size, from, to)
+	}
+
+	from := record.CreateAt
+	for _, transition := range transitions {
+		addInterval(state, from, transition.Timestamp)
+		state = transition.NewState
+		from = transition.Timestamp
+	}
+	addInterval(state, from, stop)
+
+	return usage
+}
+
+func runningRate(size, affinity string, rates map[string]float64) float64 {
+	if rate, ok := rates[size+":"+affinity]; ok {
+		return rate
+	}
+	if rate, ok := rates[size]; ok {
+		return rate
+	}
+	return rates[usageRateDefault]
+}
+
+// archiveInstallationUsage keeps the usage record of an installation which is
+// no longer tracked so that it is still included in usage reports.
+func (p *Plugin) archiveInstallationUsage(install *Installation) error {
+	record := newUsageRecord(install)
+	record.DeleteAt = model.GetMillis()
+	retainAfter := model.GetMillisForTime(time.Now().Add(-usageArchiveRetention))
+
+	for i := 0; i < StoreInstallRetries; i++ {
+		records, originalJSON, err := p.getUsageArchiveWithJSON()
+		if err != nil {
+			return err
+		}
+
+		retained := make([]*usageRecord, 0, len(records)+1)
+		for _, existing := range records {
+			if existing.DeleteAt >= retainAfter && existing.ID != record.ID {
+				retained = append(retained, existing)
+			}
+		}
+		retained = append(retained, record)
+
+		newJSON, err := json.Marshal(retained)
+		if err != nil {
+			return errors.Wrap(err, "failed to marshal usage archive")
+		}
+
+		ok, appErr := p.API.KVCompareAndSet(StoreUsageArchiveKey, originalJSON, newJSON)
+		if appErr != nil {
+			return errors.Wrap(appErr, "failed to store usage archive")
+		}
+		if ok {
+			return nil
+		}
+	}
+
+	return errors.Errorf("failed %d times to archive the usage of installation %s", StoreInstallRetries, install.ID)
+}
+
+func (p *Plugin) getUsageArchive() ([]*usageRecord, error) {
+	records, _, err := p.getUsageArchiveWithJSON()
+	return records, err
+}
+
+func (p *Plugin) getUsageArchiveWithJSON() ([]*usageRecord, []byte, error) {
+	data, appErr := p.API.KVGet(StoreUsageArchiveKey)
+	if appErr != nil {
+		return nil, nil, errors.Wrap(appErr, "failed to get usage archive")
+	}
+	if data == nil {
+		return []*usageRecord{}, nil, nil
+	}
+
+	var records []*usageRecord
+	err := json.Unmarshal(data, &records)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to unmarshal usage archive")
+	}
+
+	return records, data, nil
+}
+
+// getUsageRecords returns the usage records of every installation tracked by
+// the plugin or archived, refreshing tracked installations with their current
+// size and state from the provisioner.
+func (p *Plugin) getUsageRecords() ([]*usageRecord, error) {
+	installs, _, err := p.getInstallations()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get installations")
+	}
+
+	cloudInstalls, err := p.cloudClient.GetInstallations(&cloud.GetInstallationsRequest{
+		Paging: cloud.AllPagesNotDeleted(),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to get installations from cloud server")
+	}
+	cloudInstallsByID := make(map[string]*cloud.InstallationDTO, len(cloudInstalls))
+	for _, cloudInstall := range cloudInstalls {
+		cloudInstallsByID[cloudInstall.ID] = cloudInstall
+	}
+
+	var records []*usageRecord
+	for _, install := range installs {
+		if cloudInstall := cloudInstallsByID[install.ID]; cloudInstall != nil {
+			install.Installation = cloudInstall.Installation
+		}
+		records = append(records, newUsageRecord(install))
+	}
+
+	archived, err := p.getUsageArchive()
+	if err != nil {
+		return nil, err
+	}
+
+	return append(records, archived...), nil
+}
+
+// usageReport is the usage of installations during a month, grouped by owner
+// or team.
+type usageReport struct {
+	Month  time.Time
+	By     string
+	Usages []*installationUsage
+	Groups []*usageReportGroup
+}
+
+type usageReportGroup struct {
+	Name            string
+	Installations   int
+	RunningHours    float64
+	HibernatedHours float64
+	Cost            float64
+}
+
+// buildUsageReport computes the usage of installations during the month
+// starting at monthStart.
+func (p *Plugin) buildUsageReport(monthStart time.Time, by string, now time.Time) (*usageReport, error) {
+	records, err := p.getUsageRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	monthEnd := monthStart.AddDate(0, 1, 0)
+	if now.Before(monthEnd) {
+		monthEnd = now
+	}
+	rates := p.getConfiguration().usageHourlyRates()
+
+	report := &usageReport{Month: monthStart, By: by}
+	groups := make(map[string]*usageReportGroup)
+	groupNames := make(map[string]string)
+	for _, record := range records {
+		if record.CreateAt >= model.GetMillisForTime(monthEnd) || (record.DeleteAt != 0 && record.DeleteAt < model.GetMillisForTime(monthStart)) {
+			continue
+		}
+
+		history, err := p.getStateHistory(record.ID)
+		if err != nil {
+			return nil, err
+		}
+
+		usage := computeInstallationUsage(record, history, monthStart, monthEnd, rates)
+		if usage.RunningHours == 0 && usage.HibernatedHours == 0 {
+			continue
+		}
+		report.Usages = append(report.Usages, usage)
+
+		groupID := record.OwnerID
+		if by == "team" {
+			groupID = record.TeamID
+		}
+		group := groups[groupID]
+		if group == nil {
+			if _, ok := groupNames[groupID]; !ok {
+				groupNames[groupID] = p.getUsageGroupName(by, groupID)
+			}
+			group = &usageReportGroup{Name: groupNames[groupID]}
+			groups[groupID] = group
+			report.Groups = append(report.Groups, group)
+		}
+		group.Installations++
+		group.RunningHours += usage.RunningHours
+		group.HibernatedHours += usage.HibernatedHours
+		group.Cost += usage.Cost
+	}
+
+	sort.SliceStable(report.Groups, func(i, j int) bool {
+		if report.Groups[i].Cost != report.Groups[j].Cost {
+			return report.Groups[i].Cost > report.Groups[j].Cost
+		}
+		return report.Groups[i].RunningHours > report.Groups[j].RunningHours
+	})
+	sort.SliceStable(report.Usages, func(i, j int) bool {
+		return report.Usages[i].Record.Name < report.Usages[j].Record.Name
+	})
+
+	return report, nil
+}
+
+func (p *Plugin) getUsageGroupName(by, groupID string) string {
+	if by != "team" {
+		return p.getActorName(groupID)
+	}
+	if groupID == "" {
+		return "No team"
+	}
+
+	team, appErr := p.API.GetTeam(groupID)
+	if appErr != nil {
+		return groupID
+	}
+	return team.DisplayName
+}
+
+// Table renders the report as markdown tables of the usage by group and by
+// installation size.
+func (r *usageReport) Table() string {
+	title := "User"
+	if r.By == "team" {
+		title = "Team"
+	}
+
+	var total usageReportGroup
+	table := fmt.Sprintf("| %s | Installations | Running hours | Hibernated hours | Cost |\n| -- | --: | --: | --: | --: |\n", title)
+	for _, group := range r.Groups {
+		table += fmt.Sprintf("| %s | %d | %.1f | %.1f | %.2f |\n", group.Name, group.Installations, group.RunningHours, group.HibernatedHours, group.Cost)
+		total.Installations += group.Installations
+		total.RunningHours += group.RunningHours
+		total.HibernatedHours += group.HibernatedHours
+		total.Cost += group.Cost
+	}
+	table += fmt.Sprintf("| **Total** | %d | %.1f | %.1f | %.2f |\n", total.Installations, total.RunningHours, total.HibernatedHours, total.Cost)
+
+	// Resized installations count towards every size they had.
+	sizes := make(map[string]*usageReportGroup)
+	var sizeNames []string
+	for _, usage := range r.Usages {
+		counted := make(map[string]bool)
+		for _, row := range usage.Rows {
+			name := fmt.Sprintf("%s | %s", row.Size, usage.Record.Affinity)
+			size := sizes[name]
+			if size == nil {
+				size = &usageReportGroup{Name: name}
+				sizes[name] = size
+				sizeNames = append(sizeNames, name)
+			}
+			if !counted[name] {
+				size.Installations++
+				counted[name] = true
+			}
+			if isHibernatedState(row.State) {
+				size.HibernatedHours += row.Hours
+			} else {
+				size.RunningHours += row.Hours
+			}
+			size.Cost += row.Hours * row.Rate
+		}
+	}
+	sort.Strings(sizeNames)
+
+	var approximate []string
+	for _, usage := range r.Usages {
+		if usage.Approximate {
+			approximate = append(approximate, usage.Record.Name)
+		}
+	}
+
+	table += "\n| Size | Affinity | Installations | Running hours | Hibernated hours | Cost |\n| -- | -- | --: | --: | --: | --: |\n"
+	for _, name := range sizeNames {
+		size := sizes[name]
+		table += fmt.Sprintf("| %s | %d | %.1f | %.1f | %.2f |\n", size.Name, size.Installations, size.RunningHours, size.HibernatedHours, size.Cost)
+	}
+
+	if len(approximate) > 0 {
+		table += fmt.Sprintf("\nThe usage of %s is approximate, as part of the state history of the month is no longer available.\n", strings.Join(approximate, ", "))
+	}
+
+	return table
+}
+
+// CSV renders the hours each installation spent in each state, one row per
+// installation, state and size. Rows computed from an incomplete state
+// history are marked approximate.
+func (r *usageReport) CSV(p *Plugin) ([]byte, error) {
+	var buf strings.Builder
+	w := csv.NewWriter(&buf)
+	err := w.Write([]string{"installation_id", "installation", "owner", "team", "size", "affinity", "state", "hours", "hourly_rate", "cost", "approximate"})
+	if err != nil {
+		return nil, err
+	}
+
+	owners := make(map[string]string)
+	teams := make(map[string]string)
+	for _, usage := range r.Usages {
+		record := usage.Record
+		if _, ok := owners[record.OwnerID]; !ok {
+			owners[record.OwnerID] = p.getUsageGroupName("user", record.OwnerID)
+		}
+		if _, ok := teams[record.TeamID]; !ok {
+			teams[record.TeamID] = p.getUsageGroupName("team", record.TeamID)
+		}
+
+		rows := append([]*usageRow{}, usage.Rows...)
+		sort.SliceStable(rows, func(i, j int) bool {
+			if rows[i].State != rows[j].State {
+				return rows[i].State < rows[j].State
+			}
+			return rows[i].Size < rows[j].Size
+		})
+
+		for _, row := range rows {
+			err = w.Write([]string{
+				record.ID,
+				record.Name,
+				owners[record.OwnerID],
+				teams[record.TeamID],
+				row.Size,
+				record.Affinity,
+				row.State,
+				strconv.FormatFloat(row.Hours, 'f', 2, 64),
+				strconv.FormatFloat(row.Rate, 'f', -1, 64),
+				strconv.FormatFloat(row.Hours*row.Rate, 'f', 2, 64),
+				strconv.FormatBool(usage.Approximate),
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	w.Flush()
+	if err = w.Error(); err != nil {
+		return nil, errors.Wrap(err, "failed to write usage report")
+	}
+
+	return []byte(buf.String()), nil
+}
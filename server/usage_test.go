@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUsageHourlyRates(t *testing.T) {
+	rates, err := parseUsageHourlyRates(" miniSingleton=0.05, miniHA:isolated=1.5,hibernating=0 ")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]float64{"miniSingleton": 0.05, "miniHA:isolated": 1.5, "hibernating": 0}, rates)
+
+	_, err = parseUsageHourlyRates("miniHA")
+	assert.Error(t, err)
+	_, err = parseUsageHourlyRates("miniHA=-1")
+	assert.Error(t, err)
+	_, err = parseUsageHourlyRates("=1")
+	assert.Error(t, err)
+}
+
+func TestComputeInstallationUsage(t *testing.T) {
+	start := time.Date(2026, time.September, 1, 0, 0, 0, 0, time.UTC)
+	end := start.AddDate(0, 1, 0)
+	at := func(d time.Duration) int64 { return model.GetMillisForTime(start.Add(d)) }
+	rates := map[string]float64{"miniHA": 2, "miniHA:isolated": 10, "hibernating": 0.5, "default": 1}
+
+	record := &usageRecord{ID: "someid", Size: "miniHA", Affinity: cloud.InstallationAffinityMultiTenant, State: cloud.InstallationStateStable, CreateAt: at(-2 * time.Hour)}
+	history := &stateHistory{Transitions: []*installationEvent{
+		{Timestamp: at(-time.Hour), Source: eventSourceWebhook, OldState: cloud.InstallationStateCreationRequested, NewState: cloud.InstallationStateStable},
+		{Timestamp: at(10 * time.Hour), Source: eventSourceWebhook, OldState: cloud.InstallationStateStable, NewState: cloud.InstallationStateHibernating},
+		{Timestamp: at(30 * time.Hour), Source: eventSourceWebhook, OldState: cloud.InstallationStateHibernating, NewState: cloud.InstallationStateDeletionRequested},
+		{Timestamp: at(31 * time.Hour), Source: eventSourceWebhook, OldState: cloud.InstallationStateDeletionRequested, NewState: cloud.InstallationStateDeleted},
+	}}
+
+	usage := computeInstallationUsage(record, history, start, end, rates)
+	assert.Equal(t, map[string]float64{
+		cloud.InstallationStateStable:            10,
+		cloud.InstallationStateHibernating:       20,
+		cloud.InstallationStateDeletionRequested: 1,
+	}, usage.StateHours, "hours before the start of the month and after deletion are not counted")
+	assert.Equal(t, 11.0, usage.RunningHours)
+	assert.Equal(t, 20.0, usage.HibernatedHours)
+	assert.Equal(t, 11*2+20*0.5, usage.Cost)
+	assert.False(t, usage.Approximate)
+
+	t.Run("incomplete history", func(t *testing.T) {
+		incomplete := &stateHistory{CompleteSince: at(10 * time.Hour), Transitions: history.Transitions[1:]}
+		usage := computeInstallationUsage(record, incomplete, start, end, rates)
+		assert.True(t, usage.Approximate)
+		assert.Equal(t, 10.0, usage.StateHours[cloud.InstallationStateStable], "the installation is assumed to be in the state preceding the oldest transition")
+
+		usage = computeInstallationUsage(record, incomplete, start.Add(20*time.Hour), end, rates)
+		assert.False(t, usage.Approximate, "the history is complete for the period")
+	})
+
+	t.Run("without events", func(t *testing.T) {
+		record := &usageRecord{Size: "miniHA", Affinity: cloud.InstallationAffinityIsolated, State: cloud.InstallationStateStable, CreateAt: at(24 * time.Hour), DeleteAt: at(36 * time.Hour)}
+		usage := computeInstallationUsage(record, &stateHistory{}, start, end, rates)
+		assert.Equal(t, map[string]float64{cloud.InstallationStateStable: 12}, usage.StateHours)
+		assert.Equal(t, 120.0, usage.Cost)
+	})
+
+	t.Run("default rate", func(t *testing.T) {
+		record := &usageRecord{Size: "1000users", State: cloud.InstallationStateStable, CreateAt: at(0)}
+		usage := computeInstallationUsage(record, &stateHistory{}, start, start.Add(3*time.Hour), rates)
+		assert.Equal(t, 3.0, usage.Cost)
+	})
+
+	t.Run("resized", func(t *testing.T) {
+		record := &usageRecord{Size: "miniHA", Affinity: cloud.InstallationAffinityMultiTenant, State: cloud.InstallationStateStable, CreateAt: at(0)}
+		history := &stateHistory{
+			Transitions: []*installationEvent{
+				{Timestamp: at(4 * time.Hour), Source: eventSourceWebhook, OldState: cloud.InstallationStateStable, NewState: cloud.InstallationStateHibernating},
+				{Timestamp: at(8 * time.Hour), Source: eventSourceWebhook, OldState: cloud.InstallationStateHibernating, NewState: cloud.InstallationStateStable},
+			},
+			SizeChanges: []*sizeChange{
+				{Timestamp: at(12 * time.Hour), OldSize: "miniSingleton", NewSize: "miniHA"},
+				{Timestamp: at(6 * time.Hour), OldSize: "1000users", NewSize: "miniSingleton"},
+			},
+		}
+
+		usage := computeInstallationUsage(record, history, start, start.Add(20*time.Hour), rates)
+		assert.Equal(t, map[string]float64{cloud.InstallationStateStable: 16, cloud.InstallationStateHibernating: 4}, usage.StateHours)
+		assert.Equal(t, []*usageRow{
+			{Size: "1000users", State: cloud.InstallationStateStable, Hours: 4, Rate: 1},
+			{Size: "1000users", State: cloud.InstallationStateHibernating, Hours: 2, Rate: 0.5},
+			{Size: "miniSingleton", State: cloud.InstallationStateHibernating, Hours: 2, Rate: 0.5},
+			{Size: "miniSingleton", State: cloud.InstallationStateStable, Hours: 4, Rate: 1},
+			{Size: "miniHA", State: cloud.InstallationStateStable, Hours: 8, Rate: 2},
+		}, usage.Rows, "each interval is weighted by the size in effect")
+		assert.Equal(t, 4*1+4*0.5+4*1+8*2.0, usage.Cost)
+	})
+}
+
+func TestUsageReport(t *testing.T) {
+	joramID := model.NewId()
+	gabeID := model.NewId()
+	api := &plugintest.API{}
+	store := newMockedKVStore(api)
+	api.On("HasPermissionTo", "adminid", model.PermissionManageSystem).Return(true)
+	api.On("HasPermissionTo", joramID, model.PermissionManageSystem).Return(false)
+	api.On("GetUser", joramID).Return(&model.User{Id: joramID, Username: "joram"}, nil)
+	api.On("GetUser", gabeID).Return(&model.User{Id: gabeID, Username: "gabe"}, nil)
+	api.On("GetTeam", "teamid").Return(&model.Team{Id: "teamid", DisplayName: "QA"}, nil)
+	api.On("GetDirectChannel", "adminid", "botid").Return(&model.Channel{Id: "dmid"}, nil)
+
+	var csv []byte
+	api.On("UploadFile", mock.Anything, "dmid", mock.AnythingOfType("string")).Run(func(args mock.Arguments) {
+		csv = args.Get(0).([]byte)
+	}).Return(&model.FileInfo{Id: "fileid"}, nil)
+	var posts []*model.Post
+	api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+		posts = append(posts, args.Get(0).(*model.Post))
+	}).Return(&model.Post{}, nil)
+
+	month := time.Now().UTC().AddDate(0, -1, 0)
+	monthStart := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+	created := model.GetMillisForTime(monthStart.Add(-time.Hour))
+
+	mockedCloudClient := &MockClient{
+		mockedCloudInstallationsDTO: []*cloud.InstallationDTO{
+			{Installation: &cloud.Installation{ID: "joramsid", OwnerID: joramID, Size: "miniHA", Affinity: cloud.InstallationAffinityMultiTenant, State: cloud.InstallationStateStable, CreateAt: created}},
+		},
+	}
+	plugin := &Plugin{
+		BotUserID:     "botid",
+		cloudClient:   mockedCloudClient,
+		configuration: &configuration{UsageHourlyRates: "miniHA=1,miniSingleton=0.5"},
+	}
+	plugin.SetAPI(api)
+
+	require.NoError(t, plugin.storeInstallation(&Installation{
+		Name:            "joramsinstall",
+		TeamID:          "teamid",
+		InstallationDTO: cloud.InstallationDTO{Installation: &cloud.Installation{ID: "joramsid", OwnerID: joramID, CreateAt: created}},
+	}))
+	require.NoError(t, plugin.storeInstallation(&Installation{
+		Name:            "gabesinstall",
+		InstallationDTO: cloud.InstallationDTO{Installation: &cloud.Installation{ID: "gabesid", OwnerID: gabeID, Size: "miniSingleton", State: cloud.InstallationStateStable, CreateAt: created}},
+	}))
+	require.NoError(t, plugin.deleteInstallation("gabesid"))
+	assert.Contains(t, string(store.values[StoreUsageArchiveKey]), `"ID":"gabesid"`)
+
+	run := func(userID string, args ...string) (*model.CommandResponse, bool, error) {
+		return plugin.runReportCommand(args, &model.CommandArgs{UserId: userID, Command: "/cloud report"})
+	}
+
+	t.Run("restricted to admins", func(t *testing.T) {
+		_, isUserError, err := run(joramID, "usage")
+		require.Error(t, err)
+		assert.True(t, isUserError)
+	})
+
+	t.Run("invalid flags", func(t *testing.T) {
+		_, isUserError, err := run("adminid", "usage", "--by", "cluster")
+		require.EqualError(t, err, "invalid --by value cluster, valid options are user and team")
+		assert.True(t, isUserError)
+
+		_, isUserError, err = run("adminid", "usage", "--month", "September")
+		require.Error(t, err)
+		assert.True(t, isUserError)
+
+		_, _, err = run("adminid", "usage", "--month", time.Now().AddDate(0, 2, 0).Format("2006-01"))
+		require.Error(t, err)
+	})
+
+	t.Run("by user", func(t *testing.T) {
+		resp, isUserError, err := run("adminid", "usage", "--month", monthStart.Format("2006-01"))
+		require.NoError(t, err)
+		assert.False(t, isUserError)
+
+		hours := float64(monthStart.AddDate(0, 1, 0).Sub(monthStart) / time.Hour)
+		assert.Contains(t, resp.Text, "| @joram | 1 |")
+		assert.Contains(t, resp.Text, "| @gabe | 1 |")
+		assert.Contains(t, resp.Text, "| miniHA | multitenant | 1 |")
+
+		require.NotEmpty(t, posts)
+		assert.Equal(t, model.StringArray{"fileid"}, posts[len(posts)-1].FileIds)
+		lines := strings.Split(strings.TrimSpace(string(csv)), "\n")
+		require.Len(t, lines, 3)
+		assert.Equal(t, "installation_id,installation,owner,team,size,affinity,state,hours,hourly_rate,cost,approximate", lines[0])
+		formattedHours := strconv.FormatFloat(hours, 'f', 2, 64)
+		assert.Equal(t, "gabesid,gabesinstall,@gabe,No team,miniSingleton,,stable,"+formattedHours+",0.5,"+strconv.FormatFloat(hours*0.5, 'f', 2, 64)+",false", lines[1], "deleted installations are reported from the archive")
+		assert.Equal(t, "joramsid,joramsinstall,@joram,QA,miniHA,multitenant,stable,"+formattedHours+",1,"+formattedHours+",false", lines[2])
+	})
+
+	t.Run("by team", func(t *testing.T) {
+		resp, _, err := run("adminid", "usage", "--by", "team", "--month", monthStart.Format("2006-01"))
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, "| Team | Installations |")
+		assert.Contains(t, resp.Text, "| QA | 1 |")
+	})
+
+	t.Run("approximate", func(t *testing.T) {
+		store.values[stateHistoryKeyPrefix+"joramsid"] = []byte(fmt.Sprintf(`{"CompleteSince": %d, "Transitions": []}`, model.GetMillisForTime(monthStart.Add(time.Hour))))
+		defer delete(store.values, stateHistoryKeyPrefix+"joramsid")
+
+		resp, _, err := run("adminid", "usage", "--month", monthStart.Format("2006-01"))
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, "The usage of joramsinstall is approximate")
+		lines := strings.Split(strings.TrimSpace(string(csv)), "\n")
+		require.Len(t, lines, 3)
+		assert.True(t, strings.HasSuffix(lines[2], ",true"))
+	})
+
+	t.Run("resized", func(t *testing.T) {
+		resized := model.GetMillisForTime(monthStart.Add(24 * time.Hour))
+		store.values[stateHistoryKeyPrefix+"joramsid"] = []byte(fmt.Sprintf(`{"Transitions": [], "SizeChanges": [{"Timestamp": %d, "OldSize": "miniSingleton", "NewSize": "miniHA"}]}`, resized))
+		defer delete(store.values, stateHistoryKeyPrefix+"joramsid")
+
+		resp, _, err := run("adminid", "usage", "--month", monthStart.Format("2006-01"))
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, "| miniHA | multitenant | 1 |")
+		assert.Contains(t, resp.Text, "| miniSingleton | multitenant | 1 | 24.0 | 0.0 | 12.00 |")
+
+		lines := strings.Split(strings.TrimSpace(string(csv)), "\n")
+		require.Len(t, lines, 4)
+		hours := strconv.FormatFloat(float64(monthStart.AddDate(0, 1, 0).Sub(monthStart)/time.Hour)-24, 'f', 2, 64)
+		assert.Equal(t, "joramsid,joramsinstall,@joram,QA,miniHA,multitenant,stable,"+hours+",1,"+hours+",false", lines[2])
+		assert.Equal(t, "joramsid,joramsinstall,@joram,QA,miniSingleton,multitenant,stable,24.00,0.5,12.00,false", lines[3])
+	})
+
+	t.Run("no usage", func(t *testing.T) {
+		resp, _, err := run("adminid", "usage", "--month", "2020-01")
+		require.NoError(t, err)
+		assert.Contains(t, resp.Text, "No installation usage was recorded for 2020-01.")
+	})
+}
+
+func TestRecordStateTransition(t *testing.T) {
+	api := &plugintest.API{}
+	store := newMockedKVStore(api)
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+
+	transition := func(timestamp int64, oldState, newState string) *installationEvent {
+		return &installationEvent{Timestamp: timestamp, Source: eventSourceWebhook, OldState: oldState, NewState: newState}
+	}
+	now := model.GetMillis()
+
+	t.Run("seeded from the timeline", func(t *testing.T) {
+		plugin.recordInstallationEvent("someid", transition(now-2, cloud.InstallationStateCreationRequested, cloud.InstallationStateStable))
+		plugin.recordPluginEvent("someid", "userid", "restart", "")
+		plugin.recordStateTransition("someid", transition(now, cloud.InstallationStateStable, cloud.InstallationStateHibernating))
+
+		history, err := plugin.getStateHistory("someid")
+		require.NoError(t, err)
+		assert.Zero(t, history.CompleteSince)
+		require.Len(t, history.Transitions, 2)
+		assert.Equal(t, cloud.InstallationStateHibernating, history.Transitions[1].NewState)
+	})
+
+	t.Run("full timeline", func(t *testing.T) {
+		for i := 0; i < maxInstallationEvents+5; i++ {
+			plugin.recordPluginEvent("otherid", "userid", "restart", "")
+		}
+		events, err := plugin.getInstallationEvents("otherid")
+		require.NoError(t, err)
+
+		history, err := plugin.getStateHistory("otherid")
+		require.NoError(t, err)
+		assert.Equal(t, events[0].Timestamp, history.CompleteSince, "the history is incomplete once the timeline is truncated")
+
+		for i := 0; i < maxInstallationEvents+5; i++ {
+			plugin.recordStateTransition("otherid", transition(now+int64(i), cloud.InstallationStateStable, cloud.InstallationStateStable))
+		}
+		history, err = plugin.getStateHistory("otherid")
+		require.NoError(t, err)
+		assert.Len(t, history.Transitions, maxInstallationEvents+5, "the history isn't capped")
+		assert.Equal(t, events[0].Timestamp, history.CompleteSince)
+	})
+
+	t.Run("size changes", func(t *testing.T) {
+		plugin.recordSizeChange("fourthid", "miniSingleton", "miniHA")
+		plugin.recordStateTransition("fourthid", transition(now, cloud.InstallationStateStable, cloud.InstallationStateUpdateInProgress))
+
+		history, err := plugin.getStateHistory("fourthid")
+		require.NoError(t, err)
+		require.Len(t, history.SizeChanges, 1)
+		assert.Equal(t, "miniSingleton", history.SizeChanges[0].OldSize)
+		assert.Equal(t, "miniHA", history.SizeChanges[0].NewSize)
+		require.Len(t, history.Transitions, 1)
+	})
+
+	t.Run("old transitions are dropped", func(t *testing.T) {
+		old := model.GetMillisForTime(time.Now().Add(-usageArchiveRetention - time.Hour))
+		store.values[stateHistoryKeyPrefix+"thirdid"] = []byte(fmt.Sprintf(`{"Transitions": [{"timestamp": %d, "source": "webhook", "new_state": "stable"}]}`, old))
+		plugin.recordStateTransition("thirdid", transition(now, cloud.InstallationStateStable, cloud.InstallationStateHibernating))
+
+		history, err := plugin.getStateHistory("thirdid")
+		require.NoError(t, err)
+		assert.Equal(t, old, history.CompleteSince)
+		require.Len(t, history.Transitions, 1)
+	})
+}
@@ -35,14 +35,6 @@ func standardizeName(name string) string {
 	return strings.ToLower(name)
 }
 
-func validLicenseOption(license string) bool {
-	return license == licenseOptionEnterprise ||
-		license == licenseOptionProfessional ||
-		license == licenseOptionE20 ||
-		license == licenseOptionE10 ||
-		license == licenseOptionTE
-}
-
 func validVersionOption(version string) error {
 	v, err := semver.Parse(version)
 	if err != nil {
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// StoreStuckInstallationsKey is the key used to store the installations
+	// the watchdog is tracking in the plugin KV store.
+	StoreStuckInstallationsKey = "stuck_installations"
+	// stuckWatchdogLockKey is the cluster mutex ensuring only one plugin
+	// instance checks for stuck installations per interval.
+	stuckWatchdogLockKey = "stuck_watchdog_lock"
+
+	// stuckWatchdogInterval is how often installations are checked.
+	stuckWatchdogInterval = 5 * time.Minute
+)
+
+// defaultStuckStateThresholds is how long an installation may remain in each
+// transitional state before it is considered stuck.
+var defaultStuckStateThresholds = map[string]time.Duration{
+	cloud.InstallationStateCreationRequested:             30 * time.Minute,
+	cloud.InstallationStateCreationPreProvisioning:       30 * time.Minute,
+	cloud.InstallationStateCreationInProgress:            60 * time.Minute,
+	cloud.InstallationStateCreationDNS:                   30 * time.Minute,
+	cloud.InstallationStateCreationFinalTasks:            30 * time.Minute,
+	cloud.InstallationStateCreationNoCompatibleClusters:  60 * time.Minute,
+	cloud.InstallationStateUpdateRequested:               30 * time.Minute,
+	cloud.InstallationStateUpdateInProgress:              60 * time.Minute,
+	cloud.InstallationStateHibernationRequested:          30 * time.Minute,
+	cloud.InstallationStateHibernationInProgress:         30 * time.Minute,
+	cloud.InstallationStateWakeUpRequested:               30 * time.Minute,
+	cloud.InstallationStateImportInProgress:              4 * time.Hour,
+	cloud.InstallationStateDeletionPendingRequested:      30 * time.Minute,
+	cloud.InstallationStateDeletionPendingInProgress:     30 * time.Minute,
+	cloud.InstallationStateDeletionCancellationRequested: 30 * time.Minute,
+	cloud.InstallationStateDeletionRequested:             30 * time.Minute,
+	cloud.InstallationStateDeletionInProgress:            60 * time.Minute,
+	cloud.InstallationStateDeletionFinalCleanup:          60 * time.Minute,
+	cloud.InstallationStateDBRestorationInProgress:       2 * time.Hour,
+	cloud.InstallationStateDBMigrationInProgress:         2 * time.Hour,
+}
+
+// parseStuckStateThresholds parses comma-separated state=minutes pairs and
+// returns the default thresholds with the given overrides applied. A
+// threshold of zero disables alerts for the state.
+func parseStuckStateThresholds(value string) (map[string]time.Duration, error) {
+	thresholds := make(map[string]time.Duration, len(defaultStuckStateThresholds))
+	for state, threshold := range defaultStuckStateThresholds {
+		thresholds[state] = threshold
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return nil, errors.Errorf("invalid stuck state threshold %q, expected state=minutes", pair)
+		}
+		state := strings.TrimSpace(parts[0])
+		if _, ok := defaultStuckStateThresholds[state]; !ok {
+			return nil, errors.Errorf("invalid stuck state threshold %q, %s is not a transitional state", pair, state)
+		}
+		minutes, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || minutes < 0 {
+			return nil, errors.Errorf("invalid stuck state threshold %q, minutes must be a number of zero or more", pair)
+		}
+
+		thresholds[state] = time.Duration(minutes) * time.Minute
+	}
+
+	return thresholds, nil
+}
+
+// stuckStateThresholds returns how long installations may remain in each
+// transitional state.
+func (c *configuration) stuckStateThresholds() map[string]time.Duration {
+	thresholds, err := parseStuckStateThresholds(c.StuckStateThresholds)
+	if err != nil {
+		return defaultStuckStateThresholds
+	}
+	return thresholds
+}
+
+// stuckInstallation is an installation the watchdog has seen in a
+// transitional state.
+type stuckInstallation struct {
+	State     string
+	Since     int64
+	AlertedAt int64
+}
+
+// stuckWatchdog periodically checks for installations that have been in a
+// transitional state for longer than expected and alerts their owners.
+type stuckWatchdog struct {
+	plugin *Plugin
+	now    func() time.Time
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newStuckWatchdog(p *Plugin) *stuckWatchdog {
+	return &stuckWatchdog{
+		plugin: p,
+		now:    time.Now,
+	}
+}
+
+// Start starts checking for stuck installations.
+func (w *stuckWatchdog) Start() {
+	w.stop = make(chan struct{})
+	w.wg.Add(1)
+	go w.run()
+}
+
+// Stop stops checking for stuck installations.
+func (w *stuckWatchdog) Stop() {
+	if w.stop == nil {
+		return
+	}
+	close(w.stop)
+	w.wg.Wait()
+	w.stop = nil
+}
+
+func (w *stuckWatchdog) run() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(stuckWatchdogInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+
+		locked, err := w.tryLock()
+		if err != nil {
+			w.plugin.API.LogError(err.Error())
+			continue
+		}
+		if !locked {
+			continue
+		}
+
+		err = w.check()
+		if err != nil {
+			w.plugin.API.LogError(errors.Wrap(err, "failed to check for stuck installations").Error())
+		}
+	}
+}
+
+// tryLock acquires the watchdog lock for the current interval. The lock is
+// left to expire so that other plugin instances skip the interval.
+func (w *stuckWatchdog) tryLock() (bool, error) {
+	ok, appErr := w.plugin.API.KVSetWithOptions(stuckWatchdogLockKey, []byte(model.NewId()), model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        nil,
+		ExpireInSeconds: int64((stuckWatchdogInterval - time.Second).Seconds()),
+	})
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "failed to lock stuck installation watchdog")
+	}
+
+	return ok, nil
+}
+
+// check alerts the owners of installations that have been in a transitional
+// state for longer than its threshold. Each stuck state is alerted once.
+func (w *stuckWatchdog) check() error {
+	p := w.plugin
+
+	installs, _, err := p.getInstallations()
+	if err != nil {
+		return errors.Wrap(err, "failed to get installations")
+	}
+	if len(installs) == 0 {
+		return nil
+	}
+
+	cloudInstalls, err := p.cloudClient.GetInstallations(&cloud.GetInstallationsRequest{
+		Paging: cloud.AllPagesNotDeleted(),
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to get installations from cloud server")
+	}
+	cloudInstallsByID := make(map[string]*cloud.InstallationDTO, len(cloudInstalls))
+	for _, cloudInstall := range cloudInstalls {
+		cloudInstallsByID[cloudInstall.ID] = cloudInstall
+	}
+
+	previous, err := p.getStuckInstallations()
+	if err != nil {
+		return err
+	}
+
+	now := w.now()
+	thresholds := p.getConfiguration().stuckStateThresholds()
+	current := map[string]*stuckInstallation{}
+	for _, install := range installs {
+		cloudInstall := cloudInstallsByID[install.ID]
+		if cloudInstall == nil {
+			continue
+		}
+		threshold := thresholds[cloudInstall.State]
+		if threshold == 0 {
+			continue
+		}
+
+		tracked := &stuckInstallation{
+			State: cloudInstall.State,
+			Since: p.getStateSince(install.ID, cloudInstall),
+		}
+		if last := previous[install.ID]; last != nil && last.State == tracked.State && (tracked.Since == 0 || tracked.Since == last.Since) {
+			// Still in the same state, so keep when it was first seen and
+			// whether it was alerted.
+			tracked.Since = last.Since
+			tracked.AlertedAt = last.AlertedAt
+		}
+		if tracked.Since == 0 {
+			tracked.Since = model.GetMillisForTime(now)
+		}
+		current[install.ID] = tracked
+
+		elapsed := now.Sub(model.GetTimeForMillis(tracked.Since))
+		if elapsed < threshold || tracked.AlertedAt != 0 {
+			continue
+		}
+
+		install.InstallationDTO = *cloudInstall
+		p.alertStuckInstallation(install, elapsed, threshold)
+		tracked.AlertedAt = model.GetMillisForTime(now)
+	}
+
+	return p.storeStuckInstallations(current)
+}
+
+// getStateSince returns when an installation entered its current state, or
+// zero if it isn't known. The event timeline is used when it recorded the
+// transition, and the creation time for installations still being created.
+func (p *Plugin) getStateSince(installationID string, cloudInstall *cloud.InstallationDTO) int64 {
+	events, err := p.getInstallationEvents(installationID)
+	if err != nil {
+		p.API.LogWarn(err.Error(), "installation", installationID)
+	}
+	for i := len(events) - 1; i >= 0; i-- {
+		if events[i].Source != eventSourceWebhook {
+			continue
+		}
+		if events[i].NewState == cloudInstall.State {
+			return events[i].Timestamp
+		}
+		break
+	}
+
+	if strings.HasPrefix(cloudInstall.State, "creation-") {
+		return cloudInstall.CreateAt
+	}
+
+	return 0
+}
+
+// alertStuckInstallation notifies the owner of a stuck installation and posts
+// to the installation alerts channel, if one is configured.
+func (p *Plugin) alertStuckInstallation(install *Installation, elapsed, threshold time.Duration) {
+	p.recordPluginEvent(install.ID, "", "stuck-detected", fmt.Sprintf("%s for %s", install.State, formatDuration(elapsed)))
+
+	installationLogsURL, err := getStringFromTemplate(installationLogsURLTmpl, install)
+	if err != nil {
+		p.API.LogWarn(err.Error())
+	}
+	provisionerLogsURL, err := getStringFromTemplate(provisionerLogsURLTmpl, install)
+	if err != nil {
+		p.API.LogWarn(err.Error())
+	}
+
+	message := fmt.Sprintf(`
+Installation %s has been in state %s for %s, which is longer than the expected %s. The operation may be stuck.
+
+Grafana logs for this installation:
+
+- [Installation logs](%s)
+- [Provisioner logs](%s)
+
+Use %s to see what happened so far, and contact the Cloud Platform team if the installation doesn't recover.
+`,
+		install.Name, inlineCode(install.State), formatDuration(elapsed), formatDuration(threshold),
+		installationLogsURL, provisionerLogsURL,
+		inlineCode("/cloud events "+install.Name),
+	)
+	err = p.PostBotDM(install.OwnerID, message)
+	if err != nil {
+		p.API.LogError(errors.Wrap(err, "failed to send stuck installation alert").Error(), "installation", install.ID)
+	}
+
+	channelID := p.getConfiguration().InstallationWebhookAlertsChannelID
+	if channelID == "" {
+		return
+	}
+
+	var dns string
+	if len(install.DNSRecords) > 0 {
+		dns = install.DNSRecords[0].DomainName
+	}
+	alert := fmt.Sprintf(`
+[ Cloud Watchdog ] Stuck Installation
+---
+ID: %s
+Name: %s
+DNS: %s
+Owner: %s
+State: %s for %s (threshold %s)
+`, inlineCode(install.ID), inlineCode(install.Name), inlineCode(dns),
+		p.getActorName(install.OwnerID),
+		inlineCode(install.State), formatDuration(elapsed), formatDuration(threshold))
+
+	err = p.PostToChannelByIDAsBot(channelID, alert)
+	if err != nil {
+		p.API.LogError(errors.Wrap(err, "failed to post stuck installation alert").Error(), "installation", install.ID)
+	}
+}
+
+func (p *Plugin) getStuckInstallations() (map[string]*stuckInstallation, error) {
+	stuck := map[string]*stuckInstallation{}
+
+	data, appErr := p.API.KVGet(StoreStuckInstallationsKey)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get stuck installations")
+	}
+	if data == nil {
+		return stuck, nil
+	}
+
+	err := json.Unmarshal(data, &stuck)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal stuck installations")
+	}
+
+	return stuck, nil
+}
+
+func (p *Plugin) storeStuckInstallations(stuck map[string]*stuckInstallation) error {
+	data, err := json.Marshal(stuck)
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal stuck installations")
+	}
+
+	appErr := p.API.KVSet(StoreStuckInstallationsKey, data)
+	if appErr != nil {
+		return errors.Wrap(appErr, "failed to store stuck installations")
+	}
+
+	return nil
+}
+
+// formatDuration returns a duration rounded to minutes, without the trailing
+// zero seconds.
+func formatDuration(d time.Duration) string {
+	s := d.Round(time.Minute).String()
+	s = strings.TrimSuffix(s, "0s")
+	if s == "" {
+		return "0m"
+	}
+	return s
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStuckStateThresholds(t *testing.T) {
+	thresholds, err := parseStuckStateThresholds("")
+	require.NoError(t, err)
+	assert.Equal(t, defaultStuckStateThresholds, thresholds)
+
+	thresholds, err = parseStuckStateThresholds("update-in-progress=90, creation-in-progress=0")
+	require.NoError(t, err)
+	assert.Equal(t, 90*time.Minute, thresholds[cloud.InstallationStateUpdateInProgress])
+	assert.Zero(t, thresholds[cloud.InstallationStateCreationInProgress])
+	assert.Equal(t, 60*time.Minute, defaultStuckStateThresholds[cloud.InstallationStateUpdateInProgress], "defaults must not be modified")
+
+	for _, value := range []string{"update-in-progress", "stable=10", "update-in-progress=-1", "update-in-progress=soon"} {
+		_, err = parseStuckStateThresholds(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestStuckWatchdog(t *testing.T) {
+	now := time.Now()
+	setup := func(state string) (*stuckWatchdog, *MockClient, *mockedKVStore, *[]*model.Post) {
+		api := &plugintest.API{}
+		store := newMockedKVStore(api)
+		store.values[StoreInstallsKey] = []byte(`[{"ID": "someid", "OwnerID": "joramid", "Name": "joramsinstall"}]`)
+		api.On("GetDirectChannel", "joramid", "botid").Return(&model.Channel{Id: "dmid"}, nil)
+		api.On("LogWarn", mock.AnythingOfType("string"), mock.Anything, mock.Anything).Return()
+
+		var posts []*model.Post
+		api.On("CreatePost", mock.AnythingOfType("*model.Post")).Run(func(args mock.Arguments) {
+			posts = append(posts, args.Get(0).(*model.Post))
+		}).Return(&model.Post{}, nil)
+
+		mockedCloudClient := &MockClient{
+			mockedCloudInstallationsDTO: []*cloud.InstallationDTO{
+				{Installation: &cloud.Installation{ID: "someid", OwnerID: "joramid", State: state, CreateAt: model.GetMillisForTime(now.Add(-3 * time.Hour))}},
+				{Installation: &cloud.Installation{ID: "untrackedid", State: state}},
+			},
+		}
+
+		plugin := &Plugin{
+			BotUserID:     "botid",
+			cloudClient:   mockedCloudClient,
+			configuration: &configuration{InstallationWebhookAlertsChannelID: "alertsid"},
+		}
+		plugin.SetAPI(api)
+
+		watchdog := newStuckWatchdog(plugin)
+		watchdog.now = func() time.Time { return now }
+
+		return watchdog, mockedCloudClient, store, &posts
+	}
+
+	t.Run("alerts once using the event timeline", func(t *testing.T) {
+		watchdog, _, _, posts := setup(cloud.InstallationStateUpdateInProgress)
+		watchdog.plugin.recordInstallationEvent("someid", &installationEvent{
+			Timestamp: model.GetMillisForTime(now.Add(-2 * time.Hour)),
+			Source:    eventSourceWebhook,
+			OldState:  cloud.InstallationStateUpdateRequested,
+			NewState:  cloud.InstallationStateUpdateInProgress,
+		})
+
+		require.NoError(t, watchdog.check())
+		require.Len(t, *posts, 2)
+		assert.Equal(t, "dmid", (*posts)[0].ChannelId)
+		assert.Contains(t, (*posts)[0].Message, "Installation joramsinstall has been in state `update-in-progress` for 2h0m, which is longer than the expected 1h0m.")
+		assert.Equal(t, "alertsid", (*posts)[1].ChannelId)
+		assert.Contains(t, (*posts)[1].Message, "[ Cloud Watchdog ] Stuck Installation")
+
+		require.NoError(t, watchdog.check())
+		assert.Len(t, *posts, 2, "a stuck installation is only alerted once")
+
+		events, err := watchdog.plugin.getInstallationEvents("someid")
+		require.NoError(t, err)
+		assert.Equal(t, "stuck-detected", events[len(events)-1].Action)
+	})
+
+	t.Run("creation uses the creation time", func(t *testing.T) {
+		watchdog, _, _, posts := setup(cloud.InstallationStateCreationInProgress)
+
+		require.NoError(t, watchdog.check())
+		assert.Len(t, *posts, 2)
+	})
+
+	t.Run("unknown state start is tracked from first seen", func(t *testing.T) {
+		watchdog, _, _, posts := setup(cloud.InstallationStateHibernationInProgress)
+
+		require.NoError(t, watchdog.check())
+		assert.Empty(t, *posts)
+
+		watchdog.now = func() time.Time { return now.Add(29 * time.Minute) }
+		require.NoError(t, watchdog.check())
+		assert.Empty(t, *posts)
+
+		watchdog.now = func() time.Time { return now.Add(30 * time.Minute) }
+		require.NoError(t, watchdog.check())
+		assert.Len(t, *posts, 2)
+	})
+
+	t.Run("stable installations are not tracked", func(t *testing.T) {
+		watchdog, _, store, posts := setup(cloud.InstallationStateStable)
+
+		require.NoError(t, watchdog.check())
+		assert.Empty(t, *posts)
+		assert.Equal(t, "{}", string(store.values[StoreStuckInstallationsKey]))
+	})
+
+	t.Run("disabled threshold", func(t *testing.T) {
+		watchdog, _, _, posts := setup(cloud.InstallationStateCreationInProgress)
+		watchdog.plugin.configuration.StuckStateThresholds = "creation-in-progress=0"
+
+		require.NoError(t, watchdog.check())
+		assert.Empty(t, *posts)
+	})
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"bytes"
-	"crypto/subtle"
 	"fmt"
 	"html/template"
 	"io"
@@ -19,6 +18,9 @@ const (
 	provisionerLogsURLTmpl  = `https://grafana.internal.mattermost.com/explore?orgId=1&left={"datasource":"PFB2D5CACEC34D62E","queries":[{"refId":"A","datasource":{"type":"loki","uid":"PFB2D5CACEC34D62E"},"editorMode":"code","expr":"{namespace=\"mattermost-cloud-test\", component=\"provisioner\"} |= %60{{.ID}}%60","queryType":"range"}],"range":{"from":"now-3h","to":"now"}}`
 
 	authHeaderKey = "X-MM-Cloud-Plugin-Auth-Token"
+
+	// maxWebhookBodySize limits the size of webhook payloads that are read.
+	maxWebhookBodySize = 1024 * 1024
 )
 
 // getStringFromTemplate returns a string from a template and data provided.
@@ -37,52 +39,78 @@ func getStringFromTemplate(tmpl string, data any) (string, error) {
 	return result.String(), nil
 }
 
-func (p *Plugin) authenticateWebhook(r *http.Request) error {
-	token := r.Header.Get(authHeaderKey)
-
-	if equal := subtle.ConstantTimeCompare([]byte(token), []byte(p.configuration.ProvisioningServerWebhookSecret)); equal != 1 {
-		return errors.New("unauthorized")
+func (p *Plugin) handleWebhook(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBodySize))
+	if err != nil {
+		p.API.LogError(errors.Wrap(err, "failed to read webhook body").Error())
+		w.WriteHeader(http.StatusBadRequest)
+		return
 	}
 
-	return nil
-}
-
-func (p *Plugin) handleWebhook(w http.ResponseWriter, r *http.Request) {
-	if err := p.authenticateWebhook(r); err != nil {
+	if err = p.authenticateWebhook(r, body); err != nil {
 		p.API.LogError(errors.Wrap(err, "provisioner webhook authentication failed").Error())
 		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	payload, err := cloud.WebhookPayloadFromReader(r.Body)
+	payload, err := cloud.WebhookPayloadFromReader(bytes.NewReader(body))
 	if err != nil {
 		p.API.LogError(err.Error())
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	go p.processWebhookEvent(payload)
+	firstDelivery, err := p.recordWebhookDelivery(payload)
+	if err != nil {
+		p.API.LogError(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !firstDelivery {
+		p.API.LogDebug("Ignoring redelivered webhook", "id", payload.ID, "type", payload.Type.String(), "new_state", payload.NewState)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	p.recordWebhookEvent(payload)
+	p.metrics.observeWebhookEvent(payload.Type.String(), payload.NewState)
+
+	err = p.webhookQueue.Enqueue(payload)
+	if err != nil {
+		p.forgetWebhookDelivery(payload)
+		p.API.LogError(err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
 	w.WriteHeader(http.StatusOK)
 }
 
-func (p *Plugin) processWebhookEvent(payload *cloud.WebhookPayload) {
+// processWebhookEvent handles a webhook payload from the webhook queue.
+// Returning an error causes the payload to be processed again later. Closing
+// stop interrupts installation setup, returning errSetupInterrupted.
+func (p *Plugin) processWebhookEvent(payload *cloud.WebhookPayload, stop <-chan struct{}) error {
 	str, err := payload.ToJSON()
 	if err != nil {
-		p.API.LogError(err.Error())
-		return
+		return err
 	}
 	p.API.LogDebug(str)
 
+	current, err := p.recordWebhookTransition(payload)
+	if err != nil {
+		return err
+	}
+	if !current {
+		p.API.LogDebug("Ignoring stale webhook", "id", payload.ID, "old_state", payload.OldState, "new_state", payload.NewState)
+		return nil
+	}
+
 	switch payload.Type {
 	case cloud.TypeCluster:
-		err = p.handleClusterWebhook(payload)
-		if err != nil {
-			p.API.LogError(err.Error())
-		}
-
-		return
+		return p.handleClusterWebhook(payload)
 	case cloud.TypeInstallation:
+		// Alerts are not retried so that retrying the installation
+		// finalization below doesn't post them again.
 		err = p.handleInstallationWebhook(payload)
 		if err != nil {
 			p.API.LogError(err.Error())
@@ -90,23 +118,26 @@ func (p *Plugin) processWebhookEvent(payload *cloud.WebhookPayload) {
 
 		// Don't return so that any installation finalization can be processed.
 	default:
-		return
+		return nil
+	}
+
+	if _, failed := installationFailureStates[payload.NewState]; failed {
+		return p.notifyInstallationFailure(payload)
 	}
 
 	if payload.NewState != cloud.InstallationStateStable &&
 		payload.NewState != cloud.InstallationStateHibernating &&
 		payload.NewState != cloud.InstallationStateDeletionPending &&
 		payload.NewState != cloud.InstallationStateDeleted {
-		return
+		return nil
 	}
 
 	install, err := p.getInstallation(payload.ID)
 	if err != nil {
-		p.API.LogError(err.Error(), "installation", install.Name)
-		return
+		return errors.Wrapf(err, "failed to get installation %s", payload.ID)
 	}
 	if install == nil {
-		return
+		return nil
 	}
 
 	installation, err := p.cloudClient.GetInstallation(payload.ID,
@@ -115,38 +146,32 @@ func (p *Plugin) processWebhookEvent(payload *cloud.WebhookPayload) {
 			IncludeGroupConfigOverrides: false,
 		})
 	if err != nil {
-		p.API.LogError(err.Error(), "installation", install.Name)
-		return
+		return errors.Wrapf(err, "failed to get installation %s from the provisioner", install.Name)
 	}
 	if installation == nil {
-		p.API.LogError(fmt.Sprintf("failed to find installation %s", install.ID))
-		return
+		return errors.Errorf("failed to find installation %s", install.ID)
 	}
 	install.Installation = installation.Installation
 	install.HideSensitiveFields()
 
 	if payload.NewState == cloud.InstallationStateHibernating {
 		p.PostBotDM(install.OwnerID, fmt.Sprintf("Installation %s has been hibernated", install.Name))
-		return
+		return nil
 	}
 
 	if payload.NewState == cloud.InstallationStateDeletionPending {
-		if payload.ExtraData["actor_id"] == p.configuration.ProvisioningServerClientID {
+		if payload.ExtraData["actor_id"] == p.getConfiguration().ProvisioningServerClientID {
 			p.PostBotDM(install.OwnerID, fmt.Sprintf("Installation %s is pending final deletion. If this was a mistake, please contact the Cloud Platform team within 24 hours of this message, or your data will be lost forever.", install.Name))
-			return
+			return nil
 		}
 		p.PostBotDM(install.OwnerID, fmt.Sprintf("Installation %s has automatically been moved to pending deletion state. If you believe this to be a mistake, please contact the Cloud Platform team for restoration. You have 24 hours to initiate before your data is lost forever.", install.Name))
-		return
+		return nil
 	}
 
 	if payload.NewState == cloud.InstallationStateDeleted {
+		p.cleanupWebhookState(install.ID)
 		p.PostBotDM(install.OwnerID, fmt.Sprintf("Installation %s has been deleted", install.Name))
-		return
-	}
-
-	var dnsRecord string
-	if len(install.DNSRecords) > 0 {
-		dnsRecord = install.DNSRecords[0].DomainName
+		return nil
 	}
 
 	switch payload.OldState {
@@ -173,29 +198,57 @@ Installation details:
 		cloud.InstallationStateCreationFailed,
 		cloud.InstallationStateCreationFinalTasks:
 
-		adminPassword := generateRandomPassword(defaultAdminUsername)
-		userPassword := generateRandomPassword(defaultUserUsername)
-		err = p.setupInstallation(install, adminPassword, userPassword)
+		locked, err := p.tryLockInstallationSetup(install.ID)
 		if err != nil {
-			p.API.LogError(err.Error(), "installation", install.Name)
-			return
+			return err
 		}
-
-		install.HideSensitiveFields()
-
-		installationLogsURL, err := getStringFromTemplate(installationLogsURLTmpl, install)
-		if err != nil {
-			p.API.LogError(err.Error(), "installation", install.Name)
-			return
+		if !locked {
+			p.API.LogDebug("Installation is already being set up or was set up", "installation", install.Name)
+			return nil
 		}
 
-		provisionerLogsURL, err := getStringFromTemplate(provisionerLogsURLTmpl, install)
+		// The owner is notified of setup failures with a way to resume
+		// setup, so the webhook isn't retried unless setup was interrupted.
+		err = p.runInstallationSetup(install, "", stop)
+		if errors.Cause(err) == errSetupInterrupted {
+			return err
+		}
 		if err != nil {
-			p.API.LogError(err.Error(), "installation", install.Name)
-			return
+			p.API.LogError(err.Error(), "installation", install.ID)
 		}
+	}
 
-		message := fmt.Sprintf(`
+	return nil
+}
+
+// postInstallationReady sends the owner of an installation which has been set
+// up the logins of the created accounts. The commands to view and reset them
+// are only advertised if the credentials were stored in the vault.
+func (p *Plugin) postInstallationReady(install *Installation, credentials []*setupCredential, credentialsStored bool) error {
+	install.HideSensitiveFields()
+
+	var dnsRecord string
+	if len(install.DNSRecords) > 0 {
+		dnsRecord = install.DNSRecords[0].DomainName
+	}
+
+	installationLogsURL, err := getStringFromTemplate(installationLogsURLTmpl, install)
+	if err != nil {
+		return err
+	}
+
+	provisionerLogsURL, err := getStringFromTemplate(provisionerLogsURLTmpl, install)
+	if err != nil {
+		return err
+	}
+
+	credentialsHint := "The logins aren't stored by the plugin, so keep them somewhere safe."
+	if credentialsStored {
+		credentialsHint = fmt.Sprintf("The logins can be viewed again with %s and reset with %s.",
+			inlineCode("/cloud credentials "+install.Name), inlineCode("/cloud rotate-password "+install.Name+" [user]"))
+	}
+
+	message := fmt.Sprintf(`
 Installation %s is ready!
 
 Access at: https://%s
@@ -204,8 +257,8 @@ Login with:
 
 | Username | Password | Note |
 | -- | -- | -- |
-| %s | %s | Admin user |
-| %s | %s | Regular user |
+%s
+%s
 
 Grafana logs for this installation:
 
@@ -215,20 +268,36 @@ Grafana logs for this installation:
 Installation details:
 %s
 `,
-			install.Name,
-			dnsRecord,
-			inlineCode(defaultAdminUsername), inlineCode(adminPassword),
-			inlineCode(defaultUserUsername), inlineCode(userPassword),
-			installationLogsURL, provisionerLogsURL,
-			jsonCodeBlock(install.ToPrettyJSON()),
-		)
+		install.Name,
+		dnsRecord,
+		credentialsTable(credentials),
+		credentialsHint,
+		installationLogsURL, provisionerLogsURL,
+		jsonCodeBlock(install.ToPrettyJSON()),
+	)
+
+	if install.TestData {
+		message += "\nTest data is being generated. You will receive a DM when it is done.\n"
+	}
 
-		p.PostBotDM(install.OwnerID, message)
+	p.PostBotDM(install.OwnerID, message)
+
+	return nil
+}
+
+// credentialsTable returns the rows of a markdown table listing the logins of
+// the accounts created during setup.
+func credentialsTable(credentials []*setupCredential) string {
+	var rows string
+	for _, credential := range credentials {
+		rows += fmt.Sprintf("| %s | %s | %s |\n", inlineCode(credential.Username), inlineCode(credential.Password), credential.Note)
 	}
+	return rows
 }
 
 func (p *Plugin) handleClusterWebhook(payload *cloud.WebhookPayload) error {
-	if !p.configuration.ClusterWebhookAlertsEnable {
+	config := p.getConfiguration()
+	if !config.ClusterWebhookAlertsEnable {
 		return nil
 	}
 
@@ -243,11 +312,12 @@ ID: %s
 State: from %s to %s
 `, inlineCode(payload.ID), inlineCode(payload.OldState), inlineCode(payload.NewState))
 
-	return p.PostToChannelByIDAsBot(p.configuration.ClusterWebhookAlertsChannelID, message)
+	return p.PostToChannelByIDAsBot(config.ClusterWebhookAlertsChannelID, message)
 }
 
 func (p *Plugin) handleInstallationWebhook(payload *cloud.WebhookPayload) error {
-	if !p.configuration.InstallationWebhookAlertsEnable {
+	config := p.getConfiguration()
+	if !config.InstallationWebhookAlertsEnable {
 		return nil
 	}
 
@@ -267,7 +337,7 @@ State: from %s to %s
 		inlineCode(payload.ExtraData["ClusterID"]),
 		inlineCode(payload.OldState), inlineCode(payload.NewState))
 
-	return p.PostToChannelByIDAsBot(p.configuration.InstallationWebhookAlertsChannelID, message)
+	return p.PostToChannelByIDAsBot(config.InstallationWebhookAlertsChannelID, message)
 }
 
 func (p *Plugin) handleProfileImage(w http.ResponseWriter, r *http.Request) {
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// webhookDeliveryKeyPrefix prefixes the keys recording which webhook
+	// payloads have been received.
+	webhookDeliveryKeyPrefix = "webhook_delivery_"
+	// webhookDeliveryTTL is how long received webhook payloads are
+	// remembered to detect redeliveries.
+	webhookDeliveryTTL = 7 * 24 * time.Hour
+
+	// webhookTransitionKeyPrefix prefixes the keys recording the timestamp of
+	// the latest processed webhook for a resource.
+	webhookTransitionKeyPrefix = "webhook_transition_"
+
+	// setupLockKeyPrefix prefixes the cluster mutex keys that ensure only one
+	// plugin instance sets up an installation.
+	setupLockKeyPrefix = "setup_lock_"
+	// setupLockTTL is how long a setup lock is held without being refreshed
+	// before it expires, in case the plugin instance holding it is stopped.
+	setupLockTTL = 5 * time.Minute
+	// setupCompleteValue is stored in the setup lock of installations that
+	// were set up.
+	setupCompleteValue = "complete"
+)
+
+// setupLockRefreshInterval is how often the setup lock is extended while
+// setup runs.
+var setupLockRefreshInterval = time.Minute
+
+// webhookDeliveryKey returns the KV key identifying a webhook payload.
+func webhookDeliveryKey(payload *cloud.WebhookPayload) string {
+	hash := sha256.Sum256([]byte(fmt.Sprintf("%s:%s:%s:%d", payload.ID, payload.Type, payload.NewState, payload.Timestamp)))
+	return webhookDeliveryKeyPrefix + hex.EncodeToString(hash[:16])
+}
+
+// recordWebhookDelivery records that a webhook payload was received. It
+// returns false if the payload was already received by any plugin instance.
+func (p *Plugin) recordWebhookDelivery(payload *cloud.WebhookPayload) (bool, error) {
+	ok, appErr := p.API.KVSetWithOptions(webhookDeliveryKey(payload), []byte("1"), model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        nil,
+		ExpireInSeconds: int64(webhookDeliveryTTL.Seconds()),
+	})
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "failed to record webhook delivery")
+	}
+
+	return ok, nil
+}
+
+// forgetWebhookDelivery removes the record of a webhook payload so that it is
+// accepted if it is delivered again.
+func (p *Plugin) forgetWebhookDelivery(payload *cloud.WebhookPayload) {
+	appErr := p.API.KVDelete(webhookDeliveryKey(payload))
+	if appErr != nil {
+		p.API.LogWarn("Failed to remove webhook delivery", "error", appErr.Error())
+	}
+}
+
+// webhookTransition is the latest processed state transition of a resource.
+type webhookTransition struct {
+	Timestamp int64
+	NewState  string
+}
+
+// recordWebhookTransition records the transition in the payload as the latest
+// for its resource. It returns false if a newer transition was already
+// processed, in which case the payload is stale and must be ignored.
+func (p *Plugin) recordWebhookTransition(payload *cloud.WebhookPayload) (bool, error) {
+	if payload.Timestamp == 0 {
+		return true, nil
+	}
+
+	key := webhookTransitionKeyPrefix + payload.ID
+	for i := 0; i < StoreWebhookQueueRetries; i++ {
+		originalJSON, appErr := p.API.KVGet(key)
+		if appErr != nil {
+			return false, errors.Wrap(appErr, "failed to get latest webhook transition")
+		}
+
+		if originalJSON != nil {
+			var latest webhookTransition
+			err := json.Unmarshal(originalJSON, &latest)
+			if err != nil {
+				return false, errors.Wrap(err, "failed to unmarshal latest webhook transition")
+			}
+			if payload.Timestamp < latest.Timestamp {
+				return false, nil
+			}
+			if payload.Timestamp == latest.Timestamp {
+				return true, nil
+			}
+		}
+
+		newJSON, err := json.Marshal(&webhookTransition{
+			Timestamp: payload.Timestamp,
+			NewState:  payload.NewState,
+		})
+		if err != nil {
+			return false, errors.Wrap(err, "failed to marshal webhook transition")
+		}
+
+		ok, appErr := p.API.KVCompareAndSet(key, originalJSON, newJSON)
+		if appErr != nil {
+			return false, errors.Wrap(appErr, "failed to store webhook transition")
+		}
+		if ok {
+			return true, nil
+		}
+	}
+
+	return false, errors.Errorf("failed %d times to store webhook transition", StoreWebhookQueueRetries)
+}
+
+// tryLockInstallationSetup acquires the cluster mutex for setting up an
+// installation. It returns false if another plugin instance holds it.
+func (p *Plugin) tryLockInstallationSetup(installationID string) (bool, error) {
+	ok, appErr := p.API.KVSetWithOptions(setupLockKeyPrefix+installationID, []byte(model.NewId()), model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        nil,
+		ExpireInSeconds: int64(setupLockTTL.Seconds()),
+	})
+	if appErr != nil {
+		return false, errors.Wrap(appErr, "failed to lock installation setup")
+	}
+
+	return ok, nil
+}
+
+// refreshInstallationSetupLock extends the setup lock held by the caller until
+// done is closed, so that it doesn't expire while setup is still running. It
+// stops if the lock was lost.
+func (p *Plugin) refreshInstallationSetupLock(installationID string, done <-chan struct{}) {
+	key := setupLockKeyPrefix + installationID
+	token, appErr := p.API.KVGet(key)
+	if appErr != nil {
+		p.API.LogWarn("Failed to get installation setup lock", "installation", installationID, "error", appErr.Error())
+		return
+	}
+	if token == nil {
+		p.API.LogWarn("Installation setup lock expired before setup started", "installation", installationID)
+		return
+	}
+
+	ticker := time.NewTicker(setupLockRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		ok, appErr := p.API.KVSetWithOptions(key, token, model.PluginKVSetOptions{
+			Atomic:          true,
+			OldValue:        token,
+			ExpireInSeconds: int64(setupLockTTL.Seconds()),
+		})
+		if appErr != nil {
+			p.API.LogWarn("Failed to refresh installation setup lock", "installation", installationID, "error", appErr.Error())
+			continue
+		}
+		if !ok {
+			p.API.LogWarn("Lost installation setup lock while setting up", "installation", installationID)
+			return
+		}
+	}
+}
+
+// unlockInstallationSetup releases the cluster mutex for setting up an
+// installation. Once setup has completed the lock is kept without expiry so
+// that the installation is never set up again.
+func (p *Plugin) unlockInstallationSetup(installationID string, completed bool) {
+	var appErr *model.AppError
+	if completed {
+		appErr = p.API.KVSet(setupLockKeyPrefix+installationID, []byte(setupCompleteValue))
+	} else {
+		appErr = p.API.KVDelete(setupLockKeyPrefix + installationID)
+	}
+	if appErr != nil {
+		p.API.LogWarn("Failed to unlock installation setup", "installation", installationID, "error", appErr.Error())
+	}
+}
+
+// cleanupWebhookState removes the webhook state kept for a deleted resource.
+func (p *Plugin) cleanupWebhookState(resourceID string) {
+	for _, key := range []string{webhookTransitionKeyPrefix + resourceID, setupLockKeyPrefix + resourceID, setupProgressKeyPrefix + resourceID, credentialsKeyPrefix + resourceID, sampleDataJobKeyPrefix + resourceID, reachabilityKeyPrefix + resourceID} {
+		appErr := p.API.KVDelete(key)
+		if appErr != nil {
+			p.API.LogWarn("Failed to clean up webhook state", "key", key, "error", appErr.Error())
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWebhookDeliveries(t *testing.T) {
+	api := &plugintest.API{}
+	newMockedKVStore(api)
+	api.On("LogDebug", mock.AnythingOfType("string"), mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+
+	plugin := &Plugin{configuration: &configuration{}}
+	plugin.SetAPI(api)
+	plugin.webhookQueue = newWebhookQueue(plugin)
+
+	send := func(payload *cloud.WebhookPayload) int {
+		body, err := json.Marshal(payload)
+		require.NoError(t, err)
+		w := httptest.NewRecorder()
+		plugin.handleWebhook(w, httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body)))
+		return w.Code
+	}
+
+	payload := &cloud.WebhookPayload{Type: cloud.TypeInstallation, ID: "installid", OldState: cloud.InstallationStateCreationFinalTasks, NewState: cloud.InstallationStateStable, Timestamp: 100}
+	assert.Equal(t, http.StatusOK, send(payload))
+	assert.Equal(t, http.StatusOK, send(payload))
+
+	events, err := plugin.webhookQueue.Events()
+	require.NoError(t, err)
+	assert.Len(t, events, 1, "redelivered webhooks must not be queued again")
+
+	next := *payload
+	next.Timestamp = 200
+	assert.Equal(t, http.StatusOK, send(&next))
+
+	events, err = plugin.webhookQueue.Events()
+	require.NoError(t, err)
+	assert.Len(t, events, 2)
+}
+
+func TestWebhookTransitions(t *testing.T) {
+	api := &plugintest.API{}
+	newMockedKVStore(api)
+
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+
+	transition := func(timestamp int64) bool {
+		current, err := plugin.recordWebhookTransition(&cloud.WebhookPayload{ID: "installid", Timestamp: timestamp})
+		require.NoError(t, err)
+		return current
+	}
+
+	assert.True(t, transition(100))
+	assert.True(t, transition(300))
+	assert.False(t, transition(200), "older transitions are stale")
+	assert.True(t, transition(300), "retries of the latest transition are current")
+	assert.True(t, transition(0), "payloads without a timestamp are not ordered")
+}
+
+func TestProcessWebhookEventOrdering(t *testing.T) {
+	api := &plugintest.API{}
+	newMockedKVStore(api)
+	api.On("LogDebug", mock.AnythingOfType("string"), mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+	api.On("LogDebug", mock.AnythingOfType("string")).Return()
+
+	plugin := &Plugin{configuration: &configuration{ClusterWebhookAlertsEnable: true, ClusterWebhookAlertsChannelID: "channelid"}}
+	plugin.SetAPI(api)
+
+	api.On("CreatePost", mock.Anything).Return(nil, nil).Once()
+	require.NoError(t, plugin.processWebhookEvent(&cloud.WebhookPayload{Type: cloud.TypeCluster, ID: "clusterid", NewState: cloud.ClusterStateStable, Timestamp: 200}, nil))
+
+	// A stale transition doesn't post an alert.
+	require.NoError(t, plugin.processWebhookEvent(&cloud.WebhookPayload{Type: cloud.TypeCluster, ID: "clusterid", NewState: cloud.ClusterStateProvisionInProgress, Timestamp: 100}, nil))
+	api.AssertNumberOfCalls(t, "CreatePost", 1)
+}
+
+func TestInstallationSetupLock(t *testing.T) {
+	api := &plugintest.API{}
+	newMockedKVStore(api)
+
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+
+	locked, err := plugin.tryLockInstallationSetup("installid")
+	require.NoError(t, err)
+	assert.True(t, locked)
+
+	locked, err = plugin.tryLockInstallationSetup("installid")
+	require.NoError(t, err)
+	assert.False(t, locked, "only one plugin instance may set up an installation")
+
+	plugin.unlockInstallationSetup("installid", false)
+	locked, err = plugin.tryLockInstallationSetup("installid")
+	require.NoError(t, err)
+	assert.True(t, locked, "failed setups may be retried")
+
+	plugin.unlockInstallationSetup("installid", true)
+	locked, err = plugin.tryLockInstallationSetup("installid")
+	require.NoError(t, err)
+	assert.False(t, locked, "completed setups are not run again")
+
+	plugin.cleanupWebhookState("installid")
+	locked, err = plugin.tryLockInstallationSetup("installid")
+	require.NoError(t, err)
+	assert.True(t, locked)
+}
+
+func TestRefreshInstallationSetupLock(t *testing.T) {
+	defer func(interval time.Duration) { setupLockRefreshInterval = interval }(setupLockRefreshInterval)
+	setupLockRefreshInterval = time.Millisecond
+
+	key := setupLockKeyPrefix + "installid"
+	var refreshes atomic.Int32
+
+	api := &plugintest.API{}
+	var store *mockedKVStore
+	api.On("KVSetWithOptions", key, []byte("token"), model.PluginKVSetOptions{
+		Atomic:          true,
+		OldValue:        []byte("token"),
+		ExpireInSeconds: int64(setupLockTTL.Seconds()),
+	}).Return(func(key string, value []byte, options model.PluginKVSetOptions) bool {
+		refreshes.Add(1)
+		store.lock.Lock()
+		defer store.lock.Unlock()
+		return bytes.Equal(store.values[key], options.OldValue)
+	}, nil)
+	store = newMockedKVStore(api)
+	api.On("LogWarn", mock.AnythingOfType("string"), mock.Anything, mock.Anything).Return()
+
+	plugin := &Plugin{}
+	plugin.SetAPI(api)
+
+	t.Run("refreshed until done", func(t *testing.T) {
+		store.values[key] = []byte("token")
+		done := make(chan struct{})
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			plugin.refreshInstallationSetupLock("installid", done)
+		}()
+
+		require.Eventually(t, func() bool { return refreshes.Load() > 1 }, time.Second, time.Millisecond)
+		close(done)
+		<-stopped
+	})
+
+	t.Run("stops once the lock is lost", func(t *testing.T) {
+		store.values[key] = []byte("token")
+		refreshes.Store(0)
+		stopped := make(chan struct{})
+		go func() {
+			defer close(stopped)
+			plugin.refreshInstallationSetupLock("installid", nil)
+		}()
+
+		require.Eventually(t, func() bool { return refreshes.Load() > 0 }, time.Second, time.Millisecond)
+		store.lock.Lock()
+		store.values[key] = []byte("otherinstance")
+		store.lock.Unlock()
+
+		select {
+		case <-stopped:
+		case <-time.After(time.Second):
+			t.Fatal("the setup lock of another instance is refreshed")
+		}
+		assert.Equal(t, []byte("otherinstance"), store.values[key])
+	})
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// StoreWebhookQueueKey is the key used to store pending webhook events in
+	// the plugin KV store.
+	StoreWebhookQueueKey = "webhook_queue"
+	// StoreWebhookDeadLettersKey is the key used to store webhook events that
+	// failed too many times in the plugin KV store.
+	StoreWebhookDeadLettersKey = "webhook_dead_letters"
+
+	// StoreWebhookQueueRetries is the number of retries to use when storing
+	// the webhook queue fails on a race.
+	StoreWebhookQueueRetries = 5
+
+	// webhookQueueWorkers is the number of webhook events processed at once.
+	webhookQueueWorkers = 4
+	// webhookQueuePollInterval is how often the queue is checked for events
+	// that are due, including events enqueued by other plugin instances.
+	webhookQueuePollInterval = 5 * time.Second
+	// webhookEventLease is how long a worker owns an event before it can be
+	// claimed again. It must outlast the slowest event, which is installation
+	// setup waiting up to ten minutes for DNS.
+	webhookEventLease = 15 * time.Minute
+	// webhookEventMaxAttempts is how many times an event is processed before
+	// it is moved to the dead letters.
+	webhookEventMaxAttempts = 5
+	// webhookEventBaseBackoff is the delay before the first retry. It doubles
+	// with every attempt up to webhookEventMaxBackoff.
+	webhookEventBaseBackoff = 30 * time.Second
+	webhookEventMaxBackoff  = 10 * time.Minute
+	// maxWebhookDeadLetters limits how many dead letters are kept.
+	maxWebhookDeadLetters = 100
+)
+
+// webhookEvent is a webhook payload waiting to be processed.
+type webhookEvent struct {
+	ID            string
+	Payload       *cloud.WebhookPayload
+	CreateAt      int64
+	Attempts      int
+	NextAttemptAt int64
+	LeaseOwner    string
+	LeaseUntil    int64
+	LastError     string
+}
+
+// webhookQueue persists webhook payloads in the KV store and processes them
+// with a bounded pool of workers, retrying failed events with backoff.
+type webhookQueue struct {
+	plugin *Plugin
+
+	// process handles a single webhook payload, stopping early when the
+	// channel is closed.
+	process func(*cloud.WebhookPayload, <-chan struct{}) error
+	now     func() time.Time
+
+	// workerID identifies this plugin instance when leasing events.
+	workerID string
+
+	notify chan struct{}
+	stop   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func newWebhookQueue(p *Plugin) *webhookQueue {
+	return &webhookQueue{
+		plugin:   p,
+		process:  p.processWebhookEvent,
+		now:      time.Now,
+		workerID: model.NewId(),
+		notify:   make(chan struct{}, webhookQueueWorkers),
+	}
+}
+
+// Start starts the queue workers.
+func (q *webhookQueue) Start(workers int) {
+	q.stop = make(chan struct{})
+	for i := 0; i < workers; i++ {
+		q.wg.Add(1)
+		go q.work()
+	}
+}
+
+// Stop stops the queue workers and waits for events being processed to
+// finish. Events which are not processed remain queued. Installation setup is
+// interrupted, leaving its event leased until the lease expires.
+func (q *webhookQueue) Stop() {
+	if q.stop == nil {
+		return
+	}
+	close(q.stop)
+	q.wg.Wait()
+	q.stop = nil
+}
+
+func (q *webhookQueue) work() {
+	defer q.wg.Done()
+
+	ticker := time.NewTicker(webhookQueuePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-q.notify:
+		case <-ticker.C:
+		}
+
+		// Keep working while events are due.
+		for {
+			select {
+			case <-q.stop:
+				return
+			default:
+			}
+
+			processed, err := q.processNext()
+			if err != nil {
+				q.plugin.API.LogError(errors.Wrap(err, "failed to process webhook queue").Error())
+				break
+			}
+			if !processed {
+				break
+			}
+		}
+	}
+}
+
+// Enqueue persists a webhook payload to be processed by the workers.
+func (q *webhookQueue) Enqueue(payload *cloud.WebhookPayload) error {
+	now := q.now()
+	event := &webhookEvent{
+		ID:            model.NewId(),
+		Payload:       payload,
+		CreateAt:      model.GetMillisForTime(now),
+		NextAttemptAt: model.GetMillisForTime(now),
+	}
+
+	err := q.updateEvents(StoreWebhookQueueKey, func(events []*webhookEvent) ([]*webhookEvent, error) {
+		return append(events, event), nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed to enqueue webhook event")
+	}
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// processNext claims and processes the next due event. It returns if an event
+// was processed.
+func (q *webhookQueue) processNext() (bool, error) {
+	event, err := q.claim()
+	if err != nil {
+		return false, err
+	}
+	if event == nil {
+		return false, nil
+	}
+
+	processErr := q.process(event.Payload, q.stop)
+	if errors.Cause(processErr) == errSetupInterrupted {
+		// The event is claimed again once its lease expires.
+		return false, nil
+	}
+	if processErr == nil {
+		return true, q.complete(event)
+	}
+
+	return true, q.fail(event, processErr)
+}
+
+// claim leases the oldest event that is due and not leased by another worker.
+func (q *webhookQueue) claim() (*webhookEvent, error) {
+	var claimed *webhookEvent
+	err := q.updateEvents(StoreWebhookQueueKey, func(events []*webhookEvent) ([]*webhookEvent, error) {
+		claimed = nil
+		now := model.GetMillisForTime(q.now())
+		for _, event := range events {
+			if event.NextAttemptAt > now || event.LeaseUntil > now {
+				continue
+			}
+			event.LeaseOwner = q.workerID
+			event.LeaseUntil = now + webhookEventLease.Milliseconds()
+			event.Attempts++
+			claimed = event
+			return events, nil
+		}
+
+		return nil, errNoChanges
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return claimed, nil
+}
+
+// complete removes a processed event from the queue.
+func (q *webhookQueue) complete(event *webhookEvent) error {
+	return q.updateEvents(StoreWebhookQueueKey, func(events []*webhookEvent) ([]*webhookEvent, error) {
+		for i, existing := range events {
+			if existing.ID == event.ID {
+				return append(events[:i], events[i+1:]...), nil
+			}
+		}
+		return nil, errNoChanges
+	})
+}
+
+// fail schedules a failed event to be retried with backoff, or moves it to
+// the dead letters once it has been attempted too many times.
+func (q *webhookQueue) fail(event *webhookEvent, processErr error) error {
+	q.plugin.API.LogWarn("Failed to process webhook event",
+		"event_id", event.ID,
+		"attempt", event.Attempts,
+		"error", processErr.Error(),
+	)
+
+	event.LastError = processErr.Error()
+	event.LeaseOwner = ""
+	event.LeaseUntil = 0
+
+	if event.Attempts >= webhookEventMaxAttempts {
+		err := q.updateEvents(StoreWebhookDeadLettersKey, func(events []*webhookEvent) ([]*webhookEvent, error) {
+			events = append(events, event)
+			if len(events) > maxWebhookDeadLetters {
+				events = events[len(events)-maxWebhookDeadLetters:]
+			}
+			return events, nil
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to store webhook dead letter")
+		}
+		q.plugin.API.LogError("Webhook event moved to dead letters", "event_id", event.ID, "error", processErr.Error())
+
+		return q.complete(event)
+	}
+
+	event.NextAttemptAt = model.GetMillisForTime(q.now().Add(webhookEventBackoff(event.Attempts)))
+
+	return q.updateEvents(StoreWebhookQueueKey, func(events []*webhookEvent) ([]*webhookEvent, error) {
+		for i, existing := range events {
+			if existing.ID == event.ID {
+				events[i] = event
+				return events, nil
+			}
+		}
+		return nil, errNoChanges
+	})
+}
+
+// webhookEventBackoff returns the delay before an event is retried after the
+// given number of attempts.
+func webhookEventBackoff(attempts int) time.Duration {
+	backoff := time.Duration(float64(webhookEventBaseBackoff) * math.Pow(2, float64(attempts-1)))
+	if backoff > webhookEventMaxBackoff {
+		return webhookEventMaxBackoff
+	}
+	return backoff
+}
+
+// Events returns the events waiting to be processed.
+func (q *webhookQueue) Events() ([]*webhookEvent, error) {
+	events, _, err := q.getEvents(StoreWebhookQueueKey)
+	return events, err
+}
+
+// DeadLetters returns the events that failed too many times.
+func (q *webhookQueue) DeadLetters() ([]*webhookEvent, error) {
+	events, _, err := q.getEvents(StoreWebhookDeadLettersKey)
+	return events, err
+}
+
+// Replay moves dead letters back to the queue. All dead letters are replayed
+// when eventID is empty. The number of replayed events is returned.
+func (q *webhookQueue) Replay(eventID string) (int, error) {
+	var replayed []*webhookEvent
+	err := q.updateEvents(StoreWebhookDeadLettersKey, func(events []*webhookEvent) ([]*webhookEvent, error) {
+		replayed = nil
+		var remaining []*webhookEvent
+		for _, event := range events {
+			if eventID == "" || event.ID == eventID {
+				replayed = append(replayed, event)
+				continue
+			}
+			remaining = append(remaining, event)
+		}
+		if len(replayed) == 0 {
+			return nil, errNoChanges
+		}
+		return remaining, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(replayed) == 0 {
+		return 0, nil
+	}
+
+	now := model.GetMillisForTime(q.now())
+	for _, event := range replayed {
+		event.Attempts = 0
+		event.NextAttemptAt = now
+	}
+
+	err = q.updateEvents(StoreWebhookQueueKey, func(events []*webhookEvent) ([]*webhookEvent, error) {
+		return append(events, replayed...), nil
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to requeue dead letters")
+	}
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+
+	return len(replayed), nil
+}
+
+// errNoChanges is returned by update functions to skip storing the events.
+var errNoChanges = errors.New("no changes")
+
+func (q *webhookQueue) getEvents(key string) ([]*webhookEvent, []byte, error) {
+	data, appErr := q.plugin.API.KVGet(key)
+	if appErr != nil {
+		return nil, nil, errors.Wrapf(appErr, "failed to get %s", key)
+	}
+	if data == nil {
+		return nil, nil, nil
+	}
+
+	var events []*webhookEvent
+	err := json.Unmarshal(data, &events)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to unmarshal %s", key)
+	}
+
+	return events, data, nil
+}
+
+// updateEvents applies update to the events stored at key, retrying when
+// another worker or plugin instance changes them first.
+func (q *webhookQueue) updateEvents(key string, update func([]*webhookEvent) ([]*webhookEvent, error)) error {
+	for i := 0; i < StoreWebhookQueueRetries; i++ {
+		// Use the retry count value to build an increasing backoff that has no
+		// delay on the first attempt.
+		time.Sleep(time.Duration(i) * 100 * time.Millisecond)
+
+		events, originalJSON, err := q.getEvents(key)
+		if err != nil {
+			return err
+		}
+
+		events, err = update(events)
+		if err == errNoChanges {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		newJSON, err := json.Marshal(events)
+		if err != nil {
+			return errors.Wrapf(err, "failed to marshal %s", key)
+		}
+
+		ok, appErr := q.plugin.API.KVCompareAndSet(key, originalJSON, newJSON)
+		if appErr != nil {
+			return errors.Wrapf(appErr, "failed to store %s", key)
+		}
+		if ok {
+			return nil
+		}
+	}
+
+	return errors.Errorf("failed %d times to store %s", StoreWebhookQueueRetries, key)
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	cloud "github.com/mattermost/mattermost-cloud/model"
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+// mockedKVStore is an in-memory KV store for tests which need the plugin KV
+// store to behave like the real one.
+type mockedKVStore struct {
+	lock   sync.Mutex
+	values map[string][]byte
+}
+
+func newMockedKVStore(api *plugintest.API) *mockedKVStore {
+	store := &mockedKVStore{values: map[string][]byte{}}
+
+	api.On("KVGet", mock.AnythingOfType("string")).Return(func(key string) []byte {
+		store.lock.Lock()
+		defer store.lock.Unlock()
+		return store.values[key]
+	}, nil)
+	api.On("KVSet", mock.AnythingOfType("string"), mock.Anything).Return(func(key string, value []byte) *model.AppError {
+		store.lock.Lock()
+		defer store.lock.Unlock()
+		store.values[key] = value
+		return nil
+	})
+	api.On("KVCompareAndSet", mock.AnythingOfType("string"), mock.Anything, mock.Anything).Return(func(key string, oldValue, newValue []byte) bool {
+		store.lock.Lock()
+		defer store.lock.Unlock()
+		if !bytes.Equal(store.values[key], oldValue) {
+			return false
+		}
+		store.values[key] = newValue
+		return true
+	}, nil)
+	api.On("KVSetWithOptions", mock.AnythingOfType("string"), mock.Anything, mock.Anything).Return(func(key string, value []byte, options model.PluginKVSetOptions) bool {
+		store.lock.Lock()
+		defer store.lock.Unlock()
+		if options.Atomic && !bytes.Equal(store.values[key], options.OldValue) {
+			return false
+		}
+		if value == nil {
+			delete(store.values, key)
+		} else {
+			store.values[key] = value
+		}
+		return true
+	}, nil)
+	api.On("KVDelete", mock.AnythingOfType("string")).Return(func(key string) *model.AppError {
+		store.lock.Lock()
+		defer store.lock.Unlock()
+		delete(store.values, key)
+		return nil
+	})
+	api.On("KVList", mock.AnythingOfType("int"), mock.AnythingOfType("int")).Return(func(page, perPage int) []string {
+		store.lock.Lock()
+		defer store.lock.Unlock()
+		keys := make([]string, 0, len(store.values))
+		for key := range store.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		start := min(page*perPage, len(keys))
+		return keys[start:min(start+perPage, len(keys))]
+	}, nil)
+
+	return store
+}
+
+func TestWebhookQueue(t *testing.T) {
+	now := time.Now()
+	setup := func() (*webhookQueue, *[]*cloud.WebhookPayload, *error) {
+		api := &plugintest.API{}
+		newMockedKVStore(api)
+		api.On("LogWarn", mock.AnythingOfType("string"), mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+		api.On("LogError", mock.AnythingOfType("string"), mock.Anything, mock.Anything, mock.Anything, mock.Anything).Return()
+
+		plugin := &Plugin{}
+		plugin.SetAPI(api)
+
+		var processed []*cloud.WebhookPayload
+		var processErr error
+		queue := newWebhookQueue(plugin)
+		queue.now = func() time.Time { return now }
+		queue.process = func(payload *cloud.WebhookPayload, stop <-chan struct{}) error {
+			processed = append(processed, payload)
+			return processErr
+		}
+
+		return queue, &processed, &processErr
+	}
+	payload := &cloud.WebhookPayload{Type: cloud.TypeInstallation, ID: "installid", OldState: cloud.InstallationStateCreationInProgress, NewState: cloud.InstallationStateStable}
+
+	t.Run("processed events are removed", func(t *testing.T) {
+		queue, processed, _ := setup()
+		require.NoError(t, queue.Enqueue(payload))
+
+		ok, err := queue.processNext()
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Len(t, *processed, 1)
+
+		events, err := queue.Events()
+		require.NoError(t, err)
+		assert.Empty(t, events)
+
+		ok, err = queue.processNext()
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+
+	t.Run("failed events are retried with backoff", func(t *testing.T) {
+		queue, processed, processErr := setup()
+		*processErr = errors.New("provisioner unavailable")
+		require.NoError(t, queue.Enqueue(payload))
+
+		ok, err := queue.processNext()
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		events, err := queue.Events()
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, 1, events[0].Attempts)
+		assert.Equal(t, "provisioner unavailable", events[0].LastError)
+		assert.Equal(t, model.GetMillisForTime(now.Add(webhookEventBaseBackoff)), events[0].NextAttemptAt)
+
+		ok, err = queue.processNext()
+		require.NoError(t, err)
+		assert.False(t, ok, "event should not be retried before the backoff")
+
+		*processErr = nil
+		queue.now = func() time.Time { return now.Add(webhookEventBaseBackoff) }
+		ok, err = queue.processNext()
+		require.NoError(t, err)
+		assert.True(t, ok)
+		assert.Len(t, *processed, 2)
+
+		events, err = queue.Events()
+		require.NoError(t, err)
+		assert.Empty(t, events)
+	})
+
+	t.Run("leased events are reclaimed after the lease expires", func(t *testing.T) {
+		queue, _, _ := setup()
+		require.NoError(t, queue.Enqueue(payload))
+
+		event, err := queue.claim()
+		require.NoError(t, err)
+		require.NotNil(t, event)
+
+		event, err = queue.claim()
+		require.NoError(t, err)
+		assert.Nil(t, event)
+
+		queue.now = func() time.Time { return now.Add(webhookEventLease) }
+		event, err = queue.claim()
+		require.NoError(t, err)
+		require.NotNil(t, event)
+		assert.Equal(t, 2, event.Attempts)
+	})
+
+	t.Run("events are dead lettered and replayed", func(t *testing.T) {
+		queue, processed, processErr := setup()
+		*processErr = errors.New("setup failed")
+		require.NoError(t, queue.Enqueue(payload))
+
+		for i := 1; i <= webhookEventMaxAttempts; i++ {
+			ok, err := queue.processNext()
+			require.NoError(t, err)
+			require.True(t, ok)
+			now = now.Add(webhookEventMaxBackoff)
+		}
+		assert.Len(t, *processed, webhookEventMaxAttempts)
+
+		events, err := queue.Events()
+		require.NoError(t, err)
+		assert.Empty(t, events)
+
+		deadLetters, err := queue.DeadLetters()
+		require.NoError(t, err)
+		require.Len(t, deadLetters, 1)
+		assert.Equal(t, "setup failed", deadLetters[0].LastError)
+
+		replayed, err := queue.Replay("unknown")
+		require.NoError(t, err)
+		assert.Zero(t, replayed)
+
+		replayed, err = queue.Replay(deadLetters[0].ID)
+		require.NoError(t, err)
+		assert.Equal(t, 1, replayed)
+
+		*processErr = nil
+		ok, err := queue.processNext()
+		require.NoError(t, err)
+		assert.True(t, ok)
+
+		deadLetters, err = queue.DeadLetters()
+		require.NoError(t, err)
+		assert.Empty(t, deadLetters)
+	})
+
+	t.Run("interrupted events stay leased", func(t *testing.T) {
+		queue, _, processErr := setup()
+		*processErr = errors.Wrap(errSetupInterrupted, "failed to set up installation")
+		require.NoError(t, queue.Enqueue(payload))
+
+		ok, err := queue.processNext()
+		require.NoError(t, err)
+		assert.False(t, ok)
+
+		events, err := queue.Events()
+		require.NoError(t, err)
+		require.Len(t, events, 1)
+		assert.Equal(t, model.GetMillisForTime(now.Add(webhookEventLease)), events[0].LeaseUntil)
+		assert.Empty(t, events[0].LastError)
+
+		ok, err = queue.processNext()
+		require.NoError(t, err)
+		assert.False(t, ok, "the event isn't claimed again before its lease expires")
+	})
+
+	t.Run("stop interrupts processing", func(t *testing.T) {
+		queue, _, _ := setup()
+		started := make(chan struct{})
+		queue.process = func(payload *cloud.WebhookPayload, stop <-chan struct{}) error {
+			close(started)
+			<-stop
+			return errSetupInterrupted
+		}
+
+		queue.Start(1)
+		require.NoError(t, queue.Enqueue(payload))
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "event was not processed")
+		}
+
+		stopped := make(chan struct{})
+		go func() {
+			queue.Stop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "queue didn't stop")
+		}
+
+		events, err := queue.Events()
+		require.NoError(t, err)
+		assert.Len(t, events, 1)
+	})
+
+	t.Run("workers process enqueued events", func(t *testing.T) {
+		queue, _, _ := setup()
+		done := make(chan struct{})
+		queue.process = func(payload *cloud.WebhookPayload, stop <-chan struct{}) error {
+			close(done)
+			return nil
+		}
+
+		queue.Start(2)
+		defer queue.Stop()
+		require.NoError(t, queue.Enqueue(payload))
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			require.Fail(t, "event was not processed")
+		}
+	})
+}
+
+func TestWebhookEventBackoff(t *testing.T) {
+	assert.Equal(t, webhookEventBaseBackoff, webhookEventBackoff(1))
+	assert.Equal(t, 2*webhookEventBaseBackoff, webhookEventBackoff(2))
+	assert.Equal(t, webhookEventMaxBackoff, webhookEventBackoff(10))
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost-server/v6/model"
+	"github.com/pkg/errors"
+)
+
+const (
+	// signatureHeaderKey holds the HMAC-SHA256 signature of a webhook, in the
+	// form sha256=<hex digest>.
+	signatureHeaderKey = "X-MM-Cloud-Plugin-Signature"
+	// timestampHeaderKey holds the unix time in seconds at which a webhook
+	// was signed.
+	timestampHeaderKey = "X-MM-Cloud-Plugin-Timestamp"
+	signaturePrefix    = "sha256="
+
+	// webhookSignatureTolerance is how far the signing time of a webhook may
+	// be from the current time. Older webhooks are rejected as replays.
+	webhookSignatureTolerance = 5 * time.Minute
+
+	// StoreWebhookSecretUsageKey is the key used to store when each webhook
+	// secret was last used in the plugin KV store.
+	StoreWebhookSecretUsageKey = "webhook_secret_usage"
+	// webhookSecretUsageInterval limits how often the usage of a secret is
+	// stored.
+	webhookSecretUsageInterval = time.Minute
+)
+
+// webhookSecretUsage records when a webhook secret was last used.
+type webhookSecretUsage struct {
+	LastSignedAt int64
+	LastTokenAt  int64
+}
+
+// webhookSecrets returns the active webhook secrets. Several secrets may be
+// active at once while a secret is being rotated.
+func (c *configuration) webhookSecrets() []string {
+	var secrets []string
+	for _, secret := range strings.Split(c.ProvisioningServerWebhookSecret, ",") {
+		secret = strings.TrimSpace(secret)
+		if secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+// webhookSecretFingerprint returns a short identifier for a secret which is
+// safe to display.
+func webhookSecretFingerprint(secret string) string {
+	hash := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(hash[:])[:12]
+}
+
+// generateWebhookSecret returns a new random webhook secret.
+func generateWebhookSecret() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to generate webhook secret")
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// signWebhook returns the signature of a webhook body signed at the given
+// unix timestamp.
+func signWebhook(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// verifyWebhookSignature checks the signature of a webhook against each of the
+// secrets and returns the secret that signed it.
+func verifyWebhookSignature(secrets []string, timestamp, signature string, body []byte, now time.Time) (string, error) {
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", errors.New("unauthorized: invalid signature timestamp")
+	}
+	age := now.Sub(time.Unix(signedAt, 0))
+	if age > webhookSignatureTolerance || age < -webhookSignatureTolerance {
+		return "", errors.New("unauthorized: signature timestamp is outside of the replay window")
+	}
+
+	for _, secret := range secrets {
+		if hmac.Equal([]byte(signWebhook(secret, timestamp, body)), []byte(signature)) {
+			return secret, nil
+		}
+	}
+
+	return "", errors.New("unauthorized: invalid signature")
+}
+
+// authenticateWebhook verifies that a webhook was sent by the provisioning
+// server. Signed webhooks are verified against all active secrets. Unless
+// signatures are required, webhooks carrying one of the secrets in the auth
+// token header are also accepted.
+func (p *Plugin) authenticateWebhook(r *http.Request, body []byte) error {
+	config := p.getConfiguration()
+	secrets := config.webhookSecrets()
+
+	if signature := r.Header.Get(signatureHeaderKey); signature != "" {
+		secret, err := verifyWebhookSignature(secrets, r.Header.Get(timestampHeaderKey), signature, body, time.Now())
+		if err != nil {
+			return err
+		}
+		p.recordWebhookSecretUsage(secret, true)
+		return nil
+	}
+
+	if config.RequireSignedWebhooks {
+		return errors.New("unauthorized: webhook is not signed")
+	}
+
+	token := r.Header.Get(authHeaderKey)
+	if len(secrets) == 0 {
+		if token != "" {
+			return errors.New("unauthorized")
+		}
+		return nil
+	}
+
+	for _, secret := range secrets {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1 {
+			p.recordWebhookSecretUsage(secret, false)
+			return nil
+		}
+	}
+
+	return errors.New("unauthorized")
+}
+
+// getWebhookSecretUsage returns when each webhook secret was last used, keyed
+// by secret fingerprint.
+func (p *Plugin) getWebhookSecretUsage() (map[string]*webhookSecretUsage, error) {
+	usage := map[string]*webhookSecretUsage{}
+
+	data, appErr := p.API.KVGet(StoreWebhookSecretUsageKey)
+	if appErr != nil {
+		return nil, errors.Wrap(appErr, "failed to get webhook secret usage")
+	}
+	if data == nil {
+		return usage, nil
+	}
+
+	err := json.Unmarshal(data, &usage)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to unmarshal webhook secret usage")
+	}
+
+	return usage, nil
+}
+
+// recordWebhookSecretUsage stores that a secret was used to authenticate a
+// webhook, so that admins can tell when the provisioner has picked up a
+// rotated secret.
+func (p *Plugin) recordWebhookSecretUsage(secret string, signed bool) {
+	usage, err := p.getWebhookSecretUsage()
+	if err != nil {
+		p.API.LogWarn(err.Error())
+		return
+	}
+
+	fingerprint := webhookSecretFingerprint(secret)
+	entry := usage[fingerprint]
+	if entry == nil {
+		entry = &webhookSecretUsage{}
+		usage[fingerprint] = entry
+	}
+
+	now := model.GetMillis()
+	last := &entry.LastTokenAt
+	if signed {
+		last = &entry.LastSignedAt
+	}
+	if now-*last < webhookSecretUsageInterval.Milliseconds() {
+		return
+	}
+	*last = now
+
+	data, err := json.Marshal(usage)
+	if err != nil {
+		p.API.LogWarn(errors.Wrap(err, "failed to marshal webhook secret usage").Error())
+		return
+	}
+
+	appErr := p.API.KVSet(StoreWebhookSecretUsageKey, data)
+	if appErr != nil {
+		p.API.LogWarn(errors.Wrap(appErr, "failed to store webhook secret usage").Error())
+	}
+}
+
+// saveWebhookSecrets stores the active webhook secrets in the plugin
+// configuration.
+func (p *Plugin) saveWebhookSecrets(secrets []string) error {
+	pluginConfig := p.API.GetPluginConfig()
+	for key := range pluginConfig {
+		if strings.EqualFold(key, "ProvisioningServerWebhookSecret") {
+			delete(pluginConfig, key)
+		}
+	}
+	pluginConfig["ProvisioningServerWebhookSecret"] = strings.Join(secrets, ",")
+
+	appErr := p.API.SavePluginConfig(pluginConfig)
+	if appErr != nil {
+		return errors.Wrap(appErr, "failed to save plugin configuration")
+	}
+
+	return nil
+}
+
+// formatMillis returns a human readable time for a timestamp in milliseconds.
+func formatMillis(millis int64) string {
+	if millis == 0 {
+		return "never"
+	}
+	return fmt.Sprintf("%s ago", time.Since(model.GetTimeForMillis(millis)).Round(time.Second))
+}
@@ -2,8 +2,12 @@ package main
 
 import (
 	"net/http"
+	"strconv"
 	"testing"
+	"time"
 
+	"github.com/mattermost/mattermost-server/v6/plugin/plugintest"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -11,12 +15,15 @@ func TestAuthenticateWebhook(t *testing.T) {
 	plugin := Plugin{
 		configuration: &configuration{},
 	}
+	api := &plugintest.API{}
+	newMockedKVStore(api)
+	plugin.SetAPI(api)
 
 	t.Run("no auth set, header not defined", func(t *testing.T) {
 		request, err := http.NewRequest(http.MethodPost, "test.domain.com", nil)
 		require.NoError(t, err)
 
-		require.NoError(t, plugin.authenticateWebhook(request))
+		require.NoError(t, plugin.authenticateWebhook(request, nil))
 	})
 
 	t.Run("no auth set, header defined as empty", func(t *testing.T) {
@@ -24,7 +31,7 @@ func TestAuthenticateWebhook(t *testing.T) {
 		require.NoError(t, err)
 		request.Header.Add(authHeaderKey, "")
 
-		require.NoError(t, plugin.authenticateWebhook(request))
+		require.NoError(t, plugin.authenticateWebhook(request, nil))
 	})
 
 	t.Run("no auth set, header defined as wrong value", func(t *testing.T) {
@@ -32,7 +39,7 @@ func TestAuthenticateWebhook(t *testing.T) {
 		require.NoError(t, err)
 		request.Header.Add(authHeaderKey, "test")
 
-		require.EqualError(t, plugin.authenticateWebhook(request), "unauthorized")
+		require.EqualError(t, plugin.authenticateWebhook(request, nil), "unauthorized")
 	})
 
 	plugin.configuration.ProvisioningServerWebhookSecret = "secret1"
@@ -41,7 +48,7 @@ func TestAuthenticateWebhook(t *testing.T) {
 		request, err := http.NewRequest(http.MethodPost, "test.domain.com", nil)
 		require.NoError(t, err)
 
-		require.EqualError(t, plugin.authenticateWebhook(request), "unauthorized")
+		require.EqualError(t, plugin.authenticateWebhook(request, nil), "unauthorized")
 	})
 
 	t.Run("auth set, header defined as empty", func(t *testing.T) {
@@ -49,7 +56,7 @@ func TestAuthenticateWebhook(t *testing.T) {
 		require.NoError(t, err)
 		request.Header.Add(authHeaderKey, "")
 
-		require.EqualError(t, plugin.authenticateWebhook(request), "unauthorized")
+		require.EqualError(t, plugin.authenticateWebhook(request, nil), "unauthorized")
 	})
 
 	t.Run("auth set, header defined as wrong value", func(t *testing.T) {
@@ -57,7 +64,7 @@ func TestAuthenticateWebhook(t *testing.T) {
 		require.NoError(t, err)
 		request.Header.Add(authHeaderKey, "test")
 
-		require.EqualError(t, plugin.authenticateWebhook(request), "unauthorized")
+		require.EqualError(t, plugin.authenticateWebhook(request, nil), "unauthorized")
 	})
 
 	t.Run("auth set, header defined as right value", func(t *testing.T) {
@@ -65,6 +72,73 @@ func TestAuthenticateWebhook(t *testing.T) {
 		require.NoError(t, err)
 		request.Header.Add(authHeaderKey, "secret1")
 
-		require.NoError(t, plugin.authenticateWebhook(request))
+		require.NoError(t, plugin.authenticateWebhook(request, nil))
+	})
+}
+
+func TestAuthenticateSignedWebhook(t *testing.T) {
+	plugin := Plugin{
+		configuration: &configuration{ProvisioningServerWebhookSecret: "oldsecret, newsecret"},
+	}
+	api := &plugintest.API{}
+	newMockedKVStore(api)
+	plugin.SetAPI(api)
+
+	body := []byte(`{"id": "installid"}`)
+	signedRequest := func(secret string, signedAt time.Time, body []byte) *http.Request {
+		request, err := http.NewRequest(http.MethodPost, "test.domain.com", nil)
+		require.NoError(t, err)
+		timestamp := strconv.FormatInt(signedAt.Unix(), 10)
+		request.Header.Add(timestampHeaderKey, timestamp)
+		request.Header.Add(signatureHeaderKey, signWebhook(secret, timestamp, body))
+		return request
+	}
+
+	t.Run("signed with any active secret", func(t *testing.T) {
+		require.NoError(t, plugin.authenticateWebhook(signedRequest("oldsecret", time.Now(), body), body))
+		require.NoError(t, plugin.authenticateWebhook(signedRequest("newsecret", time.Now(), body), body))
+
+		usage, err := plugin.getWebhookSecretUsage()
+		require.NoError(t, err)
+		require.Contains(t, usage, webhookSecretFingerprint("newsecret"))
+		assert.NotZero(t, usage[webhookSecretFingerprint("newsecret")].LastSignedAt)
+		assert.Zero(t, usage[webhookSecretFingerprint("newsecret")].LastTokenAt)
+	})
+
+	t.Run("signed with an unknown secret", func(t *testing.T) {
+		require.EqualError(t, plugin.authenticateWebhook(signedRequest("retiredsecret", time.Now(), body), body), "unauthorized: invalid signature")
+	})
+
+	t.Run("body was modified", func(t *testing.T) {
+		require.EqualError(t, plugin.authenticateWebhook(signedRequest("newsecret", time.Now(), body), []byte(`{"id": "otherid"}`)), "unauthorized: invalid signature")
+	})
+
+	t.Run("outside of the replay window", func(t *testing.T) {
+		require.Error(t, plugin.authenticateWebhook(signedRequest("newsecret", time.Now().Add(-webhookSignatureTolerance-time.Minute), body), body))
+		require.Error(t, plugin.authenticateWebhook(signedRequest("newsecret", time.Now().Add(webhookSignatureTolerance+time.Minute), body), body))
+	})
+
+	t.Run("invalid timestamp", func(t *testing.T) {
+		request := signedRequest("newsecret", time.Now(), body)
+		request.Header.Set(timestampHeaderKey, "yesterday")
+		require.EqualError(t, plugin.authenticateWebhook(request, body), "unauthorized: invalid signature timestamp")
+	})
+
+	t.Run("auth token with any active secret", func(t *testing.T) {
+		request, err := http.NewRequest(http.MethodPost, "test.domain.com", nil)
+		require.NoError(t, err)
+		request.Header.Add(authHeaderKey, "oldsecret")
+		require.NoError(t, plugin.authenticateWebhook(request, body))
+	})
+
+	t.Run("signatures required", func(t *testing.T) {
+		plugin.configuration.RequireSignedWebhooks = true
+		defer func() { plugin.configuration.RequireSignedWebhooks = false }()
+
+		request, err := http.NewRequest(http.MethodPost, "test.domain.com", nil)
+		require.NoError(t, err)
+		request.Header.Add(authHeaderKey, "oldsecret")
+		require.EqualError(t, plugin.authenticateWebhook(request, body), "unauthorized: webhook is not signed")
+		require.NoError(t, plugin.authenticateWebhook(signedRequest("newsecret", time.Now(), body), body))
 	})
 }